@@ -0,0 +1,91 @@
+package main
+
+/*
+ * unicorn dump：查看 -record 写下的流量记录
+ *   ./unicorn -c 10 -D 30 -m 1 -k -record rec.bin -record-sample 0.01 -record-errors
+ *   ./unicorn dump -errors rec.bin.2 rec.bin.1 rec.bin     # 按时间顺序查看所有出错的交互
+ *   ./unicorn dump -conn 17 rec.bin                        # 某个连接上的全部交互
+ */
+import (
+    "encoding/hex"
+    "errors"
+    "flag"
+    "fmt"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//达到了最大输出条数
+var errDumpLimit = errors.New("dump limit reached")
+
+func showDumpUsage() {
+    fmt.Println()
+    fmt.Println("Usage: unicorn dump [-errors] [-code <code>] [-conn <id>] [-n <max>] [-brief] <file> [<file>...]")
+    fmt.Println()
+    fmt.Println(" -errors            only the results other than success")
+    fmt.Println(" -code <code>       only the results with this code, e.g. 1001")
+    fmt.Println(" -conn <id>         only the records on this connection")
+    fmt.Println(" -n <max>           stop after max records (default 0, all)")
+    fmt.Println(" -brief             one line per record, without the hex dump of request and response")
+    fmt.Println()
+}
+
+//输出一侧的数据，被截断时标明原始长度
+func dumpPayload(direction string, b []byte, origin int) {
+    if len(b) < origin {
+        fmt.Printf("%s %d bytes (truncated from %d)\n", direction, len(b), origin)
+    } else {
+        fmt.Printf("%s %d bytes\n", direction, len(b))
+    }
+    fmt.Print(hex.Dump(b))
+}
+
+//按顺序读取记录文件，按照条件过滤之后输出
+func dump(args []string) int {
+    fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+    onlyErrors := fs.Bool("errors", false, "only errors")
+    code := fs.Int("code", -1, "result code")
+    conn := fs.Uint64("conn", 0, "connection id")
+    max := fs.Int("n", 0, "max records")
+    brief := fs.Bool("brief", false, "brief")
+    fs.Usage = showDumpUsage
+    if err := fs.Parse(args); err != nil {
+        return 1
+    }
+    if fs.NArg() == 0 {
+        showDumpUsage()
+        return 1
+    }
+
+    count := 0
+    show := func(r *unicorn.Record) error {
+        if *onlyErrors && r.Code == unicorn.RESULT_CODE_SUCCESS ||
+            *code >= 0 && r.Code != unicorn.ResultCode(*code) ||
+            *conn != 0 && r.ConnId != *conn {
+            return nil
+        }
+        if *max > 0 && count >= *max {
+            return errDumpLimit
+        }
+        count++
+        fmt.Printf("[%s] conn=%d id=%d code=%d(%s) elapse=%v endpoint=%s",
+            r.Time.Format("15:04:05.000000"), r.ConnId, r.Id, r.Code, unicorn.ConvertCodePlain(r.Code), r.Elapse, r.Endpoint)
+        if r.Type != "" {
+            fmt.Printf(" type=%s", r.Type)
+        }
+        fmt.Println()
+        if !*brief {
+            dumpPayload(">>", r.Req, r.ReqLen)
+            dumpPayload("<<", r.Resp, r.RespLen)
+        }
+        return nil
+    }
+    for _, path := range fs.Args() {
+        if err := unicorn.ReadRecordFile(path, show); err == errDumpLimit {
+            break
+        } else if err != nil {
+            fmt.Printf("Record file %s reading failing: %s\n", path, err)
+            return 1
+        }
+    }
+    return 0
+}
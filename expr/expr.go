@@ -0,0 +1,263 @@
+package expr
+
+/*
+ * 四则运算表达式求值
+ * 支持 + - * / % 、括号以及一元负号，遵循常规的运算优先级
+ * 操作数全部是整数时，使用大整数运算（除法向零截断，和Go的整数除法一致）
+ * 只要出现小数，整个表达式按照float64运算
+ */
+import (
+    "errors"
+    "fmt"
+    "math"
+    "math/big"
+    "strconv"
+)
+
+var ErrDivByZero = errors.New("division by zero")
+
+//表达式的值，整数或者浮点数
+type Value struct {
+    Int     *big.Int  //整数值，IsFloat为false时有效
+    Float   float64   //浮点值，IsFloat为true时有效
+    IsFloat bool
+}
+
+func (v Value) String() string {
+    if v.IsFloat {
+        return strconv.FormatFloat(v.Float, 'g', -1, 64)
+    }
+    return v.Int.String()
+}
+
+//转换成float64，整数可能丢失精度
+func (v Value) Float64() float64 {
+    if v.IsFloat {
+        return v.Float
+    }
+    f, _ := new(big.Float).SetInt(v.Int).Float64()
+    return f
+}
+
+//判断两个值是否相等，整数精确比较，浮点数允许极小的相对误差
+func (v Value) Equal(o Value) bool {
+    if !v.IsFloat && !o.IsFloat {
+        return v.Int.Cmp(o.Int) == 0
+    }
+    a, b := v.Float64(), o.Float64()
+    if a == b {
+        return true
+    }
+    return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
+
+//对表达式求值
+func Eval(s string) (Value, error) {
+    p := &parser{src: s}
+    p.next()
+    v, err := p.parseExpr()
+    if err != nil {
+        return Value{}, err
+    }
+    if p.tok != tokEOF {
+        return Value{}, fmt.Errorf("unexpected %q at %d", p.lit, p.pos)
+    }
+    return v, nil
+}
+
+/************************** 词法分析 **************************/
+type token int
+const (
+    tokEOF token = iota
+    tokNum
+    tokOp
+    tokLParen
+    tokRParen
+)
+
+type parser struct {
+    src string
+    off int     //下一个待扫描的位置
+    pos int     //当前token的起始位置
+    tok token   //当前token
+    lit string  //当前token的字面值
+}
+
+func (p *parser) next() {
+    for p.off < len(p.src) && (p.src[p.off] == ' ' || p.src[p.off] == '\t' || p.src[p.off] == '\n' || p.src[p.off] == '\r') {
+        p.off++
+    }
+    p.pos = p.off
+    if p.off >= len(p.src) {
+        p.tok, p.lit = tokEOF, ""
+        return
+    }
+    c := p.src[p.off]
+    switch {
+    case c == '(':
+        p.tok, p.lit = tokLParen, "("
+        p.off++
+    case c == ')':
+        p.tok, p.lit = tokRParen, ")"
+        p.off++
+    case c == '+' || c == '-' || c == '*' || c == '/' || c == '%':
+        p.tok, p.lit = tokOp, string(c)
+        p.off++
+    case (c >= '0' && c <= '9') || c == '.':
+        for p.off < len(p.src) {
+            c = p.src[p.off]
+            if (c >= '0' && c <= '9') || c == '.' {
+                p.off++
+            } else if (c == 'e' || c == 'E') && p.off+1 < len(p.src) {
+                //科学计数法
+                p.off++
+                if p.src[p.off] == '+' || p.src[p.off] == '-' {
+                    p.off++
+                }
+            } else {
+                break
+            }
+        }
+        p.tok, p.lit = tokNum, p.src[p.pos:p.off]
+    default:
+        p.tok, p.lit = tokOp, string(c) //非法字符，交给语法分析报错
+        p.off++
+    }
+}
+
+/************************** 语法分析 **************************/
+//expr   := term   { ("+"|"-") term }
+//term   := factor { ("*"|"/"|"%") factor }
+//factor := ["-"|"+"] factor | number | "(" expr ")"
+func (p *parser) parseExpr() (Value, error) {
+    v, err := p.parseTerm()
+    if err != nil {
+        return v, err
+    }
+    for p.tok == tokOp && (p.lit == "+" || p.lit == "-") {
+        op := p.lit
+        p.next()
+        r, err := p.parseTerm()
+        if err != nil {
+            return r, err
+        }
+        if v, err = apply(op, v, r); err != nil {
+            return v, err
+        }
+    }
+    return v, nil
+}
+
+func (p *parser) parseTerm() (Value, error) {
+    v, err := p.parseFactor()
+    if err != nil {
+        return v, err
+    }
+    for p.tok == tokOp && (p.lit == "*" || p.lit == "/" || p.lit == "%") {
+        op := p.lit
+        p.next()
+        r, err := p.parseFactor()
+        if err != nil {
+            return r, err
+        }
+        if v, err = apply(op, v, r); err != nil {
+            return v, err
+        }
+    }
+    return v, nil
+}
+
+func (p *parser) parseFactor() (Value, error) {
+    switch p.tok {
+    case tokOp:
+        if p.lit == "-" || p.lit == "+" {
+            op := p.lit
+            p.next()
+            v, err := p.parseFactor()
+            if err != nil || op == "+" {
+                return v, err
+            }
+            if v.IsFloat {
+                return Value{Float: -v.Float, IsFloat: true}, nil
+            }
+            return Value{Int: new(big.Int).Neg(v.Int)}, nil
+        }
+    case tokNum:
+        lit := p.lit
+        p.next()
+        return parseNumber(lit)
+    case tokLParen:
+        p.next()
+        v, err := p.parseExpr()
+        if err != nil {
+            return v, err
+        }
+        if p.tok != tokRParen {
+            return v, fmt.Errorf("missing ')' at %d", p.pos)
+        }
+        p.next()
+        return v, nil
+    case tokEOF:
+        return Value{}, errors.New("unexpected end of expression")
+    }
+    return Value{}, fmt.Errorf("unexpected %q at %d", p.lit, p.pos)
+}
+
+func parseNumber(lit string) (Value, error) {
+    if i, ok := new(big.Int).SetString(lit, 10); ok {
+        return Value{Int: i}, nil
+    }
+    f, err := strconv.ParseFloat(lit, 64)
+    if err != nil {
+        return Value{}, fmt.Errorf("bad number %q", lit)
+    }
+    return Value{Float: f, IsFloat: true}, nil
+}
+
+//二元运算
+func apply(op string, a, b Value) (Value, error) {
+    if a.IsFloat || b.IsFloat {
+        x, y := a.Float64(), b.Float64()
+        var r float64
+        switch op {
+        case "+":
+            r = x + y
+        case "-":
+            r = x - y
+        case "*":
+            r = x * y
+        case "/":
+            if y == 0 {
+                return Value{}, ErrDivByZero
+            }
+            r = x / y
+        case "%":
+            if y == 0 {
+                return Value{}, ErrDivByZero
+            }
+            r = math.Mod(x, y)
+        }
+        return Value{Float: r, IsFloat: true}, nil
+    }
+
+    r := new(big.Int)
+    switch op {
+    case "+":
+        r.Add(a.Int, b.Int)
+    case "-":
+        r.Sub(a.Int, b.Int)
+    case "*":
+        r.Mul(a.Int, b.Int)
+    case "/":
+        if b.Int.Sign() == 0 {
+            return Value{}, ErrDivByZero
+        }
+        r.Quo(a.Int, b.Int) //向零截断
+    case "%":
+        if b.Int.Sign() == 0 {
+            return Value{}, ErrDivByZero
+        }
+        r.Rem(a.Int, b.Int)
+    }
+    return Value{Int: r}, nil
+}
@@ -0,0 +1,44 @@
+package expr
+
+import (
+    "testing"
+)
+
+//测试表达式求值
+func TestEval(t *testing.T) {
+    cases := []struct {
+        src    string
+        expect string
+    }{
+        {"1 + 2 * 3", "7"},
+        {"(1 + 2) * 3", "9"},
+        {"-7 / 2", "-3"},
+        {"7 % 4 - -1", "4"},
+        {"0 - 5 + 0", "-5"},
+        {"99999999999999999999 * 10", "999999999999999999990"},
+        {"1.5 * 2", "3"},
+        {"10 / 4.0", "2.5"},
+        {"2e3 + 1", "2001"},
+    }
+    for _, c := range cases {
+        v, err := Eval(c.src)
+        if err != nil {
+            t.Fatalf("Eval(%q) failing: %s\n", c.src, err)
+        }
+        if v.String() != c.expect {
+            t.Fatalf("Eval(%q) = %s, expected %s\n", c.src, v.String(), c.expect)
+        }
+    }
+}
+
+//测试错误的表达式
+func TestEvalError(t *testing.T) {
+    if _, err := Eval("1 / 0"); err != ErrDivByZero {
+        t.Fatalf("Expected ErrDivByZero, got %v\n", err)
+    }
+    for _, src := range []string{"", "1 +", "(1 + 2", "1 2", "a + 1"} {
+        if _, err := Eval(src); err == nil {
+            t.Fatalf("Eval(%q) should fail\n", src)
+        }
+    }
+}
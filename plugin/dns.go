@@ -0,0 +1,412 @@
+package plugin
+/*
+ * plugin
+ * DNS查询插件
+ * 按权重混合查询类型（A/AAAA/TXT/SRV等），从names中随机选择域名，按random_subdomain的比例
+ * 在域名前加上随机的一级子域名，用来绕过缓存
+ * UDP上一个数据报就是一个消息，ID对不上的数据报（比如迟到的响应）会被丢弃继续等待；
+ * TCP以及unix socket上每个消息前面有2个字节的长度
+ * 校验ID、问题部分、rcode以及回答中请求类型的记录数，请求的类型为查询类型，
+ * 测试结束之后报告中列出rcode分布以及截断（TC）的响应数
+ *
+ * 示例（YAML）：
+ *   queries: {A: 60, AAAA: 20, TXT: 10, SRV: 10}
+ *   names: [example.com, _sip._tcp.example.com]
+ *   random_subdomain: 0.2
+ *   expect:
+ *     rcode: [NOERROR, NXDOMAIN]
+ *     min_answers: 1
+ */
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math/rand"
+    "sort"
+    "strings"
+    "sync"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+const (
+    DNS_HEADER_LEN     = 12
+    DNS_MAX_NAME       = 255
+    DNS_MAX_LABEL      = 63
+    DNS_CLASS_IN       = 1
+    DNS_RANDOM_LABEL   = 12 //随机子域名的长度
+    DNS_RCODE_NOERROR  = 0
+)
+
+//支持的查询类型
+var dnsTypes = map[string]uint16{
+    "A"     : 1,
+    "NS"    : 2,
+    "CNAME" : 5,
+    "SOA"   : 6,
+    "PTR"   : 12,
+    "MX"    : 15,
+    "TXT"   : 16,
+    "AAAA"  : 28,
+    "SRV"   : 33,
+}
+
+var dnsRcodes = []string{"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED"}
+
+//DNS插件描述
+type DnsSpec struct {
+    Queries         map[string]int `json:"queries"          yaml:"queries"`          //查询类型 -> 权重，默认A:1
+    Names           []string       `json:"names"            yaml:"names"`            //查询的域名
+    RandomSubdomain float64        `json:"random_subdomain" yaml:"random_subdomain"` //加随机子域名的比例，[0, 1]
+    NoRecursion     bool           `json:"no_recursion"     yaml:"no_recursion"`     //不设置RD位
+    Expect          DnsExpect      `json:"expect"           yaml:"expect"`
+}
+
+type DnsExpect struct {
+    Rcode      []string `json:"rcode"       yaml:"rcode"`       //期望的rcode，默认NOERROR
+    MinAnswers int      `json:"min_answers" yaml:"min_answers"` //rcode为NOERROR时，回答中请求类型的最少记录数
+}
+
+//解析之后的响应
+type dnsResponse struct {
+    id        uint16
+    flags     uint16
+    qname     string
+    qtype     uint16
+    answers   int //回答中请求类型的记录数
+}
+
+type TcpDnsPlugin struct {
+    stream     bool //TCP/unix socket，消息带2个字节的长度
+    names      []string
+    qtypes     []string
+    picker     *weightedPicker
+    randomSub  float64
+    recursion  bool
+    rcodes     map[int]bool
+    minAnswers int
+
+    lock       sync.Mutex
+    counts     map[int]uint64 //rcode分布
+    truncated  uint64
+}
+
+//从文件加载DNS插件描述
+func LoadDnsSpec(path string) (*DnsSpec, error) {
+    var spec DnsSpec
+    if err := unmarshalFile(path, &spec); err != nil {
+        return nil, fmt.Errorf("Dns spec %s: %s", path, err)
+    }
+    return &spec, nil
+}
+
+//*TcpDnsPlugin实现PluginIntfs接口
+//生成请求：按权重选择查询类型，请求的Type为查询类型
+func (tdp *TcpDnsPlugin) GenRequest(id int64) unicorn.RawRequest {
+    qtype := tdp.qtypes[tdp.picker.Pick()]
+    name := tdp.names[rand.Intn(len(tdp.names))]
+    if tdp.randomSub > 0 && rand.Float64() < tdp.randomSub {
+        name = randomLabel() + "." + name
+    }
+
+    var msg bytes.Buffer
+    flags := uint16(0)
+    if tdp.recursion {
+        flags |= 0x0100
+    }
+    binary.Write(&msg, binary.BigEndian, []uint16{uint16(rand.Uint32()), flags, 1, 0, 0, 0})
+    writeDnsName(&msg, name)
+    binary.Write(&msg, binary.BigEndian, []uint16{dnsTypes[qtype], DNS_CLASS_IN})
+
+    req := msg.Bytes()
+    if tdp.stream {
+        req = append([]byte{byte(len(req) >> 8), byte(len(req))}, req...)
+    }
+    return unicorn.RawRequest{Id: id, Req: req, Type: qtype}
+}
+
+//check服务端返回是否能够构成一个完整包
+//UDP的响应ID对不上时返回SER_ERROR，框架丢弃这个数据报继续等待
+func (tdp *TcpDnsPlugin) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    msg, status := tdp.message(response)
+    if status != unicorn.SER_OK {
+        return status
+    }
+    if len(msg) < DNS_HEADER_LEN || !bytes.Equal(msg[:2], tdp.query(raw_req.Req)[:2]) {
+        return unicorn.SER_ERROR
+    }
+    return unicorn.SER_OK
+}
+
+//校验服务端返回是否符合预期，同时统计rcode分布
+func (tdp *TcpDnsPlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    msg, status := tdp.message(response)
+    if status != unicorn.SER_OK {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "Malformed dns response"
+    }
+    resp, err := parseDnsResponse(msg)
+    if err != nil {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, err.Error()
+    }
+    query, _ := parseDnsResponse(tdp.query(raw_req.Req))
+    if resp.flags&0x8000 == 0 || resp.id != query.id {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "Not a response to the query"
+    }
+    if !strings.EqualFold(resp.qname, query.qname) || resp.qtype != query.qtype {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, fmt.Sprintf("Question mismatch: %s", resp.qname)
+    }
+
+    rcode := int(resp.flags & 0x000F)
+    tc := resp.flags&0x0200 != 0
+    tdp.lock.Lock()
+    tdp.counts[rcode]++
+    if tc {
+        tdp.truncated++
+    }
+    tdp.lock.Unlock()
+
+    if !tdp.rcodes[rcode] {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "Unexpected rcode " + dnsRcodeName(rcode)
+    }
+    if tc {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "Truncated response"
+    }
+    if rcode == DNS_RCODE_NOERROR && resp.answers < tdp.minAnswers {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, fmt.Sprintf("%d %s answers, expected >= %d", resp.answers, raw_req.Type, tdp.minAnswers)
+    }
+    return unicorn.RESULT_CODE_SUCCESS, "Success"
+}
+
+//*TcpDnsPlugin实现ReporterIntfs接口：rcode分布
+func (tdp *TcpDnsPlugin) Report() string {
+    tdp.lock.Lock()
+    defer tdp.lock.Unlock()
+    rcodes := make([]int, 0, len(tdp.counts))
+    var total uint64
+    for rcode, cnt := range tdp.counts {
+        rcodes = append(rcodes, rcode)
+        total += cnt
+    }
+    sort.Ints(rcodes)
+    var buff strings.Builder
+    buff.WriteString("DNS rcode:\n")
+    for _, rcode := range rcodes {
+        fmt.Fprintf(&buff, "  %s: %d (%.2f%%)\n", dnsRcodeName(rcode), tdp.counts[rcode], 100*float64(tdp.counts[rcode])/float64(total))
+    }
+    fmt.Fprintf(&buff, "DNS truncated: %d\n", tdp.truncated)
+    return buff.String()
+}
+
+//请求中的DNS消息
+func (tdp *TcpDnsPlugin) query(req []byte) []byte {
+    if tdp.stream {
+        return req[2:]
+    }
+    return req
+}
+
+//响应中的DNS消息：TCP按2个字节的长度分帧，UDP一个数据报就是一个消息
+func (tdp *TcpDnsPlugin) message(data []byte) ([]byte, unicorn.ServerRespStatus) {
+    if !tdp.stream {
+        return data, unicorn.SER_OK
+    }
+    if len(data) < 2 {
+        return nil, unicorn.SER_NEEDMORE
+    }
+    n := int(binary.BigEndian.Uint16(data))
+    switch {
+    case len(data)-2 < n:
+        return nil, unicorn.SER_NEEDMORE
+    case len(data)-2 > n:
+        return nil, unicorn.SER_ERROR
+    }
+    return data[2:], unicorn.SER_OK
+}
+
+func dnsRcodeName(rcode int) string {
+    if rcode < len(dnsRcodes) {
+        return dnsRcodes[rcode]
+    }
+    return fmt.Sprintf("RCODE%d", rcode)
+}
+
+//随机的子域名
+func randomLabel() string {
+    const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+    label := make([]byte, DNS_RANDOM_LABEL)
+    for i := range label {
+        label[i] = letters[rand.Intn(len(letters))]
+    }
+    return string(label)
+}
+
+//编码域名，不压缩
+func writeDnsName(buff *bytes.Buffer, name string) {
+    for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+        if label == "" {
+            continue
+        }
+        buff.WriteByte(byte(len(label)))
+        buff.WriteString(label)
+    }
+    buff.WriteByte(0)
+}
+
+//检查域名是否可以编码
+func checkDnsName(name string) error {
+    name = strings.TrimSuffix(name, ".")
+    if len(name) + 2 > DNS_MAX_NAME - DNS_RANDOM_LABEL - 1 {
+        return fmt.Errorf("Dns: name too long: %s", name)
+    }
+    for _, label := range strings.Split(name, ".") {
+        if label == "" || len(label) > DNS_MAX_LABEL {
+            return fmt.Errorf("Dns: bad name %q", name)
+        }
+    }
+    return nil
+}
+
+//读取域名，支持压缩指针，返回域名以及域名在原位置占用的字节数
+func readDnsName(msg []byte, pos int) (string, int, error) {
+    var labels []string
+    start, end, jumps := pos, -1, 0
+    for {
+        if pos >= len(msg) {
+            return "", 0, errors.New("Truncated name")
+        }
+        n := int(msg[pos])
+        switch {
+        case n == 0:
+            if end < 0 {
+                end = pos + 1
+            }
+            return strings.Join(labels, "."), end - start, nil
+        case n&0xC0 == 0xC0:
+            if pos+1 >= len(msg) || jumps > 16 {
+                return "", 0, errors.New("Bad compression pointer")
+            }
+            if end < 0 {
+                end = pos + 2
+            }
+            pos = int(binary.BigEndian.Uint16(msg[pos:]) & 0x3FFF)
+            jumps++
+        case n > DNS_MAX_LABEL || pos+1+n > len(msg):
+            return "", 0, errors.New("Bad label")
+        default:
+            labels = append(labels, string(msg[pos+1:pos+1+n]))
+            pos += 1 + n
+        }
+    }
+}
+
+//解析消息：头部、第一个问题，以及回答中问题类型的记录数
+func parseDnsResponse(msg []byte) (*dnsResponse, error) {
+    if len(msg) < DNS_HEADER_LEN {
+        return nil, errors.New("Short dns message")
+    }
+    resp := &dnsResponse{
+        id    : binary.BigEndian.Uint16(msg),
+        flags : binary.BigEndian.Uint16(msg[2:]),
+    }
+    qdcount, ancount := binary.BigEndian.Uint16(msg[4:]), binary.BigEndian.Uint16(msg[6:])
+    if qdcount != 1 {
+        return nil, fmt.Errorf("Unexpected question count %d", qdcount)
+    }
+    name, n, err := readDnsName(msg, DNS_HEADER_LEN)
+    if err != nil {
+        return nil, err
+    }
+    pos := DNS_HEADER_LEN + n
+    if pos+4 > len(msg) {
+        return nil, errors.New("Truncated question")
+    }
+    resp.qname, resp.qtype = name, binary.BigEndian.Uint16(msg[pos:])
+    pos += 4
+
+    for i := 0; i < int(ancount); i++ {
+        _, n, err := readDnsName(msg, pos)
+        if err != nil {
+            return nil, err
+        }
+        pos += n
+        if pos+10 > len(msg) {
+            return nil, errors.New("Truncated answer")
+        }
+        rtype, rdlen := binary.BigEndian.Uint16(msg[pos:]), int(binary.BigEndian.Uint16(msg[pos+8:]))
+        pos += 10 + rdlen
+        if pos > len(msg) {
+            return nil, errors.New("Truncated answer")
+        }
+        if rtype == resp.qtype {
+            resp.answers++
+        }
+    }
+    return resp, nil
+}
+
+//New函数，创建TcpDnsPlugin，它是PluginIntfs的一个实现。stream为true表示TCP/unix socket
+func NewTcpDnsPlugin(spec *DnsSpec, stream bool) (unicorn.PluginIntfs, error) {
+    tdp := &TcpDnsPlugin{
+        stream     : stream,
+        names      : spec.Names,
+        randomSub  : spec.RandomSubdomain,
+        recursion  : !spec.NoRecursion,
+        rcodes     : make(map[int]bool),
+        minAnswers : spec.Expect.MinAnswers,
+        counts     : make(map[int]uint64),
+    }
+    if len(tdp.names) == 0 {
+        return nil, errors.New("Dns: no names")
+    }
+    for _, name := range tdp.names {
+        if err := checkDnsName(name); err != nil {
+            return nil, err
+        }
+    }
+    if tdp.randomSub < 0 || tdp.randomSub > 1 {
+        return nil, fmt.Errorf("Dns: random subdomain ratio %v out of [0, 1]", tdp.randomSub)
+    }
+    if tdp.minAnswers < 0 {
+        return nil, errors.New("Dns: negative min answers")
+    }
+
+    rcodes := spec.Expect.Rcode
+    if len(rcodes) == 0 {
+        rcodes = []string{"NOERROR"}
+    }
+    for _, name := range rcodes {
+        found := false
+        for rcode, rname := range dnsRcodes {
+            if strings.EqualFold(name, rname) {
+                tdp.rcodes[rcode], found = true, true
+            }
+        }
+        if !found {
+            return nil, fmt.Errorf("Dns: unknown rcode %s", name)
+        }
+    }
+
+    //查询类型的混合，按名字排序，保证结果可以复现
+    queries := spec.Queries
+    if len(queries) == 0 {
+        queries = map[string]int{"A": 1}
+    }
+    for name := range queries {
+        if _, ok := dnsTypes[strings.ToUpper(name)]; !ok {
+            return nil, fmt.Errorf("Dns: unsupported query type %s", name)
+        }
+        tdp.qtypes = append(tdp.qtypes, name)
+    }
+    sort.Strings(tdp.qtypes)
+    weights := make([]int, len(tdp.qtypes))
+    for i, name := range tdp.qtypes {
+        weights[i] = queries[name]
+        tdp.qtypes[i] = strings.ToUpper(name)
+    }
+    var err error
+    if tdp.picker, err = newWeightedPicker(weights); err != nil {
+        return nil, fmt.Errorf("Dns: %s", err)
+    }
+    return tdp, nil
+}
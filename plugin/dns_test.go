@@ -0,0 +1,193 @@
+package plugin
+
+import (
+    "bytes"
+    "encoding/binary"
+    "io"
+    "net"
+    "strings"
+    "testing"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//测试域名的读取：压缩指针、越界、指针环
+func TestDnsName(t *testing.T) {
+    var msg bytes.Buffer
+    msg.Write(make([]byte, DNS_HEADER_LEN))
+    writeDnsName(&msg, "www.example.com.")
+    msg.Write([]byte{3, 'f', 'o', 'o', 0xC0, DNS_HEADER_LEN + 4})
+    data := msg.Bytes()
+
+    name, n, err := readDnsName(data, DNS_HEADER_LEN)
+    if err != nil || name != "www.example.com" || n != 17 {
+        t.Fatalf("Got %q %d %v\n", name, n, err)
+    }
+    name, n, err = readDnsName(data, DNS_HEADER_LEN+17)
+    if err != nil || name != "foo.example.com" || n != 6 {
+        t.Fatalf("Got %q %d %v\n", name, n, err)
+    }
+    for _, bad := range [][]byte{{5, 'a', 'b'}, {0xC0, 0x00}, {0xC0}} {
+        if _, _, err := readDnsName(bad, 0); err == nil {
+            t.Fatalf("%x: expected error\n", bad)
+        }
+    }
+}
+
+//进程内的DNS服务端：example.com有2个A、1个AAAA、1个TXT，_sip._tcp.example.com有1个SRV，其他为NXDOMAIN
+func answerDns(query []byte) []byte {
+    name, n, _ := readDnsName(query, DNS_HEADER_LEN)
+    qtype := binary.BigEndian.Uint16(query[DNS_HEADER_LEN+n:])
+    records := map[string]map[uint16][][]byte{
+        "example.com": {
+            1  : {{10, 0, 0, 1}, {10, 0, 0, 2}},
+            28 : {make([]byte, 16)},
+            16 : {[]byte("\x05hello")},
+        },
+        "_sip._tcp.example.com": {
+            33 : {[]byte("\x00\x01\x00\x01\x13\xc4\x03sip\xc0\x0c")},
+        },
+    }
+
+    var resp bytes.Buffer
+    resp.Write(query[:DNS_HEADER_LEN+n+4])
+    header := resp.Bytes()
+    flags := uint16(0x8180)
+    zone, ok := records[strings.ToLower(name)]
+    if !ok {
+        flags |= 3
+    }
+    binary.BigEndian.PutUint16(header[2:], flags)
+    //先放一个其他类型的记录，不应计入回答数
+    answers := append([][]byte{nil}, zone[qtype]...)
+    if !ok {
+        answers = nil
+    }
+    binary.BigEndian.PutUint16(header[6:], uint16(len(answers)))
+    for i, rdata := range answers {
+        rtype := qtype
+        if i == 0 {
+            rtype, rdata = 5, []byte{0xC0, 0x0C}
+        }
+        binary.Write(&resp, binary.BigEndian, []uint16{0xC00C, rtype, DNS_CLASS_IN, 0, 300, uint16(len(rdata))})
+        resp.Write(rdata)
+    }
+    return resp.Bytes()
+}
+
+func startDnsServer(t *testing.T) (net.PacketConn, net.Listener) {
+    pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go func() {
+        buf := make([]byte, 512)
+        for {
+            n, addr, err := pc.ReadFrom(buf)
+            if err != nil {
+                return
+            }
+            resp := answerDns(buf[:n])
+            //先发一个ID不对的数据报，插件应该丢弃
+            stale := append([]byte{}, resp...)
+            stale[0] ^= 0xFF
+            pc.WriteTo(stale, addr)
+            pc.WriteTo(resp, addr)
+        }
+    }()
+
+    //TCP单独取一个端口，UDP的端口号在TCP上可能已经被占用
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        pc.Close()
+        t.Fatal(err)
+    }
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                for {
+                    head := make([]byte, 2)
+                    if _, err := io.ReadFull(conn, head); err != nil {
+                        return
+                    }
+                    query := make([]byte, binary.BigEndian.Uint16(head))
+                    if _, err := io.ReadFull(conn, query); err != nil {
+                        return
+                    }
+                    resp := answerDns(query)
+                    framed := append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...)
+                    conn.Write(framed[:3])
+                    conn.Write(framed[3:])
+                }
+            }()
+        }
+    }()
+    return pc, ln
+}
+
+//测试DNS插件：UDP以及TCP，查询类型混合，随机子域名，rcode以及回答数
+func TestDnsPlugin(t *testing.T) {
+    pc, ln := startDnsServer(t)
+    defer pc.Close()
+    defer ln.Close()
+
+    for _, address := range []string{"udp://" + pc.LocalAddr().String(), ln.Addr().String()} {
+        spec := &DnsSpec{
+            Queries         : map[string]int{"a": 4, "AAAA": 2, "TXT": 1},
+            Names           : []string{"example.com"},
+            RandomSubdomain : 0.3,
+            Expect          : DnsExpect{Rcode: []string{"NOERROR", "nxdomain"}, MinAnswers: 1},
+        }
+        plg, err := NewTcpDnsPlugin(spec, !strings.HasPrefix(address, "udp://"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        result_chan := make(chan *unicorn.CallResult, 50)
+        unc, err := unicorn.NewUnicorn(address, plg, 500*time.Millisecond, 0, 300*time.Millisecond, 2, true, result_chan)
+        if err != nil {
+            t.Fatalf("Unicorn initialization failing: %s.\n", err)
+        }
+        wg := unc.Start()
+        count_map := make(map[string]int)
+        for ret := range result_chan {
+            if ret.Code != unicorn.RESULT_CODE_SUCCESS && ret.Code != unicorn.RESULT_CODE_WARING_TIMEOUT {
+                t.Errorf("%s: %s %s\n", address, ret.Type, ret.Msg)
+            }
+            count_map[ret.Type]++
+        }
+        wg.Wait()
+
+        report := plg.(unicorn.ReporterIntfs).Report()
+        t.Logf("%s: %v\n%s", address, count_map, report)
+        if count_map["A"] == 0 || count_map["AAAA"] == 0 || count_map["TXT"] == 0 {
+            t.Fatalf("%s: unexpected query mix %v\n", address, count_map)
+        }
+        if !strings.Contains(report, "NOERROR: ") || !strings.Contains(report, "NXDOMAIN: ") {
+            t.Fatalf("%s: unexpected report %s\n", address, report)
+        }
+    }
+
+    //SRV要求2个回答，只有1个
+    plg, _ := NewTcpDnsPlugin(&DnsSpec{Queries: map[string]int{"SRV": 1}, Names: []string{"_sip._tcp.example.com"}, Expect: DnsExpect{MinAnswers: 2}}, true)
+    req := plg.GenRequest(1)
+    resp := answerDns(req.Req[2:])
+    resp = append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...)
+    if plg.CheckFull(&req, resp) != unicorn.SER_OK {
+        t.Fatal("Expected a full response")
+    }
+    if code, msg := plg.CheckResponse(req, resp); code != unicorn.RESULT_CODE_ERROR_RESPONSE || !strings.Contains(msg, "1 SRV answers") {
+        t.Fatalf("Expected answer count error, got %d %s\n", code, msg)
+    }
+
+    if _, err := NewTcpDnsPlugin(&DnsSpec{Names: []string{"a..b"}}, false); err == nil {
+        t.Fatal("Bad name should fail")
+    }
+    if _, err := NewTcpDnsPlugin(&DnsSpec{Names: []string{"a"}, Queries: map[string]int{"AXFR": 1}}, false); err == nil {
+        t.Fatal("Unsupported query type should fail")
+    }
+}
@@ -3,24 +3,42 @@ package plugin
  * plugin
  * Tcp版本插件
  * 测试回显服务器
+ * 消息的长度可以按分布生成（参见ParseSizeDist），内容可以是字母数字或者任意二进制，
+ * 配合大消息可以测试带宽，而不仅仅是请求速率
  */
 
 import (
+    "bytes"
     "fmt"
     "github.com/hq-cml/unicorn-go/unicorn"
-    "github.com/hq-cml/go-case/random"
+)
+
+const (
+    ECHO_DEFAULT_SIZE = 10 //默认的消息长度
+    ECHO_MSG_PREVIEW  = 32 //结果信息中最多展示的响应长度
 )
 
 type TcpEchoPlugin struct {
+    size   SizeDist //消息长度的分布
+    binary bool     //是否使用二进制内容
 }
 
 //*TcpEchoPlugin实现PluginIntfs接口
 //生成请求
 func (tep *TcpEchoPlugin) GenRequest(id int64) unicorn.RawRequest {
-    //生成随机字符串，作为消息
-    msg := random.GenRandString(10)
+    //生成随机内容，作为消息，长度为0的消息没有意义（引擎不发送空请求）
+    n := tep.size.Next()
+    if n == 0 {
+        n = 1
+    }
+    var msg []byte
+    if tep.binary {
+        msg = randBinaryPayload(n)
+    } else {
+        msg = randPayload(n)
+    }
 
-    raw_reqest := unicorn.RawRequest{Id: id, Req: []byte(msg)}
+    raw_reqest := unicorn.RawRequest{Id: id, Req: msg}
     return raw_reqest
 }
 
@@ -39,23 +57,29 @@ func (tep *TcpEchoPlugin)CheckFull(raw_req *unicorn.RawRequest, response []byte)
     }
 }
 
-//校验服务端返回是否符合预期
+//校验服务端返回是否符合预期，大消息只展示开头部分
 func (tep *TcpEchoPlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (code unicorn.ResultCode, msg string) {
-    str1 := string(raw_req.Req)
-    str2 := string(response)
-
-    if str1 == str2 {
+    if bytes.Equal(raw_req.Req, response) {
         code = unicorn.RESULT_CODE_SUCCESS
-        msg = fmt.Sprintf("Success.(%s)", string(response))
+        msg = fmt.Sprintf("Success.(%d bytes)", len(response))
     } else {
+        preview := response
+        if len(preview) > ECHO_MSG_PREVIEW {
+            preview = preview[:ECHO_MSG_PREVIEW]
+        }
         code = unicorn.RESULT_CODE_ERROR_RESPONSE
-        msg = fmt.Sprintf("Incorrectly formatted Resp: %s!\n", string(response))
+        msg = fmt.Sprintf("Incorrectly formatted Resp(%d bytes): %q!\n", len(response), preview)
     }
 
     return
 }
 
-//New函数，创建TcpEquationPlugin，它是PluginIntfs的一个实现
+//New函数，创建TcpEchoPlugin，它是PluginIntfs的一个实现，消息为10个字符
 func NewTcpEchoPlugin() unicorn.PluginIntfs {
-    return &TcpEchoPlugin{ }
+    return &TcpEchoPlugin{size: &fixedSize{n: ECHO_DEFAULT_SIZE}}
+}
+
+//New函数，创建消息长度按size分布的TcpEchoPlugin，binary为true时使用二进制内容
+func NewTcpEchoSizedPlugin(size SizeDist, binary bool) unicorn.PluginIntfs {
+    return &TcpEchoPlugin{size: size, binary: binary}
 }
@@ -0,0 +1,118 @@
+package plugin
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+    "github.com/hq-cml/unicorn-go/testserver"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//测试大小分布的解析：后缀、对数正态、直方图以及非法输入
+func TestSizeDist(t *testing.T) {
+    for spec, expect := range map[string]int{"64": 64, "fixed:2K": 2048, "fixed:3m": 3 << 20} {
+        sd, err := ParseSizeDist(spec)
+        if err != nil || sd.Next() != expect {
+            t.Fatalf("%s: expected %d, got %v\n", spec, expect, err)
+        }
+    }
+    sd, err := ParseSizeDist("uniform:1K-2K")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 100; i++ {
+        if n := sd.Next(); n < 1024 || n > 2048 {
+            t.Fatalf("Uniform size %d out of range\n", n)
+        }
+    }
+
+    //对数正态：中位数附近的各占一半
+    sd, err = ParseSizeDist("lognormal:4K,1.0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    below := 0
+    for i := 0; i < 10000; i++ {
+        n := sd.Next()
+        if n < 0 || n > SIZE_MAX {
+            t.Fatalf("Lognormal size %d out of range\n", n)
+        }
+        if n < 4096 {
+            below++
+        }
+    }
+    if below < 4500 || below > 5500 {
+        t.Fatalf("Lognormal median is off: %d/10000 below\n", below)
+    }
+
+    dir, err := ioutil.TempDir("", "unicorn-size")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "sizes.txt")
+    ioutil.WriteFile(path, []byte("# size weight\n\n100 1\n1K  0\n  2M 3\n"), 0600)
+    sd, err = ParseSizeDist("histogram:" + path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    count_map := make(map[int]int)
+    for i := 0; i < 1000; i++ {
+        count_map[sd.Next()]++
+    }
+    if len(count_map) != 2 || count_map[100] == 0 || count_map[100] > count_map[2<<20] {
+        t.Fatalf("Unexpected histogram picks: %v\n", count_map)
+    }
+
+    ioutil.WriteFile(path, []byte("100\n"), 0600)
+    for _, bad := range []string{"fixed:abc", "fixed:17M", "uniform:2K-1K", "lognormal:0,1", "lognormal:4K", "histogram:" + path, "histogram:/no/such/file", "normal:10"} {
+        if _, err := ParseSizeDist(bad); err == nil {
+            t.Fatalf("%s: expected error\n", bad)
+        }
+    }
+}
+
+//测试回显插件：二进制的大消息，以及响应的校验
+func TestEchoPlugin(t *testing.T) {
+    size, _ := ParseSizeDist("uniform:100K-1M")
+    plg := NewTcpEchoSizedPlugin(size, true)
+
+    req := plg.GenRequest(1)
+    if plg.CheckFull(&req, req.Req[:len(req.Req)-1]) != unicorn.SER_NEEDMORE {
+        t.Fatal("Expected SER_NEEDMORE")
+    }
+    wrong := append([]byte{}, req.Req...)
+    wrong[len(wrong)/2]++
+    if code, _ := plg.CheckResponse(req, wrong); code != unicorn.RESULT_CODE_ERROR_RESPONSE {
+        t.Fatal("Corrupted echo should fail")
+    }
+
+    server := testserver.NewEchoServer()
+    if err := server.Listen("127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    defer server.Close()
+    traffic := &unicorn.ByteCounter{}
+    result_chan := make(chan *unicorn.CallResult, 50)
+    unc, err := unicorn.NewUnicorn(server.Addr(), plg, 2*time.Second, 0, 500*time.Millisecond, 2, true, result_chan)
+    if err != nil {
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
+    }
+    unc.(*unicorn.Unicorn).UseConnWrapper(traffic.Wrapper())
+    wg := unc.Start()
+    success := 0
+    for ret := range result_chan {
+        if ret.Code == unicorn.RESULT_CODE_SUCCESS {
+            success++
+        } else if ret.Code != unicorn.RESULT_CODE_WARING_TIMEOUT {
+            t.Errorf("%d: %s\n", ret.Code, ret.Msg)
+        }
+    }
+    wg.Wait()
+    t.Logf("success: %d, sent: %d, recv: %d\n", success, traffic.Sent, traffic.Recv)
+    if success == 0 || traffic.Sent < uint64(success)*100<<10 || traffic.Recv < uint64(success)*100<<10 {
+        t.Fatalf("Unexpected traffic: success %d, sent %d, recv %d\n", success, traffic.Sent, traffic.Recv)
+    }
+}
@@ -3,105 +3,239 @@ package plugin
  * plugin
  * Tcp版本插件
  * 发送一个算式给服务端，服务端计算之后将结果返回
+ * 请求按权重混合以下几类，请求的类型即为报告中的分类：
+ *   simple    : 两个操作数一个操作符，Operands/Operator形式，兼容只支持这种形式的服务端
+ *   nested    : 嵌套的表达式，包含优先级不同的运算符以及括号，Expr形式
+ *   bigint    : 操作数为大整数的嵌套表达式，超出int64的范围
+ *   float     : 操作数包含小数的嵌套表达式
+ *   divzero   : 故意除以0，服务端应该返回Err
+ *   malformed : 故意发送错误的JSON，服务端应该返回Err（此时无法解析出Id，Id为0）
+ * 期望值由expr包在本地计算。非法输入得到预期的Err时，结果码为RESULT_CODE_ERROR_CALEE，
+ * 没有得到Err（服务端给出了计算结果）则为RESULT_CODE_ERROR_RESPONSE
+ *
+ * 示例（YAML）：
+ *   depth: 3
+ *   kinds: {simple: 2, nested: 5, bigint: 1, float: 1, divzero: 1, malformed: 1}
  */
 
 import (
-    "fmt"
-    "github.com/hq-cml/unicorn-go/unicorn"
+    "bytes"
     "encoding/json"
-    //"net"
-    //"bytes"
-    //"bufio"
+    "errors"
+    "fmt"
     "math/rand"
-    //"strconv"
-    "bytes"
+    "sort"
     "strconv"
+    "github.com/hq-cml/unicorn-go/expr"
+    "github.com/hq-cml/unicorn-go/unicorn"
 )
 
 const (
     DELIM = '\n'
 )
 
+//请求的种类
+const (
+    EQUATION_SIMPLE    = "simple"
+    EQUATION_NESTED    = "nested"
+    EQUATION_BIGINT    = "bigint"
+    EQUATION_FLOAT     = "float"
+    EQUATION_DIVZERO   = "divzero"
+    EQUATION_MALFORMED = "malformed"
+)
+
+const (
+    EQUATION_DEFAULT_DEPTH = 3  //表达式树的默认最大深度
+    EQUATION_MAX_DEPTH     = 8  //表达式树的最大深度上限，避免表达式过长
+    EQUATION_GEN_RETRY     = 10 //生成的表达式恰好除以0时重新生成的次数
+)
+
+//默认的请求混合：只有Operands/Operator形式，已有的服务端都能处理，其他种类需要在描述中指定
+var equationDefaultKinds = map[string]int{
+    EQUATION_SIMPLE : 1,
+}
+
+var equationOperators = []string{"+", "-", "*", "/", "%"}
+
 type ServerEquationReq struct {
     Id       int64
-    Operands []int   //操作数
-    Operator string  //操作符
+    Operands []int  `json:",omitempty"` //操作数
+    Operator string `json:",omitempty"` //操作符
+    Expr     string `json:",omitempty"` //表达式，不为空时忽略Operands和Operator
 }
 
 type ServerEquationResp struct {
     Id      int64
     Formula string   //具体公式
-    Result  int      //结果
-    Err     error
+    Result  int      //结果，Operands/Operator形式的请求
+    Value   string   `json:",omitempty"` //结果，Expr形式的请求，可能是大整数或者小数
+    Err     string   `json:",omitempty"` //服务端的错误
+}
+
+//算式插件描述
+type EquationSpec struct {
+    Depth int            `json:"depth" yaml:"depth"` //表达式树的最大深度，默认3
+    Kinds map[string]int `json:"kinds" yaml:"kinds"` //请求种类 -> 权重，默认simple:1
 }
 
 type TcpEquationPlugin struct {
+    depth  int
+    kinds  []string
+    picker *weightedPicker
+}
+
+//从文件加载描述
+func LoadEquationSpec(path string) (*EquationSpec, error) {
+    var spec EquationSpec
+    if err := unmarshalFile(path, &spec); err != nil {
+        return nil, fmt.Errorf("Equation spec %s: %s", path, err)
+    }
+    return &spec, nil
 }
 
 //*TcpEquationPlugin实现PluginIntfs接口
+//生成请求：按权重选择请求种类，请求的Type为种类
 func (tep *TcpEquationPlugin) GenRequest(id int64) unicorn.RawRequest {
-    req := ServerEquationReq{
-        Id: id,
-        Operands:[]int{ //两个随机数
+    kind := tep.kinds[tep.picker.Pick()]
+    req := ServerEquationReq{Id: id}
+    switch kind {
+    case EQUATION_SIMPLE:
+        req.Operands = []int{ //两个随机数
             int(rand.Int31n(1000) + 1),
             int(rand.Int31n(1000) + 1),
-        },
-        Operator: func() string {
-            op := []string{"+", "-", "*", "/"}
-            return op[rand.Int31n(100)%4]
-        }(),
+        }
+        req.Operator = equationOperators[rand.Intn(4)]
+    case EQUATION_DIVZERO:
+        //合法的表达式，再整体除以一个值为0的表达式
+        zeros := []string{"0", "(7 - 7)", "0.0", "(3 * 0)"}
+        req.Expr = fmt.Sprintf("(%s) %s %s", tep.genValid(EQUATION_NESTED), equationOperators[3+rand.Intn(2)], zeros[rand.Intn(len(zeros))])
+    default:
+        req.Expr = tep.genValid(kind)
     }
     bytes, err := json.Marshal(req)
     if err != nil {
         panic(err) //框架会接住这个panic，defer unc.handleError()
     }
+    if kind == EQUATION_MALFORMED {
+        bytes = malformJson(bytes)
+    }
     bytes = append(bytes, DELIM)
-    raw_reqest := unicorn.RawRequest{Id: id, Req: bytes}
+    raw_reqest := unicorn.RawRequest{Id: id, Req: bytes, Type: kind}
     return raw_reqest
 }
 
-func (tep *TcpEquationPlugin)CheckFull(rawReq *unicorn.RawRequest, response []byte)(unicorn.ServerRespStatus) {
-    //校验response
-    var sresp ServerEquationResp
+//生成一个可以正常求值的表达式，恰好除以0的重新生成，始终失败则退化为一个操作数
+func (tep *TcpEquationPlugin) genValid(kind string) string {
+    for i := 0; i < EQUATION_GEN_RETRY; i++ {
+        s := genExpr(kind, tep.depth)
+        if _, err := expr.Eval(s); err == nil {
+            return s
+        }
+    }
+    return genOperand(kind)
+}
 
-    l := len(response)
+//随机生成深度不超过depth的表达式，子表达式随机加上括号，不加括号的按优先级计算
+func genExpr(kind string, depth int) string {
+    if depth <= 0 || rand.Intn(4) == 0 {
+        return genOperand(kind)
+    }
+    op := equationOperators[rand.Intn(len(equationOperators))]
+    left, right := genExpr(kind, depth-1), genExpr(kind, depth-1)
+    if rand.Intn(2) == 0 {
+        left = "(" + left + ")"
+    }
+    if rand.Intn(2) == 0 {
+        right = "(" + right + ")"
+    }
+    return left + " " + op + " " + right
+}
 
-    if response[l-1] == DELIM {
-        err := json.Unmarshal(response[:l-1], &sresp)
-        if err != nil {
-            return unicorn.SER_NEEDMORE
+//随机生成一个操作数，不为0，偶尔为负数
+func genOperand(kind string) string {
+    var s string
+    switch {
+    case kind == EQUATION_BIGINT:
+        //20到40位的大整数
+        digits := make([]byte, 20+rand.Intn(21))
+        digits[0] = byte('1' + rand.Intn(9))
+        for i := 1; i < len(digits); i++ {
+            digits[i] = byte('0' + rand.Intn(10))
         }
+        s = string(digits)
+    case kind == EQUATION_FLOAT && rand.Intn(2) == 0:
+        s = fmt.Sprintf("%d.%03d", rand.Intn(1000), rand.Intn(999)+1)
+    default:
+        s = strconv.Itoa(rand.Intn(1000) + 1)
+    }
+    if rand.Intn(10) == 0 {
+        s = "(-" + s + ")"
+    }
+    return s
+}
 
-        if sresp.Id != rawReq.Id {
-            return unicorn.SER_ERROR
-        }
-    } else {
-        fmt.Println(string(response), len(response))
+//把一个合法的JSON改成非法的：截断、破坏分隔符或者替换成非JSON内容
+func malformJson(b []byte) []byte {
+    switch rand.Intn(3) {
+    case 0:
+        return b[:len(b)-1-rand.Intn(len(b)/2)]
+    case 1:
+        return bytes.Replace(b, []byte(":"), []byte("="), 1)
+    default:
+        return []byte("equation " + string(b))
+    }
+}
+
+//check服务端返回是否能够构成一个完整包
+func (tep *TcpEquationPlugin)CheckFull(rawReq *unicorn.RawRequest, response []byte)(unicorn.ServerRespStatus) {
+    if !bytes.HasSuffix(response, []byte{DELIM}) {
+        return unicorn.SER_NEEDMORE
+    }
+
+    //校验response
+    var sresp ServerEquationResp
+    if err := json.Unmarshal(response, &sresp); err != nil {
         return unicorn.SER_NEEDMORE
     }
+    //错误的JSON，服务端无法解析出Id
+    if sresp.Id != rawReq.Id && !(rawReq.Type == EQUATION_MALFORMED && sresp.Id == 0) {
+        return unicorn.SER_ERROR
+    }
 
     return unicorn.SER_OK
 }
 
 func (tep *TcpEquationPlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (code unicorn.ResultCode, msg string) {
-    //校验request
-    var sreq ServerEquationReq
-    err := json.Unmarshal(raw_req.Req, &sreq)
-    if err != nil {
-        code = unicorn.RESULT_CODE_FATAL_CALL
-        msg = fmt.Sprintf("Incorrectly formatted Req: %s!\n", string(raw_req.Req))
-        return
-    }
-
     //校验response
     var sresp ServerEquationResp
-    err = json.Unmarshal(response, &sresp)
+    err := json.Unmarshal(response, &sresp)
     if err != nil {
         code = unicorn.RESULT_CODE_ERROR_RESPONSE
         msg = fmt.Sprintf("Incorrectly formatted Resp: %s!\n", string(response))
         return
     }
 
+    //非法的输入，期望服务端返回Err
+    if raw_req.Type == EQUATION_MALFORMED || raw_req.Type == EQUATION_DIVZERO {
+        if sresp.Err == "" {
+            code = unicorn.RESULT_CODE_ERROR_RESPONSE
+            msg = fmt.Sprintf("Expected an error for %s request %q, got: %s!\n", raw_req.Type, bytes.TrimSpace(raw_req.Req), string(response))
+            return
+        }
+        code = unicorn.RESULT_CODE_ERROR_CALEE
+        msg = fmt.Sprintf("Expected server error: %s!\n", sresp.Err)
+        return
+    }
+
+    //校验request
+    var sreq ServerEquationReq
+    err = json.Unmarshal(raw_req.Req, &sreq)
+    if err != nil {
+        code = unicorn.RESULT_CODE_FATAL_CALL
+        msg = fmt.Sprintf("Incorrectly formatted Req: %s!\n", string(raw_req.Req))
+        return
+    }
+
     //校验id是否一致
     if sresp.Id != sreq.Id {
         code = unicorn.RESULT_CODE_ERROR_RESPONSE
@@ -110,17 +244,33 @@ func (tep *TcpEquationPlugin) CheckResponse(raw_req unicorn.RawRequest, response
     }
 
     //校验response的Err
-    if sresp.Err != nil {
+    if sresp.Err != "" {
         code = unicorn.RESULT_CODE_ERROR_CALEE
         msg = fmt.Sprintf("Abnormal server: %s!\n", sresp.Err)
         return
     }
 
     //校验最终计算结果是否一致
-    if sresp.Result != op(sreq.Operands, sreq.Operator) {
-        code = unicorn.RESULT_CODE_ERROR_RESPONSE
-        msg = fmt.Sprintf("Incorrect result: %s!\n", genFormula(sreq.Operands, sreq.Operator, sresp.Result, false))
-        return
+    if sreq.Expr != "" {
+        expect, err := expr.Eval(sreq.Expr)
+        if err != nil {
+            code = unicorn.RESULT_CODE_FATAL_CALL
+            msg = fmt.Sprintf("Bad expression %q: %s!\n", sreq.Expr, err)
+            return
+        }
+        actual, err := expr.Eval(sresp.Value)
+        if err != nil || !actual.Equal(expect) {
+            code = unicorn.RESULT_CODE_ERROR_RESPONSE
+            msg = fmt.Sprintf("Incorrect result: %s != %s (expected %s)!\n", sreq.Expr, sresp.Value, expect.String())
+            return
+        }
+    } else {
+        expect, err := op(sreq.Operands, sreq.Operator)
+        if err != nil || sresp.Result != expect {
+            code = unicorn.RESULT_CODE_ERROR_RESPONSE
+            msg = fmt.Sprintf("Incorrect result: %s!\n", genFormula(sreq.Operands, sreq.Operator, sresp.Result, false))
+            return
+        }
     }
 
     //一切都ok，则算是一次完整的请求
@@ -130,48 +280,77 @@ func (tep *TcpEquationPlugin) CheckResponse(raw_req unicorn.RawRequest, response
     return
 }
 
-//New函数，创建TcpEquationPlugin，它是PluginIntfs的一个实现
+//New函数，创建TcpEquationPlugin，它是PluginIntfs的一个实现，使用默认的请求混合
 func NewTcpEquationPlugin() unicorn.PluginIntfs {
-    return &TcpEquationPlugin{ }
+    tep, err := NewTcpEquationSpecPlugin(&EquationSpec{})
+    if err != nil {
+        panic(err) //默认配置不会出错
+    }
+    return tep
 }
 
-func op(operands []int, operator string) int {
-    var result int
-    switch {
-    case operator == "+":
-        for _, v := range operands {
-            if result == 0 {
-                result = v
-            } else {
-                result += v
-            }
-        }
-    case operator == "-":
-        for _, v := range operands {
-            if result == 0 {
-                result = v
-            } else {
-                result -= v
-            }
+//New函数，按描述创建TcpEquationPlugin
+func NewTcpEquationSpecPlugin(spec *EquationSpec) (unicorn.PluginIntfs, error) {
+    tep := &TcpEquationPlugin{depth: spec.Depth}
+    if tep.depth == 0 {
+        tep.depth = EQUATION_DEFAULT_DEPTH
+    }
+    if tep.depth < 0 || tep.depth > EQUATION_MAX_DEPTH {
+        return nil, fmt.Errorf("Equation: depth %d out of [1, %d]", tep.depth, EQUATION_MAX_DEPTH)
+    }
+
+    kinds := spec.Kinds
+    if len(kinds) == 0 {
+        kinds = equationDefaultKinds
+    }
+    var weights []int
+    for kind := range kinds {
+        switch kind {
+        case EQUATION_SIMPLE, EQUATION_NESTED, EQUATION_BIGINT, EQUATION_FLOAT, EQUATION_DIVZERO, EQUATION_MALFORMED:
+        default:
+            return nil, fmt.Errorf("Equation: unknown kind %s", kind)
         }
-    case operator == "*":
-        for _, v := range operands {
-            if result == 0 {
-                result = v
-            } else {
-                result *= v
+        tep.kinds = append(tep.kinds, kind)
+    }
+    sort.Strings(tep.kinds)
+    for _, kind := range tep.kinds {
+        weights = append(weights, kinds[kind])
+    }
+    var err error
+    if tep.picker, err = newWeightedPicker(weights); err != nil {
+        return nil, fmt.Errorf("Equation: %s", err)
+    }
+    return tep, nil
+}
+
+//计算Operands/Operator形式的算式，从左到右依次计算
+func op(operands []int, operator string) (int, error) {
+    if len(operands) == 0 {
+        return 0, errors.New("no operands")
+    }
+    result := operands[0]
+    for _, v := range operands[1:] {
+        switch operator {
+        case "+":
+            result += v
+        case "-":
+            result -= v
+        case "*":
+            result *= v
+        case "/", "%":
+            if v == 0 {
+                return 0, expr.ErrDivByZero
             }
-        }
-    case operator == "/":
-        for _, v := range operands {
-            if result == 0 {
-                result = v
-            } else {
+            if operator == "/" {
                 result /= v
+            } else {
+                result %= v
             }
+        default:
+            return 0, fmt.Errorf("unknown operator %q", operator)
         }
     }
-    return result
+    return result, nil
 }
 
 func genFormula(operands []int, operator string, result int, equal bool) string {
@@ -193,4 +372,4 @@ func genFormula(operands []int, operator string, result int, equal bool) string
     }
     buff.WriteString(strconv.Itoa(result))
     return buff.String()
-}
\ No newline at end of file
+}
@@ -6,12 +6,11 @@ import (
     "github.com/hq-cml/unicorn-go/unicorn"
     "time"
     "fmt"
-    "net"
-    "sync"
-    "encoding/json"
-    "errors"
-    "bufio"
+    "strings"
     "bytes"
+    "encoding/json"
+    "github.com/hq-cml/unicorn-go/expr"
+    "github.com/hq-cml/unicorn-go/testserver"
 )
 
 var printDetail = true
@@ -21,7 +20,7 @@ func TestStart(t *testing.T) {
     runtime.GOMAXPROCS(runtime.NumCPU())
 
     //初始化Server
-    server := NewTcpServer()
+    server := testserver.NewEquationServer()
     defer server.Close() //注册关闭
     addr := "127.0.0.1:9527"
     t.Logf("Startup Tcp Server(%s)..\n", addr)
@@ -92,7 +91,7 @@ func TestStop(t *testing.T) {
     runtime.GOMAXPROCS(runtime.NumCPU())
 
     //初始化Server
-    server := NewTcpServer()
+    server := testserver.NewEquationServer()
     defer server.Close() //注册关闭
     addr := "127.0.0.1:9527"
     t.Logf("Startup Tcp Server(%s)..\n", addr)
@@ -153,149 +152,110 @@ func TestStop(t *testing.T) {
     wg.Wait()
 }
 
-//仅仅启动一个Server，供测试unicorn main
-func TestServer(t *testing.T) {
-    runtime.GOMAXPROCS(runtime.NumCPU())
-
-    //初始化Server
-    server := NewTcpServer()
-    defer server.Close() //注册关闭
-    addr := "127.0.0.1:9527"
-    t.Logf("Startup Tcp Server(%s)..\n", addr)
-    err := server.Listen(addr)
-    if err != nil {
-        t.Fatalf("TCP Server startup failing! (addr=%s)!\n", addr)
-        t.FailNow() //结束！
+//测试Operands/Operator形式的计算：操作数为0不影响结果
+func TestOp(t *testing.T) {
+    cases := []struct {
+        operands []int
+        operator string
+        expect   int
+    }{
+        {[]int{0, 5}, "+", 5},
+        {[]int{0, 5}, "-", -5},
+        {[]int{5, 0, 3}, "*", 0},
+        {[]int{0, 7}, "/", 0},
+        {[]int{9, 4, 3}, "-", 2},
+        {[]int{17, 5}, "%", 2},
+    }
+    for _, c := range cases {
+        if r, err := op(c.operands, c.operator); err != nil || r != c.expect {
+            t.Fatalf("%v %s: expected %d, got %d %v\n", c.operands, c.operator, c.expect, r, err)
+        }
+    }
+    if _, err := op([]int{7, 0}, "/"); err == nil {
+        t.Fatal("Division by zero should fail")
     }
-
-    time.Sleep(1*time.Hour)
-}
-
-/**************************配套服务端的逻辑********************/
-type TcpServer struct {
-    listener net.Listener
-    active   bool
-    lock     *sync.Mutex
-    connCnt  int64        //处理的连接数
 }
 
-func (self *TcpServer) init(addr string) error {
-    self.lock.Lock()
-    defer self.lock.Unlock()
-    if self.active {
-        return nil
+//测试各种请求：嵌套表达式、大整数、小数，以及非法输入得到预期的服务端错误
+func TestEquationKinds(t *testing.T) {
+    server := testserver.NewEquationServer()
+    defer server.Close()
+    if err := server.Listen("127.0.0.1:0"); err != nil {
+        t.Fatal(err)
     }
-    ln, err := net.Listen("tcp", addr)
+    spec := &EquationSpec{
+        Kinds : map[string]int{"simple": 1, "nested": 1, "bigint": 1, "float": 1, "divzero": 1, "malformed": 1},
+    }
+    plg, err := NewTcpEquationSpecPlugin(spec)
     if err != nil {
-        return err
+        t.Fatal(err)
+    }
+
+    //生成的表达式都能求值，大整数超出int64
+    tep := plg.(*TcpEquationPlugin)
+    for i := 0; i < 100; i++ {
+        if _, err := expr.Eval(tep.genValid(EQUATION_NESTED)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if s := genOperand(EQUATION_BIGINT); len(strings.Trim(s, "(-)")) < 20 {
+        t.Fatalf("Big int too small: %s\n", s)
     }
-    self.listener = ln
-    self.active = true
-    self.connCnt = 0
-    return nil
-}
 
-func (self *TcpServer) Listen(addr string) error {
-    err := self.init(addr)
+    result_chan := make(chan *unicorn.CallResult, 50)
+    unc, err := unicorn.NewUnicorn(server.Addr(), plg, 200*time.Millisecond, 0, 300*time.Millisecond, 2, true, result_chan)
     if err != nil {
-        return err
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
     }
-    go func(active *bool) {
-        for {
-            conn, err := self.listener.Accept()
-            if err != nil {
-                fmt.Errorf("Server: Request Acception Error: %s\n", err)
-                continue
-            }
-            go reqHandler(conn)
-            self.connCnt++
-            runtime.Gosched()
+    wg := unc.Start()
+    count_map := make(map[string]map[unicorn.ResultCode]int)
+    for ret := range result_chan {
+        if count_map[ret.Type] == nil {
+            count_map[ret.Type] = make(map[unicorn.ResultCode]int)
         }
-    }(&self.active)
-    return nil
-}
-
-func NewTcpServer() *TcpServer {
-    return &TcpServer{lock: new(sync.Mutex)}
-}
-
-func (self *TcpServer) Close() bool {
-    self.lock.Lock()
-    defer self.lock.Unlock()
-    fmt.Println("Server serve client cnt is :", self.connCnt)
-    if self.active {
-        self.listener.Close()
-        self.active = false
-        return true
-    } else {
-        return false
+        count_map[ret.Type][ret.Code]++
     }
-}
-
-func reqHandler(conn net.Conn) {
-    var errMsg string
-    var sresp ServerEquationResp
+    wg.Wait()
+    t.Logf("%v\n", count_map)
 
-    for{
-        req, err := read(conn, DELIM)
-        //fmt.Println("AAAAAAAAAAAAAAAAAAAAAAAAAAAAAA:", string(req))
-        if err != nil {
-            errMsg = fmt.Sprintf("Server: Req Read Error: %s", err)
-            conn.Close() //短连接
-            return
-        } else {
-            var sreq ServerEquationReq
-            err := json.Unmarshal(req, &sreq)
-            if err != nil {
-                errMsg = fmt.Sprintf("Server: Req Unmarshal Error: %s", err)
-            } else {
-                sresp.Id = sreq.Id
-                sresp.Result = op(sreq.Operands, sreq.Operator)
-                sresp.Formula = genFormula(sreq.Operands, sreq.Operator, sresp.Result, true)
-            }
-        }
-        if errMsg != "" {
-            sresp.Err = errors.New(errMsg)
-        }
-        bytes, err := json.Marshal(sresp)
-        //fmt.Println("BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB:", string(bytes))
-        if err != nil {
-            fmt.Errorf("Server: Resp Marshal Error: %s", err)
+    for kind, counts := range count_map {
+        expect := unicorn.RESULT_CODE_SUCCESS
+        if kind == EQUATION_DIVZERO || kind == EQUATION_MALFORMED {
+            expect = unicorn.RESULT_CODE_ERROR_CALEE
         }
-        _, err = write(conn, bytes, DELIM)
-        if err != nil {
-            fmt.Errorf("Server: Resp Write error: %s", err)
+        for code, n := range counts {
+            if code != expect && code != unicorn.RESULT_CODE_WARING_TIMEOUT {
+                t.Fatalf("%s: unexpected code %d (%d times)\n", kind, code, n)
+            }
         }
     }
+    if len(count_map) != 6 {
+        t.Fatalf("Missing kinds: %v\n", count_map)
+    }
 
-    //conn.Close() //短连接
-}
-
-func write(conn net.Conn, content []byte, delim byte) (int, error) {
-    writer := bufio.NewWriter(conn)
-    n, err := writer.Write(content)
-    if err == nil {
-        writer.WriteByte(delim)
+    //非法输入，服务端却给出了结果
+    req := plg.GenRequest(1)
+    for req.Type != EQUATION_DIVZERO {
+        req = plg.GenRequest(1)
     }
-    if err == nil {
-        err = writer.Flush()
+    if code, _ := plg.CheckResponse(req, []byte(`{"Id":1,"Value":"3"}`)); code != unicorn.RESULT_CODE_ERROR_RESPONSE {
+        t.Fatal("Missing error should fail")
     }
-    return n, err
-}
 
-func read(conn net.Conn, delim byte) ([]byte, error) {
-    readBytes := make([]byte, 1)
-    var buffer bytes.Buffer
-    for {
-        _, err := conn.Read(readBytes)
-        if err != nil {
-            return nil, err
+    //默认只生成Operands/Operator形式，兼容只支持这种形式的服务端
+    def := NewTcpEquationPlugin()
+    for i := 0; i < 100; i++ {
+        raw_req := def.GenRequest(int64(i))
+        var sreq ServerEquationReq
+        if err := json.Unmarshal(bytes.TrimSpace(raw_req.Req), &sreq); err != nil {
+            t.Fatal(err)
         }
-        readByte := readBytes[0]
-        if readByte == delim {
-            break
+        if raw_req.Type != EQUATION_SIMPLE || sreq.Expr != "" || len(sreq.Operands) != 2 {
+            t.Fatalf("Expected simple requests by default, got %s %s\n", raw_req.Type, raw_req.Req)
         }
-        buffer.WriteByte(readByte)
     }
-    return buffer.Bytes(), nil
-}
\ No newline at end of file
+
+    if _, err := NewTcpEquationSpecPlugin(&EquationSpec{Kinds: map[string]int{"matrix": 1}}); err == nil {
+        t.Fatal("Unknown kind should fail")
+    }
+}
@@ -0,0 +1,327 @@
+package plugin
+/*
+ * plugin
+ * 外部进程插件
+ * 启动一个外部可执行程序，通过stdin/stdout上的行分隔JSON协议，把GenRequest、CheckFull、CheckResponse
+ * 转交给外部程序实现，这样不写Go的团队也可以实现自己的插件
+ *
+ * 协议：一问一答，每行一个JSON对象，[]byte字段按照encoding/json的惯例使用base64编码
+ * 外部程序按照收到的顺序逐个应答，插件按照发送的顺序匹配应答，多个worker的调用以流水线的方式
+ * 同时在管道中，不必等待前一个应答返回再发送下一个
+ *   握手(可选应答字段)：
+ *     -> {"op":"hello"}
+ *     <- {"batch":100,"framing":"delim","delim":"\n"}
+ *   生成请求（批量，降低交互开销，ids由框架分配，保证全局唯一）：
+ *     -> {"op":"gen","ids":[1,2,3]}
+ *     <- {"reqs":[{"id":1,"req":"..."},{"id":2,"req":"..."},{"id":3,"req":"..."}]}
+ *   判断响应是否完整（如果握手时声明了framing，则由插件本地判断，不再交互）：
+ *     -> {"op":"full","id":1,"req":"...","resp":"..."}
+ *     <- {"status":0}
+ *   校验响应：
+ *     -> {"op":"check","id":1,"req":"...","resp":"..."}
+ *     <- {"code":0,"msg":"Success"}
+ * 只实现了行分隔的JSON，长度前缀的二进制编码不在支持范围内
+ *
+ * 关闭时先关闭stdin，外部程序读到EOF应该自行退出，超过EXTERNAL_CLOSE_WAIT仍未退出则被杀死
+ */
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "sync"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+const (
+    EXTERNAL_DEFAULT_BATCH = 64              //默认的批量生成请求个数
+    EXTERNAL_CLOSE_WAIT    = 3 * time.Second //关闭时等待外部程序退出的最长时间，超时则杀死
+)
+
+//本地判断包完整性的几种方式
+const (
+    EXTERNAL_FRAMING_REMOTE = ""       //每次都询问外部程序
+    EXTERNAL_FRAMING_DELIM  = "delim"  //以定界符结尾即完整
+    EXTERNAL_FRAMING_ECHO   = "echo"   //长度和请求相同即完整
+)
+
+//发给外部程序的消息
+type externalCall struct {
+    Op   string  `json:"op"`
+    Id   int64   `json:"id,omitempty"`
+    Ids  []int64 `json:"ids,omitempty"`
+    Req  []byte  `json:"req,omitempty"`
+    Resp []byte  `json:"resp,omitempty"`
+}
+
+//外部程序的应答
+type externalReply struct {
+    Batch   int                  `json:"batch,omitempty"`
+    Framing string               `json:"framing,omitempty"`
+    Delim   string               `json:"delim,omitempty"`
+    Reqs    []externalRawRequest `json:"reqs,omitempty"`
+    Status  int8                 `json:"status"`
+    Code    int                  `json:"code"`
+    Msg     string               `json:"msg,omitempty"`
+    Error   string               `json:"error,omitempty"` //外部程序自身出错
+}
+
+type externalRawRequest struct {
+    Id  int64  `json:"id"`
+    Req []byte `json:"req"`
+}
+
+//一次调用的结果，由读取应答的goroutine交给等待的调用方
+type externalResult struct {
+    reply *externalReply
+    err   error
+}
+
+type TcpExternalPlugin struct {
+    cmd     *exec.Cmd
+    stdin   io.WriteCloser
+    stdout  *bufio.Reader
+    rawOut  io.ReadCloser                //stdout管道，外部程序被杀死之后关闭，确保读取应答的goroutine退出
+    done    chan struct{}                //读取应答的goroutine退出时关闭
+    wait    time.Duration                //关闭时等待外部程序退出的最长时间
+    wlock   sync.Mutex                  //写管道，同时保证等待队列的顺序和写入的顺序一致
+    qlock   sync.Mutex                  //保护waiters以及broken
+    waiters []chan externalResult       //已经发出、等待应答的调用，按发送顺序排列
+    broken  error                       //管道断开的原因，非空之后的调用都直接失败
+    glock   sync.Mutex                  //保护pending，同一时刻只有一个worker去批量生成
+    batch   int                         //每次批量生成的请求个数
+    framing string                      //本地判断包完整性的方式
+    delim   []byte                      //framing为delim时的定界符
+    pending []unicorn.RawRequest        //已经批量生成，尚未取走的请求
+}
+
+//*TcpExternalPlugin实现PluginIntfs接口
+//生成请求：本地缓存为空时，批量向外部程序要一批请求，Id由框架的生成器分配
+//外部程序出错时返回带Err的请求，框架记为致命错误
+func (tep *TcpExternalPlugin) GenRequest(id int64) unicorn.RawRequest {
+    tep.glock.Lock()
+    defer tep.glock.Unlock()
+
+    if len(tep.pending) == 0 {
+        ids := make([]int64, tep.batch)
+        ids[0] = id
+        for i := 1; i < len(ids); i++ {
+            ids[i] = unicorn.NextRequestId()
+        }
+        reply, err := tep.call(&externalCall{Op: "gen", Ids: ids})
+        if err != nil {
+            return unicorn.RawRequest{Id: id, Err: fmt.Errorf("External plugin error: %s", err)}
+        }
+        if len(reply.Reqs) == 0 {
+            return unicorn.RawRequest{Id: id, Err: errors.New("External plugin generated no request")}
+        }
+        for _, r := range reply.Reqs {
+            tep.pending = append(tep.pending, unicorn.RawRequest{Id: r.Id, Req: r.Req})
+        }
+    }
+
+    raw_reqest := tep.pending[0]
+    tep.pending = tep.pending[1:]
+    return raw_reqest
+}
+
+//check服务端返回是否能够构成一个完整包
+func (tep *TcpExternalPlugin) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    switch tep.framing {
+    case EXTERNAL_FRAMING_DELIM:
+        if bytes.HasSuffix(response, tep.delim) {
+            return unicorn.SER_OK
+        }
+        return unicorn.SER_NEEDMORE
+    case EXTERNAL_FRAMING_ECHO:
+        if len(response) == len(raw_req.Req) {
+            return unicorn.SER_OK
+        } else if len(response) < len(raw_req.Req) {
+            return unicorn.SER_NEEDMORE
+        }
+        return unicorn.SER_ERROR
+    }
+
+    reply, err := tep.call(&externalCall{Op: "full", Id: raw_req.Id, Req: raw_req.Req, Resp: response})
+    if err != nil {
+        return unicorn.SER_ERROR
+    }
+    return unicorn.ServerRespStatus(reply.Status)
+}
+
+//校验服务端返回是否符合预期
+func (tep *TcpExternalPlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (code unicorn.ResultCode, msg string) {
+    reply, err := tep.call(&externalCall{Op: "check", Id: raw_req.Id, Req: raw_req.Req, Resp: response})
+    if err != nil {
+        code = unicorn.RESULT_CODE_FATAL_CALL
+        msg = fmt.Sprintf("External plugin error: %s!\n", err)
+        return
+    }
+    code = unicorn.ResultCode(reply.Code)
+    msg = reply.Msg
+    return
+}
+
+//关闭外部程序：关闭stdin，外部程序读到EOF应该自行退出，等待中的调用随之失败
+//读取应答的goroutine退出之后才能调用cmd.Wait，否则Wait会在读取的过程中关闭管道
+func (tep *TcpExternalPlugin) Close() error {
+    tep.wlock.Lock()
+    tep.stdin.Close()
+    tep.wlock.Unlock()
+
+    select {
+    case <-tep.done:
+    case <-time.After(tep.wait):
+        //外部程序不理会EOF，杀死之后关闭stdout，即使它的子进程还持有管道，读取也会结束
+        tep.cmd.Process.Kill()
+        tep.rawOut.Close()
+        <-tep.done
+    }
+    return tep.cmd.Wait()
+}
+
+//一次调用：登记等待者并写一行，然后等待读取应答的goroutine交回结果
+//写管道时不持有qlock，外部程序写应答阻塞时，读取应答的goroutine仍然可以取出等待者
+func (tep *TcpExternalPlugin) call(c *externalCall) (*externalReply, error) {
+    line, err := json.Marshal(c)
+    if err != nil {
+        return nil, err
+    }
+    line = append(line, '\n')
+
+    ch := make(chan externalResult, 1)
+    tep.wlock.Lock()
+    tep.qlock.Lock()
+    if tep.broken != nil {
+        tep.qlock.Unlock()
+        tep.wlock.Unlock()
+        return nil, tep.broken
+    }
+    tep.waiters = append(tep.waiters, ch)
+    tep.qlock.Unlock()
+    _, err = tep.stdin.Write(line)
+    tep.wlock.Unlock()
+    if err != nil {
+        //这一行可能只写了一部分，之后的应答无法再对应，管道不能继续使用
+        tep.fail(err)
+    }
+
+    res := <-ch
+    return res.reply, res.err
+}
+
+//管道断开：之后的调用直接失败，等待中的调用全部返回错误
+func (tep *TcpExternalPlugin) fail(err error) {
+    tep.qlock.Lock()
+    defer tep.qlock.Unlock()
+    if tep.broken == nil {
+        tep.broken = err
+    }
+    for _, ch := range tep.waiters {
+        ch <- externalResult{err: tep.broken}
+    }
+    tep.waiters = nil
+}
+
+//读取一行应答
+func (tep *TcpExternalPlugin) readReply() (*externalReply, error) {
+    line, err := tep.stdout.ReadBytes('\n')
+    if err != nil {
+        return nil, err
+    }
+    var reply externalReply
+    if err = json.Unmarshal(line, &reply); err != nil {
+        return nil, fmt.Errorf("Incorrectly formatted reply: %s", string(line))
+    }
+    return &reply, nil
+}
+
+//读取应答的goroutine：按顺序把应答交给最早的等待者
+func (tep *TcpExternalPlugin) readLoop() {
+    defer close(tep.done)
+    for {
+        reply, err := tep.readReply()
+        if err != nil {
+            if err == io.EOF {
+                err = errors.New("External plugin exited")
+            }
+            tep.fail(err)
+            return
+        }
+        res := externalResult{reply: reply}
+        if reply.Error != "" {
+            res = externalResult{err: errors.New(reply.Error)}
+        }
+        tep.qlock.Lock()
+        if len(tep.waiters) == 0 {
+            tep.qlock.Unlock()
+            tep.fail(errors.New("Unexpected reply from external plugin"))
+            return
+        }
+        ch := tep.waiters[0]
+        tep.waiters = tep.waiters[1:]
+        tep.qlock.Unlock()
+        ch <- res
+    }
+}
+
+//New函数，启动外部程序并握手，创建TcpExternalPlugin，它是PluginIntfs的一个实现
+//外部程序的stderr直接透传，方便调试
+func NewTcpExternalPlugin(name string, args ...string) (unicorn.PluginIntfs, error) {
+    cmd := exec.Command(name, args...)
+    cmd.Stderr = os.Stderr
+    stdin, err := cmd.StdinPipe()
+    if err != nil {
+        return nil, err
+    }
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return nil, err
+    }
+    if err = cmd.Start(); err != nil {
+        return nil, err
+    }
+
+    tep := &TcpExternalPlugin{
+        cmd    : cmd,
+        stdin  : stdin,
+        stdout : bufio.NewReader(stdout),
+        rawOut : stdout,
+        done   : make(chan struct{}),
+        wait   : EXTERNAL_CLOSE_WAIT,
+        batch  : EXTERNAL_DEFAULT_BATCH,
+    }
+
+    //握手，外部程序可以声明批量大小以及本地判断包完整性的方式
+    go tep.readLoop()
+    reply, err := tep.call(&externalCall{Op: "hello"})
+    if err != nil {
+        tep.Close()
+        return nil, fmt.Errorf("External plugin handshake failed: %s", err)
+    }
+    if reply.Batch > 0 {
+        tep.batch = reply.Batch
+    }
+    switch reply.Framing {
+    case EXTERNAL_FRAMING_REMOTE, EXTERNAL_FRAMING_ECHO:
+        tep.framing = reply.Framing
+    case EXTERNAL_FRAMING_DELIM:
+        if reply.Delim == "" {
+            tep.Close()
+            return nil, errors.New("External plugin declared delim framing without delim")
+        }
+        tep.framing = reply.Framing
+        tep.delim = []byte(reply.Delim)
+    default:
+        tep.Close()
+        return nil, fmt.Errorf("Unknown framing: %s", reply.Framing)
+    }
+
+    return tep, nil
+}
@@ -0,0 +1,166 @@
+package plugin
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "os"
+    "sync"
+    "testing"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//测试外部进程插件：重新执行测试程序自身，作为外部程序的参考实现(回显协议)
+func TestExternalPlugin(t *testing.T) {
+    //子进程继承环境变量，据此识别自己是外部程序
+    os.Setenv("UNICORN_EXTERNAL_HELPER", "1")
+    defer os.Unsetenv("UNICORN_EXTERNAL_HELPER")
+    plg, err := NewTcpExternalPlugin(os.Args[0], "-test.run=TestExternalHelperProcess")
+    if err != nil {
+        t.Fatalf("External plugin startup failing: %s\n", err)
+    }
+    tep := plg.(*TcpExternalPlugin)
+    defer tep.Close()
+
+    //批量生成：第一次调用会一次性取回一批，批量中其余的Id也由框架分配，不会和其他worker冲突
+    req := plg.GenRequest(100)
+    if req.Err != nil || req.Id != 100 || string(req.Req) != "req-100" {
+        t.Fatalf("Wrong request: Id=%d, Req=%s, Err=%v\n", req.Id, string(req.Req), req.Err)
+    }
+    if len(tep.pending) != 2 {
+        t.Fatalf("Expected 2 pending requests, got %d\n", len(tep.pending))
+    }
+    ids := map[int64]bool{req.Id: true}
+    for i := 0; i < 5; i++ {
+        r := plg.GenRequest(unicorn.NextRequestId())
+        if r.Err != nil || ids[r.Id] || string(r.Req) != fmt.Sprintf("req-%d", r.Id) {
+            t.Fatalf("Wrong request: Id=%d, Req=%s, Err=%v\n", r.Id, string(r.Req), r.Err)
+        }
+        ids[r.Id] = true
+    }
+
+    if s := plg.CheckFull(&req, []byte("req")); s != unicorn.SER_NEEDMORE {
+        t.Fatalf("Expected SER_NEEDMORE, got %d\n", s)
+    }
+    if s := plg.CheckFull(&req, []byte("req-100")); s != unicorn.SER_OK {
+        t.Fatalf("Expected SER_OK, got %d\n", s)
+    }
+    if code, msg := plg.CheckResponse(req, []byte("req-100")); code != unicorn.RESULT_CODE_SUCCESS {
+        t.Fatalf("Expected success, got %d (%s)\n", code, msg)
+    }
+    if code, _ := plg.CheckResponse(req, []byte("req-999")); code != unicorn.RESULT_CODE_ERROR_RESPONSE {
+        t.Fatalf("Expected response error, got %d\n", code)
+    }
+
+    //多个worker并发调用，应答按发送顺序对应到各自的调用
+    var wg sync.WaitGroup
+    errs := make(chan string, 100)
+    for g := 0; g < 10; g++ {
+        wg.Add(1)
+        go func(g int) {
+            defer wg.Done()
+            for i := 0; i < 10; i++ {
+                r := unicorn.RawRequest{Id: int64(g*100 + i), Req: []byte(fmt.Sprintf("req-%d-%d", g, i))}
+                expect := unicorn.RESULT_CODE_SUCCESS
+                resp := r.Req
+                if i%2 == 1 {
+                    expect, resp = unicorn.RESULT_CODE_ERROR_RESPONSE, []byte("other")
+                }
+                if code, msg := plg.CheckResponse(r, resp); code != expect {
+                    errs <- fmt.Sprintf("%s: expected %d, got %d (%s)", r.Req, expect, code, msg)
+                }
+            }
+        }(g)
+    }
+    wg.Wait()
+    close(errs)
+    for e := range errs {
+        t.Error(e)
+    }
+
+    //外部程序读到EOF正常退出，之后的调用返回错误而不是panic
+    if err := tep.Close(); err != nil {
+        t.Fatalf("Expected clean exit, got %s\n", err)
+    }
+    tep.pending = nil
+    if r := plg.GenRequest(1); r.Err == nil {
+        t.Fatal("Expected error after external plugin exited")
+    }
+    if code, _ := plg.CheckResponse(req, []byte("req-100")); code != unicorn.RESULT_CODE_FATAL_CALL {
+        t.Fatalf("Expected fatal call, got %d\n", code)
+    }
+    if s := plg.CheckFull(&req, []byte("req-100")); s != unicorn.SER_ERROR {
+        t.Fatalf("Expected SER_ERROR, got %d\n", s)
+    }
+}
+
+//测试关闭不理会EOF的外部程序：等待超时之后被杀死，Close不会一直阻塞
+func TestExternalClose(t *testing.T) {
+    os.Setenv("UNICORN_EXTERNAL_HELPER", "ignore-eof")
+    defer os.Unsetenv("UNICORN_EXTERNAL_HELPER")
+    plg, err := NewTcpExternalPlugin(os.Args[0], "-test.run=TestExternalHelperProcess")
+    if err != nil {
+        t.Fatalf("External plugin startup failing: %s\n", err)
+    }
+    tep := plg.(*TcpExternalPlugin)
+    tep.wait = 100 * time.Millisecond
+
+    start := time.Now()
+    if err := tep.Close(); err == nil {
+        t.Fatal("Expected the killed process to exit with error")
+    }
+    if elapse := time.Since(start); elapse > 2*time.Second {
+        t.Fatalf("Close took %v\n", elapse)
+    }
+    if r := plg.GenRequest(1); r.Err == nil {
+        t.Fatal("Expected error after external plugin killed")
+    }
+}
+
+//外部程序的参考实现，只有被TestExternalPlugin、TestExternalClose拉起时才生效
+//ignore-eof模式下读到EOF之后不退出，模拟不理会关闭的外部程序
+func TestExternalHelperProcess(t *testing.T) {
+    mode := os.Getenv("UNICORN_EXTERNAL_HELPER")
+    if mode == "" {
+        t.Skip("Only run as external plugin helper")
+    }
+    in := bufio.NewScanner(os.Stdin)
+    out := json.NewEncoder(os.Stdout)
+    for in.Scan() {
+        var c externalCall
+        var r externalReply
+        if err := json.Unmarshal(in.Bytes(), &c); err != nil {
+            r.Error = err.Error()
+            out.Encode(r)
+            continue
+        }
+        switch c.Op {
+        case "hello":
+            r.Batch = 3
+        case "gen":
+            for _, id := range c.Ids {
+                r.Reqs = append(r.Reqs, externalRawRequest{Id: id, Req: []byte(fmt.Sprintf("req-%d", id))})
+            }
+        case "full":
+            if len(c.Resp) < len(c.Req) {
+                r.Status = int8(unicorn.SER_NEEDMORE)
+            } else {
+                r.Status = int8(unicorn.SER_OK)
+            }
+        case "check":
+            if string(c.Req) == string(c.Resp) {
+                r.Code, r.Msg = int(unicorn.RESULT_CODE_SUCCESS), "Success"
+            } else {
+                r.Code, r.Msg = int(unicorn.RESULT_CODE_ERROR_RESPONSE), "Mismatch"
+            }
+        default:
+            r.Error = "unknown op " + c.Op
+        }
+        out.Encode(r)
+    }
+    if mode == "ignore-eof" {
+        time.Sleep(time.Minute)
+    }
+    os.Exit(0)
+}
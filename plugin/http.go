@@ -0,0 +1,512 @@
+package plugin
+/*
+ * plugin
+ * HTTP/1.1插件
+ * 请求由方法、URL、头部、body模板生成（模板变量同场景文件），响应按照HTTP/1.1解析：
+ * 头部、Content-Length、chunked传输编码，跳过100 Continue这类临时响应
+ * 校验状态码是否符合预期，测试结束之后在报告中列出状态码分布
+ * 以关闭连接作为结束的响应（既没有Content-Length，也不是chunked）不支持
+ * 响应是增量解析的：解析进度保存在请求中，每次收到数据从上次的位置继续，CheckResponse和ShouldClose直接使用解析结果
+ *
+ * 示例（YAML）：
+ *   vars:
+ *     uid: {type: int, min: 1, max: 100000}
+ *   method: POST
+ *   url: /api/user/{{uid}}
+ *   headers:
+ *     Content-Type: application/json
+ *   body: "{\"uid\":{{uid}}}"
+ *   expect:
+ *     status: [200, 3xx]
+ *     body: "\"ok\":true"
+ */
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "net/url"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+const (
+    HTTP_MAX_HEADER     = 64 * 1024 //响应头部的最大长度
+    HTTP_DEFAULT_METHOD = "GET"
+    HTTP_USER_AGENT     = "unicorn"
+)
+
+//增量解析的阶段
+const (
+    HTTP_PHASE_HEAD       = iota //等待头部
+    HTTP_PHASE_LENGTH            //按照Content-Length读取body
+    HTTP_PHASE_CHUNK_SIZE        //等待chunk的长度行
+    HTTP_PHASE_CHUNK_DATA        //读取chunk的数据以及结尾的CRLF
+    HTTP_PHASE_TRAILER           //最后一个chunk之后的trailer，以空行结束
+    HTTP_PHASE_DONE              //响应完整
+    HTTP_PHASE_ERROR             //响应有误
+)
+
+var (
+    crlf     = []byte("\r\n")
+    crlfcrlf = []byte("\r\n\r\n")
+)
+
+//HTTP请求描述
+type HttpSpec struct {
+    Vars    map[string]VarSpec `json:"vars"    yaml:"vars"`
+    Method  string             `json:"method"  yaml:"method"`  //默认GET
+    URL     string             `json:"url"     yaml:"url"`     ///path?query，或者http://host:port/path
+    Headers map[string]string  `json:"headers" yaml:"headers"`
+    Body    string             `json:"body"    yaml:"body"`
+    Expect  HttpExpect         `json:"expect"  yaml:"expect"`
+}
+
+type HttpExpect struct {
+    Status []string `json:"status" yaml:"status"` //期望的状态码，比如200、2xx，默认2xx
+    Body   string   `json:"body"   yaml:"body"`   //可选：body需要匹配的正则
+}
+
+//解析之后的响应
+type httpResponse struct {
+    version string
+    status  int
+    headers map[string]string //key为小写，同名的头部以", "连接
+    body    []byte            //chunked已解码
+}
+
+//响应的增量解析器，每个请求一个，由CheckFull保存在RawRequest.State中
+type httpParser struct {
+    isHead bool
+    phase  int
+    pos    int           //已经解析完的字节数，之后的解析从这里继续
+    scan   int           //查找分隔符时已经检查到的位置，避免重复扫描
+    need   int           //HTTP_PHASE_LENGTH/HTTP_PHASE_CHUNK_DATA阶段还需要的body字节数
+    parsed int           //最近一次解析时数据的长度
+    resp   *httpResponse
+}
+
+type httpHeader struct {
+    name string
+    tpl  *Template
+}
+
+type TcpHttpPlugin struct {
+    vars    *VarSet
+    method  *Template
+    target  *Template         //请求行中的目标
+    headers []httpHeader      //按名字排序
+    body    *Template
+    status  []func(int) bool  //期望的状态码，满足其一即可
+    bodyRe  *regexp.Regexp
+
+    lock     sync.Mutex
+    statuses map[int]uint64   //状态码分布
+}
+
+//从文件加载HTTP请求描述
+func LoadHttpSpec(path string) (*HttpSpec, error) {
+    var spec HttpSpec
+    if err := unmarshalFile(path, &spec); err != nil {
+        return nil, fmt.Errorf("Http spec %s: %s", path, err)
+    }
+    return &spec, nil
+}
+
+//*TcpHttpPlugin实现PluginIntfs接口
+//生成请求
+func (thp *TcpHttpPlugin) GenRequest(id int64) unicorn.RawRequest {
+    vals := thp.vars.Gen(id)
+    method := thp.method.Render(vals)
+    body := thp.body.Render(vals)
+
+    var buff bytes.Buffer
+    fmt.Fprintf(&buff, "%s %s HTTP/1.1\r\n", method, thp.target.Render(vals))
+    for _, h := range thp.headers {
+        fmt.Fprintf(&buff, "%s: %s\r\n", h.name, h.tpl.Render(vals))
+    }
+    if body != "" || method == "POST" || method == "PUT" || method == "PATCH" {
+        fmt.Fprintf(&buff, "Content-Length: %d\r\n", len(body))
+    }
+    buff.WriteString("\r\n")
+    buff.WriteString(body)
+    return unicorn.RawRequest{Id: id, Req: buff.Bytes()}
+}
+
+//check服务端返回是否能够构成一个完整包
+//解析进度保存在请求中，每次只解析新收到的数据
+func (thp *TcpHttpPlugin) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    hp, ok := raw_req.State.(*httpParser)
+    if !ok {
+        hp = &httpParser{isHead: isHeadRequest(raw_req.Req)}
+        raw_req.State = hp
+    }
+    return hp.feed(response)
+}
+
+//校验服务端返回是否符合预期，同时统计状态码分布
+func (thp *TcpHttpPlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    resp, status := parsedHttpResponse(raw_req, response)
+    if status != unicorn.SER_OK {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "Malformed http response"
+    }
+
+    thp.lock.Lock()
+    thp.statuses[resp.status]++
+    thp.lock.Unlock()
+
+    matched := false
+    for _, match := range thp.status {
+        if match(resp.status) {
+            matched = true
+            break
+        }
+    }
+    if !matched {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, fmt.Sprintf("Unexpected status %d", resp.status)
+    }
+    if thp.bodyRe != nil && !thp.bodyRe.Match(resp.body) {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, fmt.Sprintf("Body mismatch: %.64q", resp.body)
+    }
+    return unicorn.RESULT_CODE_SUCCESS, "Success"
+}
+
+//*TcpHttpPlugin实现ConnCloseIntfs接口：Connection: close，或者HTTP/1.0没有keep-alive，服务端会关闭连接
+func (thp *TcpHttpPlugin) ShouldClose(raw_req unicorn.RawRequest, response []byte) bool {
+    resp, status := parsedHttpResponse(raw_req, response)
+    if status != unicorn.SER_OK {
+        return true
+    }
+    conn := strings.ToLower(resp.headers["connection"])
+    if strings.Contains(conn, "close") {
+        return true
+    }
+    return resp.version == "HTTP/1.0" && !strings.Contains(conn, "keep-alive")
+}
+
+//*TcpHttpPlugin实现ReporterIntfs接口：状态码分布
+func (thp *TcpHttpPlugin) Report() string {
+    thp.lock.Lock()
+    defer thp.lock.Unlock()
+    codes := make([]int, 0, len(thp.statuses))
+    var total uint64
+    for code, cnt := range thp.statuses {
+        codes = append(codes, code)
+        total += cnt
+    }
+    sort.Ints(codes)
+    var buff strings.Builder
+    buff.WriteString("HTTP status:\n")
+    for _, code := range codes {
+        fmt.Fprintf(&buff, "  %d: %d (%.2f%%)\n", code, thp.statuses[code], 100*float64(thp.statuses[code])/float64(total))
+    }
+    return buff.String()
+}
+
+func isHeadRequest(req []byte) bool {
+    return bytes.HasPrefix(req, []byte("HEAD "))
+}
+
+//解析响应，判断是否完整。同步交互，完整的响应之后不应该有多余的数据
+func parseHttpResponse(data []byte, isHead bool) (*httpResponse, unicorn.ServerRespStatus) {
+    hp := &httpParser{isHead: isHead}
+    return hp.result(hp.feed(data))
+}
+
+//取得CheckFull的解析结果，请求中没有解析状态或者数据不一致时（比如没有经过CheckFull）重新解析
+func parsedHttpResponse(raw_req unicorn.RawRequest, response []byte) (*httpResponse, unicorn.ServerRespStatus) {
+    if hp, ok := raw_req.State.(*httpParser); ok && hp.parsed == len(response) {
+        return hp.result(hp.status())
+    }
+    return parseHttpResponse(response, isHeadRequest(raw_req.Req))
+}
+
+func (hp *httpParser) result(status unicorn.ServerRespStatus) (*httpResponse, unicorn.ServerRespStatus) {
+    if status != unicorn.SER_OK {
+        return nil, status
+    }
+    return hp.resp, status
+}
+
+//当前阶段对应的状态
+func (hp *httpParser) status() unicorn.ServerRespStatus {
+    switch hp.phase {
+    case HTTP_PHASE_DONE:
+        return unicorn.SER_OK
+    case HTTP_PHASE_ERROR:
+        return unicorn.SER_ERROR
+    }
+    return unicorn.SER_NEEDMORE
+}
+
+func (hp *httpParser) fail() unicorn.ServerRespStatus {
+    hp.phase = HTTP_PHASE_ERROR
+    return unicorn.SER_ERROR
+}
+
+//当前阶段的数据解析完毕，前进到n
+func (hp *httpParser) advance(n int) {
+    hp.pos = n
+    hp.scan = n
+}
+
+//从上次检查到的位置继续查找分隔符，返回分隔符的绝对位置
+func (hp *httpParser) find(data, sep []byte) int {
+    from := hp.scan - len(sep) + 1
+    if from < hp.pos {
+        from = hp.pos
+    }
+    i := bytes.Index(data[from:], sep)
+    if i < 0 {
+        hp.scan = len(data)
+        return -1
+    }
+    return from + i
+}
+
+//解析新收到的数据，data是目前为止收到的全部内容
+func (hp *httpParser) feed(data []byte) unicorn.ServerRespStatus {
+    if len(data) < hp.parsed {
+        //数据不是上次的延续，从头解析
+        *hp = httpParser{isHead: hp.isHead}
+    }
+    hp.parsed = len(data)
+    for {
+        switch hp.phase {
+        case HTTP_PHASE_HEAD:
+            end := hp.find(data, crlfcrlf)
+            if end < 0 {
+                if len(data)-hp.pos > HTTP_MAX_HEADER {
+                    return hp.fail()
+                }
+                return unicorn.SER_NEEDMORE
+            }
+            resp, err := parseHttpHead(data[hp.pos:end])
+            if err != nil {
+                return hp.fail()
+            }
+            hp.advance(end + 4)
+
+            //1xx的临时响应（比如100 Continue）之后才是最终的响应，101切换协议除外
+            if resp.status < 200 && resp.status != 101 {
+                continue
+            }
+            hp.resp = resp
+
+            te := strings.ToLower(resp.headers["transfer-encoding"])
+            cl, hasLength := resp.headers["content-length"]
+            switch {
+            case hp.isHead || resp.status < 200 || resp.status == 204 || resp.status == 304:
+                //没有body
+                hp.phase = HTTP_PHASE_DONE
+            case strings.HasSuffix(te, "chunked"):
+                resp.body = make([]byte, 0)
+                hp.phase = HTTP_PHASE_CHUNK_SIZE
+            case hasLength:
+                length, err := strconv.Atoi(strings.TrimSpace(cl))
+                if err != nil || length < 0 {
+                    return hp.fail()
+                }
+                hp.need = length
+                hp.phase = HTTP_PHASE_LENGTH
+            default:
+                //以关闭连接作为结束，不支持
+                return hp.fail()
+            }
+        case HTTP_PHASE_LENGTH:
+            if len(data)-hp.pos < hp.need {
+                return unicorn.SER_NEEDMORE
+            }
+            hp.resp.body = data[hp.pos : hp.pos+hp.need]
+            hp.advance(hp.pos + hp.need)
+            hp.phase = HTTP_PHASE_DONE
+        case HTTP_PHASE_CHUNK_SIZE:
+            i := hp.find(data, crlf)
+            if i < 0 {
+                return unicorn.SER_NEEDMORE
+            }
+            line := string(data[hp.pos:i])
+            if j := strings.IndexByte(line, ';'); j >= 0 {
+                line = line[:j] //chunk扩展
+            }
+            size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 32)
+            if err != nil || size < 0 {
+                return hp.fail()
+            }
+            hp.advance(i + 2)
+            if size == 0 {
+                hp.phase = HTTP_PHASE_TRAILER
+            } else {
+                hp.need = int(size)
+                hp.phase = HTTP_PHASE_CHUNK_DATA
+            }
+        case HTTP_PHASE_CHUNK_DATA:
+            if len(data)-hp.pos < hp.need+2 {
+                return unicorn.SER_NEEDMORE
+            }
+            end := hp.pos + hp.need
+            if !bytes.Equal(data[end:end+2], crlf) {
+                return hp.fail()
+            }
+            hp.resp.body = append(hp.resp.body, data[hp.pos:end]...)
+            hp.advance(end + 2)
+            hp.phase = HTTP_PHASE_CHUNK_SIZE
+        case HTTP_PHASE_TRAILER:
+            //最后一个chunk之后是trailer，以空行结束
+            j := hp.find(data, crlf)
+            if j < 0 {
+                return unicorn.SER_NEEDMORE
+            }
+            if j == hp.pos {
+                hp.phase = HTTP_PHASE_DONE
+            }
+            hp.advance(j + 2)
+        case HTTP_PHASE_DONE:
+            if len(data) > hp.pos {
+                return hp.fail()
+            }
+            return unicorn.SER_OK
+        default:
+            return unicorn.SER_ERROR
+        }
+    }
+}
+
+//解析状态行以及头部
+func parseHttpHead(head []byte) (*httpResponse, error) {
+    lines := strings.Split(string(head), "\r\n")
+    fields := strings.SplitN(lines[0], " ", 3)
+    if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/1.") || len(fields[1]) != 3 {
+        return nil, fmt.Errorf("Bad status line: %q", lines[0])
+    }
+    status, err := strconv.Atoi(fields[1])
+    if err != nil || status < 100 {
+        return nil, fmt.Errorf("Bad status line: %q", lines[0])
+    }
+    resp := &httpResponse{
+        version : fields[0],
+        status  : status,
+        headers : make(map[string]string),
+    }
+    for _, line := range lines[1:] {
+        i := strings.IndexByte(line, ':')
+        if i <= 0 {
+            return nil, fmt.Errorf("Bad header: %q", line)
+        }
+        name := strings.ToLower(strings.TrimSpace(line[:i]))
+        value := strings.TrimSpace(line[i+1:])
+        if prev, ok := resp.headers[name]; ok {
+            value = prev + ", " + value
+        }
+        resp.headers[name] = value
+    }
+    return resp, nil
+}
+
+//编译期望的状态码：200这样的精确值，或者2xx这样的一类
+func compileStatus(s string) (func(int) bool, error) {
+    s = strings.ToLower(strings.TrimSpace(s))
+    if len(s) == 3 && strings.HasSuffix(s, "xx") && s[0] >= '1' && s[0] <= '5' {
+        class := int(s[0] - '0')
+        return func(code int) bool { return code/100 == class }, nil
+    }
+    code, err := strconv.Atoi(s)
+    if err != nil || code < 100 || code > 999 {
+        return nil, fmt.Errorf("Bad expected status: %s", s)
+    }
+    return func(c int) bool { return c == code }, nil
+}
+
+//New函数，编译请求描述，创建TcpHttpPlugin，它是PluginIntfs的一个实现
+//host是默认的Host头，URL是绝对地址或者头部中有Host时不使用
+func NewTcpHttpPlugin(spec *HttpSpec, host string) (unicorn.PluginIntfs, error) {
+    if spec.URL == "" {
+        return nil, errors.New("Http: empty url")
+    }
+    vars, err := NewVarSet(spec.Vars)
+    if err != nil {
+        return nil, err
+    }
+    thp := &TcpHttpPlugin{
+        vars     : vars,
+        statuses : make(map[int]uint64),
+    }
+
+    method := spec.Method
+    if method == "" {
+        method = HTTP_DEFAULT_METHOD
+    }
+    if thp.method, err = CompileTemplate(method, vars.Has); err != nil {
+        return nil, err
+    }
+    if thp.body, err = CompileTemplate(spec.Body, vars.Has); err != nil {
+        return nil, err
+    }
+
+    //绝对地址：拆出Host，请求行中只保留路径
+    target := spec.URL
+    if strings.HasPrefix(target, "http://") {
+        u, err := url.Parse(target)
+        if err != nil || strings.Contains(u.Host, "{{") {
+            return nil, fmt.Errorf("Http: bad url %s", spec.URL)
+        }
+        host = u.Host
+        target = strings.TrimPrefix(target, "http://" + u.Host)
+        if target == "" {
+            target = "/"
+        }
+    } else if strings.Contains(target, "://") {
+        return nil, fmt.Errorf("Http: unsupported url %s", spec.URL)
+    }
+    if thp.target, err = CompileTemplate(target, vars.Has); err != nil {
+        return nil, err
+    }
+
+    //头部：默认的Host、User-Agent可以被覆盖，Content-Length自动计算
+    headers := map[string]string{"Host": host, "User-Agent": HTTP_USER_AGENT}
+    for name, value := range spec.Headers {
+        for def := range headers {
+            if strings.EqualFold(def, name) {
+                delete(headers, def)
+            }
+        }
+        if strings.EqualFold(name, "Content-Length") {
+            return nil, errors.New("Http: Content-Length is computed automatically")
+        }
+        headers[name] = value
+    }
+    if headers["Host"] == "" {
+        delete(headers, "Host")
+    }
+    for name, value := range headers {
+        tpl, err := CompileTemplate(value, vars.Has)
+        if err != nil {
+            return nil, err
+        }
+        thp.headers = append(thp.headers, httpHeader{name: name, tpl: tpl})
+    }
+    sort.Slice(thp.headers, func(i, j int) bool { return thp.headers[i].name < thp.headers[j].name })
+
+    //期望
+    status := spec.Expect.Status
+    if len(status) == 0 {
+        status = []string{"2xx"}
+    }
+    for _, s := range status {
+        match, err := compileStatus(s)
+        if err != nil {
+            return nil, err
+        }
+        thp.status = append(thp.status, match)
+    }
+    if spec.Expect.Body != "" {
+        if thp.bodyRe, err = regexp.Compile(spec.Expect.Body); err != nil {
+            return nil, err
+        }
+    }
+    return thp, nil
+}
@@ -0,0 +1,149 @@
+package plugin
+
+import (
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//测试HTTP响应解析：逐字节喂入，完整之前都是SER_NEEDMORE
+func TestHttpParse(t *testing.T) {
+    cases := []struct {
+        resp   string
+        isHead bool
+        status int
+        body   string
+    }{
+        {"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", false, 200, "hello"},
+        {"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Trailer: 1\r\n\r\n", false, 200, "hello world"},
+        {"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", true, 200, ""},
+        {"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok", false, 201, "ok"},
+        {"HTTP/1.0 204 No Content\r\n\r\n", false, 204, ""},
+    }
+    for _, c := range cases {
+        for i := 0; i < len(c.resp); i++ {
+            if _, s := parseHttpResponse([]byte(c.resp[:i]), c.isHead); s != unicorn.SER_NEEDMORE {
+                t.Fatalf("%q: prefix %d got %d\n", c.resp, i, s)
+            }
+        }
+        resp, s := parseHttpResponse([]byte(c.resp), c.isHead)
+        if s != unicorn.SER_OK || resp.status != c.status || string(resp.body) != c.body {
+            t.Fatalf("%q: got %d, %v\n", c.resp, s, resp)
+        }
+    }
+
+    //插件增量解析：逐字节喂入同一个请求，解析进度保存在请求中，CheckResponse直接使用解析结果
+    plg, err := NewTcpHttpPlugin(&HttpSpec{URL: "/"}, "localhost")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, c := range cases {
+        raw_req := unicorn.RawRequest{Req: []byte("GET / HTTP/1.1\r\n\r\n")}
+        if c.isHead {
+            raw_req.Req = []byte("HEAD / HTTP/1.1\r\n\r\n")
+        }
+        for i := 1; i < len(c.resp); i++ {
+            if s := plg.CheckFull(&raw_req, []byte(c.resp[:i])); s != unicorn.SER_NEEDMORE {
+                t.Fatalf("%q: prefix %d got %d\n", c.resp, i, s)
+            }
+        }
+        if s := plg.CheckFull(&raw_req, []byte(c.resp)); s != unicorn.SER_OK {
+            t.Fatalf("%q: got %d\n", c.resp, s)
+        }
+        hp, ok := raw_req.State.(*httpParser)
+        if !ok || hp.phase != HTTP_PHASE_DONE || hp.pos != len(c.resp) || string(hp.resp.body) != c.body {
+            t.Fatalf("%q: unexpected parse state %+v\n", c.resp, raw_req.State)
+        }
+        resp, s := parsedHttpResponse(raw_req, []byte(c.resp))
+        if s != unicorn.SER_OK || resp != hp.resp {
+            t.Fatalf("%q: expected the cached response, got %d, %v\n", c.resp, s, resp)
+        }
+        if c.status == 200 {
+            if code, msg := plg.CheckResponse(raw_req, []byte(c.resp)); code != unicorn.RESULT_CODE_SUCCESS {
+                t.Fatalf("%q: %d %s\n", c.resp, code, msg)
+            }
+        }
+    }
+
+    for _, bad := range []string{
+        "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nabc",
+        "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabc\r\n",
+        "HTTP/1.1 200 OK\r\n\r\n",
+        "SSH-2.0-OpenSSH\r\n\r\n",
+    } {
+        if _, s := parseHttpResponse([]byte(bad), false); s != unicorn.SER_ERROR {
+            t.Fatalf("%q: expected SER_ERROR, got %d\n", bad, s)
+        }
+    }
+}
+
+//测试HTTP插件：chunked响应、服务端主动关闭连接、状态码分布
+func TestHttpPlugin(t *testing.T) {
+    var cnt int64
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        n := atomic.AddInt64(&cnt, 1)
+        if n%5 == 0 {
+            w.Header().Set("Connection", "close")
+        }
+        if n%7 == 0 {
+            w.WriteHeader(http.StatusNotFound)
+        }
+        //Flush之后没有Content-Length，以chunked发送
+        w.Write([]byte(`{"uid":` + r.URL.Query().Get("uid") + `,`))
+        w.(http.Flusher).Flush()
+        w.Write([]byte(`"ok":true}`))
+    }))
+    defer server.Close()
+
+    dir, err := ioutil.TempDir("", "unicorn-http")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "http.yaml")
+    spec := "vars:\n  uid: {type: int, min: 1, max: 100}\nurl: /user?uid={{uid}}\nexpect:\n  status: [200]\n  body: '\"ok\":true'\n"
+    if err := ioutil.WriteFile(path, []byte(spec), 0600); err != nil {
+        t.Fatal(err)
+    }
+    sc, err := LoadHttpSpec(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := strings.TrimPrefix(server.URL, "http://")
+    plg, err := NewTcpHttpPlugin(sc, addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    result_chan := make(chan *unicorn.CallResult, 50)
+    unc, err := unicorn.NewUnicorn(addr, plg, 500*time.Millisecond, 0, 300*time.Millisecond, 2, true, result_chan)
+    if err != nil {
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
+    }
+    wg := unc.Start()
+    count_map := make(map[unicorn.ResultCode]int)
+    for ret := range result_chan {
+        count_map[ret.Code]++
+    }
+    wg.Wait()
+
+    report := plg.(unicorn.ReporterIntfs).Report()
+    t.Logf("%v\n%s", count_map, report)
+    if count_map[unicorn.RESULT_CODE_SUCCESS] == 0 || count_map[unicorn.RESULT_CODE_ERROR_RESPONSE] == 0 {
+        t.Fatalf("Expected successes and 404s, got %v\n", count_map)
+    }
+    //服务端关闭连接之前框架已经主动断开，不会出现调用错误
+    if count_map[unicorn.RESULT_CODE_ERROR_CALL] > 0 {
+        t.Fatalf("Unexpected call errors: %v\n", count_map)
+    }
+    if !strings.Contains(report, "200: ") || !strings.Contains(report, "404: ") {
+        t.Fatalf("Unexpected report: %s\n", report)
+    }
+}
@@ -0,0 +1,455 @@
+package plugin
+/*
+ * plugin
+ * Memcached插件（文本协议以及二进制协议）
+ * 按权重混合get/set/delete/incr，value的大小按分布生成
+ * 命中率通过key空间控制：set/delete的key在key_space内，get的key在key_space/hit_ratio内，
+ * 所以在写满之后，get的命中率约为hit_ratio
+ * 写入的value自带key和校验和，读到的value属于别的key、被截断或者被篡改，都会判定为错误的响应
+ * 文本协议的incr之前先发送add，保证计数器存在；二进制协议的incr自带初始值
+ *
+ * 示例（YAML）：
+ *   protocol: binary
+ *   commands: {get: 80, set: 15, delete: 3, incr: 2}
+ *   key_space: 100000
+ *   hit_ratio: 0.9
+ *   value_size: uniform:64-4096
+ */
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "math/rand"
+    "sort"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//协议
+const (
+    MEMCACHED_TEXT   = "text"
+    MEMCACHED_BINARY = "binary"
+)
+
+const (
+    MEMCACHED_DEFAULT_KEY_SPACE  = 10000
+    MEMCACHED_DEFAULT_KEY_PREFIX = "unicorn:"
+    MEMCACHED_DEFAULT_VALUE_SIZE = "fixed:64"
+    MEMCACHED_VALUE_SEP          = '|'  //value的格式：key|crc32|payload
+)
+
+//二进制协议
+const (
+    MC_MAGIC_REQUEST  = 0x80
+    MC_MAGIC_RESPONSE = 0x81
+    MC_HEADER_LEN     = 24
+    MC_OP_GET         = 0x00
+    MC_OP_SET         = 0x01
+    MC_OP_DELETE      = 0x04
+    MC_OP_INCREMENT   = 0x05
+    MC_STATUS_OK      = 0x0000
+    MC_STATUS_MISS    = 0x0001 //key不存在
+)
+
+var memcachedOps = map[string]byte{
+    "get"    : MC_OP_GET,
+    "set"    : MC_OP_SET,
+    "delete" : MC_OP_DELETE,
+    "incr"   : MC_OP_INCREMENT,
+}
+
+//Memcached插件描述
+type MemcachedSpec struct {
+    Protocol  string         `json:"protocol"   yaml:"protocol"`   //text或者binary，默认text
+    Commands  map[string]int `json:"commands"   yaml:"commands"`   //命令 -> 权重，默认get:80, set:20
+    KeySpace  int            `json:"key_space"  yaml:"key_space"`  //set/delete的key数量，默认10000
+    KeyPrefix string         `json:"key_prefix" yaml:"key_prefix"` //key的前缀，默认unicorn:
+    HitRatio  float64        `json:"hit_ratio"  yaml:"hit_ratio"`  //期望的get命中率，(0, 1]，默认1
+    ValueSize string         `json:"value_size" yaml:"value_size"` //value的大小分布，默认fixed:64
+    Expire    int            `json:"expire"     yaml:"expire"`     //过期时间（秒），默认0，不过期
+}
+
+type TcpMemcachedPlugin struct {
+    binary    bool
+    names     []string
+    picker    *weightedPicker
+    keySpace  int
+    readSpace int     //get的key空间
+    keyPrefix string
+    valueSize SizeDist
+    expire    int
+
+    hits      uint64  //get命中数
+    misses    uint64  //get未命中数
+}
+
+//从文件加载Memcached插件描述
+func LoadMemcachedSpec(path string) (*MemcachedSpec, error) {
+    var spec MemcachedSpec
+    if err := unmarshalFile(path, &spec); err != nil {
+        return nil, fmt.Errorf("Memcached spec %s: %s", path, err)
+    }
+    return &spec, nil
+}
+
+//*TcpMemcachedPlugin实现PluginIntfs接口
+//生成请求：按权重选择命令，请求的Type为命令名
+func (tmp *TcpMemcachedPlugin) GenRequest(id int64) unicorn.RawRequest {
+    name := tmp.names[tmp.picker.Pick()]
+    var key string
+    switch name {
+    case "get":
+        key = tmp.keyPrefix + strconv.Itoa(rand.Intn(tmp.readSpace))
+    case "incr":
+        key = tmp.keyPrefix + "cnt:" + strconv.Itoa(rand.Intn(tmp.keySpace))
+    default:
+        key = tmp.keyPrefix + strconv.Itoa(rand.Intn(tmp.keySpace))
+    }
+    var value []byte
+    if name == "set" {
+        value = memcachedValue(key, randPayload(tmp.valueSize.Next()))
+    }
+
+    var buff bytes.Buffer
+    if tmp.binary {
+        writeMcBinary(&buff, memcachedOps[name], uint32(id), key, value, tmp.expire)
+    } else {
+        switch name {
+        case "set":
+            fmt.Fprintf(&buff, "set %s 0 %d %d\r\n", key, tmp.expire, len(value))
+            buff.Write(value)
+            buff.WriteString("\r\n")
+        case "incr":
+            fmt.Fprintf(&buff, "add %s 0 %d 1\r\n0\r\n", key, tmp.expire)
+            fmt.Fprintf(&buff, "incr %s 1\r\n", key)
+        default:
+            fmt.Fprintf(&buff, "%s %s\r\n", name, key)
+        }
+    }
+    return unicorn.RawRequest{Id: id, Req: buff.Bytes(), Type: name}
+}
+
+//check服务端返回是否能够构成一个完整包
+func (tmp *TcpMemcachedPlugin) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    if tmp.binary {
+        _, status := parseMcBinary(response)
+        return status
+    }
+    _, status := parseMcText(raw_req.Type, response)
+    return status
+}
+
+//校验服务端返回是否符合预期
+func (tmp *TcpMemcachedPlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    if tmp.binary {
+        return tmp.checkBinary(raw_req, response)
+    }
+    return tmp.checkText(raw_req, response)
+}
+
+//*TcpMemcachedPlugin实现ReporterIntfs接口：get的命中率
+func (tmp *TcpMemcachedPlugin) Report() string {
+    hits, misses := atomic.LoadUint64(&tmp.hits), atomic.LoadUint64(&tmp.misses)
+    ratio := 0.0
+    if hits+misses > 0 {
+        ratio = 100 * float64(hits) / float64(hits+misses)
+    }
+    return fmt.Sprintf("Memcached get: hits %d, misses %d, hit ratio %.2f%%\n", hits, misses, ratio)
+}
+
+//生成自带校验的value：key|crc32|payload
+func memcachedValue(key string, payload []byte) []byte {
+    value := make([]byte, 0, len(key)+10+len(payload))
+    value = append(value, key...)
+    value = append(value, MEMCACHED_VALUE_SEP)
+    value = append(value, fmt.Sprintf("%08x", crc32.ChecksumIEEE(payload))...)
+    value = append(value, MEMCACHED_VALUE_SEP)
+    return append(value, payload...)
+}
+
+//校验读到的value
+func verifyMemcachedValue(key string, value []byte) error {
+    parts := bytes.SplitN(value, []byte{MEMCACHED_VALUE_SEP}, 3)
+    if len(parts) != 3 {
+        return fmt.Errorf("Malformed value of %s: %.32q", key, value)
+    }
+    if string(parts[0]) != key {
+        return fmt.Errorf("Value of %s belongs to %.64s", key, parts[0])
+    }
+    if string(parts[1]) != fmt.Sprintf("%08x", crc32.ChecksumIEEE(parts[2])) {
+        return fmt.Errorf("Value of %s is corrupted", key)
+    }
+    return nil
+}
+
+/************************** 文本协议 **************************/
+//文本协议的响应
+type mcTextResponse struct {
+    lines []string //状态行，get的VALUE行除外
+    value []byte   //get命中时的value
+}
+
+//一行是否是错误
+func isMcTextError(line string) bool {
+    return line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR")
+}
+
+//解析文本协议的响应：get以END结尾，incr有add和incr两行，其他命令一行
+func parseMcText(name string, data []byte) (*mcTextResponse, unicorn.ServerRespStatus) {
+    resp := &mcTextResponse{}
+    expect := 1
+    if name == "incr" {
+        expect = 2
+    }
+    pos := 0
+    for {
+        i := bytes.Index(data[pos:], crlf)
+        if i < 0 {
+            return nil, unicorn.SER_NEEDMORE
+        }
+        line := string(data[pos : pos+i])
+        pos += i + 2
+
+        if name == "get" && strings.HasPrefix(line, "VALUE ") {
+            fields := strings.Fields(line)
+            if len(fields) < 4 || resp.value != nil {
+                return nil, unicorn.SER_ERROR
+            }
+            n, err := strconv.Atoi(fields[3])
+            if err != nil || n < 0 {
+                return nil, unicorn.SER_ERROR
+            }
+            if len(data)-pos < n+2 {
+                return nil, unicorn.SER_NEEDMORE
+            }
+            if !bytes.Equal(data[pos+n:pos+n+2], crlf) {
+                return nil, unicorn.SER_ERROR
+            }
+            resp.value = data[pos : pos+n]
+            pos += n + 2
+            continue
+        }
+
+        resp.lines = append(resp.lines, line)
+        if name == "get" && line != "END" && !isMcTextError(line) {
+            return nil, unicorn.SER_ERROR
+        }
+        if len(resp.lines) == expect || isMcTextError(line) && name != "incr" {
+            break
+        }
+    }
+    if pos != len(data) {
+        return nil, unicorn.SER_ERROR
+    }
+    return resp, unicorn.SER_OK
+}
+
+func (tmp *TcpMemcachedPlugin) checkText(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    resp, status := parseMcText(raw_req.Type, response)
+    if status != unicorn.SER_OK {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "Malformed memcached response"
+    }
+    last := resp.lines[len(resp.lines)-1]
+    for _, line := range resp.lines {
+        if isMcTextError(line) {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, line
+        }
+    }
+
+    switch raw_req.Type {
+    case "get":
+        if resp.value == nil {
+            atomic.AddUint64(&tmp.misses, 1)
+            return unicorn.RESULT_CODE_SUCCESS, "Miss"
+        }
+        atomic.AddUint64(&tmp.hits, 1)
+        key := strings.Fields(string(raw_req.Req))[1]
+        if err := verifyMemcachedValue(key, resp.value); err != nil {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, err.Error()
+        }
+    case "set":
+        if last != "STORED" {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, last
+        }
+    case "delete":
+        if last != "DELETED" && last != "NOT_FOUND" {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, last
+        }
+    case "incr":
+        if _, err := strconv.ParseUint(last, 10, 64); err != nil {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, last
+        }
+    }
+    return unicorn.RESULT_CODE_SUCCESS, "Success"
+}
+
+/************************** 二进制协议 **************************/
+//二进制协议的包
+type mcPacket struct {
+    opcode byte
+    status uint16
+    opaque uint32
+    key    []byte
+    value  []byte
+}
+
+//编码二进制协议的请求，opaque用于和响应对应
+func writeMcBinary(buff *bytes.Buffer, op byte, opaque uint32, key string, value []byte, expire int) {
+    var extras []byte
+    switch op {
+    case MC_OP_SET:
+        extras = make([]byte, 8) //flags + expiration
+        binary.BigEndian.PutUint32(extras[4:], uint32(expire))
+    case MC_OP_INCREMENT:
+        extras = make([]byte, 20) //delta + initial + expiration
+        binary.BigEndian.PutUint64(extras[0:], 1)
+        binary.BigEndian.PutUint32(extras[16:], uint32(expire))
+    }
+    header := make([]byte, MC_HEADER_LEN)
+    header[0] = MC_MAGIC_REQUEST
+    header[1] = op
+    binary.BigEndian.PutUint16(header[2:], uint16(len(key)))
+    header[4] = byte(len(extras))
+    binary.BigEndian.PutUint32(header[8:], uint32(len(extras)+len(key)+len(value)))
+    binary.BigEndian.PutUint32(header[12:], opaque)
+    buff.Write(header)
+    buff.Write(extras)
+    buff.WriteString(key)
+    buff.Write(value)
+}
+
+//解析一个二进制协议的包，请求和响应都可以
+func parseMcBinary(data []byte) (*mcPacket, unicorn.ServerRespStatus) {
+    if len(data) < MC_HEADER_LEN {
+        return nil, unicorn.SER_NEEDMORE
+    }
+    if data[0] != MC_MAGIC_RESPONSE && data[0] != MC_MAGIC_REQUEST {
+        return nil, unicorn.SER_ERROR
+    }
+    keyLen := int(binary.BigEndian.Uint16(data[2:]))
+    extLen := int(data[4])
+    bodyLen := int(binary.BigEndian.Uint32(data[8:]))
+    if keyLen+extLen > bodyLen || bodyLen > SIZE_MAX*4 {
+        return nil, unicorn.SER_ERROR
+    }
+    if len(data) < MC_HEADER_LEN+bodyLen {
+        return nil, unicorn.SER_NEEDMORE
+    }
+    if len(data) > MC_HEADER_LEN+bodyLen {
+        return nil, unicorn.SER_ERROR
+    }
+    body := data[MC_HEADER_LEN:]
+    return &mcPacket{
+        opcode : data[1],
+        status : binary.BigEndian.Uint16(data[6:]),
+        opaque : binary.BigEndian.Uint32(data[12:]),
+        key    : body[extLen : extLen+keyLen],
+        value  : body[extLen+keyLen:],
+    }, unicorn.SER_OK
+}
+
+func (tmp *TcpMemcachedPlugin) checkBinary(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    resp, status := parseMcBinary(response)
+    if status != unicorn.SER_OK || response[0] != MC_MAGIC_RESPONSE {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "Malformed memcached response"
+    }
+    req, _ := parseMcBinary(raw_req.Req)
+    if resp.opcode != req.opcode || resp.opaque != req.opaque {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, fmt.Sprintf("Response mismatch: opcode %#x, opaque %d", resp.opcode, resp.opaque)
+    }
+
+    switch {
+    case resp.status == MC_STATUS_MISS && (req.opcode == MC_OP_GET || req.opcode == MC_OP_DELETE):
+        if req.opcode == MC_OP_GET {
+            atomic.AddUint64(&tmp.misses, 1)
+        }
+        return unicorn.RESULT_CODE_SUCCESS, "Miss"
+    case resp.status != MC_STATUS_OK:
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, fmt.Sprintf("Status %#04x: %s", resp.status, resp.value)
+    }
+
+    switch req.opcode {
+    case MC_OP_GET:
+        atomic.AddUint64(&tmp.hits, 1)
+        if err := verifyMemcachedValue(string(req.key), resp.value); err != nil {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, err.Error()
+        }
+    case MC_OP_INCREMENT:
+        if len(resp.value) != 8 {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, "Bad incr value"
+        }
+    }
+    return unicorn.RESULT_CODE_SUCCESS, "Success"
+}
+
+//New函数，创建TcpMemcachedPlugin，它是PluginIntfs的一个实现
+func NewTcpMemcachedPlugin(spec *MemcachedSpec) (unicorn.PluginIntfs, error) {
+    tmp := &TcpMemcachedPlugin{
+        keySpace  : spec.KeySpace,
+        keyPrefix : spec.KeyPrefix,
+        expire    : spec.Expire,
+    }
+    switch spec.Protocol {
+    case "", MEMCACHED_TEXT:
+    case MEMCACHED_BINARY:
+        tmp.binary = true
+    default:
+        return nil, fmt.Errorf("Memcached: unknown protocol %s", spec.Protocol)
+    }
+    if tmp.keySpace == 0 {
+        tmp.keySpace = MEMCACHED_DEFAULT_KEY_SPACE
+    }
+    if tmp.keyPrefix == "" {
+        tmp.keyPrefix = MEMCACHED_DEFAULT_KEY_PREFIX
+    }
+    if tmp.keySpace < 0 || tmp.expire < 0 {
+        return nil, errors.New("Memcached: negative key space or expire")
+    }
+    if strings.ContainsAny(tmp.keyPrefix, " \r\n|") {
+        return nil, errors.New("Memcached: key prefix can't contain spaces, newlines or '|'")
+    }
+    hitRatio := spec.HitRatio
+    if hitRatio == 0 {
+        hitRatio = 1
+    }
+    if hitRatio < 0 || hitRatio > 1 {
+        return nil, fmt.Errorf("Memcached: hit ratio %v out of (0, 1]", spec.HitRatio)
+    }
+    tmp.readSpace = int(float64(tmp.keySpace) / hitRatio)
+
+    valueSize := spec.ValueSize
+    if valueSize == "" {
+        valueSize = MEMCACHED_DEFAULT_VALUE_SIZE
+    }
+    var err error
+    if tmp.valueSize, err = ParseSizeDist(valueSize); err != nil {
+        return nil, err
+    }
+
+    //命令混合，按名字排序，保证结果可以复现
+    commands := spec.Commands
+    if len(commands) == 0 {
+        commands = map[string]int{"get": 80, "set": 20}
+    }
+    for name := range commands {
+        if _, ok := memcachedOps[strings.ToLower(name)]; !ok {
+            return nil, fmt.Errorf("Memcached: unsupported command %s", name)
+        }
+        tmp.names = append(tmp.names, name)
+    }
+    sort.Strings(tmp.names)
+    weights := make([]int, len(tmp.names))
+    for i, name := range tmp.names {
+        weights[i] = commands[name]
+        tmp.names[i] = strings.ToLower(name)
+    }
+    if tmp.picker, err = newWeightedPicker(weights); err != nil {
+        return nil, fmt.Errorf("Memcached: %s", err)
+    }
+    return tmp, nil
+}
@@ -0,0 +1,322 @@
+package plugin
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//测试文本协议响应解析：逐字节喂入，完整之前都是SER_NEEDMORE
+func TestMcTextParse(t *testing.T) {
+    cases := []struct {
+        name  string
+        resp  string
+        value string
+    }{
+        {"get", "VALUE k 0 5\r\nhello\r\nEND\r\n", "hello"},
+        {"get", "END\r\n", ""},
+        {"set", "STORED\r\n", ""},
+        {"delete", "NOT_FOUND\r\n", ""},
+        {"incr", "NOT_STORED\r\n42\r\n", ""},
+        {"get", "SERVER_ERROR out of memory\r\n", ""},
+    }
+    for _, c := range cases {
+        for i := 0; i < len(c.resp); i++ {
+            if _, s := parseMcText(c.name, []byte(c.resp[:i])); s != unicorn.SER_NEEDMORE {
+                t.Fatalf("%q: prefix %d got %d\n", c.resp, i, s)
+            }
+        }
+        resp, s := parseMcText(c.name, []byte(c.resp))
+        if s != unicorn.SER_OK || string(resp.value) != c.value {
+            t.Fatalf("%q: got %d, %v\n", c.resp, s, resp)
+        }
+    }
+
+    for _, bad := range []string{"VALUE k 0 2\r\nabc\r\nEND\r\n", "STORED\r\n", "END\r\nEND\r\n"} {
+        if _, s := parseMcText("get", []byte(bad)); s != unicorn.SER_ERROR {
+            t.Fatalf("%q: expected SER_ERROR, got %d\n", bad, s)
+        }
+    }
+
+    key := "unicorn:1"
+    value := memcachedValue(key, []byte("payload"))
+    if err := verifyMemcachedValue(key, value); err != nil {
+        t.Fatal(err)
+    }
+    if err := verifyMemcachedValue("unicorn:2", value); err == nil {
+        t.Fatal("Value of another key should fail")
+    }
+    if err := verifyMemcachedValue(key, value[:len(value)-1]); err == nil {
+        t.Fatal("Truncated value should fail")
+    }
+}
+
+//进程内的memcached服务端，同时支持文本协议和二进制协议
+//corrupt为true时，get返回的value被篡改
+type fakeMemcached struct {
+    lock    sync.Mutex
+    items   map[string][]byte
+    corrupt bool
+}
+
+func (fm *fakeMemcached) get(key string) ([]byte, bool) {
+    fm.lock.Lock()
+    defer fm.lock.Unlock()
+    v, ok := fm.items[key]
+    if ok && fm.corrupt {
+        v = append([]byte{}, v...)
+        v[len(v)-1] ^= 0xff
+    }
+    return v, ok
+}
+
+//incr不存在的key时，initial非负则以initial创建
+func (fm *fakeMemcached) incr(key string, delta uint64, initial int64) (uint64, bool) {
+    fm.lock.Lock()
+    defer fm.lock.Unlock()
+    v, ok := fm.items[key]
+    if !ok {
+        if initial < 0 {
+            return 0, false
+        }
+        fm.items[key] = []byte(strconv.FormatInt(initial, 10))
+        return uint64(initial), true
+    }
+    n, _ := strconv.ParseUint(string(v), 10, 64)
+    n += delta
+    fm.items[key] = []byte(strconv.FormatUint(n, 10))
+    return n, true
+}
+
+func (fm *fakeMemcached) serveText(r *bufio.Reader, w io.Writer) error {
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return err
+    }
+    f := strings.Fields(line)
+    switch f[0] {
+    case "get":
+        if v, ok := fm.get(f[1]); ok {
+            fmt.Fprintf(w, "VALUE %s 0 %d\r\n%s\r\n", f[1], len(v), v)
+        }
+        _, err = io.WriteString(w, "END\r\n")
+    case "set", "add":
+        n, _ := strconv.Atoi(f[4])
+        buf := make([]byte, n+2)
+        if _, err = io.ReadFull(r, buf); err != nil {
+            return err
+        }
+        fm.lock.Lock()
+        _, exist := fm.items[f[1]]
+        if f[0] == "set" || !exist {
+            fm.items[f[1]] = buf[:n]
+        }
+        fm.lock.Unlock()
+        if f[0] == "add" && exist {
+            _, err = io.WriteString(w, "NOT_STORED\r\n")
+        } else {
+            _, err = io.WriteString(w, "STORED\r\n")
+        }
+    case "delete":
+        fm.lock.Lock()
+        _, ok := fm.items[f[1]]
+        delete(fm.items, f[1])
+        fm.lock.Unlock()
+        if ok {
+            _, err = io.WriteString(w, "DELETED\r\n")
+        } else {
+            _, err = io.WriteString(w, "NOT_FOUND\r\n")
+        }
+    case "incr":
+        delta, _ := strconv.ParseUint(f[2], 10, 64)
+        if n, ok := fm.incr(f[1], delta, -1); ok {
+            fmt.Fprintf(w, "%d\r\n", n)
+        } else {
+            _, err = io.WriteString(w, "NOT_FOUND\r\n")
+        }
+    default:
+        _, err = io.WriteString(w, "ERROR\r\n")
+    }
+    return err
+}
+
+func (fm *fakeMemcached) serveBinary(r *bufio.Reader, w io.Writer) error {
+    header := make([]byte, MC_HEADER_LEN)
+    if _, err := io.ReadFull(r, header); err != nil {
+        return err
+    }
+    body := make([]byte, binary.BigEndian.Uint32(header[8:]))
+    if _, err := io.ReadFull(r, body); err != nil {
+        return err
+    }
+    req, _ := parseMcBinary(append(header, body...))
+    extras := body[:header[4]]
+    key := string(req.key)
+
+    var status uint16
+    var resExtras, value []byte
+    switch req.opcode {
+    case MC_OP_GET:
+        v, ok := fm.get(key)
+        if ok {
+            resExtras, value = make([]byte, 4), v
+        } else {
+            status = MC_STATUS_MISS
+        }
+    case MC_OP_SET:
+        fm.lock.Lock()
+        fm.items[key] = append([]byte{}, req.value...)
+        fm.lock.Unlock()
+    case MC_OP_DELETE:
+        fm.lock.Lock()
+        if _, ok := fm.items[key]; !ok {
+            status = MC_STATUS_MISS
+        }
+        delete(fm.items, key)
+        fm.lock.Unlock()
+    case MC_OP_INCREMENT:
+        n, _ := fm.incr(key, binary.BigEndian.Uint64(extras), int64(binary.BigEndian.Uint64(extras[8:])))
+        value = make([]byte, 8)
+        binary.BigEndian.PutUint64(value, n)
+    }
+
+    var buff bytes.Buffer
+    res := make([]byte, MC_HEADER_LEN)
+    res[0] = MC_MAGIC_RESPONSE
+    res[1] = req.opcode
+    res[4] = byte(len(resExtras))
+    binary.BigEndian.PutUint16(res[6:], status)
+    binary.BigEndian.PutUint32(res[8:], uint32(len(resExtras)+len(value)))
+    binary.BigEndian.PutUint32(res[12:], req.opaque)
+    buff.Write(res)
+    buff.Write(resExtras)
+    buff.Write(value)
+    //分两次写出，检验增量解析
+    half := buff.Len() / 2
+    if _, err := w.Write(buff.Bytes()[:half]); err != nil {
+        return err
+    }
+    _, err := w.Write(buff.Bytes()[half:])
+    return err
+}
+
+//启动服务端：根据第一个字节区分协议
+func startFakeMemcached(t *testing.T, fm *fakeMemcached) net.Listener {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                r := bufio.NewReader(conn)
+                for {
+                    b, err := r.Peek(1)
+                    if err != nil {
+                        return
+                    }
+                    if b[0] == MC_MAGIC_REQUEST {
+                        err = fm.serveBinary(r, conn)
+                    } else {
+                        err = fm.serveText(r, conn)
+                    }
+                    if err != nil {
+                        return
+                    }
+                }
+            }()
+        }
+    }()
+    return ln
+}
+
+//运行一轮压测，返回按请求类型以及结果分类的计数
+func runMemcached(t *testing.T, addr string, plg unicorn.PluginIntfs) (map[string]int, map[unicorn.ResultCode]int) {
+    result_chan := make(chan *unicorn.CallResult, 50)
+    unc, err := unicorn.NewUnicorn(addr, plg, 500*time.Millisecond, 0, 300*time.Millisecond, 2, true, result_chan)
+    if err != nil {
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
+    }
+    wg := unc.Start()
+    type_map := make(map[string]int)
+    code_map := make(map[unicorn.ResultCode]int)
+    for ret := range result_chan {
+        type_map[ret.Type]++
+        code_map[ret.Code]++
+        if ret.Code != unicorn.RESULT_CODE_SUCCESS && code_map[ret.Code] == 1 {
+            t.Logf("%s: %s\n", ret.Type, ret.Msg)
+        }
+    }
+    wg.Wait()
+    return type_map, code_map
+}
+
+//测试Memcached插件：文本协议以及二进制协议，命令混合，命中率，value校验
+func TestMemcachedPlugin(t *testing.T) {
+    fm := &fakeMemcached{items: make(map[string][]byte)}
+    ln := startFakeMemcached(t, fm)
+    defer ln.Close()
+
+    for _, protocol := range []string{MEMCACHED_TEXT, MEMCACHED_BINARY} {
+        spec := &MemcachedSpec{
+            Protocol  : protocol,
+            Commands  : map[string]int{"get": 50, "set": 40, "delete": 5, "incr": 5},
+            KeySpace  : 20,
+            KeyPrefix : protocol + ":",
+            HitRatio  : 0.5,
+            ValueSize : "uniform:1-512",
+        }
+        plg, err := NewTcpMemcachedPlugin(spec)
+        if err != nil {
+            t.Fatal(err)
+        }
+        type_map, code_map := runMemcached(t, ln.Addr().String(), plg)
+        report := plg.(unicorn.ReporterIntfs).Report()
+        t.Logf("%s: %v %v\n%s", protocol, type_map, code_map, report)
+        if len(code_map) != 1 || code_map[unicorn.RESULT_CODE_SUCCESS] == 0 {
+            t.Fatalf("%s: unexpected results %v\n", protocol, code_map)
+        }
+        for _, typ := range []string{"get", "set", "delete", "incr"} {
+            if type_map[typ] == 0 {
+                t.Fatalf("%s: no %s\n", protocol, typ)
+            }
+        }
+        //读的key空间是写的两倍，必然有未命中
+        tmp := plg.(*TcpMemcachedPlugin)
+        if tmp.hits == 0 || tmp.misses == 0 {
+            t.Fatalf("%s: expected both hits and misses: %s", protocol, report)
+        }
+
+        //篡改之后，命中的get都是错误的响应
+        fm.corrupt = true
+        spec.Commands = map[string]int{"get": 1}
+        spec.HitRatio = 1
+        plg, _ = NewTcpMemcachedPlugin(spec)
+        _, code_map = runMemcached(t, ln.Addr().String(), plg)
+        fm.corrupt = false
+        if code_map[unicorn.RESULT_CODE_ERROR_RESPONSE] == 0 {
+            t.Fatalf("%s: corruption not detected: %v\n", protocol, code_map)
+        }
+    }
+
+    if _, err := NewTcpMemcachedPlugin(&MemcachedSpec{Commands: map[string]int{"flush_all": 1}}); err == nil {
+        t.Fatal("Unsupported command should fail")
+    }
+    if _, err := NewTcpMemcachedPlugin(&MemcachedSpec{HitRatio: 1.5}); err == nil {
+        t.Fatal("Hit ratio above 1 should fail")
+    }
+}
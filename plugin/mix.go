@@ -0,0 +1,140 @@
+package plugin
+/*
+ * plugin
+ * 混合插件
+ * 按权重把多个插件（多种请求类型）组合在一起，对同一个目标施压，比如70%读、25%写、5%管理操作
+ * 每个请求的Type会被设置为子插件的名字，报告中的各项统计据此按请求类型分类
+ */
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+const (
+    MIX_TYPE_SEP = "/" //子插件自己也设置了Type时，最终的Type为"名字/子类型"
+)
+
+//混合中的一项
+type MixEntry struct {
+    Name   string              //名字，即报告中的请求类型
+    Weight int                 //权重
+    Plugin unicorn.PluginIntfs
+}
+
+type TcpMixPlugin struct {
+    entries []MixEntry
+    index   map[string]int   //名字 -> entries下标
+    picker  *weightedPicker
+}
+
+//*TcpMixPlugin实现PluginIntfs接口
+//生成请求：按权重选择一个子插件生成请求，并打上类型
+func (tmp *TcpMixPlugin) GenRequest(id int64) unicorn.RawRequest {
+    e := &tmp.entries[tmp.picker.Pick()]
+    raw_reqest := e.Plugin.GenRequest(id)
+    if raw_reqest.Type == "" {
+        raw_reqest.Type = e.Name
+    } else {
+        raw_reqest.Type = e.Name + MIX_TYPE_SEP + raw_reqest.Type
+    }
+    return raw_reqest
+}
+
+//check服务端返回是否能够构成一个完整包：交给生成该请求的子插件
+func (tmp *TcpMixPlugin) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    e, sub := tmp.route(raw_req.Type)
+    if e == nil {
+        return unicorn.SER_ERROR
+    }
+    req := *raw_req
+    req.Type = sub
+    status := e.Plugin.CheckFull(&req, response)
+    raw_req.State = req.State //子插件保存的解析状态
+    return status
+}
+
+//校验服务端返回是否符合预期：交给生成该请求的子插件
+func (tmp *TcpMixPlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    e, sub := tmp.route(raw_req.Type)
+    if e == nil {
+        return unicorn.RESULT_CODE_FATAL_CALL, fmt.Sprintf("Unknown request type: %s!\n", raw_req.Type)
+    }
+    raw_req.Type = sub
+    return e.Plugin.CheckResponse(raw_req, response)
+}
+
+//服务端是否会关闭连接：交给生成该请求的子插件
+func (tmp *TcpMixPlugin) ShouldClose(raw_req unicorn.RawRequest, response []byte) bool {
+    e, sub := tmp.route(raw_req.Type)
+    if e == nil {
+        return false
+    }
+    cp, ok := e.Plugin.(unicorn.ConnCloseIntfs)
+    if !ok {
+        return false
+    }
+    raw_req.Type = sub
+    return cp.ShouldClose(raw_req, response)
+}
+
+//子插件自己的统计，按名字依次列出
+func (tmp *TcpMixPlugin) Report() string {
+    var buff strings.Builder
+    for _, e := range tmp.entries {
+        if rp, ok := e.Plugin.(unicorn.ReporterIntfs); ok {
+            fmt.Fprintf(&buff, "[%s]\n%s", e.Name, rp.Report())
+        }
+    }
+    return buff.String()
+}
+
+//根据类型找到子插件，同时还原子插件自己设置的类型
+func (tmp *TcpMixPlugin) route(typ string) (*MixEntry, string) {
+    name, sub := typ, ""
+    if i := strings.Index(typ, MIX_TYPE_SEP); i >= 0 {
+        name, sub = typ[:i], typ[i+len(MIX_TYPE_SEP):]
+    }
+    i, ok := tmp.index[name]
+    if !ok {
+        return nil, ""
+    }
+    return &tmp.entries[i], sub
+}
+
+//New函数，创建TcpMixPlugin，它是PluginIntfs的一个实现
+//子插件不能是会话插件，会话插件需要独占连接，无法和其他插件混合
+func NewTcpMixPlugin(entries []MixEntry) (unicorn.PluginIntfs, error) {
+    if len(entries) == 0 {
+        return nil, errors.New("Mix: no plugin")
+    }
+    tmp := &TcpMixPlugin{
+        entries : entries,
+        index   : make(map[string]int),
+    }
+    weights := make([]int, len(entries))
+    for i, e := range entries {
+        if e.Name == "" || strings.Contains(e.Name, MIX_TYPE_SEP) {
+            return nil, fmt.Errorf("Mix: bad name %q", e.Name)
+        }
+        if _, ok := tmp.index[e.Name]; ok {
+            return nil, fmt.Errorf("Mix: duplicate name %s", e.Name)
+        }
+        if e.Plugin == nil {
+            return nil, fmt.Errorf("Mix: nil plugin %s", e.Name)
+        }
+        if _, ok := e.Plugin.(unicorn.SessionFactoryIntfs); ok {
+            return nil, fmt.Errorf("Mix: session plugin %s can't be mixed", e.Name)
+        }
+        tmp.index[e.Name] = i
+        weights[i] = e.Weight
+    }
+    picker, err := newWeightedPicker(weights)
+    if err != nil {
+        return nil, fmt.Errorf("Mix: %s", err)
+    }
+    tmp.picker = picker
+    return tmp, nil
+}
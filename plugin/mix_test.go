@@ -0,0 +1,134 @@
+package plugin
+
+import (
+    "math"
+    "testing"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//测试按权重选择：各下标被选中的比例接近权重的比例，权重为0的从不被选中
+func TestWeightedPicker(t *testing.T) {
+    weights := []int{70, 0, 25, 5}
+    wp, err := newWeightedPicker(weights)
+    if err != nil {
+        t.Fatal(err)
+    }
+    counts := make([]int, len(weights))
+    n := 100000
+    for i := 0; i < n; i++ {
+        counts[wp.Pick()]++
+    }
+    for i, w := range weights {
+        ratio := float64(counts[i]) / float64(n)
+        if math.Abs(ratio-float64(w)/100) > 0.01 {
+            t.Fatalf("Index %d: expected ratio %.2f, got %.4f\n", i, float64(w)/100, ratio)
+        }
+    }
+    if counts[1] != 0 {
+        t.Fatalf("Zero weight picked %d times\n", counts[1])
+    }
+
+    for _, bad := range [][]int{{}, {0, 0}, {1, -1}} {
+        if _, err := newWeightedPicker(bad); err == nil {
+            t.Fatalf("Expected error for weights %v\n", bad)
+        }
+    }
+}
+
+//记录收到的请求类型的子插件，typ非空时为请求打上子类型，CheckFull在请求中保存解析状态
+type routeProbe struct {
+    name   string
+    typ    string
+    seen   []string
+    closes int
+}
+
+func (rp *routeProbe) GenRequest(id int64) unicorn.RawRequest {
+    return unicorn.RawRequest{Id: id, Req: []byte(rp.name), Type: rp.typ}
+}
+
+func (rp *routeProbe) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    rp.seen = append(rp.seen, "full:"+raw_req.Type)
+    raw_req.State = rp.name
+    return unicorn.SER_OK
+}
+
+func (rp *routeProbe) CheckResponse(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    rp.seen = append(rp.seen, "check:"+raw_req.Type)
+    if raw_req.State != rp.name {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "lost parse state"
+    }
+    if string(response) != rp.name {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "routed to " + rp.name
+    }
+    return unicorn.RESULT_CODE_SUCCESS, rp.name
+}
+
+func (rp *routeProbe) ShouldClose(raw_req unicorn.RawRequest, response []byte) bool {
+    rp.closes++
+    return true
+}
+
+//测试按类型路由：请求交给生成它的子插件校验，子插件看到的是自己设置的类型，以及自己保存的解析状态
+func TestMixRouting(t *testing.T) {
+    read := &routeProbe{name: "read"}
+    write := &routeProbe{name: "write", typ: "set"}
+    plg, err := NewTcpMixPlugin([]MixEntry{
+        {Name: "read", Weight: 1, Plugin: read},
+        {Name: "write", Weight: 1, Plugin: write},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    types := make(map[string]int)
+    for i := 0; i < 1000; i++ {
+        raw_req := plg.GenRequest(int64(i))
+        types[raw_req.Type]++
+        if s := plg.CheckFull(&raw_req, raw_req.Req); s != unicorn.SER_OK {
+            t.Fatalf("%s: unexpected status %d\n", raw_req.Type, s)
+        }
+        if code, msg := plg.CheckResponse(raw_req, raw_req.Req); code != unicorn.RESULT_CODE_SUCCESS {
+            t.Fatalf("%s: %s\n", raw_req.Type, msg)
+        }
+        plg.(unicorn.ConnCloseIntfs).ShouldClose(raw_req, raw_req.Req)
+    }
+    if len(types) != 2 || types["read"] < 400 || types["write/set"] < 400 {
+        t.Fatalf("Unexpected types: %v\n", types)
+    }
+    for _, s := range read.seen {
+        if s != "full:" && s != "check:" {
+            t.Fatalf("read plugin saw %q\n", s)
+        }
+    }
+    for _, s := range write.seen {
+        if s != "full:set" && s != "check:set" {
+            t.Fatalf("write plugin saw %q\n", s)
+        }
+    }
+    if read.closes != types["read"] || write.closes != types["write/set"] {
+        t.Fatalf("Unexpected ShouldClose calls: %d %d\n", read.closes, write.closes)
+    }
+
+    //未知的类型
+    unknown := unicorn.RawRequest{Id: 1, Type: "admin"}
+    if s := plg.CheckFull(&unknown, nil); s != unicorn.SER_ERROR {
+        t.Fatalf("Expected SER_ERROR for unknown type, got %d\n", s)
+    }
+    if code, _ := plg.CheckResponse(unknown, nil); code != unicorn.RESULT_CODE_FATAL_CALL {
+        t.Fatalf("Expected fatal for unknown type, got %d\n", code)
+    }
+
+    for _, entries := range [][]MixEntry{
+        nil,
+        {{Name: "", Weight: 1, Plugin: read}},
+        {{Name: "a/b", Weight: 1, Plugin: read}},
+        {{Name: "a", Weight: 1, Plugin: read}, {Name: "a", Weight: 1, Plugin: write}},
+        {{Name: "a", Weight: 1}},
+        {{Name: "a", Weight: 0, Plugin: read}},
+    } {
+        if _, err := NewTcpMixPlugin(entries); err == nil {
+            t.Fatalf("Expected error for %+v\n", entries)
+        }
+    }
+}
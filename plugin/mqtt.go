@@ -0,0 +1,557 @@
+package plugin
+/*
+ * plugin
+ * MQTT 3.1.1插件
+ * 每个连接是一个会话，按publishers:subscribers的比例分为发布者和订阅者，先CONNECT等待CONNACK
+ * 发布者：随机选择主题发布消息，payload的前8个字节是发布时间，应答流程按QoS：
+ *   QoS 0：PUBLISH之后紧跟PINGREQ，以PINGRESP作为响应（QoS 0本身没有应答）
+ *   QoS 1：PUBLISH -> PUBACK
+ *   QoS 2：PUBLISH -> PUBREC，下一个请求PUBREL -> PUBCOMP
+ * 订阅者：SUBSCRIBE所有主题等待SUBACK，之后不断发送PINGREQ，收取PINGRESP之前投递过来的消息，
+ *   根据payload中的发布时间计算端到端的延迟；需要应答的消息（PUBACK/PUBREC/PUBCOMP）随下一个PINGREQ发出
+ * 请求的类型为CONNECT/SUBSCRIBE/PUBLISH/PUBREL/RECEIVE，测试结束之后报告中列出每个主题的发布数、收到数以及端到端延迟
+ * 端到端延迟依赖发布者和订阅者在同一个进程中
+ *
+ * 示例（YAML）：
+ *   topics: [sensors/temp, sensors/humidity]
+ *   qos: 1
+ *   payload_size: uniform:16-256
+ *   publishers: 4
+ *   subscribers: 1
+ */
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math/rand"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//请求类型
+const (
+    MQTT_CONNECT_TYPE   = "CONNECT"
+    MQTT_SUBSCRIBE_TYPE = "SUBSCRIBE"
+    MQTT_PUBLISH_TYPE   = "PUBLISH"
+    MQTT_PUBREL_TYPE    = "PUBREL"
+    MQTT_RECEIVE_TYPE   = "RECEIVE"
+)
+
+//控制报文类型
+const (
+    MQTT_CONNECT    = 1
+    MQTT_CONNACK    = 2
+    MQTT_PUBLISH    = 3
+    MQTT_PUBACK     = 4
+    MQTT_PUBREC     = 5
+    MQTT_PUBREL     = 6
+    MQTT_PUBCOMP    = 7
+    MQTT_SUBSCRIBE  = 8
+    MQTT_SUBACK     = 9
+    MQTT_PINGREQ    = 12
+    MQTT_PINGRESP   = 13
+)
+
+const (
+    MQTT_DEFAULT_CLIENT_ID    = "unicorn"
+    MQTT_DEFAULT_KEEPALIVE    = 60
+    MQTT_DEFAULT_PAYLOAD_SIZE = "fixed:64"
+    MQTT_TIMESTAMP_LEN        = 8          //payload中发布时间的长度
+)
+
+//MQTT插件描述
+type MqttSpec struct {
+    ClientId    string   `json:"client_id"    yaml:"client_id"`    //客户端标识的前缀，默认unicorn，后面加上会话序号
+    Username    string   `json:"username"     yaml:"username"`
+    Password    string   `json:"password"     yaml:"password"`
+    KeepAlive   int      `json:"keepalive"    yaml:"keepalive"`    //秒，默认60
+    Topics      []string `json:"topics"       yaml:"topics"`       //发布的主题，订阅者订阅全部
+    Qos         int      `json:"qos"          yaml:"qos"`          //发布以及订阅的QoS，0/1/2
+    PayloadSize string   `json:"payload_size" yaml:"payload_size"` //payload的大小分布，默认fixed:64，至少8字节
+    Publishers  int      `json:"publishers"   yaml:"publishers"`   //发布者的比例，默认1
+    Subscribers int      `json:"subscribers"  yaml:"subscribers"`  //订阅者的比例，默认0
+}
+
+//一个控制报文
+type mqttPacket struct {
+    typ   byte
+    flags byte
+    body  []byte
+}
+
+//每个主题的统计
+type mqttTopicStat struct {
+    published uint64
+    received  uint64
+    latency   time.Duration //端到端延迟之和
+    maxLat    time.Duration
+}
+
+type TcpMqttPlugin struct {
+    clientId    string
+    username    string
+    password    string
+    keepAlive   int
+    topics      []string
+    qos         byte
+    payloadSize SizeDist
+    publishers  int
+    subscribers int
+    sessions    uint64 //已经创建的会话数，用于分配角色以及客户端标识
+
+    lock        sync.Mutex
+    stats       map[string]*mqttTopicStat
+}
+
+//每个连接的会话
+type mqttSession struct {
+    *TcpMqttPlugin
+    clientId   string
+    subscriber bool
+    connected  bool
+    subscribed bool
+    packetId   uint16       //最近一个需要应答的报文标识
+    topic      string       //最近发布的主题
+    pubrel     bool         //QoS 2：收到PUBREC，下一个请求是PUBREL
+    acks       bytes.Buffer //订阅者待发送的应答
+    done       bool
+}
+
+//从文件加载MQTT插件描述
+func LoadMqttSpec(path string) (*MqttSpec, error) {
+    var spec MqttSpec
+    if err := unmarshalFile(path, &spec); err != nil {
+        return nil, fmt.Errorf("Mqtt spec %s: %s", path, err)
+    }
+    return &spec, nil
+}
+
+//*TcpMqttPlugin实现SessionFactoryIntfs接口：按比例分配发布者和订阅者
+func (tmp *TcpMqttPlugin) NewSession() unicorn.SessionIntfs {
+    seq := atomic.AddUint64(&tmp.sessions, 1) - 1
+    return &mqttSession{
+        TcpMqttPlugin : tmp,
+        clientId      : tmp.clientId + "-" + strconv.FormatUint(seq, 10),
+        subscriber    : int(seq % uint64(tmp.publishers+tmp.subscribers)) < tmp.subscribers,
+    }
+}
+
+//*TcpMqttPlugin同时需要满足PluginIntfs接口，但框架只会通过会话实例调用，走到这里说明用法有误
+func (tmp *TcpMqttPlugin) GenRequest(id int64) unicorn.RawRequest {
+    panic(errors.New("Mqtt plugin must run in session mode"))
+}
+
+func (tmp *TcpMqttPlugin) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    return unicorn.SER_ERROR
+}
+
+func (tmp *TcpMqttPlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    return unicorn.RESULT_CODE_FATAL_CALL, "Mqtt plugin must run in session mode"
+}
+
+//*TcpMqttPlugin实现ReporterIntfs接口：每个主题的发布数、收到数以及端到端延迟
+func (tmp *TcpMqttPlugin) Report() string {
+    tmp.lock.Lock()
+    defer tmp.lock.Unlock()
+    topics := make([]string, 0, len(tmp.stats))
+    for topic := range tmp.stats {
+        topics = append(topics, topic)
+    }
+    sort.Strings(topics)
+    var buff strings.Builder
+    buff.WriteString("MQTT by topic:\n")
+    for _, topic := range topics {
+        stat := tmp.stats[topic]
+        var avg time.Duration
+        if stat.received > 0 {
+            avg = stat.latency / time.Duration(stat.received)
+        }
+        fmt.Fprintf(&buff, "  %s: published %d, received %d, end-to-end latency avg %v, max %v\n",
+            topic, stat.published, stat.received, avg, stat.maxLat)
+    }
+    return buff.String()
+}
+
+func (tmp *TcpMqttPlugin) stat(topic string) *mqttTopicStat {
+    stat, ok := tmp.stats[topic]
+    if !ok {
+        stat = &mqttTopicStat{}
+        tmp.stats[topic] = stat
+    }
+    return stat
+}
+
+//生成请求
+func (ms *mqttSession) GenRequest(id int64) unicorn.RawRequest {
+    var buff bytes.Buffer
+    switch {
+    case !ms.connected:
+        ms.writeConnect(&buff)
+        return unicorn.RawRequest{Id: id, Req: buff.Bytes(), Type: MQTT_CONNECT_TYPE}
+
+    case ms.subscriber && !ms.subscribed:
+        ms.packetId = ms.nextPacketId()
+        var body bytes.Buffer
+        binary.Write(&body, binary.BigEndian, ms.packetId)
+        for _, topic := range ms.topics {
+            writeMqttString(&body, topic)
+            body.WriteByte(ms.qos)
+        }
+        writeMqttPacket(&buff, MQTT_SUBSCRIBE<<4|0x02, body.Bytes())
+        return unicorn.RawRequest{Id: id, Req: buff.Bytes(), Type: MQTT_SUBSCRIBE_TYPE}
+
+    case ms.subscriber:
+        buff.Write(ms.acks.Bytes())
+        ms.acks.Reset()
+        writeMqttPacket(&buff, MQTT_PINGREQ<<4, nil)
+        return unicorn.RawRequest{Id: id, Req: buff.Bytes(), Type: MQTT_RECEIVE_TYPE}
+
+    case ms.pubrel:
+        writeMqttPacket(&buff, MQTT_PUBREL<<4|0x02, mqttPacketIdBody(ms.packetId))
+        return unicorn.RawRequest{Id: id, Req: buff.Bytes(), Type: MQTT_PUBREL_TYPE}
+    }
+
+    //发布：payload的前8个字节是发布时间
+    ms.topic = ms.topics[rand.Intn(len(ms.topics))]
+    var body bytes.Buffer
+    writeMqttString(&body, ms.topic)
+    if ms.qos > 0 {
+        ms.packetId = ms.nextPacketId()
+        binary.Write(&body, binary.BigEndian, ms.packetId)
+    }
+    binary.Write(&body, binary.BigEndian, time.Now().UnixNano())
+    if n := ms.payloadSize.Next() - MQTT_TIMESTAMP_LEN; n > 0 {
+        body.Write(randPayload(n))
+    }
+    writeMqttPacket(&buff, MQTT_PUBLISH<<4|ms.qos<<1, body.Bytes())
+    if ms.qos == 0 {
+        writeMqttPacket(&buff, MQTT_PINGREQ<<4, nil)
+    }
+    return unicorn.RawRequest{Id: id, Req: buff.Bytes(), Type: MQTT_PUBLISH_TYPE}
+}
+
+//请求期望的应答报文
+func (ms *mqttSession) expect(typ string) byte {
+    switch typ {
+    case MQTT_CONNECT_TYPE:
+        return MQTT_CONNACK
+    case MQTT_SUBSCRIBE_TYPE:
+        return MQTT_SUBACK
+    case MQTT_PUBREL_TYPE:
+        return MQTT_PUBCOMP
+    case MQTT_PUBLISH_TYPE:
+        switch ms.qos {
+        case 1:
+            return MQTT_PUBACK
+        case 2:
+            return MQTT_PUBREC
+        }
+    }
+    return MQTT_PINGRESP
+}
+
+//check服务端返回是否能够构成一个完整包
+func (ms *mqttSession) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    _, status := parseMqttResponse(response, ms.expect(raw_req.Type))
+    return status
+}
+
+//校验服务端返回是否符合预期，订阅者同时处理投递过来的消息
+func (ms *mqttSession) CheckResponse(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    expect := ms.expect(raw_req.Type)
+    packets, status := parseMqttResponse(response, expect)
+    if status != unicorn.SER_OK {
+        ms.done = true
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "Malformed mqtt packets"
+    }
+
+    for _, p := range packets {
+        switch p.typ {
+        case MQTT_PUBLISH:
+            if err := ms.receive(p); err != nil {
+                ms.done = true
+                return unicorn.RESULT_CODE_ERROR_RESPONSE, err.Error()
+            }
+        case MQTT_PUBREL:
+            //QoS 2的投递：PUBREL -> PUBCOMP
+            if len(p.body) != 2 {
+                ms.done = true
+                return unicorn.RESULT_CODE_ERROR_RESPONSE, "Bad PUBREL"
+            }
+            writeMqttPacket(&ms.acks, MQTT_PUBCOMP<<4, p.body)
+        case expect:
+            if err := ms.acknowledged(raw_req.Type, p); err != nil {
+                ms.done = true
+                return unicorn.RESULT_CODE_ERROR_RESPONSE, err.Error()
+            }
+        }
+    }
+    return unicorn.RESULT_CODE_SUCCESS, "Success"
+}
+
+//连接出错之后不再继续，其余情况会话不会自己结束，可以用-R/-L限制连接的寿命
+func (ms *mqttSession) Done() bool {
+    return ms.done
+}
+
+//处理期望的应答
+func (ms *mqttSession) acknowledged(typ string, p *mqttPacket) error {
+    switch p.typ {
+    case MQTT_CONNACK:
+        if len(p.body) != 2 {
+            return errors.New("Bad CONNACK")
+        }
+        if p.body[1] != 0 {
+            return fmt.Errorf("Connection refused: return code %d", p.body[1])
+        }
+        ms.connected = true
+        return nil
+    case MQTT_PINGRESP:
+        if typ == MQTT_RECEIVE_TYPE {
+            return nil
+        }
+    case MQTT_SUBACK:
+        if len(p.body) != 2+len(ms.topics) || binary.BigEndian.Uint16(p.body) != ms.packetId {
+            return errors.New("Bad SUBACK")
+        }
+        for i, granted := range p.body[2:] {
+            if granted == 0x80 {
+                return fmt.Errorf("Subscription to %s rejected", ms.topics[i])
+            }
+        }
+        ms.subscribed = true
+        return nil
+    default:
+        if len(p.body) != 2 || binary.BigEndian.Uint16(p.body) != ms.packetId {
+            return fmt.Errorf("Packet id mismatch in packet type %d", p.typ)
+        }
+    }
+
+    //发布得到了应答。QoS 2收到PUBREC之后还需要PUBREL
+    switch p.typ {
+    case MQTT_PUBREC:
+        ms.pubrel = true
+    case MQTT_PUBCOMP:
+        ms.pubrel = false
+        return nil
+    }
+    ms.lock.Lock()
+    ms.stat(ms.topic).published++
+    ms.lock.Unlock()
+    return nil
+}
+
+//订阅者收到一条消息：计算端到端延迟，需要应答的放入待发送的应答
+func (ms *mqttSession) receive(p *mqttPacket) error {
+    qos := (p.flags >> 1) & 0x03
+    if len(p.body) < 2 {
+        return errors.New("Bad PUBLISH")
+    }
+    n := int(binary.BigEndian.Uint16(p.body))
+    pos := 2 + n
+    if qos > 0 {
+        pos += 2
+    }
+    if qos > 2 || len(p.body) < pos + MQTT_TIMESTAMP_LEN {
+        return errors.New("Bad PUBLISH")
+    }
+    topic := string(p.body[2 : 2+n])
+    latency := time.Duration(time.Now().UnixNano() - int64(binary.BigEndian.Uint64(p.body[pos:])))
+
+    ms.lock.Lock()
+    stat := ms.stat(topic)
+    stat.received++
+    stat.latency += latency
+    if latency > stat.maxLat {
+        stat.maxLat = latency
+    }
+    ms.lock.Unlock()
+
+    switch qos {
+    case 1:
+        writeMqttPacket(&ms.acks, MQTT_PUBACK<<4, p.body[pos-2:pos])
+    case 2:
+        writeMqttPacket(&ms.acks, MQTT_PUBREC<<4, p.body[pos-2:pos])
+    }
+    return nil
+}
+
+//报文标识，不能为0
+func (ms *mqttSession) nextPacketId() uint16 {
+    ms.packetId++
+    if ms.packetId == 0 {
+        ms.packetId = 1
+    }
+    return ms.packetId
+}
+
+//CONNECT报文，总是使用clean session
+func (ms *mqttSession) writeConnect(buff *bytes.Buffer) {
+    var body bytes.Buffer
+    writeMqttString(&body, "MQTT")
+    body.WriteByte(4) //协议级别：3.1.1
+    flags := byte(0x02)
+    if ms.username != "" {
+        flags |= 0x80
+    }
+    if ms.password != "" {
+        flags |= 0x40
+    }
+    body.WriteByte(flags)
+    binary.Write(&body, binary.BigEndian, uint16(ms.keepAlive))
+    writeMqttString(&body, ms.clientId)
+    if ms.username != "" {
+        writeMqttString(&body, ms.username)
+    }
+    if ms.password != "" {
+        writeMqttString(&body, ms.password)
+    }
+    writeMqttPacket(buff, MQTT_CONNECT<<4, body.Bytes())
+}
+
+func mqttPacketIdBody(id uint16) []byte {
+    body := make([]byte, 2)
+    binary.BigEndian.PutUint16(body, id)
+    return body
+}
+
+//带长度前缀的字符串
+func writeMqttString(buff *bytes.Buffer, s string) {
+    binary.Write(buff, binary.BigEndian, uint16(len(s)))
+    buff.WriteString(s)
+}
+
+//编码一个报文：固定头部（类型以及标志）、剩余长度、body
+func writeMqttPacket(buff *bytes.Buffer, header byte, body []byte) {
+    buff.WriteByte(header)
+    n := len(body)
+    for {
+        b := byte(n % 128)
+        n /= 128
+        if n > 0 {
+            b |= 0x80
+        }
+        buff.WriteByte(b)
+        if n == 0 {
+            break
+        }
+    }
+    buff.Write(body)
+}
+
+//解析一个报文，返回报文以及消耗的字节数
+func parseMqttPacket(data []byte) (*mqttPacket, int, unicorn.ServerRespStatus) {
+    if len(data) < 2 {
+        return nil, 0, unicorn.SER_NEEDMORE
+    }
+    n, multiplier, pos := 0, 1, 1
+    for {
+        if pos >= len(data) {
+            return nil, 0, unicorn.SER_NEEDMORE
+        }
+        if pos > 4 {
+            return nil, 0, unicorn.SER_ERROR
+        }
+        b := data[pos]
+        pos++
+        n += int(b&0x7F) * multiplier
+        multiplier *= 128
+        if b&0x80 == 0 {
+            break
+        }
+    }
+    if len(data)-pos < n {
+        return nil, 0, unicorn.SER_NEEDMORE
+    }
+    return &mqttPacket{typ: data[0] >> 4, flags: data[0] & 0x0F, body: data[pos : pos+n]}, pos + n, unicorn.SER_OK
+}
+
+//解析服务端的报文，直到出现期望的应答，并且数据在报文边界结束
+//订阅者的应答之前以及之后可能穿插着投递过来的消息
+func parseMqttResponse(data []byte, expect byte) ([]*mqttPacket, unicorn.ServerRespStatus) {
+    var packets []*mqttPacket
+    found := false
+    for len(data) > 0 {
+        p, n, status := parseMqttPacket(data)
+        if status != unicorn.SER_OK {
+            return nil, status
+        }
+        switch p.typ {
+        case expect:
+            if found {
+                return nil, unicorn.SER_ERROR
+            }
+            found = true
+        case MQTT_PUBLISH, MQTT_PUBREL:
+        default:
+            return nil, unicorn.SER_ERROR
+        }
+        packets = append(packets, p)
+        data = data[n:]
+    }
+    if !found {
+        return nil, unicorn.SER_NEEDMORE
+    }
+    return packets, unicorn.SER_OK
+}
+
+//New函数，创建TcpMqttPlugin，它是SessionFactoryIntfs的一个实现
+func NewTcpMqttPlugin(spec *MqttSpec) (unicorn.PluginIntfs, error) {
+    tmp := &TcpMqttPlugin{
+        clientId    : spec.ClientId,
+        username    : spec.Username,
+        password    : spec.Password,
+        keepAlive   : spec.KeepAlive,
+        topics      : spec.Topics,
+        publishers  : spec.Publishers,
+        subscribers : spec.Subscribers,
+        stats       : make(map[string]*mqttTopicStat),
+    }
+    if len(tmp.topics) == 0 {
+        return nil, errors.New("Mqtt: no topics")
+    }
+    for _, topic := range tmp.topics {
+        if topic == "" || strings.ContainsAny(topic, "+#") {
+            return nil, fmt.Errorf("Mqtt: bad topic %q, wildcards are not allowed", topic)
+        }
+    }
+    if spec.Qos < 0 || spec.Qos > 2 {
+        return nil, fmt.Errorf("Mqtt: bad qos %d", spec.Qos)
+    }
+    tmp.qos = byte(spec.Qos)
+    if tmp.clientId == "" {
+        tmp.clientId = MQTT_DEFAULT_CLIENT_ID
+    }
+    if tmp.keepAlive == 0 {
+        tmp.keepAlive = MQTT_DEFAULT_KEEPALIVE
+    }
+    if tmp.keepAlive < 0 || tmp.keepAlive > 0xFFFF {
+        return nil, fmt.Errorf("Mqtt: bad keepalive %d", tmp.keepAlive)
+    }
+    if tmp.password != "" && tmp.username == "" {
+        return nil, errors.New("Mqtt: password without username")
+    }
+    if tmp.publishers == 0 && tmp.subscribers == 0 {
+        tmp.publishers = 1
+    }
+    if tmp.publishers < 0 || tmp.subscribers < 0 {
+        return nil, errors.New("Mqtt: negative publishers or subscribers")
+    }
+
+    payloadSize := spec.PayloadSize
+    if payloadSize == "" {
+        payloadSize = MQTT_DEFAULT_PAYLOAD_SIZE
+    }
+    var err error
+    if tmp.payloadSize, err = ParseSizeDist(payloadSize); err != nil {
+        return nil, err
+    }
+    return tmp, nil
+}
@@ -0,0 +1,247 @@
+package plugin
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "io"
+    "net"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//测试报文解析：剩余长度的变长编码，逐字节喂入，完整之前都是SER_NEEDMORE
+func TestMqttParse(t *testing.T) {
+    var buff bytes.Buffer
+    publish := make([]byte, 200) //剩余长度需要两个字节
+    binary.BigEndian.PutUint16(publish, 3)
+    copy(publish[2:], "a/b")
+    writeMqttPacket(&buff, MQTT_PUBLISH<<4, publish)
+    writeMqttPacket(&buff, MQTT_PUBREL<<4|0x02, mqttPacketIdBody(7))
+    writeMqttPacket(&buff, MQTT_PUBACK<<4, mqttPacketIdBody(9))
+    stream := buff.Bytes()
+    if stream[1] != 0xC8 || stream[2] != 0x01 {
+        t.Fatalf("Bad remaining length encoding: %x\n", stream[:3])
+    }
+    for i := 0; i < len(stream); i++ {
+        if _, s := parseMqttResponse(stream[:i], MQTT_PUBACK); s != unicorn.SER_NEEDMORE {
+            t.Fatalf("Prefix %d: got %d\n", i, s)
+        }
+    }
+    packets, s := parseMqttResponse(stream, MQTT_PUBACK)
+    if s != unicorn.SER_OK || len(packets) != 3 || len(packets[0].body) != 200 || packets[2].typ != MQTT_PUBACK {
+        t.Fatalf("Unexpected packets: %d %v\n", s, packets)
+    }
+
+    for _, bad := range [][]byte{
+        {MQTT_CONNACK << 4, 2, 0, 0},   //不期望的报文
+        {MQTT_PUBACK << 4, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}, //剩余长度超过4个字节
+        {MQTT_PUBACK << 4, 2, 0, 1, MQTT_PUBACK << 4, 2, 0, 2},
+    } {
+        if _, s := parseMqttResponse(bad, MQTT_PUBACK); s != unicorn.SER_ERROR {
+            t.Fatalf("%x: expected SER_ERROR, got %d\n", bad, s)
+        }
+    }
+}
+
+//进程内的最小broker：主题精确匹配，按订阅的QoS投递
+type mqttBroker struct {
+    lock   sync.Mutex
+    subs   map[string][]*mqttClient
+    acks   int64 //订阅者的PUBACK以及PUBCOMP数
+}
+
+type mqttClient struct {
+    lock sync.Mutex
+    conn net.Conn
+    qos  byte
+    id   uint16
+}
+
+func (c *mqttClient) send(header byte, body []byte) {
+    var buff bytes.Buffer
+    writeMqttPacket(&buff, header, body)
+    c.lock.Lock()
+    c.conn.Write(buff.Bytes())
+    c.lock.Unlock()
+}
+
+func readMqttPacket(r *bufio.Reader) (*mqttPacket, error) {
+    head := []byte{0}
+    if _, err := io.ReadFull(r, head); err != nil {
+        return nil, err
+    }
+    n, multiplier := 0, 1
+    for {
+        b, err := r.ReadByte()
+        if err != nil {
+            return nil, err
+        }
+        n += int(b&0x7F) * multiplier
+        multiplier *= 128
+        if b&0x80 == 0 {
+            break
+        }
+    }
+    body := make([]byte, n)
+    if _, err := io.ReadFull(r, body); err != nil {
+        return nil, err
+    }
+    return &mqttPacket{typ: head[0] >> 4, flags: head[0] & 0x0F, body: body}, nil
+}
+
+func (mb *mqttBroker) serve(conn net.Conn) {
+    defer conn.Close()
+    r := bufio.NewReader(conn)
+    c := &mqttClient{conn: conn}
+    for {
+        p, err := readMqttPacket(r)
+        if err != nil {
+            return
+        }
+        switch p.typ {
+        case MQTT_CONNECT:
+            c.send(MQTT_CONNACK<<4, []byte{0, 0})
+        case MQTT_SUBSCRIBE:
+            ack := append([]byte{}, p.body[:2]...)
+            body := p.body[2:]
+            mb.lock.Lock()
+            for len(body) > 0 {
+                n := int(binary.BigEndian.Uint16(body))
+                topic := string(body[2 : 2+n])
+                c.qos = body[2+n]
+                mb.subs[topic] = append(mb.subs[topic], c)
+                ack = append(ack, c.qos)
+                body = body[3+n:]
+            }
+            mb.lock.Unlock()
+            c.send(MQTT_SUBACK<<4, ack)
+        case MQTT_PUBLISH:
+            qos := (p.flags >> 1) & 0x03
+            n := int(binary.BigEndian.Uint16(p.body))
+            topic := string(p.body[2 : 2+n])
+            pos := 2 + n
+            if qos > 0 {
+                pos += 2
+            }
+            mb.deliver(topic, p.body[pos:])
+            switch qos {
+            case 1:
+                c.send(MQTT_PUBACK<<4, p.body[pos-2:pos])
+            case 2:
+                c.send(MQTT_PUBREC<<4, p.body[pos-2:pos])
+            }
+        case MQTT_PUBREL:
+            c.send(MQTT_PUBCOMP<<4, p.body)
+        case MQTT_PUBREC:
+            c.send(MQTT_PUBREL<<4|0x02, p.body)
+        case MQTT_PUBACK, MQTT_PUBCOMP:
+            atomic.AddInt64(&mb.acks, 1)
+        case MQTT_PINGREQ:
+            c.send(MQTT_PINGRESP<<4, nil)
+        }
+    }
+}
+
+func (mb *mqttBroker) deliver(topic string, payload []byte) {
+    mb.lock.Lock()
+    subs := mb.subs[topic]
+    mb.lock.Unlock()
+    for _, c := range subs {
+        var body bytes.Buffer
+        writeMqttString(&body, topic)
+        c.lock.Lock()
+        if c.qos > 0 {
+            c.id++
+            binary.Write(&body, binary.BigEndian, c.id)
+        }
+        c.lock.Unlock()
+        body.Write(payload)
+        c.send(MQTT_PUBLISH<<4|c.qos<<1, body.Bytes())
+    }
+}
+
+func startMqttBroker(t *testing.T) (net.Listener, *mqttBroker) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    mb := &mqttBroker{subs: make(map[string][]*mqttClient)}
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go mb.serve(conn)
+        }
+    }()
+    return ln, mb
+}
+
+//测试MQTT插件：QoS 0/1/2的应答流程，发布者到订阅者的端到端延迟，按主题统计
+func TestMqttPlugin(t *testing.T) {
+    for _, qos := range []int{0, 1, 2} {
+        ln, mb := startMqttBroker(t)
+        plg, err := NewTcpMqttPlugin(&MqttSpec{
+            Topics      : []string{"sensors/temp", "sensors/humidity"},
+            Qos         : qos,
+            PayloadSize : "uniform:8-128",
+            Publishers  : 1,
+            Subscribers : 1,
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        result_chan := make(chan *unicorn.CallResult, 50)
+        unc, err := unicorn.NewUnicorn(ln.Addr().String(), plg, 500*time.Millisecond, 0, 300*time.Millisecond, 4, true, result_chan)
+        if err != nil {
+            t.Fatalf("Unicorn initialization failing: %s.\n", err)
+        }
+        wg := unc.Start()
+        count_map := make(map[string]int)
+        for ret := range result_chan {
+            if ret.Code != unicorn.RESULT_CODE_SUCCESS && ret.Code != unicorn.RESULT_CODE_WARING_TIMEOUT {
+                t.Errorf("QoS %d: %s %s\n", qos, ret.Type, ret.Msg)
+            }
+            count_map[ret.Type]++
+        }
+        wg.Wait()
+        ln.Close()
+
+        report := plg.(unicorn.ReporterIntfs).Report()
+        t.Logf("QoS %d: %v\n%s", qos, count_map, report)
+        if count_map[MQTT_CONNECT_TYPE] == 0 || count_map[MQTT_SUBSCRIBE_TYPE] == 0 ||
+            count_map[MQTT_PUBLISH_TYPE] == 0 || count_map[MQTT_RECEIVE_TYPE] == 0 {
+            t.Fatalf("QoS %d: unexpected requests %v\n", qos, count_map)
+        }
+        if (count_map[MQTT_PUBREL_TYPE] > 0) != (qos == 2) {
+            t.Fatalf("QoS %d: unexpected PUBREL count %d\n", qos, count_map[MQTT_PUBREL_TYPE])
+        }
+        if (atomic.LoadInt64(&mb.acks) > 0) != (qos > 0) {
+            t.Fatalf("QoS %d: unexpected subscriber acks %d\n", qos, mb.acks)
+        }
+        tmp := plg.(*TcpMqttPlugin)
+        for _, topic := range []string{"sensors/temp", "sensors/humidity"} {
+            stat := tmp.stats[topic]
+            if stat == nil || stat.published == 0 || stat.received == 0 || stat.maxLat <= 0 {
+                t.Fatalf("QoS %d: bad stat of %s: %+v\n", qos, topic, stat)
+            }
+        }
+        if !strings.Contains(report, "end-to-end latency") {
+            t.Fatalf("Unexpected report: %s\n", report)
+        }
+    }
+
+    if _, err := NewTcpMqttPlugin(&MqttSpec{Topics: []string{"a/#"}}); err == nil {
+        t.Fatal("Wildcard topic should fail")
+    }
+    if _, err := NewTcpMqttPlugin(&MqttSpec{Topics: []string{"a"}, Qos: 3}); err == nil {
+        t.Fatal("QoS 3 should fail")
+    }
+}
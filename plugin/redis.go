@@ -0,0 +1,396 @@
+package plugin
+/*
+ * plugin
+ * Redis插件（RESP2/RESP3）
+ * 按权重混合多种命令，key在指定的key空间内随机选择，value的大小按分布生成
+ * 一个请求中可以包含多个流水线（pipeline）命令，同一个请求中的命令相同，请求的Type为命令名，报告据此按命令分类
+ * RESP3或者需要认证时，每个连接先发送HELLO/AUTH，连接上的会话不会自己结束，可以用-R/-L限制连接的寿命
+ *
+ * 示例（YAML）：
+ *   commands: {GET: 70, SET: 20, INCR: 5, LPUSH: 5}
+ *   key_space: 100000
+ *   key_prefix: "unicorn:"
+ *   value_size: uniform:16-1024
+ *   pipeline: 10
+ *   protocol: 3
+ */
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "math/rand"
+    "sort"
+    "strconv"
+    "strings"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+const (
+    REDIS_DEFAULT_KEY_SPACE  = 10000
+    REDIS_DEFAULT_KEY_PREFIX = "unicorn:"
+    REDIS_DEFAULT_VALUE_SIZE = "fixed:64"
+    REDIS_HASH_FIELDS        = 10       //hash类型的key中的field数量
+    REDIS_HELLO_TYPE         = "HELLO"  //连接建立之后的HELLO/AUTH请求的类型
+    RESP_MAX_LINE            = 64 * 1024
+    RESP_MAX_ELEMENTS        = 1 << 24
+)
+
+//回复的类别
+const (
+    REPLY_STATUS = 1 << iota //+
+    REPLY_INT                //:
+    REPLY_BULK               //$ =
+    REPLY_ARRAY              //* ~ %
+    REPLY_NULL               //_ 以及RESP2的$-1、*-1
+)
+
+//Redis插件描述
+type RedisSpec struct {
+    Commands  map[string]int `json:"commands"   yaml:"commands"`   //命令 -> 权重，默认GET:80, SET:20
+    KeySpace  int            `json:"key_space"  yaml:"key_space"`  //key的数量，默认10000
+    KeyPrefix string         `json:"key_prefix" yaml:"key_prefix"` //key的前缀，默认unicorn:
+    ValueSize string         `json:"value_size" yaml:"value_size"` //value的大小分布，默认fixed:64
+    Pipeline  int            `json:"pipeline"   yaml:"pipeline"`   //每个请求中的命令数，默认1
+    Protocol  int            `json:"protocol"   yaml:"protocol"`   //RESP版本：2或者3，默认2
+    User      string         `json:"user"       yaml:"user"`       //ACL用户，为空则是default
+    Password  string         `json:"password"   yaml:"password"`
+}
+
+//支持的命令
+type redisCommand struct {
+    kind  string //key的类别，不同类别的key互不重叠，避免WRONGTYPE错误
+    value bool   //是否需要value
+    reply int    //期望的回复类别
+}
+
+var redisCommands = map[string]redisCommand{
+    "PING"    : {"", false, REPLY_STATUS},
+    "GET"     : {"str", false, REPLY_BULK | REPLY_NULL},
+    "SET"     : {"str", true, REPLY_STATUS},
+    "DEL"     : {"str", false, REPLY_INT},
+    "EXISTS"  : {"str", false, REPLY_INT},
+    "INCR"    : {"cnt", false, REPLY_INT},
+    "DECR"    : {"cnt", false, REPLY_INT},
+    "LPUSH"   : {"list", true, REPLY_INT},
+    "RPUSH"   : {"list", true, REPLY_INT},
+    "LPOP"    : {"list", false, REPLY_BULK | REPLY_NULL},
+    "RPOP"    : {"list", false, REPLY_BULK | REPLY_NULL},
+    "LRANGE"  : {"list", false, REPLY_ARRAY},
+    "SADD"    : {"set", true, REPLY_INT},
+    "SPOP"    : {"set", false, REPLY_BULK | REPLY_NULL},
+    "HSET"    : {"hash", true, REPLY_INT},
+    "HGET"    : {"hash", false, REPLY_BULK | REPLY_NULL},
+    "HGETALL" : {"hash", false, REPLY_ARRAY},
+}
+
+//一个RESP值
+type respReply struct {
+    typ  byte
+    line string //简单字符串、错误、数字的内容，或者bulk的内容
+}
+
+type TcpRedisPlugin struct {
+    names     []string //命令名，下标和picker对应
+    picker    *weightedPicker
+    keySpace  int
+    keyPrefix string
+    valueSize SizeDist
+    pipeline  int
+    protocol  int
+    hello     []byte   //连接建立之后的HELLO/AUTH，为空则不需要
+}
+
+//RESP3或者需要认证时的会话插件，每个连接先发送HELLO/AUTH
+type TcpRedisSessionPlugin struct {
+    *TcpRedisPlugin
+}
+
+type redisSession struct {
+    *TcpRedisPlugin
+    ready bool //HELLO/AUTH已经发送
+}
+
+//从文件加载Redis插件描述
+func LoadRedisSpec(path string) (*RedisSpec, error) {
+    var spec RedisSpec
+    if err := unmarshalFile(path, &spec); err != nil {
+        return nil, fmt.Errorf("Redis spec %s: %s", path, err)
+    }
+    return &spec, nil
+}
+
+//*TcpRedisPlugin实现PluginIntfs接口
+//生成请求：按权重选择命令，生成pipeline个
+func (trp *TcpRedisPlugin) GenRequest(id int64) unicorn.RawRequest {
+    name := trp.names[trp.picker.Pick()]
+    var buff bytes.Buffer
+    for i := 0; i < trp.pipeline; i++ {
+        writeRespCommand(&buff, trp.args(name))
+    }
+    return unicorn.RawRequest{Id: id, Req: buff.Bytes(), Type: name}
+}
+
+//命令的参数
+func (trp *TcpRedisPlugin) args(name string) [][]byte {
+    cmd := redisCommands[name]
+    if cmd.kind == "" {
+        return [][]byte{[]byte(name)}
+    }
+    key := []byte(trp.keyPrefix + cmd.kind + ":" + strconv.Itoa(rand.Intn(trp.keySpace)))
+    field := []byte("f" + strconv.Itoa(rand.Intn(REDIS_HASH_FIELDS)))
+    switch name {
+    case "LRANGE":
+        return [][]byte{[]byte(name), key, []byte("0"), []byte("9")}
+    case "HSET":
+        return [][]byte{[]byte(name), key, field, randPayload(trp.valueSize.Next())}
+    case "HGET":
+        return [][]byte{[]byte(name), key, field}
+    }
+    if cmd.value {
+        return [][]byte{[]byte(name), key, randPayload(trp.valueSize.Next())}
+    }
+    return [][]byte{[]byte(name), key}
+}
+
+//请求中的命令数，即期望的回复数
+func (trp *TcpRedisPlugin) replies(typ string) int {
+    if typ == REDIS_HELLO_TYPE {
+        return 1
+    }
+    return trp.pipeline
+}
+
+//check服务端返回是否能够构成一个完整包
+func (trp *TcpRedisPlugin) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    _, status := parseRespReplies(response, trp.replies(raw_req.Type))
+    return status
+}
+
+//校验服务端返回是否符合预期：不能有错误回复，回复的类别和命令相符
+func (trp *TcpRedisPlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    replies, status := parseRespReplies(response, trp.replies(raw_req.Type))
+    if status != unicorn.SER_OK {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "Malformed RESP reply"
+    }
+    expect := redisCommands[raw_req.Type].reply
+    if raw_req.Type == REDIS_HELLO_TYPE {
+        expect = REPLY_STATUS
+        if trp.protocol == 3 {
+            expect = REPLY_ARRAY
+        }
+    }
+    for _, r := range replies {
+        if r.typ == '-' || r.typ == '!' {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, "Error reply: " + r.line
+        }
+        if replyClass(r.typ) & expect == 0 {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, fmt.Sprintf("Unexpected reply type '%c' to %s", r.typ, raw_req.Type)
+        }
+    }
+    return unicorn.RESULT_CODE_SUCCESS, "Success"
+}
+
+//*TcpRedisSessionPlugin实现SessionFactoryIntfs接口
+func (trsp *TcpRedisSessionPlugin) NewSession() unicorn.SessionIntfs {
+    return &redisSession{TcpRedisPlugin: trsp.TcpRedisPlugin}
+}
+
+//会话的第一个请求是HELLO/AUTH
+func (rs *redisSession) GenRequest(id int64) unicorn.RawRequest {
+    if !rs.ready {
+        rs.ready = true
+        return unicorn.RawRequest{Id: id, Req: rs.hello, Type: REDIS_HELLO_TYPE}
+    }
+    return rs.TcpRedisPlugin.GenRequest(id)
+}
+
+func (rs *redisSession) Done() bool {
+    return false
+}
+
+//把命令编码成RESP数组
+func writeRespCommand(buff *bytes.Buffer, args [][]byte) {
+    fmt.Fprintf(buff, "*%d\r\n", len(args))
+    for _, arg := range args {
+        fmt.Fprintf(buff, "$%d\r\n", len(arg))
+        buff.Write(arg)
+        buff.WriteString("\r\n")
+    }
+}
+
+//回复的类别
+func replyClass(typ byte) int {
+    switch typ {
+    case '+':
+        return REPLY_STATUS
+    case ':':
+        return REPLY_INT
+    case '$', '=':
+        return REPLY_BULK
+    case '*', '~', '%':
+        return REPLY_ARRAY
+    case '_':
+        return REPLY_NULL
+    }
+    return 0
+}
+
+//解析count个回复，跳过RESP3的推送消息。同步交互，回复之后不应该有多余的数据
+func parseRespReplies(data []byte, count int) ([]*respReply, unicorn.ServerRespStatus) {
+    replies := make([]*respReply, 0, count)
+    pos := 0
+    for len(replies) < count {
+        r, next, status := parseResp(data, pos)
+        if status != unicorn.SER_OK {
+            return nil, status
+        }
+        pos = next
+        if r.typ != '>' {
+            replies = append(replies, r)
+        }
+    }
+    if pos != len(data) {
+        return nil, unicorn.SER_ERROR
+    }
+    return replies, unicorn.SER_OK
+}
+
+//从pos开始增量解析一个RESP值，返回值以及结束位置；聚合类型只返回类型，元素被跳过
+//RESP3的属性（|）对调用方透明，返回的是属性之后的值
+func parseResp(data []byte, pos int) (*respReply, int, unicorn.ServerRespStatus) {
+    if pos >= len(data) {
+        return nil, 0, unicorn.SER_NEEDMORE
+    }
+    i := bytes.Index(data[pos:], crlf)
+    if i < 0 {
+        if len(data)-pos > RESP_MAX_LINE {
+            return nil, 0, unicorn.SER_ERROR
+        }
+        return nil, 0, unicorn.SER_NEEDMORE
+    }
+    typ, line, next := data[pos], string(data[pos+1:pos+i]), pos+i+2
+
+    switch typ {
+    case '+', '-', ':', '_', ',', '#', '(':
+        return &respReply{typ: typ, line: line}, next, unicorn.SER_OK
+
+    case '$', '!', '=':
+        n, err := strconv.Atoi(line)
+        if err != nil || n < -1 || n > SIZE_MAX*4 || n == -1 && typ != '$' {
+            return nil, 0, unicorn.SER_ERROR
+        }
+        if n == -1 {
+            return &respReply{typ: '_'}, next, unicorn.SER_OK
+        }
+        if len(data)-next < n+2 {
+            return nil, 0, unicorn.SER_NEEDMORE
+        }
+        if !bytes.Equal(data[next+n:next+n+2], crlf) {
+            return nil, 0, unicorn.SER_ERROR
+        }
+        return &respReply{typ: typ, line: string(data[next : next+n])}, next + n + 2, unicorn.SER_OK
+
+    case '*', '~', '>', '%', '|':
+        n, err := strconv.Atoi(line)
+        if err != nil || n < -1 || n > RESP_MAX_ELEMENTS || n == -1 && typ != '*' {
+            return nil, 0, unicorn.SER_ERROR
+        }
+        if n == -1 {
+            return &respReply{typ: '_'}, next, unicorn.SER_OK
+        }
+        if typ == '%' || typ == '|' {
+            n *= 2 //map和属性的元素是key-value对
+        }
+        for k := 0; k < n; k++ {
+            var status unicorn.ServerRespStatus
+            if _, next, status = parseResp(data, next); status != unicorn.SER_OK {
+                return nil, 0, status
+            }
+        }
+        if typ == '|' {
+            return parseResp(data, next)
+        }
+        return &respReply{typ: typ, line: line}, next, unicorn.SER_OK
+    }
+    return nil, 0, unicorn.SER_ERROR
+}
+
+//New函数，创建Redis插件，它是PluginIntfs的一个实现；RESP3或者需要认证时，是SessionFactoryIntfs的实现
+func NewTcpRedisPlugin(spec *RedisSpec) (unicorn.PluginIntfs, error) {
+    trp := &TcpRedisPlugin{
+        keySpace  : spec.KeySpace,
+        keyPrefix : spec.KeyPrefix,
+        pipeline  : spec.Pipeline,
+        protocol  : spec.Protocol,
+    }
+    if trp.keySpace == 0 {
+        trp.keySpace = REDIS_DEFAULT_KEY_SPACE
+    }
+    if trp.keyPrefix == "" {
+        trp.keyPrefix = REDIS_DEFAULT_KEY_PREFIX
+    }
+    if trp.pipeline == 0 {
+        trp.pipeline = 1
+    }
+    if trp.protocol == 0 {
+        trp.protocol = 2
+    }
+    if trp.keySpace < 0 || trp.pipeline < 0 {
+        return nil, errors.New("Redis: negative key space or pipeline")
+    }
+    if trp.protocol != 2 && trp.protocol != 3 {
+        return nil, fmt.Errorf("Redis: unknown protocol %d", trp.protocol)
+    }
+    valueSize := spec.ValueSize
+    if valueSize == "" {
+        valueSize = REDIS_DEFAULT_VALUE_SIZE
+    }
+    var err error
+    if trp.valueSize, err = ParseSizeDist(valueSize); err != nil {
+        return nil, err
+    }
+
+    //命令混合，按名字排序，保证结果可以复现
+    commands := spec.Commands
+    if len(commands) == 0 {
+        commands = map[string]int{"GET": 80, "SET": 20}
+    }
+    for name := range commands {
+        if _, ok := redisCommands[strings.ToUpper(name)]; !ok {
+            return nil, fmt.Errorf("Redis: unsupported command %s", name)
+        }
+        trp.names = append(trp.names, name)
+    }
+    sort.Strings(trp.names)
+    weights := make([]int, len(trp.names))
+    for i, name := range trp.names {
+        weights[i] = commands[name]
+        trp.names[i] = strings.ToUpper(name)
+    }
+    if trp.picker, err = newWeightedPicker(weights); err != nil {
+        return nil, fmt.Errorf("Redis: %s", err)
+    }
+
+    //HELLO/AUTH
+    var hello [][]byte
+    user := spec.User
+    if user == "" {
+        user = "default"
+    }
+    if trp.protocol == 3 {
+        hello = [][]byte{[]byte("HELLO"), []byte("3")}
+        if spec.Password != "" {
+            hello = append(hello, []byte("AUTH"), []byte(user), []byte(spec.Password))
+        }
+    } else if spec.Password != "" {
+        hello = [][]byte{[]byte("AUTH"), []byte(user), []byte(spec.Password)}
+    }
+    if hello == nil {
+        return trp, nil
+    }
+    var buff bytes.Buffer
+    writeRespCommand(&buff, hello)
+    trp.hello = buff.Bytes()
+    return &TcpRedisSessionPlugin{TcpRedisPlugin: trp}, nil
+}
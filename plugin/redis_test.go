@@ -0,0 +1,212 @@
+package plugin
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//测试RESP解析：逐字节喂入，完整之前都是SER_NEEDMORE
+func TestRespParse(t *testing.T) {
+    stream := "+OK\r\n" +
+        ":42\r\n" +
+        "$5\r\nhello\r\n" +
+        "$-1\r\n" +
+        "*2\r\n$1\r\na\r\n*1\r\n:1\r\n" +
+        ">2\r\n+invalidate\r\n*0\r\n" + //推送消息不计数
+        "|1\r\n+ttl\r\n:3600\r\n%1\r\n+k\r\n=7\r\ntxt:abc\r\n" +
+        "_\r\n" +
+        "-ERR wrong\r\n"
+    types := "+:$_*%_-"
+    for i := 0; i < len(stream); i++ {
+        if _, s := parseRespReplies([]byte(stream[:i]), len(types)); s != unicorn.SER_NEEDMORE {
+            t.Fatalf("Prefix %d: got %d\n", i, s)
+        }
+    }
+    replies, s := parseRespReplies([]byte(stream), len(types))
+    if s != unicorn.SER_OK {
+        t.Fatalf("Expected SER_OK, got %d\n", s)
+    }
+    for i, r := range replies {
+        if r.typ != types[i] {
+            t.Fatalf("Reply %d: expected '%c', got '%c'\n", i, types[i], r.typ)
+        }
+    }
+    if replies[2].line != "hello" || replies[7].line != "ERR wrong" {
+        t.Fatalf("Unexpected replies: %v, %v\n", replies[2], replies[7])
+    }
+
+    for _, bad := range []string{"?what\r\n", "$3\r\nabcd\r\n", "*x\r\n", "+OK\r\n+OK\r\n"} {
+        if _, s := parseRespReplies([]byte(bad), 1); s != unicorn.SER_ERROR {
+            t.Fatalf("%q: expected SER_ERROR, got %d\n", bad, s)
+        }
+    }
+}
+
+//进程内的Redis服务端，只实现测试用到的命令
+type fakeRedis struct {
+    lock  sync.Mutex
+    strs  map[string]string
+    lists map[string][]string
+}
+
+//读取一个命令
+func readRespCommand(r *bufio.Reader) ([]string, error) {
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+    if err != nil || line[0] != '*' {
+        return nil, fmt.Errorf("Bad command: %q", line)
+    }
+    args := make([]string, n)
+    for i := range args {
+        if line, err = r.ReadString('\n'); err != nil {
+            return nil, err
+        }
+        size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+        buf := make([]byte, size+2)
+        if _, err = io.ReadFull(r, buf); err != nil {
+            return nil, err
+        }
+        args[i] = string(buf[:size])
+    }
+    return args, nil
+}
+
+func (fr *fakeRedis) exec(args []string, resp3 bool) string {
+    fr.lock.Lock()
+    defer fr.lock.Unlock()
+    null := "$-1\r\n"
+    if resp3 {
+        null = "_\r\n"
+    }
+    switch strings.ToUpper(args[0]) {
+    case "HELLO":
+        return "%1\r\n+server\r\n+fake\r\n"
+    case "PING":
+        return "+PONG\r\n"
+    case "SET":
+        fr.strs[args[1]] = args[2]
+        return "+OK\r\n"
+    case "GET":
+        v, ok := fr.strs[args[1]]
+        if !ok {
+            return null
+        }
+        return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+    case "INCR":
+        n, _ := strconv.Atoi(fr.strs[args[1]])
+        fr.strs[args[1]] = strconv.Itoa(n + 1)
+        return fmt.Sprintf(":%d\r\n", n+1)
+    case "LPUSH":
+        fr.lists[args[1]] = append(fr.lists[args[1]], args[2])
+        return fmt.Sprintf(":%d\r\n", len(fr.lists[args[1]]))
+    case "LRANGE":
+        l := fr.lists[args[1]]
+        if len(l) > 10 {
+            l = l[:10]
+        }
+        reply := fmt.Sprintf("*%d\r\n", len(l))
+        for _, v := range l {
+            reply += fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+        }
+        return reply
+    }
+    return "-ERR unknown command\r\n"
+}
+
+//启动服务端：回复分两次写出，检验增量解析
+func startFakeRedis(t *testing.T) net.Listener {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    fr := &fakeRedis{strs: make(map[string]string), lists: make(map[string][]string)}
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                r := bufio.NewReader(conn)
+                resp3 := false
+                for {
+                    args, err := readRespCommand(r)
+                    if err != nil {
+                        return
+                    }
+                    if strings.ToUpper(args[0]) == "HELLO" {
+                        resp3 = args[1] == "3"
+                    }
+                    reply := fr.exec(args, resp3)
+                    half := len(reply) / 2
+                    conn.Write([]byte(reply[:half]))
+                    conn.Write([]byte(reply[half:]))
+                }
+            }()
+        }
+    }()
+    return ln
+}
+
+//测试Redis插件：RESP2以及RESP3，命令混合，流水线
+func TestRedisPlugin(t *testing.T) {
+    ln := startFakeRedis(t)
+    defer ln.Close()
+
+    for _, protocol := range []int{2, 3} {
+        plg, err := NewTcpRedisPlugin(&RedisSpec{
+            Commands  : map[string]int{"get": 40, "SET": 30, "INCR": 10, "LPUSH": 10, "LRANGE": 10},
+            KeySpace  : 100,
+            ValueSize : "uniform:1-256",
+            Pipeline  : 5,
+            Protocol  : protocol,
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, ok := plg.(unicorn.SessionFactoryIntfs); ok != (protocol == 3) {
+            t.Fatalf("RESP%d: session factory mismatch\n", protocol)
+        }
+
+        result_chan := make(chan *unicorn.CallResult, 50)
+        unc, err := unicorn.NewUnicorn(ln.Addr().String(), plg, 500*time.Millisecond, 0, 300*time.Millisecond, 2, true, result_chan)
+        if err != nil {
+            t.Fatalf("Unicorn initialization failing: %s.\n", err)
+        }
+        wg := unc.Start()
+        count_map := make(map[string]int)
+        for ret := range result_chan {
+            if ret.Code != unicorn.RESULT_CODE_SUCCESS {
+                t.Errorf("RESP%d: %s %s\n", protocol, ret.Type, ret.Msg)
+            }
+            count_map[ret.Type]++
+        }
+        wg.Wait()
+
+        t.Logf("RESP%d: %v\n", protocol, count_map)
+        for _, typ := range []string{"GET", "SET", "INCR", "LPUSH", "LRANGE"} {
+            if count_map[typ] == 0 {
+                t.Fatalf("RESP%d: no %s\n", protocol, typ)
+            }
+        }
+        if protocol == 3 && count_map[REDIS_HELLO_TYPE] != 2 {
+            t.Fatalf("RESP3: expected 2 HELLO, got %d\n", count_map[REDIS_HELLO_TYPE])
+        }
+    }
+
+    if _, err := NewTcpRedisPlugin(&RedisSpec{Commands: map[string]int{"FLUSHALL": 1}}); err == nil {
+        t.Fatal("Unsupported command should fail")
+    }
+}
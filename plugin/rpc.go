@@ -0,0 +1,394 @@
+package plugin
+/*
+ * plugin
+ * 通用的二进制RPC插件：定长头部 + 二进制body
+ * 头部的布局在描述文件中配置：头部长度、字节序，以及各个字段的偏移和长度（1/2/4/8字节）：
+ *   magic/version：常量，请求中写入，响应中校验
+ *   id：请求ID，用于关联请求和响应
+ *   length：body的长度（length_includes_header为true时是整个包的长度）
+ *   method：可选，方法编号
+ *   status：可选，响应的状态，非expect_status视为错误
+ * 方法按权重选择，body从fixture文件中随机选取（支持通配符，相对路径相对于描述文件所在目录）
+ * pipeline大于1时，一次发送多个请求，响应可以乱序返回，按ID关联，每个ID必须恰好有一个响应
+ * 请求的类型为方法名
+ *
+ * 示例（YAML）：
+ *   header:
+ *     size: 16
+ *     endian: big
+ *     magic:   {offset: 0, size: 2, value: 0xCAFE}
+ *     version: {offset: 2, size: 1, value: 1}
+ *     method:  {offset: 3, size: 1}
+ *     id:      {offset: 4, size: 8}
+ *     length:  {offset: 12, size: 4}
+ *     status:  {offset: 3, size: 1}   #响应中method的位置复用为状态
+ *   methods:
+ *     - {name: GetUser, code: 1, weight: 80, fixtures: [fixtures/get_user/*.bin]}
+ *     - {name: SetUser, code: 2, weight: 20, fixtures: [fixtures/set_user.bin]}
+ *   pipeline: 4
+ */
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "math/rand"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "sync/atomic"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+const (
+    RPC_ENDIAN_BIG    = "big"
+    RPC_ENDIAN_LITTLE = "little"
+    RPC_MAX_BODY      = 64 * 1024 * 1024 //响应body的最大长度
+)
+
+//RPC插件描述
+type RpcSpec struct {
+    Header   RpcHeader   `json:"header"   yaml:"header"`
+    Methods  []RpcMethod `json:"methods"  yaml:"methods"`
+    Pipeline int         `json:"pipeline" yaml:"pipeline"` //一次发送的请求数，默认1
+}
+
+//头部的布局
+type RpcHeader struct {
+    Size                 int      `json:"size"                   yaml:"size"`
+    Endian               string   `json:"endian"                 yaml:"endian"` //big（默认）或者little
+    Magic                RpcField `json:"magic"                  yaml:"magic"`
+    Version              RpcField `json:"version"                yaml:"version"`
+    Id                   RpcField `json:"id"                     yaml:"id"`
+    Length               RpcField `json:"length"                 yaml:"length"`
+    LengthIncludesHeader bool     `json:"length_includes_header" yaml:"length_includes_header"`
+    Method               RpcField `json:"method"                 yaml:"method"`
+    Status               RpcField `json:"status"                 yaml:"status"`
+}
+
+//头部的一个字段，size为0表示没有这个字段
+type RpcField struct {
+    Offset int    `json:"offset" yaml:"offset"`
+    Size   int    `json:"size"   yaml:"size"`
+    Value  uint64 `json:"value"  yaml:"value"` //magic/version的值
+}
+
+type RpcMethod struct {
+    Name         string   `json:"name"          yaml:"name"`
+    Code         uint64   `json:"code"          yaml:"code"`          //写入头部method字段的值
+    Weight       int      `json:"weight"        yaml:"weight"`
+    Fixtures     []string `json:"fixtures"      yaml:"fixtures"`      //body文件，支持通配符，为空表示body为空
+    ExpectStatus uint64   `json:"expect_status" yaml:"expect_status"` //期望的状态，默认0
+    ExpectBody   string   `json:"expect_body"   yaml:"expect_body"`   //可选：响应body需要匹配的正则
+}
+
+//一个包
+type rpcFrame struct {
+    id     uint64
+    status uint64
+    body   []byte
+}
+
+type rpcMethod struct {
+    name         string
+    code         uint64
+    bodies       [][]byte
+    expectStatus uint64
+    expectBody   *regexp.Regexp
+}
+
+type TcpRpcPlugin struct {
+    header   RpcHeader
+    order    binary.ByteOrder
+    methods  map[string]*rpcMethod
+    names    []string
+    picker   *weightedPicker
+    pipeline int
+    nextId   uint64
+}
+
+//从文件加载RPC插件描述，fixture的相对路径相对于描述文件所在目录
+func LoadRpcSpec(path string) (*RpcSpec, error) {
+    var spec RpcSpec
+    if err := unmarshalFile(path, &spec); err != nil {
+        return nil, fmt.Errorf("Rpc spec %s: %s", path, err)
+    }
+    dir := filepath.Dir(path)
+    for i := range spec.Methods {
+        for j, fixture := range spec.Methods[i].Fixtures {
+            if !filepath.IsAbs(fixture) {
+                spec.Methods[i].Fixtures[j] = filepath.Join(dir, fixture)
+            }
+        }
+    }
+    return &spec, nil
+}
+
+//*TcpRpcPlugin实现PluginIntfs接口
+//生成请求：按权重选择方法，生成pipeline个请求，每个请求有自己的ID
+func (trp *TcpRpcPlugin) GenRequest(id int64) unicorn.RawRequest {
+    method := trp.methods[trp.names[trp.picker.Pick()]]
+    var req []byte
+    for i := 0; i < trp.pipeline; i++ {
+        var body []byte
+        if len(method.bodies) > 0 {
+            body = method.bodies[rand.Intn(len(method.bodies))]
+        }
+        req = trp.appendFrame(req, atomic.AddUint64(&trp.nextId, 1), method.code, body)
+    }
+    return unicorn.RawRequest{Id: id, Req: req, Type: method.name}
+}
+
+//check服务端返回是否能够构成一个完整包：pipeline个响应
+func (trp *TcpRpcPlugin) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    _, status := trp.parseFrames(response, trp.pipeline)
+    return status
+}
+
+//校验服务端返回是否符合预期：按ID关联请求和响应
+func (trp *TcpRpcPlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    resps, status := trp.parseFrames(response, trp.pipeline)
+    if status != unicorn.SER_OK {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "Malformed rpc response"
+    }
+    reqs, _ := trp.parseFrames(raw_req.Req, trp.pipeline)
+    pending := make(map[uint64]bool, len(reqs))
+    for _, f := range reqs {
+        pending[f.id] = true
+    }
+
+    method := trp.methods[raw_req.Type]
+    for _, f := range resps {
+        if !pending[f.id] {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, fmt.Sprintf("Unexpected response id %d", f.id)
+        }
+        delete(pending, f.id)
+        if f.status != method.expectStatus {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, fmt.Sprintf("Status %d of id %d", f.status, f.id)
+        }
+        if method.expectBody != nil && !method.expectBody.Match(f.body) {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, fmt.Sprintf("Body mismatch of id %d: %.64q", f.id, f.body)
+        }
+    }
+    return unicorn.RESULT_CODE_SUCCESS, "Success"
+}
+
+//按布局编码一个包
+func (trp *TcpRpcPlugin) appendFrame(buf []byte, id, code uint64, body []byte) []byte {
+    h := &trp.header
+    header := make([]byte, h.Size)
+    length := uint64(len(body))
+    if h.LengthIncludesHeader {
+        length += uint64(h.Size)
+    }
+    trp.put(header, h.Magic, h.Magic.Value)
+    trp.put(header, h.Version, h.Version.Value)
+    trp.put(header, h.Method, code)
+    trp.put(header, h.Id, id)
+    trp.put(header, h.Length, length)
+    return append(append(buf, header...), body...)
+}
+
+//解析n个包，多余的数据视为错误
+func (trp *TcpRpcPlugin) parseFrames(data []byte, n int) ([]*rpcFrame, unicorn.ServerRespStatus) {
+    h := &trp.header
+    frames := make([]*rpcFrame, 0, n)
+    for len(frames) < n {
+        if len(data) < h.Size {
+            return nil, unicorn.SER_NEEDMORE
+        }
+        if h.Magic.Size > 0 && trp.get(data, h.Magic) != h.Magic.Value ||
+            h.Version.Size > 0 && trp.get(data, h.Version) != h.Version.Value {
+            return nil, unicorn.SER_ERROR
+        }
+        length := trp.get(data, h.Length)
+        if h.LengthIncludesHeader {
+            if length < uint64(h.Size) {
+                return nil, unicorn.SER_ERROR
+            }
+            length -= uint64(h.Size)
+        }
+        if length > RPC_MAX_BODY {
+            return nil, unicorn.SER_ERROR
+        }
+        total := h.Size + int(length)
+        if len(data) < total {
+            return nil, unicorn.SER_NEEDMORE
+        }
+        frames = append(frames, &rpcFrame{
+            id     : trp.get(data, h.Id),
+            status : trp.get(data, h.Status),
+            body   : data[h.Size:total],
+        })
+        data = data[total:]
+    }
+    if len(data) > 0 {
+        return nil, unicorn.SER_ERROR
+    }
+    return frames, unicorn.SER_OK
+}
+
+//写入一个字段，size为0的字段忽略，超出字段长度的高位被截断
+func (trp *TcpRpcPlugin) put(header []byte, f RpcField, v uint64) {
+    b := header[f.Offset : f.Offset+f.Size]
+    switch f.Size {
+    case 1:
+        b[0] = byte(v)
+    case 2:
+        trp.order.PutUint16(b, uint16(v))
+    case 4:
+        trp.order.PutUint32(b, uint32(v))
+    case 8:
+        trp.order.PutUint64(b, v)
+    }
+}
+
+//读取一个字段，size为0的字段为0
+func (trp *TcpRpcPlugin) get(header []byte, f RpcField) uint64 {
+    b := header[f.Offset : f.Offset+f.Size]
+    switch f.Size {
+    case 1:
+        return uint64(b[0])
+    case 2:
+        return uint64(trp.order.Uint16(b))
+    case 4:
+        return uint64(trp.order.Uint32(b))
+    case 8:
+        return trp.order.Uint64(b)
+    }
+    return 0
+}
+
+//检查字段的布局
+func checkRpcField(name string, f RpcField, headerSize int, required bool) error {
+    switch f.Size {
+    case 0:
+        if required {
+            return fmt.Errorf("Rpc: header field %s is required", name)
+        }
+        return nil
+    case 1, 2, 4, 8:
+    default:
+        return fmt.Errorf("Rpc: header field %s: size must be 1/2/4/8", name)
+    }
+    if f.Offset < 0 || f.Offset+f.Size > headerSize {
+        return fmt.Errorf("Rpc: header field %s out of header", name)
+    }
+    if f.Size < 8 && f.Value >= 1<<(8*uint(f.Size)) {
+        return fmt.Errorf("Rpc: value of header field %s overflows", name)
+    }
+    return nil
+}
+
+//加载方法的fixture
+func loadRpcFixtures(patterns []string) ([][]byte, error) {
+    var bodies [][]byte
+    for _, pattern := range patterns {
+        paths, err := filepath.Glob(pattern)
+        if err != nil {
+            return nil, err
+        }
+        if len(paths) == 0 {
+            return nil, fmt.Errorf("no fixture matches %s", pattern)
+        }
+        for _, path := range paths {
+            body, err := ioutil.ReadFile(path)
+            if err != nil {
+                return nil, err
+            }
+            bodies = append(bodies, body)
+        }
+    }
+    return bodies, nil
+}
+
+//New函数，创建TcpRpcPlugin，它是PluginIntfs的一个实现
+func NewTcpRpcPlugin(spec *RpcSpec) (unicorn.PluginIntfs, error) {
+    trp := &TcpRpcPlugin{
+        header   : spec.Header,
+        methods  : make(map[string]*rpcMethod),
+        pipeline : spec.Pipeline,
+        nextId   : uint64(rand.Uint32()),
+    }
+    if trp.pipeline == 0 {
+        trp.pipeline = 1
+    }
+    if trp.pipeline < 0 {
+        return nil, errors.New("Rpc: negative pipeline")
+    }
+
+    //头部
+    h := &trp.header
+    switch h.Endian {
+    case "", RPC_ENDIAN_BIG:
+        trp.order = binary.BigEndian
+    case RPC_ENDIAN_LITTLE:
+        trp.order = binary.LittleEndian
+    default:
+        return nil, fmt.Errorf("Rpc: unknown endian %s", h.Endian)
+    }
+    if h.Size <= 0 {
+        return nil, errors.New("Rpc: header size must be positive")
+    }
+    fields := []struct {
+        name     string
+        field    RpcField
+        required bool
+    }{
+        {"magic", h.Magic, false},
+        {"version", h.Version, false},
+        {"id", h.Id, true},
+        {"length", h.Length, true},
+        {"method", h.Method, false},
+        {"status", h.Status, false},
+    }
+    for _, f := range fields {
+        if err := checkRpcField(f.name, f.field, h.Size, f.required); err != nil {
+            return nil, err
+        }
+    }
+    //ID的长度决定了不会重复的请求数
+    if h.Id.Size < 8 {
+        trp.nextId &= 1<<(8*uint(h.Id.Size)) - 1
+    }
+
+    //方法，按名字排序，保证结果可以复现
+    if len(spec.Methods) == 0 {
+        return nil, errors.New("Rpc: no methods")
+    }
+    for _, m := range spec.Methods {
+        if m.Name == "" {
+            return nil, errors.New("Rpc: method without name")
+        }
+        if _, ok := trp.methods[m.Name]; ok {
+            return nil, fmt.Errorf("Rpc: duplicated method %s", m.Name)
+        }
+        method := &rpcMethod{name: m.Name, code: m.Code, expectStatus: m.ExpectStatus}
+        var err error
+        if method.bodies, err = loadRpcFixtures(m.Fixtures); err != nil {
+            return nil, fmt.Errorf("Rpc: method %s: %s", m.Name, err)
+        }
+        if m.ExpectBody != "" {
+            if method.expectBody, err = regexp.Compile(m.ExpectBody); err != nil {
+                return nil, fmt.Errorf("Rpc: method %s: %s", m.Name, err)
+            }
+        }
+        trp.methods[m.Name] = method
+        trp.names = append(trp.names, m.Name)
+    }
+    sort.Strings(trp.names)
+    weights := make([]int, len(trp.names))
+    for _, m := range spec.Methods {
+        weight := m.Weight
+        if len(spec.Methods) == 1 && weight == 0 {
+            weight = 1 //只有一个方法时可以不写权重
+        }
+        weights[sort.SearchStrings(trp.names, m.Name)] = weight
+    }
+    var err error
+    if trp.picker, err = newWeightedPicker(weights); err != nil {
+        return nil, fmt.Errorf("Rpc: %s", err)
+    }
+    return trp, nil
+}
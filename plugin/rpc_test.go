@@ -0,0 +1,148 @@
+package plugin
+
+import (
+    "encoding/binary"
+    "io"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//测试用的布局：4字节长度（包含头部）在最前面，小端
+const rpcTestSpec = `
+header:
+  size: 16
+  endian: little
+  length:  {offset: 0, size: 4}
+  magic:   {offset: 4, size: 2, value: 0xCAFE}
+  version: {offset: 6, size: 1, value: 2}
+  method:  {offset: 7, size: 1}
+  status:  {offset: 7, size: 1}
+  id:      {offset: 8, size: 8}
+  length_includes_header: true
+methods:
+  - {name: Get, code: 0, weight: 3, fixtures: [get/*.bin], expect_body: "^get-"}
+  - {name: Put, code: 0, weight: 1, fixtures: [put.bin]}
+pipeline: 4
+`
+
+//进程内的RPC服务端：每次读取batch个请求，倒序返回，body原样返回，状态为0
+func startRpcServer(t *testing.T, batch int) net.Listener {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                for {
+                    frames := make([][]byte, batch)
+                    for i := range frames {
+                        head := make([]byte, 4)
+                        if _, err := io.ReadFull(conn, head); err != nil {
+                            return
+                        }
+                        frame := make([]byte, binary.LittleEndian.Uint32(head))
+                        copy(frame, head)
+                        if _, err := io.ReadFull(conn, frame[4:]); err != nil {
+                            return
+                        }
+                        frame[7] = 0
+                        frames[i] = frame
+                    }
+                    for i := len(frames) - 1; i >= 0; i-- {
+                        conn.Write(frames[i][:10])
+                        conn.Write(frames[i][10:])
+                    }
+                }
+            }()
+        }
+    }()
+    return ln
+}
+
+//测试RPC插件：可配置的头部布局，fixture，流水线的乱序响应按ID关联
+func TestRpcPlugin(t *testing.T) {
+    dir, err := ioutil.TempDir("", "unicorn-rpc")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    os.Mkdir(filepath.Join(dir, "get"), 0700)
+    files := map[string]string{
+        "get/1.bin" : "get-\x00\x01",
+        "get/2.bin" : "get-" + strings.Repeat("\xff", 300),
+        "put.bin"   : "put-body",
+        "rpc.yaml"  : rpcTestSpec,
+    }
+    for name, content := range files {
+        if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    spec, err := LoadRpcSpec(filepath.Join(dir, "rpc.yaml"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    plg, err := NewTcpRpcPlugin(spec)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    //请求的编码：4个包，ID各不相同
+    trp := plg.(*TcpRpcPlugin)
+    req := plg.GenRequest(1)
+    frames, status := trp.parseFrames(req.Req, 4)
+    if status != unicorn.SER_OK || frames[0].id == frames[1].id || binary.LittleEndian.Uint16(req.Req[4:]) != 0xCAFE {
+        t.Fatalf("Bad request encoding: %d %x\n", status, req.Req[:16])
+    }
+    //响应缺一个，或者ID不对
+    if trp.CheckFull(&req, req.Req[:len(req.Req)-1]) != unicorn.SER_NEEDMORE {
+        t.Fatal("Expected SER_NEEDMORE")
+    }
+    wrong := append([]byte{}, req.Req...)
+    wrong[8]++
+    if code, _ := plg.CheckResponse(req, wrong); code != unicorn.RESULT_CODE_ERROR_RESPONSE {
+        t.Fatal("Wrong id should fail")
+    }
+
+    ln := startRpcServer(t, 4)
+    defer ln.Close()
+    result_chan := make(chan *unicorn.CallResult, 50)
+    unc, err := unicorn.NewUnicorn(ln.Addr().String(), plg, 500*time.Millisecond, 0, 300*time.Millisecond, 2, true, result_chan)
+    if err != nil {
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
+    }
+    wg := unc.Start()
+    count_map := make(map[string]int)
+    for ret := range result_chan {
+        if ret.Code != unicorn.RESULT_CODE_SUCCESS && ret.Code != unicorn.RESULT_CODE_WARING_TIMEOUT {
+            t.Errorf("%s: %s\n", ret.Type, ret.Msg)
+        }
+        count_map[ret.Type]++
+    }
+    wg.Wait()
+    t.Logf("%v\n", count_map)
+    if count_map["Get"] == 0 || count_map["Put"] == 0 || count_map["Get"] < count_map["Put"] {
+        t.Fatalf("Unexpected method mix: %v\n", count_map)
+    }
+
+    spec.Header.Id = RpcField{Offset: 14, Size: 4}
+    if _, err := NewTcpRpcPlugin(spec); err == nil {
+        t.Fatal("Field out of header should fail")
+    }
+    spec.Header.Id = RpcField{Offset: 8, Size: 3}
+    if _, err := NewTcpRpcPlugin(spec); err == nil {
+        t.Fatal("Field size 3 should fail")
+    }
+}
@@ -0,0 +1,327 @@
+package plugin
+/*
+ * plugin
+ * 场景文件插件
+ * 对于回显、算式这类简单的文本协议，不需要编写Go代码，用一个YAML/JSON场景文件描述即可：
+ * 请求模板及其变量、包的定界方式、以及对响应的断言，启动时编译成PluginIntfs的实现
+ *
+ * 示例（YAML）：
+ *   vars:
+ *     a: {type: int, min: 1, max: 1000}
+ *     b: {type: int, min: 1, max: 1000}
+ *   request: "{\"Id\":{{id}},\"Operands\":[{{a}},{{b}}],\"Operator\":\"+\"}\n"
+ *   framing: {type: delim, delim: "\n"}
+ *   expect:
+ *     - {type: regex, pattern: "^\\{.*\\}\n$"}
+ *     - {type: json, path: "Result", equals: "{{a}} + {{b}}"}
+ *   key: "{{a}}"   #可选：请求的key模板，负载均衡策略为hash时按key选择节点
+ */
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "github.com/hq-cml/unicorn-go/expr"
+    "github.com/hq-cml/unicorn-go/unicorn"
+    "gopkg.in/yaml.v2"
+)
+
+//定界方式
+const (
+    FRAMING_DELIM  = "delim"   //以定界符结尾即完整（默认，定界符默认为\n）
+    FRAMING_LENGTH = "length"  //固定长度
+    FRAMING_ECHO   = "echo"    //长度和请求相同
+)
+
+//断言方式
+const (
+    ASSERT_EXACT = "exact"  //响应和value模板的渲染结果完全相同
+    ASSERT_REGEX = "regex"  //响应匹配正则
+    ASSERT_JSON  = "json"   //响应是JSON，path处的值等于equals模板渲染后计算出的表达式
+)
+
+//场景描述
+type Scenario struct {
+    Vars    map[string]VarSpec `json:"vars"    yaml:"vars"`
+    Request string             `json:"request" yaml:"request"`
+    Framing ScenarioFraming    `json:"framing" yaml:"framing"`
+    Expect  []ScenarioAssert   `json:"expect"  yaml:"expect"`
+    Key     string             `json:"key"     yaml:"key"`
+}
+
+type ScenarioFraming struct {
+    Type   string `json:"type"   yaml:"type"`
+    Delim  string `json:"delim"  yaml:"delim"`
+    Length int    `json:"length" yaml:"length"`
+}
+
+type ScenarioAssert struct {
+    Type    string `json:"type"    yaml:"type"`
+    Value   string `json:"value"   yaml:"value"`
+    Pattern string `json:"pattern" yaml:"pattern"`
+    Path    string `json:"path"    yaml:"path"`
+    Equals  string `json:"equals"  yaml:"equals"`
+}
+
+//编译后的断言
+type scenarioCheck struct {
+    typ     string
+    tpl     *Template       //exact的value，json的equals
+    re      *regexp.Regexp  //regex
+    path    []string        //json
+}
+
+type TcpScenarioPlugin struct {
+    vars    *VarSet
+    request *Template
+    key     *Template  //请求的key，可以为空
+    framing string
+    delim   []byte
+    length  int
+    checks  []scenarioCheck
+    needVal bool       //断言中是否引用了变量，如果没有，就不必在请求中保存变量取值
+}
+
+//从文件加载描述，.yaml/.yml按YAML解析，其他按JSON解析
+func unmarshalFile(path string, v interface{}) error {
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".yaml", ".yml":
+        return yaml.Unmarshal(content, v)
+    default:
+        return json.Unmarshal(content, v)
+    }
+}
+
+//从文件加载场景
+func LoadScenario(path string) (*Scenario, error) {
+    var sc Scenario
+    if err := unmarshalFile(path, &sc); err != nil {
+        return nil, fmt.Errorf("Scenario %s: %s", path, err)
+    }
+    return &sc, nil
+}
+
+//*TcpScenarioPlugin实现PluginIntfs接口
+//生成请求
+func (tsp *TcpScenarioPlugin) GenRequest(id int64) unicorn.RawRequest {
+    vals := tsp.vars.Gen(id)
+    raw_req := unicorn.RawRequest{Id: id, Req: []byte(tsp.request.Render(vals))}
+    if tsp.needVal {
+        raw_req.State = vals //变量取值随请求交给CheckResponse，超时或者出错的请求随之释放
+    }
+    if tsp.key != nil {
+        raw_req.Key = tsp.key.Render(vals)
+    }
+    return raw_req
+}
+
+//check服务端返回是否能够构成一个完整包
+func (tsp *TcpScenarioPlugin) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    var expect int
+    switch tsp.framing {
+    case FRAMING_DELIM:
+        if bytes.HasSuffix(response, tsp.delim) {
+            return unicorn.SER_OK
+        }
+        return unicorn.SER_NEEDMORE
+    case FRAMING_LENGTH:
+        expect = tsp.length
+    case FRAMING_ECHO:
+        expect = len(raw_req.Req)
+    }
+
+    if len(response) == expect {
+        return unicorn.SER_OK
+    } else if len(response) < expect {
+        return unicorn.SER_NEEDMORE
+    }
+    return unicorn.SER_ERROR
+}
+
+//校验服务端返回是否符合预期，断言依次检查，第一个失败的断言决定结果
+func (tsp *TcpScenarioPlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (code unicorn.ResultCode, msg string) {
+    var vals map[string]string
+    if tsp.needVal {
+        var ok bool
+        vals, ok = raw_req.State.(map[string]string)
+        if !ok {
+            code = unicorn.RESULT_CODE_FATAL_CALL
+            msg = fmt.Sprintf("Vars of request %d lost!\n", raw_req.Id)
+            return
+        }
+    }
+
+    for i, c := range tsp.checks {
+        if err := c.check(response, vals); err != nil {
+            code = unicorn.RESULT_CODE_ERROR_RESPONSE
+            msg = fmt.Sprintf("Assertion %d(%s) failed: %s!\n", i, c.typ, err)
+            return
+        }
+    }
+
+    code = unicorn.RESULT_CODE_SUCCESS
+    msg = fmt.Sprintf("Success.(%s)", string(response))
+    return
+}
+
+//执行一个断言
+func (c *scenarioCheck) check(response []byte, vals map[string]string) error {
+    switch c.typ {
+    case ASSERT_EXACT:
+        if expect := c.tpl.Render(vals); string(response) != expect {
+            return fmt.Errorf("%q != %q", string(response), expect)
+        }
+    case ASSERT_REGEX:
+        if !c.re.Match(response) {
+            return fmt.Errorf("%q not match %s", string(response), c.re.String())
+        }
+    case ASSERT_JSON:
+        dec := json.NewDecoder(bytes.NewReader(response))
+        dec.UseNumber() //保留数字的原文，大整数不丢精度
+        var doc interface{}
+        if err := dec.Decode(&doc); err != nil {
+            return fmt.Errorf("Bad json: %s", err)
+        }
+        actual, err := jsonLookup(doc, c.path)
+        if err != nil {
+            return err
+        }
+        return jsonEquals(actual, c.tpl.Render(vals))
+    }
+    return nil
+}
+
+//按照a.b.0.c形式的路径取值
+func jsonLookup(doc interface{}, path []string) (interface{}, error) {
+    cur := doc
+    for _, key := range path {
+        switch node := cur.(type) {
+        case map[string]interface{}:
+            v, ok := node[key]
+            if !ok {
+                return nil, fmt.Errorf("Path %s not found", strings.Join(path, "."))
+            }
+            cur = v
+        case []interface{}:
+            i, err := strconv.Atoi(key)
+            if err != nil || i < 0 || i >= len(node) {
+                return nil, fmt.Errorf("Bad index %s in path %s", key, strings.Join(path, "."))
+            }
+            cur = node[i]
+        default:
+            return nil, fmt.Errorf("Path %s not found", strings.Join(path, "."))
+        }
+    }
+    return cur, nil
+}
+
+//比较JSON中的值和期望值：期望值能作为表达式求值，则按数值比较，否则按字符串比较
+func jsonEquals(actual interface{}, expect string) error {
+    var actualStr string
+    switch v := actual.(type) {
+    case json.Number:
+        actualStr = v.String()
+    case string:
+        actualStr = v
+    case bool:
+        actualStr = strconv.FormatBool(v)
+    case nil:
+        actualStr = "null"
+    default:
+        b, _ := json.Marshal(v)
+        actualStr = string(b)
+    }
+
+    if ev, err := expr.Eval(expect); err == nil {
+        av, err := expr.Eval(actualStr)
+        if err != nil || !av.Equal(ev) {
+            return fmt.Errorf("%s != %s (%s)", actualStr, ev.String(), expect)
+        }
+        return nil
+    }
+    if actualStr != expect {
+        return fmt.Errorf("%q != %q", actualStr, expect)
+    }
+    return nil
+}
+
+//New函数，编译场景，创建TcpScenarioPlugin，它是PluginIntfs的一个实现
+func NewTcpScenarioPlugin(sc *Scenario) (unicorn.PluginIntfs, error) {
+    if sc.Request == "" {
+        return nil, errors.New("Scenario: empty request")
+    }
+    vars, err := NewVarSet(sc.Vars)
+    if err != nil {
+        return nil, err
+    }
+    tsp := &TcpScenarioPlugin{
+        vars : vars,
+    }
+    if tsp.request, err = CompileTemplate(sc.Request, vars.Has); err != nil {
+        return nil, err
+    }
+    if sc.Key != "" {
+        if tsp.key, err = CompileTemplate(sc.Key, vars.Has); err != nil {
+            return nil, err
+        }
+    }
+
+    //定界方式
+    switch sc.Framing.Type {
+    case "", FRAMING_DELIM:
+        tsp.framing = FRAMING_DELIM
+        tsp.delim = []byte(sc.Framing.Delim)
+        if len(tsp.delim) == 0 {
+            tsp.delim = []byte{DELIM}
+        }
+    case FRAMING_LENGTH:
+        if sc.Framing.Length <= 0 {
+            return nil, errors.New("Scenario: framing length must be positive")
+        }
+        tsp.framing = FRAMING_LENGTH
+        tsp.length = sc.Framing.Length
+    case FRAMING_ECHO:
+        tsp.framing = FRAMING_ECHO
+    default:
+        return nil, fmt.Errorf("Scenario: unknown framing %s", sc.Framing.Type)
+    }
+
+    //断言
+    for i, a := range sc.Expect {
+        c := scenarioCheck{typ: a.Type}
+        switch a.Type {
+        case ASSERT_EXACT:
+            c.tpl, err = CompileTemplate(a.Value, vars.Has)
+        case ASSERT_REGEX:
+            c.re, err = regexp.Compile(a.Pattern)
+        case ASSERT_JSON:
+            if a.Path == "" {
+                err = errors.New("empty path")
+                break
+            }
+            c.path = strings.Split(a.Path, ".")
+            c.tpl, err = CompileTemplate(a.Equals, vars.Has)
+        default:
+            err = fmt.Errorf("unknown type %s", a.Type)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("Scenario: expect %d: %s", i, err)
+        }
+        if c.tpl != nil && c.tpl.HasVar() {
+            tsp.needVal = true
+        }
+        tsp.checks = append(tsp.checks, c)
+    }
+
+    return tsp, nil
+}
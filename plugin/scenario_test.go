@@ -0,0 +1,259 @@
+package plugin
+
+import (
+    "io/ioutil"
+    "math"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//写一个临时文件，返回路径
+func writeTempFile(t *testing.T, dir, name, content string) string {
+    path := filepath.Join(dir, name)
+    if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+//测试场景文件的加载：YAML和JSON得到相同的场景
+func TestLoadScenario(t *testing.T) {
+    dir, err := ioutil.TempDir("", "unicorn-scenario")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    yamlPath := writeTempFile(t, dir, "sc.yaml", `
+vars:
+  a: {type: int, min: 1, max: 9}
+request: "{{a}}+{{a}}\n"
+framing: {type: length, length: 3}
+expect:
+  - {type: regex, pattern: "^[0-9]+$"}
+key: "{{a}}"
+`)
+    jsonPath := writeTempFile(t, dir, "sc.json", `{
+  "vars": {"a": {"type": "int", "min": 1, "max": 9}},
+  "request": "{{a}}+{{a}}\n",
+  "framing": {"type": "length", "length": 3},
+  "expect": [{"type": "regex", "pattern": "^[0-9]+$"}],
+  "key": "{{a}}"
+}`)
+    for _, path := range []string{yamlPath, jsonPath} {
+        sc, err := LoadScenario(path)
+        if err != nil {
+            t.Fatalf("%s: %s\n", path, err)
+        }
+        if sc.Vars["a"].Type != VAR_TYPE_INT || sc.Vars["a"].Max != 9 || sc.Request != "{{a}}+{{a}}\n" ||
+            sc.Framing.Type != FRAMING_LENGTH || sc.Framing.Length != 3 || len(sc.Expect) != 1 ||
+            sc.Expect[0].Pattern != "^[0-9]+$" || sc.Key != "{{a}}" {
+            t.Fatalf("%s: unexpected scenario %+v\n", path, sc)
+        }
+    }
+
+    bad := writeTempFile(t, dir, "bad.yaml", "vars: [1, 2\n")
+    if _, err := LoadScenario(bad); err == nil || !strings.Contains(err.Error(), bad) {
+        t.Fatalf("Expected error with file name, got %v\n", err)
+    }
+    if _, err := LoadScenario(filepath.Join(dir, "missing.json")); err == nil {
+        t.Fatal("Expected error for missing file")
+    }
+}
+
+//测试三种定界方式
+func TestScenarioFraming(t *testing.T) {
+    cases := []struct {
+        framing ScenarioFraming
+        request string
+        resp    string
+        expect  unicorn.ServerRespStatus
+    }{
+        {ScenarioFraming{}, "ping\n", "pong", unicorn.SER_NEEDMORE},
+        {ScenarioFraming{}, "ping\n", "pong\n", unicorn.SER_OK},
+        {ScenarioFraming{Type: FRAMING_DELIM, Delim: "\r\n"}, "ping", "pong\n", unicorn.SER_NEEDMORE},
+        {ScenarioFraming{Type: FRAMING_DELIM, Delim: "\r\n"}, "ping", "pong\r\n", unicorn.SER_OK},
+        {ScenarioFraming{Type: FRAMING_LENGTH, Length: 4}, "ping", "po", unicorn.SER_NEEDMORE},
+        {ScenarioFraming{Type: FRAMING_LENGTH, Length: 4}, "ping", "pong", unicorn.SER_OK},
+        {ScenarioFraming{Type: FRAMING_LENGTH, Length: 4}, "ping", "pongs", unicorn.SER_ERROR},
+        {ScenarioFraming{Type: FRAMING_ECHO}, "hello", "hell", unicorn.SER_NEEDMORE},
+        {ScenarioFraming{Type: FRAMING_ECHO}, "hello", "hello", unicorn.SER_OK},
+        {ScenarioFraming{Type: FRAMING_ECHO}, "hello", "hello!", unicorn.SER_ERROR},
+    }
+    for i, c := range cases {
+        plg, err := NewTcpScenarioPlugin(&Scenario{Request: c.request, Framing: c.framing})
+        if err != nil {
+            t.Fatalf("Case %d: %s\n", i, err)
+        }
+        raw_req := plg.GenRequest(1)
+        if s := plg.CheckFull(&raw_req, []byte(c.resp)); s != c.expect {
+            t.Fatalf("Case %d: expected %d, got %d\n", i, c.expect, s)
+        }
+    }
+
+    for _, framing := range []ScenarioFraming{{Type: FRAMING_LENGTH}, {Type: "http"}} {
+        if _, err := NewTcpScenarioPlugin(&Scenario{Request: "x", Framing: framing}); err == nil {
+            t.Fatalf("Expected error for framing %+v\n", framing)
+        }
+    }
+}
+
+//测试断言：exact、regex、json，分别通过和失败
+func TestScenarioAssert(t *testing.T) {
+    vars := map[string]VarSpec{"a": {Type: VAR_TYPE_SEQ, Start: 7}}
+    cases := []struct {
+        assert ScenarioAssert
+        resp   string
+        ok     bool
+    }{
+        {ScenarioAssert{Type: ASSERT_EXACT, Value: "got {{a}}\n"}, "got 7\n", true},
+        {ScenarioAssert{Type: ASSERT_EXACT, Value: "got {{a}}\n"}, "got 8\n", false},
+        {ScenarioAssert{Type: ASSERT_REGEX, Pattern: `^got \d+\n$`}, "got 7\n", true},
+        {ScenarioAssert{Type: ASSERT_REGEX, Pattern: `^got \d+\n$`}, "got x\n", false},
+        {ScenarioAssert{Type: ASSERT_JSON, Path: "Result", Equals: "{{a}} * 2"}, `{"Result": 14}`, true},
+        {ScenarioAssert{Type: ASSERT_JSON, Path: "Result", Equals: "{{a}} * 2"}, `{"Result": 15}`, false},
+        {ScenarioAssert{Type: ASSERT_JSON, Path: "data.1.name", Equals: "bob"}, `{"data": [{}, {"name": "bob"}]}`, true},
+        {ScenarioAssert{Type: ASSERT_JSON, Path: "data.2.name", Equals: "bob"}, `{"data": [{}, {"name": "bob"}]}`, false},
+        {ScenarioAssert{Type: ASSERT_JSON, Path: "Big", Equals: "123456789012345678901234567890"}, `{"Big": 123456789012345678901234567890}`, true},
+        {ScenarioAssert{Type: ASSERT_JSON, Path: "Result", Equals: "14"}, `not json`, false},
+    }
+    for i, c := range cases {
+        plg, err := NewTcpScenarioPlugin(&Scenario{Vars: vars, Request: "{{a}}\n", Expect: []ScenarioAssert{c.assert}})
+        if err != nil {
+            t.Fatalf("Case %d: %s\n", i, err)
+        }
+        raw_req := plg.GenRequest(1)
+        code, msg := plg.CheckResponse(raw_req, []byte(c.resp))
+        if (code == unicorn.RESULT_CODE_SUCCESS) != c.ok {
+            t.Fatalf("Case %d: expected ok=%v, got %d %s\n", i, c.ok, code, msg)
+        }
+        if !c.ok && code != unicorn.RESULT_CODE_ERROR_RESPONSE {
+            t.Fatalf("Case %d: expected response error, got %d\n", i, code)
+        }
+    }
+
+    //断言依次检查，第一个失败的断言决定结果
+    plg, err := NewTcpScenarioPlugin(&Scenario{Request: "x\n", Expect: []ScenarioAssert{
+        {Type: ASSERT_REGEX, Pattern: "^o"},
+        {Type: ASSERT_EXACT, Value: "no"},
+    }})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if code, msg := plg.CheckResponse(plg.GenRequest(1), []byte("no")); code != unicorn.RESULT_CODE_ERROR_RESPONSE || !strings.Contains(msg, "Assertion 0(regex)") {
+        t.Fatalf("Expected the first assertion to fail, got %d %s\n", code, msg)
+    }
+
+    for _, a := range []ScenarioAssert{
+        {Type: ASSERT_REGEX, Pattern: "("},
+        {Type: ASSERT_JSON, Equals: "1"},
+        {Type: ASSERT_EXACT, Value: "{{b}}"},
+        {Type: "xpath"},
+    } {
+        if _, err := NewTcpScenarioPlugin(&Scenario{Vars: vars, Request: "x", Expect: []ScenarioAssert{a}}); err == nil {
+            t.Fatalf("Expected error for assertion %+v\n", a)
+        }
+    }
+}
+
+//测试模板的编译以及渲染
+func TestTemplate(t *testing.T) {
+    has := func(name string) bool { return name == "a" || name == TEMPLATE_VAR_ID }
+    tpl, err := CompileTemplate("id={{ id }},a={{a}}{{a}}.", has)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if s := tpl.Render(map[string]string{"id": "1", "a": "x"}); s != "id=1,a=xx." || !tpl.HasVar() {
+        t.Fatalf("Unexpected render: %q\n", s)
+    }
+    if tpl, err = CompileTemplate("plain", has); err != nil || tpl.HasVar() || tpl.Render(nil) != "plain" {
+        t.Fatalf("Unexpected plain template: %v %v\n", tpl, err)
+    }
+
+    for _, bad := range []string{"{{a", "x {{b}} y", "{{}}"} {
+        if _, err := CompileTemplate(bad, has); err == nil {
+            t.Fatalf("%q: expected compile error\n", bad)
+        }
+    }
+    //不检查变量时，未声明的变量渲染为空
+    if tpl, err = CompileTemplate("[{{b}}]", nil); err != nil || tpl.Render(nil) != "[]" {
+        t.Fatalf("Unexpected unchecked template: %v %v\n", tpl, err)
+    }
+
+    for _, specs := range []map[string]VarSpec{
+        {"id": {Type: VAR_TYPE_INT}},
+        {"a": {Type: VAR_TYPE_INT, Min: 5, Max: 1}},
+        {"a": {Type: VAR_TYPE_STRING}},
+        {"a": {Type: VAR_TYPE_FILE, Path: "/nonexistent"}},
+        {"a": {Type: "uuid"}},
+    } {
+        if _, err := NewVarSet(specs); err == nil {
+            t.Fatalf("Expected error for vars %+v\n", specs)
+        }
+    }
+}
+
+//测试变量取值随请求保存在State中，交给CheckResponse
+func TestScenarioVars(t *testing.T) {
+    plg, err := NewTcpScenarioPlugin(&Scenario{
+        Vars    : map[string]VarSpec{"a": {Type: VAR_TYPE_INT, Min: 1, Max: 9}},
+        Request : "{{a}}\n",
+        Expect  : []ScenarioAssert{{Type: ASSERT_EXACT, Value: "{{a}}\n"}},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    raw_req := plg.GenRequest(1)
+    vals, ok := raw_req.State.(map[string]string)
+    if !ok || vals["a"]+"\n" != string(raw_req.Req) {
+        t.Fatalf("Expected vars in request state, got %+v\n", raw_req.State)
+    }
+    if code, msg := plg.CheckResponse(raw_req, raw_req.Req); code != unicorn.RESULT_CODE_SUCCESS {
+        t.Fatalf("Unexpected result: %d %s\n", code, msg)
+    }
+    raw_req.State = nil
+    if code, _ := plg.CheckResponse(raw_req, raw_req.Req); code != unicorn.RESULT_CODE_FATAL_CALL {
+        t.Fatalf("Expected fatal for lost vars, got %d\n", code)
+    }
+
+    //断言不引用变量时不保存
+    plg, err = NewTcpScenarioPlugin(&Scenario{
+        Vars    : map[string]VarSpec{"a": {Type: VAR_TYPE_INT, Min: 1, Max: 9}},
+        Request : "{{a}}\n",
+        Expect  : []ScenarioAssert{{Type: ASSERT_REGEX, Pattern: "^\\d\n$"}},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if raw_req = plg.GenRequest(2); raw_req.State != nil {
+        t.Fatalf("Unexpected state %+v\n", raw_req.State)
+    }
+}
+
+//测试随机整数的范围，包括超过int64的跨度以及整个int64的范围
+func TestIntVar(t *testing.T) {
+    for _, r := range [][2]int64{
+        {1, 3},
+        {-5, -5},
+        {-1, math.MaxInt64},
+        {math.MinInt64, 0},
+        {math.MinInt64, math.MaxInt64},
+    } {
+        v := &intVar{min: r[0], max: r[1]}
+        seen := make(map[int64]bool)
+        for i := 0; i < 1000; i++ {
+            n, err := strconv.ParseInt(v.Next(), 10, 64)
+            if err != nil || n < r[0] || n > r[1] {
+                t.Fatalf("[%d, %d]: got %d %v\n", r[0], r[1], n, err)
+            }
+            seen[n] = true
+        }
+        if span := uint64(r[1]-r[0]) + 1; span != 0 && span <= 3 && uint64(len(seen)) != span {
+            t.Fatalf("[%d, %d]: expected all values, got %v\n", r[0], r[1], seen)
+        }
+    }
+}
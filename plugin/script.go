@@ -0,0 +1,297 @@
+package plugin
+/*
+ * plugin
+ * send/expect脚本插件
+ * 类似expect，用脚本描述有状态的文本协议交互：发送字符串、带超时地等待匹配正则的响应、
+ * 把捕获组保存为变量、根据匹配结果跳转（分支/循环）。脚本按连接执行，每个连接各自维护
+ * 执行进度和变量，先登录后操作这类多步流程不需要再编写专门的插件
+ *
+ * 示例（YAML）：
+ *   session_vars:                  # 每个会话生成一次
+ *     user: {type: string, len: 8}
+ *   vars:                          # 每一步重新生成
+ *     key: {type: int, min: 1, max: 10000}
+ *   steps:
+ *     - label: login
+ *       send: "LOGIN {{user}}\n"
+ *       timeout: 1s
+ *       expect:
+ *         - {match: "^OK (\\w+)\n", capture: [token]}
+ *     - label: op
+ *       send: "GET {{token}} {{key}}\n"
+ *       expect:
+ *         - {match: "^VALUE .*\n"}
+ *         - {match: "^EXPIRED\n", goto: login}
+ *       loop: {goto: op, times: 100}
+ *     - send: "QUIT\n"
+ *       expect:
+ *         - {match: "^BYE\n", done: true}
+ *
+ * 每一步对应框架的一次交互：send为空表示不发送，直接等待服务端的数据
+ * 匹配的规则没有goto时，执行loop（如果有），否则顺序执行下一步；最后一步执行完，会话结束
+ * 响应按行判定：收到的数据以换行结尾仍然没有规则匹配，判定为错误的响应，不必等到超时；
+ * 响应有多行、需要等待后续行的步骤设置multiline: true，此时只能等待匹配或者超时
+ */
+
+import (
+    "errors"
+    "fmt"
+    "regexp"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//脚本描述
+type Script struct {
+    SessionVars map[string]VarSpec `json:"session_vars" yaml:"session_vars"`
+    Vars        map[string]VarSpec `json:"vars"         yaml:"vars"`
+    Steps       []ScriptStep       `json:"steps"        yaml:"steps"`
+}
+
+type ScriptStep struct {
+    Label   string        `json:"label"   yaml:"label"`
+    Send    string        `json:"send"    yaml:"send"`
+    Timeout string        `json:"timeout" yaml:"timeout"` //等待响应的超时，比如"2s"，为空则使用全局超时
+    Expect    []ScriptRule `json:"expect"    yaml:"expect"`
+    Loop      *ScriptLoop  `json:"loop"      yaml:"loop"`
+    Multiline bool         `json:"multiline" yaml:"multiline"` //响应有多行，不按行判定不匹配
+}
+
+type ScriptRule struct {
+    Match   string   `json:"match"   yaml:"match"`
+    Capture []string `json:"capture" yaml:"capture"` //按顺序保存捕获组
+    Goto    string   `json:"goto"    yaml:"goto"`
+    Done    bool     `json:"done"    yaml:"done"`    //匹配后结束会话
+}
+
+type ScriptLoop struct {
+    Goto  string `json:"goto"  yaml:"goto"`
+    Times int    `json:"times" yaml:"times"` //跳转次数，0表示无限循环
+}
+
+//编译后的脚本，多个会话共享
+type compiledScript struct {
+    sessionVars *VarSet
+    vars        *VarSet
+    steps       []compiledStep
+}
+
+type compiledStep struct {
+    label     string
+    send      *Template
+    timeout   time.Duration
+    rules     []compiledRule
+    loop      int //loop跳转的目标，-1表示没有loop
+    times     int
+    multiline bool
+}
+
+type compiledRule struct {
+    re      *regexp.Regexp
+    capture []string
+    next    int //跳转目标，-1表示没有goto
+    done    bool
+}
+
+//脚本插件，作为会话工厂，每个连接生成一个ScriptSession
+type TcpScriptPlugin struct {
+    script *compiledScript
+}
+
+//*TcpScriptPlugin实现SessionFactoryIntfs接口
+func (tsp *TcpScriptPlugin) NewSession() unicorn.SessionIntfs {
+    ss := &ScriptSession{
+        script : tsp.script,
+        vars   : tsp.script.sessionVars.Gen(0),
+        loops  : make([]int, len(tsp.script.steps)),
+        rule   : -1,
+    }
+    delete(ss.vars, TEMPLATE_VAR_ID)
+    return ss
+}
+
+//*TcpScriptPlugin同时需要满足PluginIntfs接口，但框架只会通过会话实例调用，走到这里说明用法有误
+func (tsp *TcpScriptPlugin) GenRequest(id int64) unicorn.RawRequest {
+    panic(errors.New("Script plugin must run in session mode"))
+}
+
+func (tsp *TcpScriptPlugin) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    return unicorn.SER_ERROR
+}
+
+func (tsp *TcpScriptPlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    return unicorn.RESULT_CODE_FATAL_CALL, "Script plugin must run in session mode"
+}
+
+//一个连接上的脚本执行状态
+type ScriptSession struct {
+    script *compiledScript
+    step   int                //当前步骤
+    vars   map[string]string  //会话变量以及捕获的变量
+    loops  []int              //每个步骤loop已经跳转的次数
+    rule   int                //CheckFull匹配上的规则
+    done   bool
+}
+
+//*ScriptSession实现SessionIntfs接口
+//生成请求：渲染当前步骤的send
+func (ss *ScriptSession) GenRequest(id int64) unicorn.RawRequest {
+    step := &ss.script.steps[ss.step]
+    for k, v := range ss.script.vars.Gen(id) {
+        ss.vars[k] = v
+    }
+    ss.rule = -1
+    return unicorn.RawRequest{Id: id, Req: []byte(step.send.Render(ss.vars)), Timeout: step.timeout}
+}
+
+//check服务端返回是否能够构成一个完整包：匹配上当前步骤的任意一条规则即完整
+//已经收到完整的行却没有规则匹配，则是错误的响应，框架会关闭连接，会话随之结束
+func (ss *ScriptSession) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    step := &ss.script.steps[ss.step]
+    for i, r := range step.rules {
+        if r.re.Match(response) {
+            ss.rule = i
+            return unicorn.SER_OK
+        }
+    }
+    if !step.multiline && len(response) > 0 && response[len(response)-1] == '\n' {
+        return unicorn.SER_ERROR
+    }
+    return unicorn.SER_NEEDMORE
+}
+
+//校验服务端返回：保存捕获组，并决定下一步
+func (ss *ScriptSession) CheckResponse(raw_req unicorn.RawRequest, response []byte) (code unicorn.ResultCode, msg string) {
+    step := &ss.script.steps[ss.step]
+    //CheckFull没有匹配上规则时返回SER_NEEDMORE或者SER_ERROR，正常不会走到这里，仅作防御
+    if ss.rule < 0 {
+        code = unicorn.RESULT_CODE_ERROR_RESPONSE
+        msg = fmt.Sprintf("Step %d: no rule matched: %s!\n", ss.step, string(response))
+        return
+    }
+    rule := &step.rules[ss.rule]
+
+    groups := rule.re.FindSubmatch(response)
+    for i, name := range rule.capture {
+        if i+1 < len(groups) {
+            ss.vars[name] = string(groups[i+1])
+        }
+    }
+
+    code = unicorn.RESULT_CODE_SUCCESS
+    msg = fmt.Sprintf("Success.(step %d, rule %d)", ss.step, ss.rule)
+
+    //决定下一步
+    switch {
+    case rule.done:
+        ss.done = true
+    case rule.next >= 0:
+        ss.step = rule.next
+    case step.loop >= 0 && (step.times == 0 || ss.loops[ss.step] < step.times):
+        ss.loops[ss.step]++
+        ss.step = step.loop
+    default:
+        ss.loops[ss.step] = 0 //循环结束，复位计数，外层循环再次进入时重新计数
+        ss.step++
+        if ss.step >= len(ss.script.steps) {
+            ss.done = true
+        }
+    }
+    return
+}
+
+func (ss *ScriptSession) Done() bool {
+    return ss.done
+}
+
+//从文件加载脚本，.yaml/.yml按YAML解析，其他按JSON解析
+func LoadScript(path string) (*Script, error) {
+    var sc Script
+    if err := unmarshalFile(path, &sc); err != nil {
+        return nil, fmt.Errorf("Script %s: %s", path, err)
+    }
+    return &sc, nil
+}
+
+//New函数，编译脚本，创建TcpScriptPlugin，它是PluginIntfs以及SessionFactoryIntfs的实现
+func NewTcpScriptPlugin(sc *Script) (unicorn.PluginIntfs, error) {
+    if len(sc.Steps) == 0 {
+        return nil, errors.New("Script: no steps")
+    }
+    sessionVars, err := NewVarSet(sc.SessionVars)
+    if err != nil {
+        return nil, err
+    }
+    vars, err := NewVarSet(sc.Vars)
+    if err != nil {
+        return nil, err
+    }
+
+    //标签以及全部可引用的变量名
+    labels := make(map[string]int)
+    known := make(map[string]bool)
+    for i, st := range sc.Steps {
+        if st.Label != "" {
+            if _, ok := labels[st.Label]; ok {
+                return nil, fmt.Errorf("Script: duplicate label %s", st.Label)
+            }
+            labels[st.Label] = i
+        }
+        for _, r := range st.Expect {
+            for _, name := range r.Capture {
+                known[name] = true
+            }
+        }
+    }
+    has := func(name string) bool {
+        return known[name] || sessionVars.Has(name) || vars.Has(name)
+    }
+    target := func(label string) (int, error) {
+        if label == "" {
+            return -1, nil
+        }
+        i, ok := labels[label]
+        if !ok {
+            return -1, fmt.Errorf("undefined label %s", label)
+        }
+        return i, nil
+    }
+
+    script := &compiledScript{sessionVars: sessionVars, vars: vars}
+    for i, st := range sc.Steps {
+        cs := compiledStep{label: st.Label, loop: -1, multiline: st.Multiline}
+        if cs.send, err = CompileTemplate(st.Send, has); err != nil {
+            return nil, fmt.Errorf("Script: step %d: %s", i, err)
+        }
+        if st.Timeout != "" {
+            if cs.timeout, err = time.ParseDuration(st.Timeout); err != nil {
+                return nil, fmt.Errorf("Script: step %d: %s", i, err)
+            }
+        }
+        if st.Loop != nil {
+            if cs.loop, err = target(st.Loop.Goto); err != nil {
+                return nil, fmt.Errorf("Script: step %d: %s", i, err)
+            }
+            cs.times = st.Loop.Times
+        }
+        if len(st.Expect) == 0 {
+            return nil, fmt.Errorf("Script: step %d: no expect", i)
+        }
+        for j, r := range st.Expect {
+            cr := compiledRule{capture: r.Capture, done: r.Done}
+            if cr.re, err = regexp.Compile(r.Match); err != nil {
+                return nil, fmt.Errorf("Script: step %d rule %d: %s", i, j, err)
+            }
+            if len(r.Capture) > cr.re.NumSubexp() {
+                return nil, fmt.Errorf("Script: step %d rule %d: %d captures but %d groups", i, j, len(r.Capture), cr.re.NumSubexp())
+            }
+            if cr.next, err = target(r.Goto); err != nil {
+                return nil, fmt.Errorf("Script: step %d rule %d: %s", i, j, err)
+            }
+            cs.rules = append(cs.rules, cr)
+        }
+        script.steps = append(script.steps, cs)
+    }
+
+    return &TcpScriptPlugin{script: script}, nil
+}
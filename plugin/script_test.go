@@ -0,0 +1,174 @@
+package plugin
+
+import (
+    "strings"
+    "testing"
+    "time"
+    "github.com/hq-cml/unicorn-go/testserver"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//按照脚本和给定的响应推进一个会话，返回每一步发出的请求
+func runScriptSession(t *testing.T, sc *Script, responses []string) (*ScriptSession, []string) {
+    plg, err := NewTcpScriptPlugin(sc)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ss := plg.(unicorn.SessionFactoryIntfs).NewSession().(*ScriptSession)
+    var sent []string
+    for i, resp := range responses {
+        if ss.Done() {
+            t.Fatalf("Session done before response %d\n", i)
+        }
+        raw_req := ss.GenRequest(int64(i))
+        sent = append(sent, string(raw_req.Req))
+        if s := ss.CheckFull(&raw_req, []byte(resp)); s != unicorn.SER_OK {
+            t.Fatalf("Response %d %q: expected SER_OK, got %d\n", i, resp, s)
+        }
+        if code, msg := ss.CheckResponse(raw_req, []byte(resp)); code != unicorn.RESULT_CODE_SUCCESS {
+            t.Fatalf("Response %d %q: %d %s\n", i, resp, code, msg)
+        }
+    }
+    return ss, sent
+}
+
+//测试捕获、goto、loop以及done
+func TestScriptFlow(t *testing.T) {
+    sc := &Script{
+        SessionVars : map[string]VarSpec{"user": {Type: VAR_TYPE_SEQ, Start: 7}},
+        Steps       : []ScriptStep{
+            {Label: "login", Send: "LOGIN {{user}}\n", Timeout: "1s", Expect: []ScriptRule{
+                {Match: `^OK (\w+) (\d+)\n`, Capture: []string{"token", "n"}},
+            }},
+            {Label: "op", Send: "GET {{token}} {{n}}\n", Expect: []ScriptRule{
+                {Match: "^VALUE\n"},
+                {Match: "^EXPIRED\n", Goto: "login"},
+                {Match: "^KICKED\n", Done: true},
+            }, Loop: &ScriptLoop{Goto: "op", Times: 2}},
+            {Send: "QUIT\n", Expect: []ScriptRule{{Match: "^BYE\n", Done: true}}},
+        },
+    }
+
+    //登录，token过期重新登录，之后循环3次（首次+2次跳转），退出
+    ss, sent := runScriptSession(t, sc, []string{
+        "OK abc 1\n", "EXPIRED\n",
+        "OK xyz 2\n", "VALUE\n", "VALUE\n", "VALUE\n",
+        "BYE\n",
+    })
+    expect := []string{
+        "LOGIN 7\n", "GET abc 1\n",
+        "LOGIN 7\n", "GET xyz 2\n", "GET xyz 2\n", "GET xyz 2\n",
+        "QUIT\n",
+    }
+    if strings.Join(sent, "") != strings.Join(expect, "") {
+        t.Fatalf("Unexpected requests: %q\n", sent)
+    }
+    if !ss.Done() {
+        t.Fatal("Expected session done after BYE")
+    }
+
+    //规则的done提前结束会话
+    ss, _ = runScriptSession(t, sc, []string{"OK abc 1\n", "KICKED\n"})
+    if !ss.Done() {
+        t.Fatal("Expected session done after KICKED")
+    }
+
+    //每一步的超时
+    plg, _ := NewTcpScriptPlugin(sc)
+    raw_req := plg.(unicorn.SessionFactoryIntfs).NewSession().GenRequest(1)
+    if raw_req.Timeout != time.Second {
+        t.Fatalf("Expected 1s timeout, got %v\n", raw_req.Timeout)
+    }
+}
+
+//测试不匹配的判定：收到完整的行仍然不匹配，返回SER_ERROR，multiline的步骤继续等待
+func TestScriptMismatch(t *testing.T) {
+    for _, multiline := range []bool{false, true} {
+        plg, err := NewTcpScriptPlugin(&Script{Steps: []ScriptStep{
+            {Send: "LIST\n", Multiline: multiline, Expect: []ScriptRule{{Match: "^ITEM \\d+\nEND\n"}}},
+        }})
+        if err != nil {
+            t.Fatal(err)
+        }
+        ss := plg.(unicorn.SessionFactoryIntfs).NewSession()
+        raw_req := ss.GenRequest(1)
+        if s := ss.CheckFull(&raw_req, []byte("ITE")); s != unicorn.SER_NEEDMORE {
+            t.Fatalf("Partial line: expected SER_NEEDMORE, got %d\n", s)
+        }
+        expect := unicorn.SER_ERROR
+        if multiline {
+            expect = unicorn.SER_NEEDMORE
+        }
+        if s := ss.CheckFull(&raw_req, []byte("ITEM 1\n")); s != expect {
+            t.Fatalf("multiline=%v: expected %d, got %d\n", multiline, expect, s)
+        }
+        if multiline {
+            if s := ss.CheckFull(&raw_req, []byte("ITEM 1\nEND\n")); s != unicorn.SER_OK {
+                t.Fatalf("Expected SER_OK, got %d\n", s)
+            }
+        }
+    }
+}
+
+//测试脚本的编译错误
+func TestScriptCompile(t *testing.T) {
+    rule := []ScriptRule{{Match: "^OK\n"}}
+    for _, sc := range []*Script{
+        {},
+        {Steps: []ScriptStep{{Send: "x"}}},
+        {Steps: []ScriptStep{{Send: "{{token}}", Expect: rule}}},
+        {Steps: []ScriptStep{{Label: "a", Expect: rule}, {Label: "a", Expect: rule}}},
+        {Steps: []ScriptStep{{Expect: []ScriptRule{{Match: "^OK\n", Goto: "nowhere"}}}}},
+        {Steps: []ScriptStep{{Expect: rule, Loop: &ScriptLoop{Goto: "nowhere"}}}},
+        {Steps: []ScriptStep{{Expect: []ScriptRule{{Match: "("}}}}},
+        {Steps: []ScriptStep{{Expect: []ScriptRule{{Match: "^OK\n", Capture: []string{"token"}}}}}},
+        {Steps: []ScriptStep{{Expect: rule, Timeout: "soon"}}},
+    } {
+        if _, err := NewTcpScriptPlugin(sc); err == nil {
+            t.Fatalf("Expected error for %+v\n", sc)
+        }
+    }
+}
+
+//端到端：scenarios/login.yaml对scenarios/scripted.yaml描述的服务端
+func TestScriptPlugin(t *testing.T) {
+    spec, err := testserver.LoadScriptedSpec("../scenarios/scripted.yaml")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv, err := testserver.NewScriptedServer(spec)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Listen("127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Close()
+
+    sc, err := LoadScript("../scenarios/login.yaml")
+    if err != nil {
+        t.Fatal(err)
+    }
+    plg, err := NewTcpScriptPlugin(sc)
+    if err != nil {
+        t.Fatal(err)
+    }
+    result_chan := make(chan *unicorn.CallResult, 50)
+    unc, err := unicorn.NewUnicorn(srv.Addr(), plg, 500*time.Millisecond, 0, 300*time.Millisecond, 2, true, result_chan)
+    if err != nil {
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
+    }
+    wg := unc.Start()
+    success := 0
+    for ret := range result_chan {
+        if ret.Code == unicorn.RESULT_CODE_SUCCESS {
+            success++
+        } else if ret.Code != unicorn.RESULT_CODE_WARING_TIMEOUT {
+            t.Errorf("%d: %s\n", ret.Code, ret.Msg)
+        }
+    }
+    wg.Wait()
+    if success == 0 {
+        t.Fatal("Expected successful steps")
+    }
+}
@@ -0,0 +1,246 @@
+package plugin
+/*
+ * plugin
+ * 大小分布：请求中value、payload的长度，以及生成指定长度的随机内容
+ */
+
+import (
+    "bufio"
+    "fmt"
+    "math"
+    "math/rand"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+const (
+    SIZE_MAX = 16 << 20 //单个value的最大长度
+)
+
+//大小生成器，多个worker会并发调用
+type SizeDist interface {
+    Next() int
+}
+
+//固定大小
+type fixedSize struct {
+    n int
+}
+
+func (fs *fixedSize) Next() int {
+    return fs.n
+}
+
+//[min, max]之间均匀分布的大小
+type uniformSize struct {
+    min, max int
+}
+
+func (us *uniformSize) Next() int {
+    return us.min + rand.Intn(us.max-us.min+1)
+}
+
+//对数正态分布的大小，中位数为median，sigma为ln(size)的标准差，超出[0, SIZE_MAX]的截断
+type lognormalSize struct {
+    median float64
+    sigma  float64
+}
+
+func (ls *lognormalSize) Next() int {
+    n := ls.median * math.Exp(ls.sigma*rand.NormFloat64())
+    if n > SIZE_MAX {
+        return SIZE_MAX
+    }
+    return int(n)
+}
+
+//按直方图文件中的权重选择大小
+type histogramSize struct {
+    sizes  []int
+    picker *weightedPicker
+}
+
+func (hs *histogramSize) Next() int {
+    return hs.sizes[hs.picker.Pick()]
+}
+
+//解析大小，支持K、M后缀（1024进制），比如64K、2M
+func parseSize(s string) (int, error) {
+    s = strings.TrimSpace(s)
+    orig, unit := s, 1
+    switch {
+    case strings.HasSuffix(s, "K"), strings.HasSuffix(s, "k"):
+        unit, s = 1<<10, s[:len(s)-1]
+    case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+        unit, s = 1<<20, s[:len(s)-1]
+    }
+    n, err := strconv.Atoi(s)
+    if err != nil {
+        return 0, err
+    }
+    if n > SIZE_MAX/unit {
+        return 0, fmt.Errorf("Size %s out of range [0, %d]", orig, SIZE_MAX)
+    }
+    n *= unit
+    return n, checkSize(n)
+}
+
+/*
+ * 加载直方图文件，每行一个大小及其权重，#开头的为注释：
+ *   # size  weight
+ *   64      70
+ *   4K      25
+ *   1M      5
+ */
+func loadHistogram(path string) (*histogramSize, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    hs := &histogramSize{}
+    var weights []int
+    scanner := bufio.NewScanner(f)
+    for line := 1; scanner.Scan(); line++ {
+        text := strings.TrimSpace(scanner.Text())
+        if text == "" || strings.HasPrefix(text, "#") {
+            continue
+        }
+        fields := strings.Fields(text)
+        if len(fields) != 2 {
+            return nil, fmt.Errorf("Histogram %s:%d: should be \"size weight\"", path, line)
+        }
+        n, err := parseSize(fields[0])
+        if err != nil {
+            return nil, fmt.Errorf("Histogram %s:%d: %s", path, line, err)
+        }
+        w, err := strconv.Atoi(fields[1])
+        if err != nil {
+            return nil, fmt.Errorf("Histogram %s:%d: bad weight %s", path, line, fields[1])
+        }
+        hs.sizes = append(hs.sizes, n)
+        weights = append(weights, w)
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    if hs.picker, err = newWeightedPicker(weights); err != nil {
+        return nil, fmt.Errorf("Histogram %s: %s", path, err)
+    }
+    return hs, nil
+}
+
+//校验大小
+func checkSize(n int) error {
+    if n < 0 || n > SIZE_MAX {
+        return fmt.Errorf("Size %d out of range [0, %d]", n, SIZE_MAX)
+    }
+    return nil
+}
+
+/*
+ * 解析大小分布的描述，和思考时间的写法一致，大小可以带K、M后缀：
+ *   fixed:64      （或者直接写64）
+ *   uniform:16-1024
+ *   lognormal:4K,1.0   （中位数,sigma）
+ *   histogram:sizes.txt
+ */
+func ParseSizeDist(spec string) (SizeDist, error) {
+    kind, arg := "fixed", spec
+    if i := strings.Index(spec, ":"); i >= 0 {
+        kind, arg = spec[:i], spec[i+1:]
+    }
+    switch kind {
+    case "fixed":
+        n, err := parseSize(arg)
+        if err != nil {
+            return nil, fmt.Errorf("Bad size: %s", spec)
+        }
+        return &fixedSize{n: n}, nil
+    case "uniform":
+        parts := strings.SplitN(arg, "-", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("Uniform size should be like uniform:16-1024, got %s", spec)
+        }
+        min, err1 := parseSize(parts[0])
+        max, err2 := parseSize(parts[1])
+        if err1 != nil || err2 != nil || min > max {
+            return nil, fmt.Errorf("Bad size range: %s", spec)
+        }
+        return &uniformSize{min: min, max: max}, nil
+    case "lognormal":
+        parts := strings.SplitN(arg, ",", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("Lognormal size should be like lognormal:4K,1.0, got %s", spec)
+        }
+        median, err1 := parseSize(parts[0])
+        sigma, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+        if err1 != nil || err2 != nil || median <= 0 || sigma < 0 {
+            return nil, fmt.Errorf("Bad lognormal size: %s", spec)
+        }
+        return &lognormalSize{median: float64(median), sigma: sigma}, nil
+    case "histogram":
+        return loadHistogram(arg)
+    }
+    return nil, fmt.Errorf("Unknown size distribution: %s", spec)
+}
+
+const (
+    PAYLOAD_SOURCE_SIZE = 2 << 20 //随机内容来源的大小
+)
+
+//随机内容的来源，生成value时从中截取，避免每次都生成随机数，第一次使用时初始化
+var payloadSource []byte
+var payloadOnce sync.Once
+
+//二进制的随机内容来源，包含全部256种字节
+var binarySource []byte
+var binaryOnce sync.Once
+
+func initPayloadSource() {
+    const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+    payloadSource = make([]byte, PAYLOAD_SOURCE_SIZE)
+    for i := range payloadSource {
+        payloadSource[i] = letters[rand.Intn(len(letters))]
+    }
+}
+
+func initBinarySource() {
+    binarySource = make([]byte, PAYLOAD_SOURCE_SIZE)
+    for i := 0; i < len(binarySource); i += 8 {
+        v := rand.Uint64()
+        for j := 0; j < 8; j++ {
+            binarySource[i+j] = byte(v >> (8 * uint(j)))
+        }
+    }
+}
+
+//长度为n的随机内容。不超过来源一半大小的，直接返回来源的切片（共享，只读）；更大的，重复来源拼接
+func randPayload(n int) []byte {
+    payloadOnce.Do(initPayloadSource)
+    return sliceSource(payloadSource, n)
+}
+
+//长度为n的随机二进制内容，规则和randPayload相同
+func randBinaryPayload(n int) []byte {
+    binaryOnce.Do(initBinarySource)
+    return sliceSource(binarySource, n)
+}
+
+func sliceSource(src []byte, n int) []byte {
+    if n <= PAYLOAD_SOURCE_SIZE/2 {
+        off := rand.Intn(PAYLOAD_SOURCE_SIZE - n + 1)
+        return src[off : off+n]
+    }
+    //从随机位置开始重复拼接，不同请求的内容不至于完全相同
+    b := make([]byte, n)
+    off := rand.Intn(PAYLOAD_SOURCE_SIZE)
+    for i := 0; i < n; {
+        i += copy(b[i:], src[off:])
+        off = 0
+    }
+    return b
+}
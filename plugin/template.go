@@ -0,0 +1,260 @@
+package plugin
+/*
+ * plugin
+ * 请求模板以及模板变量
+ * 模板中用{{name}}引用变量，{{id}}是内置变量，表示请求Id
+ * 变量的取值方式：随机整数、随机字符串、自增序列、从文件按行读取
+ */
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "math"
+    "math/rand"
+    "os"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "github.com/hq-cml/go-case/random"
+)
+
+const (
+    TEMPLATE_VAR_ID = "id"  //内置变量：请求Id
+)
+
+//变量取值方式
+const (
+    VAR_TYPE_INT    = "int"     //[min, max]之间的随机整数
+    VAR_TYPE_STRING = "string"  //长度为len的随机字符串
+    VAR_TYPE_SEQ    = "seq"     //从start开始，每次增加step的序列
+    VAR_TYPE_FILE   = "file"    //从文件按行取值，顺序或者随机
+)
+
+//变量声明，可以从json或者yaml中解析
+type VarSpec struct {
+    Type   string `json:"type"   yaml:"type"`
+    Min    int64  `json:"min"    yaml:"min"`
+    Max    int64  `json:"max"    yaml:"max"`
+    Len    int    `json:"len"    yaml:"len"`
+    Start  int64  `json:"start"  yaml:"start"`
+    Step   int64  `json:"step"   yaml:"step"`
+    Path   string `json:"path"   yaml:"path"`
+    Random bool   `json:"random" yaml:"random"`
+}
+
+//变量生成器，多个worker会并发调用
+type VarGen interface {
+    Next() string
+}
+
+type intVar struct {
+    min, max int64
+}
+
+//按无符号数计算取值的个数，范围超过int64时也不会溢出
+func (v *intVar) Next() string {
+    span := uint64(v.max-v.min) + 1
+    var off uint64
+    switch {
+    case span == 0:
+        //整个int64的范围
+        off = rand.Uint64()
+    case span <= math.MaxInt64:
+        off = uint64(rand.Int63n(int64(span)))
+    default:
+        //超过一半的取值落在范围内，拒绝采样很快结束
+        for off = rand.Uint64(); off >= span; off = rand.Uint64() {
+        }
+    }
+    return strconv.FormatInt(v.min+int64(off), 10)
+}
+
+type stringVar struct {
+    len int
+}
+
+func (v *stringVar) Next() string {
+    return random.GenRandString(v.len)
+}
+
+type seqVar struct {
+    cur  int64
+    step int64
+}
+
+func (v *seqVar) Next() string {
+    return strconv.FormatInt(atomic.AddInt64(&v.cur, v.step)-v.step, 10)
+}
+
+type fileVar struct {
+    lines  []string
+    random bool
+    idx    uint64
+}
+
+func (v *fileVar) Next() string {
+    if v.random {
+        return v.lines[rand.Intn(len(v.lines))]
+    }
+    i := atomic.AddUint64(&v.idx, 1) - 1
+    return v.lines[i%uint64(len(v.lines))]
+}
+
+//根据声明生成变量生成器
+func (vs *VarSpec) Compile() (VarGen, error) {
+    switch vs.Type {
+    case VAR_TYPE_INT:
+        if vs.Max < vs.Min {
+            return nil, fmt.Errorf("Bad int range [%d, %d]", vs.Min, vs.Max)
+        }
+        return &intVar{min: vs.Min, max: vs.Max}, nil
+    case VAR_TYPE_STRING:
+        if vs.Len <= 0 {
+            return nil, errors.New("String length must be positive")
+        }
+        return &stringVar{len: vs.Len}, nil
+    case VAR_TYPE_SEQ:
+        step := vs.Step
+        if step == 0 {
+            step = 1
+        }
+        return &seqVar{cur: vs.Start, step: step}, nil
+    case VAR_TYPE_FILE:
+        lines, err := readLines(vs.Path)
+        if err != nil {
+            return nil, err
+        }
+        if len(lines) == 0 {
+            return nil, fmt.Errorf("Empty var file: %s", vs.Path)
+        }
+        return &fileVar{lines: lines, random: vs.Random}, nil
+    }
+    return nil, fmt.Errorf("Unknown var type: %s", vs.Type)
+}
+
+func readLines(path string) ([]string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    var lines []string
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+            lines = append(lines, line)
+        }
+    }
+    return lines, scanner.Err()
+}
+
+//一组变量，每个请求生成一份取值
+type VarSet struct {
+    names []string
+    gens  []VarGen
+}
+
+func NewVarSet(specs map[string]VarSpec) (*VarSet, error) {
+    vs := &VarSet{}
+    for name, spec := range specs {
+        if name == TEMPLATE_VAR_ID {
+            return nil, errors.New("Var name 'id' is reserved")
+        }
+        gen, err := spec.Compile()
+        if err != nil {
+            return nil, fmt.Errorf("Var %s: %s", name, err)
+        }
+        vs.names = append(vs.names, name)
+        vs.gens = append(vs.gens, gen)
+    }
+    return vs, nil
+}
+
+//是否声明了某个变量
+func (vs *VarSet) Has(name string) bool {
+    if name == TEMPLATE_VAR_ID {
+        return true
+    }
+    for _, n := range vs.names {
+        if n == name {
+            return true
+        }
+    }
+    return false
+}
+
+//为一个请求生成全部变量的取值
+func (vs *VarSet) Gen(id int64) map[string]string {
+    vals := make(map[string]string, len(vs.names)+1)
+    vals[TEMPLATE_VAR_ID] = strconv.FormatInt(id, 10)
+    for i, name := range vs.names {
+        vals[name] = vs.gens[i].Next()
+    }
+    return vals
+}
+
+//编译后的模板，由字面量和变量引用交替组成
+type Template struct {
+    parts []tplPart
+}
+
+type tplPart struct {
+    lit  string
+    name string //非空表示变量引用
+}
+
+//编译模板，has用来检查变量是否已声明，为nil则不检查
+func CompileTemplate(s string, has func(string) bool) (*Template, error) {
+    t := &Template{}
+    for {
+        i := strings.Index(s, "{{")
+        if i < 0 {
+            break
+        }
+        j := strings.Index(s[i:], "}}")
+        if j < 0 {
+            return nil, fmt.Errorf("Unclosed '{{' in template: %s", s)
+        }
+        name := strings.TrimSpace(s[i+2 : i+j])
+        if has != nil && !has(name) {
+            return nil, fmt.Errorf("Undefined var %s in template", name)
+        }
+        if i > 0 {
+            t.parts = append(t.parts, tplPart{lit: s[:i]})
+        }
+        t.parts = append(t.parts, tplPart{name: name})
+        s = s[i+j+2:]
+    }
+    if s != "" {
+        t.parts = append(t.parts, tplPart{lit: s})
+    }
+    return t, nil
+}
+
+//模板中是否引用了变量
+func (t *Template) HasVar() bool {
+    for _, p := range t.parts {
+        if p.name != "" {
+            return true
+        }
+    }
+    return false
+}
+
+//用变量取值渲染模板
+func (t *Template) Render(vals map[string]string) string {
+    if len(t.parts) == 1 && t.parts[0].name == "" {
+        return t.parts[0].lit
+    }
+    var buff strings.Builder
+    for _, p := range t.parts {
+        if p.name != "" {
+            buff.WriteString(vals[p.name])
+        } else {
+            buff.WriteString(p.lit)
+        }
+    }
+    return buff.String()
+}
@@ -0,0 +1,484 @@
+package plugin
+/*
+ * plugin
+ * WebSocket客户端插件（RFC 6455）
+ * 每个连接是一个会话：先发送HTTP Upgrade握手（类型HANDSHAKE），之后发送消息（类型MESSAGE），
+ * 每条消息等待服务端的一条完整的数据消息作为响应，所以报告中可以分别看到握手耗时和消息的往返耗时
+ * 客户端的帧都带掩码，消息可以按fragment_size分片；服务端的帧支持文本、二进制、分片以及控制帧：
+ * 服务端的ping在下一个请求之前回复pong，pong忽略，close则结束会话
+ * 设置了messages时，每个连接发送这么多条消息之后发送close（类型CLOSE），等待服务端的close之后关闭连接
+ * 不支持扩展（比如permessage-deflate），RSV位非0视为错误
+ *
+ * 示例（YAML）：
+ *   vars:
+ *     uid: {type: int, min: 1, max: 100000}
+ *   url: /push?uid={{uid}}
+ *   subprotocol: chat
+ *   message: "{\"uid\":{{uid}},\"op\":\"echo\"}"
+ *   messages: 100
+ *   expect: "\"uid\":{{uid}}"
+ */
+
+import (
+    "bytes"
+    "crypto/sha1"
+    "encoding/base64"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math/rand"
+    "net/url"
+    "regexp"
+    "sort"
+    "strings"
+    "sync/atomic"
+    "unicode/utf8"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//请求类型
+const (
+    WS_HANDSHAKE_TYPE = "HANDSHAKE"
+    WS_MESSAGE_TYPE   = "MESSAGE"
+    WS_CLOSE_TYPE     = "CLOSE"
+)
+
+//帧的操作码
+const (
+    WS_OP_CONTINUATION = 0x0
+    WS_OP_TEXT         = 0x1
+    WS_OP_BINARY       = 0x2
+    WS_OP_CLOSE        = 0x8
+    WS_OP_PING         = 0x9
+    WS_OP_PONG         = 0xA
+)
+
+const (
+    WS_GUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+    WS_MAX_MESSAGE    = 64 * 1024 * 1024 //服务端消息的最大长度
+    WS_CLOSE_NORMAL   = 1000
+    WS_MAX_CONTROL    = 125              //控制帧payload的最大长度
+)
+
+//WebSocket插件描述
+type WebSocketSpec struct {
+    Vars         map[string]VarSpec `json:"vars"          yaml:"vars"`
+    URL          string             `json:"url"           yaml:"url"`           ///path?query，或者ws://host:port/path，默认/
+    Headers      map[string]string  `json:"headers"       yaml:"headers"`       //握手请求额外的头部
+    Subprotocol  string             `json:"subprotocol"   yaml:"subprotocol"`   //可选：Sec-WebSocket-Protocol
+    Message      string             `json:"message"       yaml:"message"`       //消息模板
+    Binary       bool               `json:"binary"        yaml:"binary"`        //以二进制帧发送，默认文本帧
+    FragmentSize int                `json:"fragment_size" yaml:"fragment_size"` //消息分片的大小，0表示不分片
+    Messages     int                `json:"messages"      yaml:"messages"`      //每个连接发送的消息数，之后关闭，0表示不限制
+    Expect       string             `json:"expect"        yaml:"expect"`        //可选：响应消息需要匹配的正则，可以引用变量
+}
+
+//服务端的一条消息，以及之前穿插的控制帧
+type wsMessage struct {
+    opcode  byte     //数据消息为TEXT/BINARY，收到close时为CLOSE
+    payload []byte   //分片已拼接
+    frames  int      //数据消息的帧数
+    pings   [][]byte //需要回复pong的ping
+}
+
+type TcpWebSocketPlugin struct {
+    vars         *VarSet
+    target       *Template
+    headers      []httpHeader //按名字排序
+    subprotocol  string
+    message      *Template
+    opcode       byte
+    fragmentSize int
+    messages     int
+    expect       *Template
+
+    handshakes   uint64 //成功的握手数
+    replies      uint64 //收到的数据消息数
+    fragmented   uint64 //其中分片的消息数
+    pings        uint64 //服务端的ping数
+    closes       uint64 //服务端主动的close数
+}
+
+//每个连接的会话
+type wsSession struct {
+    *TcpWebSocketPlugin
+    key    string            //握手的Sec-WebSocket-Key
+    ready  bool              //握手已经完成
+    sent   int               //已经发送的消息数
+    pongs  [][]byte          //待回复的pong
+    vals   map[string]string //当前消息的变量，用于校验响应
+    done   bool
+}
+
+//从文件加载WebSocket插件描述
+func LoadWebSocketSpec(path string) (*WebSocketSpec, error) {
+    var spec WebSocketSpec
+    if err := unmarshalFile(path, &spec); err != nil {
+        return nil, fmt.Errorf("WebSocket spec %s: %s", path, err)
+    }
+    return &spec, nil
+}
+
+//*TcpWebSocketPlugin实现SessionFactoryIntfs接口
+func (twp *TcpWebSocketPlugin) NewSession() unicorn.SessionIntfs {
+    return &wsSession{TcpWebSocketPlugin: twp}
+}
+
+//*TcpWebSocketPlugin本身不直接处理交互，连接上的交互都由会话处理
+func (twp *TcpWebSocketPlugin) GenRequest(id int64) unicorn.RawRequest {
+    panic(errors.New("WebSocket plugin must run in session mode"))
+}
+
+func (twp *TcpWebSocketPlugin) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    return unicorn.SER_ERROR
+}
+
+func (twp *TcpWebSocketPlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    return unicorn.RESULT_CODE_FATAL_CALL, "WebSocket plugin must run in session mode"
+}
+
+//*TcpWebSocketPlugin实现ReporterIntfs接口
+func (twp *TcpWebSocketPlugin) Report() string {
+    return fmt.Sprintf("WebSocket: handshakes %d, replies %d (fragmented %d), server pings %d, server closes %d\n",
+        atomic.LoadUint64(&twp.handshakes), atomic.LoadUint64(&twp.replies), atomic.LoadUint64(&twp.fragmented),
+        atomic.LoadUint64(&twp.pings), atomic.LoadUint64(&twp.closes))
+}
+
+//生成请求：第一个请求是握手，之后是消息，达到消息数之后是close
+func (ws *wsSession) GenRequest(id int64) unicorn.RawRequest {
+    vals := ws.vars.Gen(id)
+    var buff bytes.Buffer
+    if !ws.ready {
+        key := make([]byte, 16)
+        binary.BigEndian.PutUint64(key, rand.Uint64())
+        binary.BigEndian.PutUint64(key[8:], rand.Uint64())
+        ws.key = base64.StdEncoding.EncodeToString(key)
+        fmt.Fprintf(&buff, "GET %s HTTP/1.1\r\n", ws.target.Render(vals))
+        for _, h := range ws.headers {
+            fmt.Fprintf(&buff, "%s: %s\r\n", h.name, h.tpl.Render(vals))
+        }
+        fmt.Fprintf(&buff, "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: %s\r\n", ws.key)
+        if ws.subprotocol != "" {
+            fmt.Fprintf(&buff, "Sec-WebSocket-Protocol: %s\r\n", ws.subprotocol)
+        }
+        buff.WriteString("\r\n")
+        return unicorn.RawRequest{Id: id, Req: buff.Bytes(), Type: WS_HANDSHAKE_TYPE}
+    }
+
+    //先回复服务端的ping
+    for _, payload := range ws.pongs {
+        writeWsFrame(&buff, true, WS_OP_PONG, payload)
+    }
+    ws.pongs = nil
+
+    if ws.messages > 0 && ws.sent >= ws.messages {
+        payload := make([]byte, 2)
+        binary.BigEndian.PutUint16(payload, WS_CLOSE_NORMAL)
+        writeWsFrame(&buff, true, WS_OP_CLOSE, payload)
+        return unicorn.RawRequest{Id: id, Req: buff.Bytes(), Type: WS_CLOSE_TYPE}
+    }
+
+    ws.sent++
+    ws.vals = vals
+    msg := []byte(ws.message.Render(vals))
+    opcode := ws.opcode
+    for ws.fragmentSize > 0 && len(msg) > ws.fragmentSize {
+        writeWsFrame(&buff, false, opcode, msg[:ws.fragmentSize])
+        msg = msg[ws.fragmentSize:]
+        opcode = WS_OP_CONTINUATION
+    }
+    writeWsFrame(&buff, true, opcode, msg)
+    return unicorn.RawRequest{Id: id, Req: buff.Bytes(), Type: WS_MESSAGE_TYPE}
+}
+
+//check服务端返回是否能够构成一个完整包
+func (ws *wsSession) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    if raw_req.Type == WS_HANDSHAKE_TYPE {
+        _, status := parseHttpResponse(response, false)
+        return status
+    }
+    _, status := parseWsMessage(response, raw_req.Type == WS_CLOSE_TYPE)
+    return status
+}
+
+//校验服务端返回是否符合预期
+func (ws *wsSession) CheckResponse(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    if raw_req.Type == WS_HANDSHAKE_TYPE {
+        if err := ws.checkHandshake(response); err != nil {
+            ws.done = true
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, err.Error()
+        }
+        ws.ready = true
+        atomic.AddUint64(&ws.handshakes, 1)
+        return unicorn.RESULT_CODE_SUCCESS, "Success"
+    }
+
+    msg, status := parseWsMessage(response, raw_req.Type == WS_CLOSE_TYPE)
+    if status != unicorn.SER_OK {
+        ws.done = true
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "Malformed websocket frames"
+    }
+    atomic.AddUint64(&ws.pings, uint64(len(msg.pings)))
+    ws.pongs = append(ws.pongs, msg.pings...)
+
+    if msg.opcode == WS_OP_CLOSE {
+        ws.done = true
+        if raw_req.Type == WS_CLOSE_TYPE {
+            return unicorn.RESULT_CODE_SUCCESS, "Success"
+        }
+        atomic.AddUint64(&ws.closes, 1)
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "Closed by server: " + wsCloseReason(msg.payload)
+    }
+
+    atomic.AddUint64(&ws.replies, 1)
+    if msg.frames > 1 {
+        atomic.AddUint64(&ws.fragmented, 1)
+    }
+    if msg.opcode == WS_OP_TEXT && !utf8.Valid(msg.payload) {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, "Invalid UTF-8 in text message"
+    }
+    if ws.expect != nil {
+        re, err := regexp.Compile(ws.expect.Render(ws.vals))
+        if err != nil {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, err.Error()
+        }
+        if !re.Match(msg.payload) {
+            return unicorn.RESULT_CODE_ERROR_RESPONSE, fmt.Sprintf("Message mismatch: %.64q", msg.payload)
+        }
+    }
+    return unicorn.RESULT_CODE_SUCCESS, "Success"
+}
+
+//握手失败、收到close或者帧出错，会话结束
+func (ws *wsSession) Done() bool {
+    return ws.done
+}
+
+//校验握手的响应：101，Upgrade，Sec-WebSocket-Accept，子协议
+func (ws *wsSession) checkHandshake(response []byte) error {
+    resp, status := parseHttpResponse(response, false)
+    if status != unicorn.SER_OK {
+        return errors.New("Malformed handshake response")
+    }
+    if resp.status != 101 {
+        return fmt.Errorf("Unexpected handshake status %d", resp.status)
+    }
+    if !strings.EqualFold(resp.headers["upgrade"], "websocket") ||
+        !strings.Contains(strings.ToLower(resp.headers["connection"]), "upgrade") {
+        return errors.New("Missing upgrade headers")
+    }
+    if resp.headers["sec-websocket-accept"] != wsAccept(ws.key) {
+        return errors.New("Bad Sec-WebSocket-Accept")
+    }
+    if ws.subprotocol != "" && resp.headers["sec-websocket-protocol"] != ws.subprotocol {
+        return fmt.Errorf("Subprotocol %q not accepted", ws.subprotocol)
+    }
+    return nil
+}
+
+//Sec-WebSocket-Key对应的Sec-WebSocket-Accept
+func wsAccept(key string) string {
+    sum := sha1.Sum([]byte(key + WS_GUID))
+    return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+//close帧payload中的状态码以及原因
+func wsCloseReason(payload []byte) string {
+    if len(payload) < 2 {
+        return "no status"
+    }
+    return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(payload), payload[2:])
+}
+
+//编码一个客户端的帧，客户端的帧必须带掩码
+func writeWsFrame(buff *bytes.Buffer, fin bool, opcode byte, payload []byte) {
+    b0 := opcode
+    if fin {
+        b0 |= 0x80
+    }
+    buff.WriteByte(b0)
+    switch n := len(payload); {
+    case n <= 125:
+        buff.WriteByte(0x80 | byte(n))
+    case n <= 0xFFFF:
+        buff.WriteByte(0x80 | 126)
+        binary.Write(buff, binary.BigEndian, uint16(n))
+    default:
+        buff.WriteByte(0x80 | 127)
+        binary.Write(buff, binary.BigEndian, uint64(n))
+    }
+    mask := make([]byte, 4)
+    binary.BigEndian.PutUint32(mask, rand.Uint32())
+    buff.Write(mask)
+    for i, b := range payload {
+        buff.WriteByte(b ^ mask[i&3])
+    }
+}
+
+//解析一个服务端的帧，返回fin、操作码、payload以及消耗的字节数。服务端的帧不能带掩码
+func parseWsFrame(data []byte) (bool, byte, []byte, int, unicorn.ServerRespStatus) {
+    if len(data) < 2 {
+        return false, 0, nil, 0, unicorn.SER_NEEDMORE
+    }
+    fin, opcode := data[0]&0x80 != 0, data[0]&0x0F
+    if data[0]&0x70 != 0 || data[1]&0x80 != 0 {
+        return false, 0, nil, 0, unicorn.SER_ERROR
+    }
+    pos, n := 2, uint64(data[1]&0x7F)
+    switch n {
+    case 126:
+        if len(data) < 4 {
+            return false, 0, nil, 0, unicorn.SER_NEEDMORE
+        }
+        n, pos = uint64(binary.BigEndian.Uint16(data[2:])), 4
+    case 127:
+        if len(data) < 10 {
+            return false, 0, nil, 0, unicorn.SER_NEEDMORE
+        }
+        n, pos = binary.BigEndian.Uint64(data[2:]), 10
+    }
+    if n > WS_MAX_MESSAGE || opcode >= WS_OP_CLOSE && (!fin || n > WS_MAX_CONTROL) {
+        return false, 0, nil, 0, unicorn.SER_ERROR
+    }
+    if uint64(len(data)-pos) < n {
+        return false, 0, nil, 0, unicorn.SER_NEEDMORE
+    }
+    return fin, opcode, data[pos : pos+int(n)], pos + int(n), unicorn.SER_OK
+}
+
+//解析服务端的帧，直到一条完整的数据消息或者close。untilClose为true时，跳过数据消息直到close
+//同步交互，完整的消息之后不应该有多余的数据
+func parseWsMessage(data []byte, untilClose bool) (*wsMessage, unicorn.ServerRespStatus) {
+    msg := &wsMessage{}
+    var payload []byte
+    for {
+        fin, opcode, frame, n, status := parseWsFrame(data)
+        if status != unicorn.SER_OK {
+            return nil, status
+        }
+        data = data[n:]
+
+        switch opcode {
+        case WS_OP_PING:
+            msg.pings = append(msg.pings, frame)
+            continue
+        case WS_OP_PONG:
+            continue
+        case WS_OP_CLOSE:
+            msg.opcode, msg.payload = WS_OP_CLOSE, frame
+        case WS_OP_TEXT, WS_OP_BINARY:
+            if msg.frames > 0 {
+                return nil, unicorn.SER_ERROR
+            }
+            msg.opcode = opcode
+            fallthrough
+        case WS_OP_CONTINUATION:
+            if msg.opcode == 0 {
+                return nil, unicorn.SER_ERROR
+            }
+            msg.frames++
+            payload = append(payload, frame...)
+            if len(payload) > WS_MAX_MESSAGE {
+                return nil, unicorn.SER_ERROR
+            }
+            if !fin {
+                continue
+            }
+            msg.payload = payload
+        default:
+            return nil, unicorn.SER_ERROR
+        }
+
+        if untilClose && msg.opcode != WS_OP_CLOSE {
+            msg.opcode, msg.frames, payload = 0, 0, nil
+            continue
+        }
+        if len(data) > 0 {
+            return nil, unicorn.SER_ERROR
+        }
+        return msg, unicorn.SER_OK
+    }
+}
+
+//New函数，创建TcpWebSocketPlugin，它是SessionFactoryIntfs的一个实现
+func NewTcpWebSocketPlugin(spec *WebSocketSpec, host string) (unicorn.PluginIntfs, error) {
+    vars, err := NewVarSet(spec.Vars)
+    if err != nil {
+        return nil, err
+    }
+    twp := &TcpWebSocketPlugin{
+        vars         : vars,
+        subprotocol  : spec.Subprotocol,
+        opcode       : WS_OP_TEXT,
+        fragmentSize : spec.FragmentSize,
+        messages     : spec.Messages,
+    }
+    if spec.Binary {
+        twp.opcode = WS_OP_BINARY
+    }
+    if twp.fragmentSize < 0 || twp.messages < 0 {
+        return nil, errors.New("WebSocket: negative fragment size or messages")
+    }
+    if twp.message, err = CompileTemplate(spec.Message, vars.Has); err != nil {
+        return nil, err
+    }
+    if spec.Expect != "" {
+        if twp.expect, err = CompileTemplate(spec.Expect, vars.Has); err != nil {
+            return nil, err
+        }
+        if !twp.expect.HasVar() {
+            if _, err := regexp.Compile(spec.Expect); err != nil {
+                return nil, fmt.Errorf("WebSocket: bad expect: %s", err)
+            }
+        }
+    }
+
+    //绝对地址：拆出Host，请求行中只保留路径。wss依赖-tls
+    target := spec.URL
+    if target == "" {
+        target = "/"
+    }
+    if strings.HasPrefix(target, "ws://") || strings.HasPrefix(target, "wss://") {
+        u, err := url.Parse(target)
+        if err != nil || strings.Contains(u.Host, "{{") {
+            return nil, fmt.Errorf("WebSocket: bad url %s", spec.URL)
+        }
+        host = u.Host
+        target = strings.TrimPrefix(target, u.Scheme + "://" + u.Host)
+        if target == "" {
+            target = "/"
+        }
+    } else if strings.Contains(target, "://") {
+        return nil, fmt.Errorf("WebSocket: unsupported url %s", spec.URL)
+    }
+    if twp.target, err = CompileTemplate(target, vars.Has); err != nil {
+        return nil, err
+    }
+
+    //头部：默认的Host、User-Agent可以被覆盖，握手相关的头部自动生成
+    headers := map[string]string{"Host": host, "User-Agent": HTTP_USER_AGENT}
+    for name, value := range spec.Headers {
+        for def := range headers {
+            if strings.EqualFold(def, name) {
+                delete(headers, def)
+            }
+        }
+        lower := strings.ToLower(name)
+        if lower == "upgrade" || lower == "connection" || strings.HasPrefix(lower, "sec-websocket-") {
+            return nil, fmt.Errorf("WebSocket: %s is generated automatically", name)
+        }
+        headers[name] = value
+    }
+    if headers["Host"] == "" {
+        delete(headers, "Host")
+    }
+    for name, value := range headers {
+        tpl, err := CompileTemplate(value, vars.Has)
+        if err != nil {
+            return nil, err
+        }
+        twp.headers = append(twp.headers, httpHeader{name: name, tpl: tpl})
+    }
+    sort.Slice(twp.headers, func(i, j int) bool { return twp.headers[i].name < twp.headers[j].name })
+    return twp, nil
+}
@@ -0,0 +1,260 @@
+package plugin
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//服务端的帧，不带掩码
+func serverWsFrame(fin bool, opcode byte, payload []byte) []byte {
+    var buff bytes.Buffer
+    b0 := opcode
+    if fin {
+        b0 |= 0x80
+    }
+    buff.WriteByte(b0)
+    if len(payload) <= 125 {
+        buff.WriteByte(byte(len(payload)))
+    } else {
+        buff.WriteByte(126)
+        binary.Write(&buff, binary.BigEndian, uint16(len(payload)))
+    }
+    buff.Write(payload)
+    return buff.Bytes()
+}
+
+//测试服务端帧的解析：分片、穿插的控制帧，逐字节喂入，完整之前都是SER_NEEDMORE
+func TestWsParse(t *testing.T) {
+    long := strings.Repeat("x", 300)
+    stream := string(serverWsFrame(false, WS_OP_TEXT, []byte("hel"))) +
+        string(serverWsFrame(true, WS_OP_PING, []byte("p1"))) +
+        string(serverWsFrame(false, WS_OP_CONTINUATION, []byte("lo "))) +
+        string(serverWsFrame(true, WS_OP_PONG, nil)) +
+        string(serverWsFrame(true, WS_OP_CONTINUATION, []byte(long)))
+    for i := 0; i < len(stream); i++ {
+        if _, s := parseWsMessage([]byte(stream[:i]), false); s != unicorn.SER_NEEDMORE {
+            t.Fatalf("Prefix %d: got %d\n", i, s)
+        }
+    }
+    msg, s := parseWsMessage([]byte(stream), false)
+    if s != unicorn.SER_OK || msg.opcode != WS_OP_TEXT || string(msg.payload) != "hello " + long ||
+        msg.frames != 3 || len(msg.pings) != 1 || string(msg.pings[0]) != "p1" {
+        t.Fatalf("Unexpected message: %d %+v\n", s, msg)
+    }
+
+    //等待close时，跳过之前的数据消息
+    closing := string(serverWsFrame(true, WS_OP_TEXT, []byte("late"))) + string(serverWsFrame(true, WS_OP_CLOSE, []byte{0x03, 0xe8}))
+    if msg, s = parseWsMessage([]byte(closing), true); s != unicorn.SER_OK || msg.opcode != WS_OP_CLOSE {
+        t.Fatalf("Expected close, got %d %+v\n", s, msg)
+    }
+
+    for _, bad := range [][]byte{
+        serverWsFrame(true, WS_OP_CONTINUATION, []byte("x")),  //没有开头的分片
+        serverWsFrame(false, WS_OP_PING, nil),                  //控制帧不能分片
+        {0x81, 0x81, 0, 0, 0, 0, 'x'},                          //服务端的帧带掩码
+        {0xC1, 0x01, 'x'},                                      //RSV1
+        append(serverWsFrame(true, WS_OP_TEXT, []byte("a")), 0x81),
+    } {
+        if _, s := parseWsMessage(bad, false); s != unicorn.SER_ERROR {
+            t.Fatalf("%x: expected SER_ERROR, got %d\n", bad, s)
+        }
+    }
+}
+
+//客户端的帧没有掩码，属于协议错误，其他的都是连接上的读错误
+var errWsNotMasked = errors.New("Client frame not masked")
+
+//读取一个客户端的帧，客户端的帧必须带掩码
+func readClientWsFrame(r *bufio.Reader) (bool, byte, []byte, error) {
+    head := make([]byte, 2)
+    if _, err := io.ReadFull(r, head); err != nil {
+        return false, 0, nil, err
+    }
+    if head[1]&0x80 == 0 {
+        return false, 0, nil, errWsNotMasked
+    }
+    n := uint64(head[1] & 0x7F)
+    switch n {
+    case 126:
+        ext := make([]byte, 2)
+        if _, err := io.ReadFull(r, ext); err != nil {
+            return false, 0, nil, err
+        }
+        n = uint64(binary.BigEndian.Uint16(ext))
+    case 127:
+        ext := make([]byte, 8)
+        if _, err := io.ReadFull(r, ext); err != nil {
+            return false, 0, nil, err
+        }
+        n = binary.BigEndian.Uint64(ext)
+    }
+    buf := make([]byte, 4+n)
+    if _, err := io.ReadFull(r, buf); err != nil {
+        return false, 0, nil, err
+    }
+    payload := buf[4:]
+    for i := range payload {
+        payload[i] ^= buf[i&3]
+    }
+    return head[0]&0x80 != 0, head[0] & 0x0F, payload, nil
+}
+
+//启动WebSocket回显服务端：每3条消息先发一个ping，回复分两片，两片之间穿插ping
+//返回的stop关闭监听以及所有连接，等待服务端的goroutine全部退出
+func startWsEcho(t *testing.T, pongs *int64) (net.Listener, func()) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    var wg sync.WaitGroup
+    var lock sync.Mutex
+    conns := make(map[net.Conn]bool)
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            lock.Lock()
+            conns[conn] = true
+            lock.Unlock()
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                defer func() {
+                    lock.Lock()
+                    delete(conns, conn)
+                    lock.Unlock()
+                    conn.Close()
+                }()
+                r := bufio.NewReader(conn)
+                key := ""
+                for {
+                    line, err := r.ReadString('\n')
+                    if err != nil {
+                        return
+                    }
+                    if line == "\r\n" {
+                        break
+                    }
+                    if strings.HasPrefix(line, "Sec-WebSocket-Key:") {
+                        key = strings.TrimSpace(line[len("Sec-WebSocket-Key:"):])
+                    }
+                }
+                io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+                    "Sec-WebSocket-Protocol: echo\r\nSec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+
+                var msg []byte
+                count := 0
+                for {
+                    fin, opcode, payload, err := readClientWsFrame(r)
+                    //unicorn停止时关闭连接，EOF等读错误是正常的结束，只报告协议错误
+                    if err == errWsNotMasked {
+                        t.Error(err)
+                    }
+                    if err != nil {
+                        return
+                    }
+                    switch opcode {
+                    case WS_OP_PONG:
+                        atomic.AddInt64(pongs, 1)
+                        continue
+                    case WS_OP_CLOSE:
+                        conn.Write(serverWsFrame(true, WS_OP_CLOSE, payload))
+                        return
+                    }
+                    msg = append(msg, payload...)
+                    if !fin {
+                        continue
+                    }
+                    count++
+                    var out []byte
+                    if count%3 == 0 {
+                        out = append(out, serverWsFrame(true, WS_OP_PING, []byte("hb"))...)
+                    }
+                    half := len(msg) / 2
+                    out = append(out, serverWsFrame(false, WS_OP_TEXT, msg[:half])...)
+                    out = append(out, serverWsFrame(true, WS_OP_PONG, nil)...)
+                    out = append(out, serverWsFrame(true, WS_OP_CONTINUATION, msg[half:])...)
+                    conn.Write(out[:len(out)/2])
+                    conn.Write(out[len(out)/2:])
+                    msg = nil
+                }
+            }()
+        }
+    }()
+    stop := func() {
+        ln.Close()
+        lock.Lock()
+        for conn := range conns {
+            conn.Close()
+        }
+        lock.Unlock()
+        wg.Wait()
+    }
+    return ln, stop
+}
+
+//测试WebSocket插件：握手、分片、ping/pong、close
+func TestWebSocketPlugin(t *testing.T) {
+    var pongs int64
+    ln, stop := startWsEcho(t, &pongs)
+    defer stop()
+
+    plg, err := NewTcpWebSocketPlugin(&WebSocketSpec{
+        Vars         : map[string]VarSpec{"uid": {Type: "int", Min: 1, Max: 100}},
+        URL          : "ws://example.com/push?uid={{uid}}",
+        Subprotocol  : "echo",
+        Message      : `{"uid":{{uid}},"data":"` + strings.Repeat("abc", 100) + `"}`,
+        FragmentSize : 128,
+        Messages     : 5,
+        Expect       : `"uid":{{uid}},`,
+    }, ln.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    result_chan := make(chan *unicorn.CallResult, 50)
+    unc, err := unicorn.NewUnicorn(ln.Addr().String(), plg, 500*time.Millisecond, 0, 300*time.Millisecond, 2, true, result_chan)
+    if err != nil {
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
+    }
+    wg := unc.Start()
+    count_map := make(map[string]int)
+    for ret := range result_chan {
+        if ret.Code != unicorn.RESULT_CODE_SUCCESS && ret.Code != unicorn.RESULT_CODE_WARING_TIMEOUT {
+            t.Errorf("%s: %s\n", ret.Type, ret.Msg)
+        }
+        count_map[ret.Type]++
+    }
+    wg.Wait()
+
+    report := plg.(unicorn.ReporterIntfs).Report()
+    t.Logf("%v\n%s", count_map, report)
+    if count_map[WS_HANDSHAKE_TYPE] == 0 || count_map[WS_CLOSE_TYPE] == 0 {
+        t.Fatalf("Expected handshakes and closes: %v\n", count_map)
+    }
+    //每个会话5条消息，之后close，再重新握手
+    if count_map[WS_MESSAGE_TYPE] < 5*count_map[WS_CLOSE_TYPE] || count_map[WS_HANDSHAKE_TYPE] < count_map[WS_CLOSE_TYPE] {
+        t.Fatalf("Unexpected session shape: %v\n", count_map)
+    }
+    if atomic.LoadInt64(&pongs) == 0 {
+        t.Fatal("Server pings were not answered")
+    }
+
+    if _, err := NewTcpWebSocketPlugin(&WebSocketSpec{Headers: map[string]string{"Sec-WebSocket-Key": "x"}}, ""); err == nil {
+        t.Fatal("Handshake headers should be rejected")
+    }
+}
@@ -0,0 +1,38 @@
+package plugin
+/*
+ * plugin
+ * 按权重随机选择
+ */
+
+import (
+    "errors"
+    "math/rand"
+    "sort"
+)
+
+//按权重随机选择下标，构造之后只读，可以并发使用
+type weightedPicker struct {
+    cumulative []int //权重的前缀和
+    total      int
+}
+
+func newWeightedPicker(weights []int) (*weightedPicker, error) {
+    wp := &weightedPicker{}
+    for _, w := range weights {
+        if w < 0 {
+            return nil, errors.New("Negative weight")
+        }
+        wp.total += w
+        wp.cumulative = append(wp.cumulative, wp.total)
+    }
+    if wp.total == 0 {
+        return nil, errors.New("Total weight is 0")
+    }
+    return wp, nil
+}
+
+//随机选择一个下标，被选中的概率正比于权重
+func (wp *weightedPicker) Pick() int {
+    r := rand.Intn(wp.total)
+    return sort.SearchInts(wp.cumulative, r+1)
+}
@@ -0,0 +1,80 @@
+package main
+
+/*
+ * unicorn proxy：在unicorn和真实的服务端之间启动混沌代理，按时间表注入延迟、抖动、限速、分段以及RST
+ *   ./unicorn proxy -t 10.0.0.1:9527 -latency 50ms -jitter 20ms      # 单一阶段，持续生效
+ *   ./unicorn proxy -s scenarios/chaos.yaml                          # 按时间表
+ *   ./unicorn -c 10 -D 60 -m 1 -k -a 127.0.0.1:9600                  # 压测代理，报告和平常一样
+ */
+import (
+    "flag"
+    "fmt"
+    "os"
+    "os/signal"
+    "syscall"
+    "github.com/hq-cml/unicorn-go/proxy"
+)
+
+func showProxyUsage() {
+    fmt.Println()
+    fmt.Println("Usage: unicorn proxy -t <target>|-s <file> [-l <address>] [-latency <d>] [-jitter <d>] [-bw <bytes/s>] [-fragment <bytes>] [-reset <p>]")
+    fmt.Println()
+    fmt.Println(" -l <address>       listen address (default 127.0.0.1:9600)")
+    fmt.Println(" -t <target>        real server, host:port, overrides the target in the schedule file")
+    fmt.Println(" -s <file>          schedule file (.yaml/.yml/.json), phases of impairments in turn")
+    fmt.Println(" -latency <d>       delay before every forwarded write, e.g. 50ms, when no schedule file")
+    fmt.Println(" -jitter <d>        delay jitter, uniform in [latency-jitter, latency+jitter]")
+    fmt.Println(" -bw <bytes/s>      bandwidth per connection and direction (default 0, unlimited)")
+    fmt.Println(" -fragment <bytes>  split forwarded data into segments of this size (default 0, no split)")
+    fmt.Println(" -reset <p>         probability of resetting the connection on every forwarded write")
+    fmt.Println()
+}
+
+//启动混沌代理，直到收到SIGINT/SIGTERM
+func runProxy(args []string) int {
+    fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+    listen := fs.String("l", "127.0.0.1:9600", "listen address")
+    target := fs.String("t", "", "target")
+    schedule := fs.String("s", "", "schedule file")
+    latency := fs.String("latency", "", "latency")
+    jitter := fs.String("jitter", "", "jitter")
+    bw := fs.Int64("bw", 0, "bandwidth")
+    fragment := fs.Int("fragment", 0, "fragment size")
+    reset := fs.Float64("reset", 0, "reset probability")
+    fs.Usage = showProxyUsage
+    if err := fs.Parse(args); err != nil {
+        return 1
+    }
+
+    spec := &proxy.Spec{
+        Phases : []proxy.Phase{{Latency: *latency, Jitter: *jitter, Bandwidth: *bw, Fragment: *fragment, Reset: *reset}},
+    }
+    if *schedule != "" {
+        var err error
+        if spec, err = proxy.LoadSpec(*schedule); err != nil {
+            fmt.Println("Schedule loading failing:", err)
+            return 1
+        }
+    }
+    if *target != "" {
+        spec.Target = *target
+    }
+    px, err := proxy.NewProxy(spec)
+    if err != nil {
+        fmt.Println("Proxy initialization failing:", err)
+        showProxyUsage()
+        return 1
+    }
+    if err := px.Listen(*listen); err != nil {
+        fmt.Println("Proxy startup failing:", err)
+        return 1
+    }
+    fmt.Printf("Proxying %s -> %s, Ctrl-C to stop...\n", px.Addr(), spec.Target)
+
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+    <-sig
+    px.Close()
+    fmt.Println("Proxy stats:", px.Stats())
+    return 0
+}
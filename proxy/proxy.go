@@ -0,0 +1,326 @@
+package proxy
+/*
+ * proxy
+ * 混沌代理：位于unicorn和真实的服务端之间，按照时间表注入网络故障，
+ * 这样不必修改服务端，就可以用正常的压测和报告观察客户端在恶劣网络下的表现
+ * 时间表由若干阶段组成，每个阶段持续一段时间，依次生效，loop为true时循环，否则停留在最后一个阶段
+ * 故障以每次转发（每个方向上的一次写）为单位，使用当时生效的阶段，长连接上也能观察到阶段的切换：
+ *   latency/jitter : 转发之前的延迟，在[latency-jitter, latency+jitter]之间均匀分布
+ *   bandwidth      : 每个连接每个方向的带宽，字节/秒
+ *   fragment       : 把数据拆成不超过fragment字节的小段逐段发送
+ *   reset          : 按概率以RST断开连接（SO_LINGER=0）
+ *
+ * 示例（YAML）：
+ *   target: 127.0.0.1:9527
+ *   loop: true
+ *   phases:
+ *     - {duration: 10s}                                  #正常
+ *     - {duration: 10s, latency: 50ms, jitter: 20ms}
+ *     - {duration: 10s, bandwidth: 10240, fragment: 16}
+ *     - {duration: 5s, reset: 0.01}
+ */
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "math/rand"
+    "net"
+    "path/filepath"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/hq-cml/unicorn-go/log"
+    "github.com/hq-cml/unicorn-go/testserver"
+    "github.com/hq-cml/unicorn-go/unicorn"
+    "gopkg.in/yaml.v2"
+)
+
+const (
+    PROXY_DIAL_TIMEOUT = 3 * time.Second
+    PROXY_BUFFER_SIZE  = 32768
+    PROXY_WATCH_PERIOD = 100 * time.Millisecond //检查阶段切换的周期
+)
+
+//一个阶段
+type Phase struct {
+    Duration  string  `json:"duration"  yaml:"duration"`  //持续时间，比如10s
+    Latency   string  `json:"latency"   yaml:"latency"`   //可选：延迟，比如50ms
+    Jitter    string  `json:"jitter"    yaml:"jitter"`    //可选：延迟的抖动
+    Bandwidth int64   `json:"bandwidth" yaml:"bandwidth"` //可选：字节/秒，0不限速
+    Fragment  int     `json:"fragment"  yaml:"fragment"`  //可选：分段大小，0不分段
+    Reset     float64 `json:"reset"     yaml:"reset"`     //可选：每次转发以RST断开连接的概率
+}
+
+//代理描述
+type Spec struct {
+    Target string  `json:"target" yaml:"target"` //真实的服务端，host:port
+    Loop   bool    `json:"loop"   yaml:"loop"`
+    Phases []Phase `json:"phases" yaml:"phases"`
+}
+
+//编译后的阶段
+type phase struct {
+    index     int
+    duration  time.Duration
+    latency   time.Duration
+    jitter    time.Duration
+    bandwidth int64
+    fragment  int
+    reset     float64
+}
+
+func (ph *phase) String() string {
+    return fmt.Sprintf("phase %d: latency=%v, jitter=%v, bandwidth=%d, fragment=%d, reset=%v",
+        ph.index, ph.latency, ph.jitter, ph.bandwidth, ph.fragment, ph.reset)
+}
+
+//代理的统计
+type Stats struct {
+    Conns    uint64              //接受的连接数
+    Failures uint64              //连接目标失败的次数
+    Resets   uint64              //注入的RST次数
+    Client   unicorn.ByteCounter //和客户端之间收发的字节数
+}
+
+func (st *Stats) String() string {
+    return fmt.Sprintf("conns: %d, dial failures: %d, resets: %d, from client: %d bytes, to client: %d bytes",
+        atomic.LoadUint64(&st.Conns), atomic.LoadUint64(&st.Failures), atomic.LoadUint64(&st.Resets),
+        atomic.LoadUint64(&st.Client.Recv), atomic.LoadUint64(&st.Client.Sent))
+}
+
+type Proxy struct {
+    target string
+    loop   bool
+    phases []*phase
+    total  time.Duration //一轮的总时长
+    start  time.Time
+    server *testserver.Server
+    stats  *Stats
+    stop   chan bool
+    once   sync.Once
+}
+
+//从文件加载描述，.yaml/.yml按YAML解析，其他按JSON解析
+func LoadSpec(path string) (*Spec, error) {
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var spec Spec
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".yaml", ".yml":
+        err = yaml.Unmarshal(content, &spec)
+    default:
+        err = json.Unmarshal(content, &spec)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("Proxy spec %s: %s", path, err)
+    }
+    return &spec, nil
+}
+
+//解析可以为空的时长
+func parseDuration(s string) (time.Duration, error) {
+    if s == "" {
+        return 0, nil
+    }
+    d, err := time.ParseDuration(s)
+    if err == nil && d < 0 {
+        err = fmt.Errorf("negative duration %s", s)
+    }
+    return d, err
+}
+
+//New函数，编译时间表，创建代理
+func NewProxy(spec *Spec) (*Proxy, error) {
+    if spec.Target == "" {
+        return nil, errors.New("Proxy: empty target")
+    }
+    px := &Proxy{target: spec.Target, loop: spec.Loop, stats: &Stats{}, stop: make(chan bool)}
+    phases := spec.Phases
+    if len(phases) == 0 {
+        phases = []Phase{{}} //没有时间表，原样转发
+    }
+    for i, p := range phases {
+        ph := &phase{index: i, bandwidth: p.Bandwidth, fragment: p.Fragment, reset: p.Reset}
+        var err error
+        if ph.duration, err = parseDuration(p.Duration); err == nil {
+            if ph.latency, err = parseDuration(p.Latency); err == nil {
+                ph.jitter, err = parseDuration(p.Jitter)
+            }
+        }
+        if err != nil {
+            return nil, fmt.Errorf("Proxy: phase %d: %s", i, err)
+        }
+        if ph.duration == 0 && i < len(phases)-1 {
+            return nil, fmt.Errorf("Proxy: phase %d: duration is required except for the last phase", i)
+        }
+        if ph.bandwidth < 0 || ph.fragment < 0 || ph.reset < 0 || ph.reset > 1 {
+            return nil, fmt.Errorf("Proxy: phase %d: bad bandwidth, fragment or reset", i)
+        }
+        px.phases = append(px.phases, ph)
+        px.total += ph.duration
+    }
+    if px.loop && px.total == 0 {
+        return nil, errors.New("Proxy: loop requires phase durations")
+    }
+    px.server = testserver.NewServer(px.handle)
+    return px, nil
+}
+
+//开始监听，时间表从此刻开始计时，有多个阶段时在日志中记录阶段的切换
+func (px *Proxy) Listen(addr string) error {
+    px.start = time.Now()
+    if err := px.server.Listen(addr); err != nil {
+        return err
+    }
+    if len(px.phases) > 1 {
+        go px.watch()
+    }
+    return nil
+}
+
+func (px *Proxy) watch() {
+    ticker := time.NewTicker(PROXY_WATCH_PERIOD)
+    defer ticker.Stop()
+    var last *phase
+    for {
+        if ph := px.current(); ph != last {
+            log.Logger.Info("Proxy enters " + ph.String())
+            last = ph
+        }
+        select {
+        case <-px.stop:
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+func (px *Proxy) Addr() string {
+    return px.server.Addr()
+}
+
+func (px *Proxy) Close() error {
+    px.once.Do(func() { close(px.stop) })
+    return px.server.Close()
+}
+
+func (px *Proxy) Stats() *Stats {
+    return px.stats
+}
+
+//当前生效的阶段
+func (px *Proxy) current() *phase {
+    return px.phaseAt(time.Since(px.start))
+}
+
+func (px *Proxy) phaseAt(elapsed time.Duration) *phase {
+    if px.loop {
+        elapsed %= px.total
+    }
+    for _, ph := range px.phases {
+        if elapsed < ph.duration {
+            return ph
+        }
+        elapsed -= ph.duration
+    }
+    return px.phases[len(px.phases)-1]
+}
+
+//处理一个客户端连接：连接目标，双向转发，任意一个方向结束则关闭两端
+func (px *Proxy) handle(client net.Conn) {
+    atomic.AddUint64(&px.stats.Conns, 1)
+    server, err := net.DialTimeout("tcp", px.target, PROXY_DIAL_TIMEOUT)
+    if err != nil {
+        atomic.AddUint64(&px.stats.Failures, 1)
+        return
+    }
+    defer server.Close()
+
+    counted := px.stats.Client.Wrapper()(client)
+    pair := [2]net.Conn{client, server}
+    done := make(chan bool, 2)
+    go func() {
+        io.CopyBuffer(px.wrap(server, pair), counted, make([]byte, PROXY_BUFFER_SIZE))
+        done <- true
+    }()
+    go func() {
+        io.CopyBuffer(px.wrap(counted, pair), server, make([]byte, PROXY_BUFFER_SIZE))
+        done <- true
+    }()
+    <-done
+}
+
+//注入故障的包装，作用在写的方向上，pair是客户端以及目标的原始连接，用于设置socket选项以及RST
+func (px *Proxy) wrap(conn net.Conn, pair [2]net.Conn) net.Conn {
+    return &chaosConn{Conn: conn, px: px, pair: pair}
+}
+
+type chaosConn struct {
+    net.Conn
+    px   *Proxy
+    pair [2]net.Conn
+}
+
+func (cc *chaosConn) Write(b []byte) (int, error) {
+    ph := cc.px.current()
+    if ph.reset > 0 && rand.Float64() < ph.reset {
+        atomic.AddUint64(&cc.px.stats.Resets, 1)
+        cc.reset()
+        return 0, errors.New("Proxy: connection reset injected")
+    }
+
+    delay := ph.latency
+    if ph.jitter > 0 {
+        delay += time.Duration(rand.Int63n(int64(2*ph.jitter)+1)) - ph.jitter
+    }
+    if delay > 0 {
+        time.Sleep(delay)
+    }
+
+    size := len(b)
+    if ph.fragment > 0 {
+        size = ph.fragment
+        cc.setNoDelay()
+    }
+    written := 0
+    for written < len(b) {
+        end := written + size
+        if end > len(b) {
+            end = len(b)
+        }
+        n, err := cc.Conn.Write(b[written:end])
+        written += n
+        if err != nil {
+            return written, err
+        }
+        //按带宽等待这一段应该花费的时间
+        if ph.bandwidth > 0 {
+            time.Sleep(time.Duration(int64(n) * int64(time.Second) / ph.bandwidth))
+        }
+    }
+    return written, nil
+}
+
+func (cc *chaosConn) setNoDelay() {
+    for _, conn := range cc.pair {
+        if tc, ok := conn.(*net.TCPConn); ok {
+            tc.SetNoDelay(true)
+        }
+    }
+}
+
+//以RST关闭两端的连接（unix socket上的客户端只是普通的关闭）
+func (cc *chaosConn) reset() {
+    for _, conn := range cc.pair {
+        if tc, ok := conn.(*net.TCPConn); ok {
+            tc.SetLinger(0)
+        }
+        conn.Close()
+    }
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+    "net"
+    "strings"
+    "testing"
+    "time"
+    "github.com/hq-cml/unicorn-go/plugin"
+    "github.com/hq-cml/unicorn-go/testserver"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//启动回显服务端以及它前面的代理
+func startProxy(t *testing.T, phases ...Phase) (*Proxy, *testserver.Server) {
+    srv := testserver.NewEchoServer()
+    if err := srv.Listen("127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    px, err := NewProxy(&Spec{Target: srv.Addr(), Phases: phases})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := px.Listen("127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    return px, srv
+}
+
+//经过代理回显一次，返回耗时以及读到的次数
+func echoOnce(t *testing.T, conn net.Conn, msg string) (time.Duration, int, error) {
+    start := time.Now()
+    if _, err := conn.Write([]byte(msg)); err != nil {
+        return 0, 0, err
+    }
+    buf := make([]byte, len(msg))
+    got, reads := 0, 0
+    for got < len(msg) {
+        n, err := conn.Read(buf[got:])
+        if err != nil {
+            return 0, reads, err
+        }
+        got += n
+        reads++
+    }
+    if string(buf) != msg {
+        t.Fatalf("Echo mismatch: %q\n", buf)
+    }
+    return time.Since(start), reads, nil
+}
+
+//测试时间表：阶段依次生效，循环以及停留在最后一个阶段
+func TestSchedule(t *testing.T) {
+    phases := []Phase{{Duration: "1s"}, {Duration: "2s", Latency: "10ms"}, {Duration: "1s", Reset: 0.5}}
+    px, err := NewProxy(&Spec{Target: "127.0.0.1:1", Phases: phases})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for elapsed, expect := range map[time.Duration]int{0: 0, 1500 * time.Millisecond: 1, 3500 * time.Millisecond: 2, time.Minute: 2} {
+        if ph := px.phaseAt(elapsed); ph.index != expect {
+            t.Fatalf("%v: expected phase %d, got %d\n", elapsed, expect, ph.index)
+        }
+    }
+    px.loop = true
+    if ph := px.phaseAt(5500 * time.Millisecond); ph.index != 1 {
+        t.Fatalf("Loop: expected phase 1, got %d\n", ph.index)
+    }
+
+    for _, bad := range [][]Phase{{{Latency: "10ms"}, {Duration: "1s"}}, {{Duration: "1s", Reset: 2}}, {{Duration: "1x"}}} {
+        if _, err := NewProxy(&Spec{Target: "127.0.0.1:1", Phases: bad}); err == nil {
+            t.Fatalf("%v: expected error\n", bad)
+        }
+    }
+}
+
+//测试延迟、分段以及带宽
+func TestImpairments(t *testing.T) {
+    px, srv := startProxy(t, Phase{Latency: "30ms", Jitter: "10ms", Fragment: 4, Bandwidth: 2000})
+    defer srv.Close()
+    defer px.Close()
+    conn, err := net.Dial("tcp", px.Addr())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    msg := strings.Repeat("0123456789", 10)
+    elapsed, reads, err := echoOnce(t, conn, msg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Logf("elapsed %v, reads %d, %s\n", elapsed, reads, px.Stats())
+    //两个方向各有至少20ms延迟，100字节在2000字节/秒的带宽下各需要50ms
+    if elapsed < 140*time.Millisecond || reads < 2 {
+        t.Fatalf("Impairments not applied: elapsed %v, reads %d\n", elapsed, reads)
+    }
+    if st := px.Stats(); st.Conns != 1 || st.Client.Recv != 100 || st.Client.Sent != 100 {
+        t.Fatalf("Unexpected stats: %s\n", st)
+    }
+}
+
+//测试RST：客户端收到connection reset，unicorn的报告中出现Call Error
+func TestReset(t *testing.T) {
+    px, srv := startProxy(t, Phase{Reset: 0.3})
+    defer srv.Close()
+    defer px.Close()
+
+    conn, err := net.Dial("tcp", px.Addr())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    for i := 0; i < 100; i++ {
+        if _, _, err = echoOnce(t, conn, "hello"); err != nil {
+            break
+        }
+    }
+    if err == nil || !strings.Contains(err.Error(), "reset") {
+        t.Fatalf("Expected connection reset, got %v\n", err)
+    }
+
+    result_chan := make(chan *unicorn.CallResult, 50)
+    unc, err := unicorn.NewUnicorn(px.Addr(), plugin.NewTcpEchoPlugin(), 100*time.Millisecond, 0, 300*time.Millisecond, 2, true, result_chan)
+    if err != nil {
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
+    }
+    wg := unc.Start()
+    count_map := make(map[unicorn.ResultCode]int)
+    for ret := range result_chan {
+        count_map[ret.Code]++
+    }
+    wg.Wait()
+    t.Logf("%v, %s\n", count_map, px.Stats())
+    if count_map[unicorn.RESULT_CODE_SUCCESS] == 0 || count_map[unicorn.RESULT_CODE_ERROR_CALL] == 0 || px.Stats().Resets == 0 {
+        t.Fatalf("Expected successes and call errors: %v\n", count_map)
+    }
+}
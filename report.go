@@ -0,0 +1,261 @@
+package main
+
+/*
+ * 测试报告：汇总调用结果，按结果码以及请求类型分类统计
+ */
+import (
+    "fmt"
+    "math/bits"
+    "sort"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//耗时直方图的精度：按2的幂分段，每段等分为HIST_SUB_BUCKETS个桶，分位数的相对误差不超过1/HIST_SUB_BUCKETS
+const (
+    HIST_SUB_BITS    = 5
+    HIST_SUB_BUCKETS = 1 << HIST_SUB_BITS
+    HIST_BUCKETS     = (64 - HIST_SUB_BITS) * HIST_SUB_BUCKETS //耗时是int64，最大的桶对应2^62以上
+)
+
+//一组耗时的直方图，用于计算分布，内存固定，不随请求数增长
+type durations struct {
+    counts [HIST_BUCKETS]uint64
+    n      uint64
+    sum    time.Duration
+    min    time.Duration
+    max    time.Duration
+}
+
+//耗时所在的桶，小于HIST_SUB_BUCKETS纳秒的耗时每个值一个桶
+func histIndex(v uint64) int {
+    if v < HIST_SUB_BUCKETS {
+        return int(v)
+    }
+    shift := bits.Len64(v) - HIST_SUB_BITS - 1
+    return (shift+1)*HIST_SUB_BUCKETS + int(v>>uint(shift)) - HIST_SUB_BUCKETS
+}
+
+//桶的取值范围[low, low+width)
+func histRange(i int) (uint64, uint64) {
+    if i < HIST_SUB_BUCKETS {
+        return uint64(i), 1
+    }
+    shift := uint(i/HIST_SUB_BUCKETS - 1)
+    return uint64(i%HIST_SUB_BUCKETS+HIST_SUB_BUCKETS) << shift, 1 << shift
+}
+
+func (ds *durations) add(d time.Duration) {
+    if d < 0 {
+        d = 0
+    }
+    if ds.n == 0 || d < ds.min {
+        ds.min = d
+    }
+    if d > ds.max {
+        ds.max = d
+    }
+    ds.n++
+    ds.sum += d
+    ds.counts[histIndex(uint64(d))]++
+}
+
+//耗时分布的摘要
+func (ds *durations) summary() string {
+    if ds.n == 0 {
+        return "none"
+    }
+    return fmt.Sprintf("avg=%v, min=%v, p50=%v, p90=%v, p99=%v, max=%v",
+        ds.sum/time.Duration(ds.n), ds.min, ds.percentile(0.5), ds.percentile(0.9), ds.percentile(0.99), ds.max)
+}
+
+//分位数：所在桶的中点，限制在[min, max]之内
+func (ds *durations) percentile(p float64) time.Duration {
+    rank := uint64(float64(ds.n) * p)
+    if rank >= ds.n {
+        rank = ds.n - 1
+    }
+    var seen uint64
+    for i, c := range ds.counts {
+        seen += c
+        if seen > rank {
+            low, width := histRange(i)
+            d := time.Duration(low + width/2)
+            if d < ds.min {
+                d = ds.min
+            }
+            if d > ds.max {
+                d = ds.max
+            }
+            return d
+        }
+    }
+    return ds.max
+}
+
+//字节数的可读形式，1024进制
+func formatBytes(n float64) string {
+    units := []string{"B", "KB", "MB", "GB"}
+    i := 0
+    for n >= 1024 && i < len(units)-1 {
+        n /= 1024
+        i++
+    }
+    return fmt.Sprintf("%.2f%s", n, units[i])
+}
+
+//一组结果的统计
+type statistic struct {
+    total    int
+    countMap map[unicorn.ResultCode]int //将结果按Code分类收集
+    elapses  durations                  //耗时直方图，用于计算分位数
+}
+
+func newStatistic() *statistic {
+    return &statistic{countMap: make(map[unicorn.ResultCode]int)}
+}
+
+func (st *statistic) add(ret *unicorn.CallResult) {
+    st.total++
+    st.countMap[ret.Code]++
+    st.elapses.add(ret.Elapse)
+}
+
+//打印耗时分布以及结果码分布，indent是缩进
+func (st *statistic) show(indent string, duration time.Duration) {
+    success_cnt := st.countMap[unicorn.RESULT_CODE_SUCCESS]
+
+    fmt.Printf("%sRequests: %d, Success: %d, TPS: %.2f\n", indent, st.total, success_cnt, float64(success_cnt)/duration.Seconds())
+    if st.total > 0 {
+        fmt.Printf("%sLatency : %s\n", indent, st.elapses.summary())
+    }
+    codes := make([]int, 0, len(st.countMap))
+    for code := range st.countMap {
+        codes = append(codes, int(code))
+    }
+    sort.Ints(codes)
+    for _, code := range codes {
+        code_plain := unicorn.ConvertCodePlain(unicorn.ResultCode(code))
+        fmt.Printf("%s  Code plain: %s, Count: %d.\n", indent, code_plain, st.countMap[unicorn.ResultCode(code)])
+    }
+}
+
+//测试报告
+type report struct {
+    all        *statistic
+    byType     map[string]*statistic //按请求类型分类
+    byEndpoint map[string]*statistic //按目标节点分类
+    connects   durations             //建连耗时
+    handshakes durations             //TLS握手耗时
+    traffic    *unicorn.ByteCounter  //收发的字节数，可以为空
+}
+
+func newReport() *report {
+    return &report{
+        all        : newStatistic(),
+        byType     : make(map[string]*statistic),
+        byEndpoint : make(map[string]*statistic),
+    }
+}
+
+func (r *report) add(ret *unicorn.CallResult) {
+    r.all.add(ret)
+    if ret.Connect > 0 {
+        r.connects.add(ret.Connect)
+    }
+    if ret.Handshake > 0 {
+        r.handshakes.add(ret.Handshake)
+    }
+    if ret.Type != "" {
+        addTo(r.byType, ret.Type, ret)
+    }
+    if ret.Endpoint != "" {
+        addTo(r.byEndpoint, ret.Endpoint, ret)
+    }
+}
+
+//按name分类收集
+func addTo(m map[string]*statistic, name string, ret *unicorn.CallResult) {
+    st, ok := m[name]
+    if !ok {
+        st = newStatistic()
+        m[name] = st
+    }
+    st.add(ret)
+}
+
+//按名字排序，依次打印分类统计
+func (r *report) showGroup(title string, m map[string]*statistic, duration time.Duration) {
+    names := make([]string, 0, len(m))
+    for name := range m {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    fmt.Println()
+    fmt.Println(title)
+    for _, name := range names {
+        st := m[name]
+        fmt.Printf("  [%s] %.2f%% of results\n", name, 100*float64(st.total)/float64(r.all.total))
+        st.show("    ", duration)
+    }
+}
+
+//打印测试报告
+func (r *report) show(unc *unicorn.Unicorn) {
+    success_cnt := r.all.countMap[unicorn.RESULT_CODE_SUCCESS]
+    tps := float64(success_cnt) / unc.Duration.Seconds()
+
+    //打印测试配置，便于对比不同的测试
+    fmt.Println()
+    fmt.Println()
+    fmt.Println("[CONFIG]")
+    fmt.Println("Target          :", unc.Address())
+    fmt.Println("Transport       :", fmt.Sprintf("%s, endpoints: %d, balance: %s", unc.Network(), len(unc.Endpoints()), unc.Balance()))
+    fmt.Println("Socket  options :", unc.SocketOptions())
+
+    //打印最终结果
+    fmt.Println()
+    fmt.Println("[FINAL REPORT]")
+    fmt.Println("All     requests:", unc.AllCnt)
+    fmt.Println("Success requests:", success_cnt)
+    fmt.Println("Ignore  requests:", unc.IgnoreCnt)
+    fmt.Printf("Average TPS     : %.2f\n", tps)
+    fmt.Println("Percent of Succ :", fmt.Sprintf("%.3f", 100*(float64(success_cnt)/float64(unc.AllCnt))), "%")
+    //UDP：丢失和迟到分开统计
+    if unc.Network() == unicorn.NETWORK_UDP {
+        lost := r.all.countMap[unicorn.RESULT_CODE_WARING_LOST]
+        late := r.all.countMap[unicorn.RESULT_CODE_WARING_TIMEOUT]
+        fmt.Println("Loss    rate    :", fmt.Sprintf("%.3f", 100*(float64(lost)/float64(unc.AllCnt))), "%", fmt.Sprintf("(lost: %d, late: %d)", lost, late))
+    }
+    //吞吐量：连接上实际收发的字节数（TLS时为加密之后的）
+    if r.traffic != nil {
+        secs := unc.Duration.Seconds()
+        fmt.Printf("Throughput      : sent %s/s, recv %s/s (total sent %s, recv %s)\n",
+            formatBytes(float64(r.traffic.Sent)/secs), formatBytes(float64(r.traffic.Recv)/secs),
+            formatBytes(float64(r.traffic.Sent)), formatBytes(float64(r.traffic.Recv)))
+    }
+    fmt.Println("Time    Duration:", unc.Duration)
+    fmt.Println()
+
+    //打印详细结果
+    fmt.Println("Detail infomation:")
+    r.all.show("  ", unc.Duration)
+
+    //打印建连阶段的耗时
+    fmt.Println()
+    fmt.Println("Connection phases:")
+    fmt.Printf("  Connect   (%d): %s\n", r.connects.n, r.connects.summary())
+    if r.handshakes.n > 0 {
+        fmt.Printf("  Handshake (%d): %s\n", r.handshakes.n, r.handshakes.summary())
+    }
+
+    //按请求类型打印
+    if len(r.byType) > 0 {
+        r.showGroup("Detail by request type:", r.byType, unc.Duration)
+    }
+
+    //按目标节点打印，便于找出有问题的节点
+    if len(unc.Endpoints()) > 1 {
+        r.showGroup("Detail by endpoint:", r.byEndpoint, unc.Duration)
+    }
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+    "math"
+    "math/rand"
+    "sort"
+    "testing"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//测试耗时直方图：分位数和精确值的相对误差在一个桶的宽度之内
+func TestDurations(t *testing.T) {
+    var ds durations
+    if ds.summary() != "none" {
+        t.Fatalf("Unexpected empty summary: %s\n", ds.summary())
+    }
+
+    var exact []time.Duration
+    for i := 0; i < 100000; i++ {
+        //跨越多个数量级：微秒到秒
+        d := time.Duration(rand.ExpFloat64() * float64(time.Millisecond) * float64(1+i%1000))
+        exact = append(exact, d)
+        ds.add(d)
+    }
+    sort.Slice(exact, func(i, j int) bool { return exact[i] < exact[j] })
+    if ds.n != uint64(len(exact)) || ds.min != exact[0] || ds.max != exact[len(exact)-1] {
+        t.Fatalf("Unexpected n/min/max: %d %v %v\n", ds.n, ds.min, ds.max)
+    }
+    for _, p := range []float64{0, 0.5, 0.9, 0.99, 0.999, 1} {
+        i := int(float64(len(exact)) * p)
+        if i >= len(exact) {
+            i = len(exact) - 1
+        }
+        got, want := float64(ds.percentile(p)), float64(exact[i])
+        if got < want*(1-1.0/HIST_SUB_BUCKETS) || got > want*(1+1.0/HIST_SUB_BUCKETS) {
+            t.Fatalf("p%v: expected about %v, got %v\n", p*100, exact[i], ds.percentile(p))
+        }
+    }
+
+    //每个桶的取值范围首尾相接，覆盖全部的取值
+    next := uint64(0)
+    for i := 0; i < HIST_BUCKETS; i++ {
+        low, width := histRange(i)
+        if low != next || histIndex(low) != i || histIndex(low+width-1) != i {
+            t.Fatalf("Bucket %d: [%d, +%d) after %d\n", i, low, width, next)
+        }
+        next = low + width
+    }
+    if histIndex(uint64(math.MaxInt64)) != HIST_BUCKETS-1 {
+        t.Fatal("Unexpected index of the largest duration")
+    }
+}
+
+//测试报告按请求类型以及节点分类
+func TestReportBreakdown(t *testing.T) {
+    rpt := newReport()
+    results := []*unicorn.CallResult{
+        {Type: "read", Endpoint: "a", Code: unicorn.RESULT_CODE_SUCCESS, Elapse: time.Millisecond, Connect: time.Millisecond},
+        {Type: "read", Endpoint: "b", Code: unicorn.RESULT_CODE_WARING_TIMEOUT, Elapse: 50 * time.Millisecond},
+        {Type: "write", Endpoint: "a", Code: unicorn.RESULT_CODE_SUCCESS, Elapse: 2 * time.Millisecond},
+        {Type: "write/set", Endpoint: "a", Code: unicorn.RESULT_CODE_ERROR_RESPONSE, Elapse: 3 * time.Millisecond},
+        {Code: unicorn.RESULT_CODE_SUCCESS, Elapse: time.Millisecond},
+    }
+    for _, ret := range results {
+        rpt.add(ret)
+    }
+
+    if rpt.all.total != 5 || rpt.all.countMap[unicorn.RESULT_CODE_SUCCESS] != 3 || rpt.connects.n != 1 {
+        t.Fatalf("Unexpected overall statistic: %+v\n", rpt.all.countMap)
+    }
+    if len(rpt.byType) != 3 || len(rpt.byEndpoint) != 2 {
+        t.Fatalf("Unexpected groups: %d types, %d endpoints\n", len(rpt.byType), len(rpt.byEndpoint))
+    }
+    read := rpt.byType["read"]
+    if read.total != 2 || read.countMap[unicorn.RESULT_CODE_SUCCESS] != 1 || read.countMap[unicorn.RESULT_CODE_WARING_TIMEOUT] != 1 ||
+        read.elapses.max != 50*time.Millisecond {
+        t.Fatalf("Unexpected read statistic: %d %+v\n", read.total, read.countMap)
+    }
+    if rpt.byType["write/set"].countMap[unicorn.RESULT_CODE_ERROR_RESPONSE] != 1 || rpt.byEndpoint["a"].total != 3 {
+        t.Fatal("Unexpected write/set or endpoint statistic")
+    }
+}
@@ -0,0 +1,99 @@
+package main
+
+/*
+ * unicorn serve <kind>：启动一个进程内的测试服务端，不依赖外部项目就可以端到端地测试插件
+ *   ./unicorn serve echo                           # 回显，配合 -m 0
+ *   ./unicorn serve equation -a 127.0.0.1:9527     # 算式，配合 -m 1
+ *   ./unicorn serve reversi                        # 简化版黑白棋，配合 -m 2
+ *   ./unicorn serve scripted -s scenarios/scripted.yaml   # 配合 -m 5 -s scenarios/login.yaml
+ *   ./unicorn serve echo -f scenarios/faults.yaml         # 按概率注入故障，验证客户端的错误处理
+ */
+import (
+    "flag"
+    "fmt"
+    "os"
+    "os/signal"
+    "syscall"
+    "github.com/hq-cml/unicorn-go/testserver"
+)
+
+func showServeUsage() {
+    fmt.Println()
+    fmt.Println("Usage: unicorn serve <echo|equation|reversi|scripted> [-a <address>] [-s <file>] [-f <file>]")
+    fmt.Println()
+    fmt.Println(" -a <address>       listen address: host:port, unix:///path/to/sock or unix-abstract:name")
+    fmt.Println("                    (default 127.0.0.1:9527)")
+    fmt.Println(" -s <file>          rules file (.yaml/.yml/.json), used by scripted")
+    fmt.Println(" -f <file>          fault spec (.yaml/.yml/.json): latency, hang, garbage, coalesce, drop, split")
+    fmt.Println()
+}
+
+//启动测试服务端，直到收到SIGINT/SIGTERM
+func serve(args []string) int {
+    if len(args) == 0 {
+        showServeUsage()
+        return 1
+    }
+    kind := args[0]
+    fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+    addr := fs.String("a", "127.0.0.1:9527", "listen address")
+    rules := fs.String("s", "", "rules file")
+    faults := fs.String("f", "", "fault spec")
+    fs.Usage = showServeUsage
+    if err := fs.Parse(args[1:]); err != nil {
+        return 1
+    }
+
+    var srv *testserver.Server
+    switch kind {
+    case "echo":
+        srv = testserver.NewEchoServer()
+    case "equation":
+        srv = testserver.NewEquationServer()
+    case "reversi":
+        srv = testserver.NewReversiServer()
+    case "scripted":
+        spec, err := testserver.LoadScriptedSpec(*rules)
+        if err != nil {
+            fmt.Println("Rules loading failing:", err)
+            return 1
+        }
+        if srv, err = testserver.NewScriptedServer(spec); err != nil {
+            fmt.Println("Scripted server initialization failing:", err)
+            return 1
+        }
+    default:
+        fmt.Println("Unknown server kind:", kind)
+        showServeUsage()
+        return 1
+    }
+
+    var stats *testserver.FaultStats
+    if *faults != "" {
+        spec, err := testserver.LoadFaultSpec(*faults)
+        if err != nil {
+            fmt.Println("Fault spec loading failing:", err)
+            return 1
+        }
+        if stats, err = srv.InjectFaults(spec); err != nil {
+            fmt.Println("Fault injection failing:", err)
+            return 1
+        }
+    }
+
+    if err := srv.Listen(*addr); err != nil {
+        fmt.Println("Server startup failing:", err)
+        return 1
+    }
+    fmt.Printf("Serving %s on %s, Ctrl-C to stop...\n", kind, srv.Addr())
+
+    sig := make(chan os.Signal, 1)
+    signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+    <-sig
+    srv.Close()
+    fmt.Println("Server served client cnt is:", srv.ConnCount())
+    if stats != nil {
+        fmt.Println("Injected faults:", stats)
+    }
+    return 0
+}
@@ -0,0 +1,21 @@
+package testserver
+/*
+ * testserver
+ * 回显服务端：收到什么就返回什么
+ */
+
+import (
+    "io"
+    "net"
+)
+
+const (
+    ECHO_BUFFER_SIZE = 32768 //每次读取的最大长度
+)
+
+//New函数，创建回显服务端
+func NewEchoServer() *Server {
+    return NewServer(func(conn net.Conn) {
+        io.CopyBuffer(conn, conn, make([]byte, ECHO_BUFFER_SIZE))
+    })
+}
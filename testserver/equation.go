@@ -0,0 +1,112 @@
+package testserver
+/*
+ * testserver
+ * 算式服务端：每行一个JSON请求，计算之后返回一行JSON响应，协议和plugin/equation.go一致
+ *   Operands/Operator形式：从左到右依次计算，结果在Result中
+ *   Expr形式：用expr包求值，结果（可能是大整数或者小数）在Value中
+ * 无法解析的请求以及计算错误（比如除以0），在Err中返回错误，无法解析的请求Id为0
+ */
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net"
+    "strconv"
+    "github.com/hq-cml/unicorn-go/expr"
+)
+
+const (
+    EQUATION_DELIM = '\n'
+)
+
+//请求，和plugin.ServerEquationReq一致
+type EquationReq struct {
+    Id       int64
+    Operands []int
+    Operator string
+    Expr     string
+}
+
+//响应，和plugin.ServerEquationResp一致
+type EquationResp struct {
+    Id      int64
+    Formula string
+    Result  int
+    Value   string `json:",omitempty"`
+    Err     string `json:",omitempty"`
+}
+
+//New函数，创建算式服务端
+func NewEquationServer() *Server {
+    return NewServer(func(conn net.Conn) {
+        reader := bufio.NewReader(conn)
+        for {
+            line, err := reader.ReadBytes(EQUATION_DELIM)
+            if err != nil {
+                return
+            }
+            resp, _ := json.Marshal(AnswerEquation(line))
+            if _, err := conn.Write(append(resp, EQUATION_DELIM)); err != nil {
+                return
+            }
+        }
+    })
+}
+
+//计算一个请求
+func AnswerEquation(req []byte) EquationResp {
+    var resp EquationResp
+    var sreq EquationReq
+    if err := json.Unmarshal(req, &sreq); err != nil {
+        resp.Err = fmt.Sprintf("Server: Req Unmarshal Error: %s", err)
+        return resp
+    }
+    resp.Id = sreq.Id
+    if sreq.Expr != "" {
+        v, err := expr.Eval(sreq.Expr)
+        if err != nil {
+            resp.Err = fmt.Sprintf("Server: Eval Error: %s", err)
+            return resp
+        }
+        resp.Value = v.String()
+        resp.Formula = sreq.Expr + " = " + resp.Value
+        return resp
+    }
+
+    if len(sreq.Operands) == 0 {
+        resp.Err = "Server: Op Error: no operands"
+        return resp
+    }
+    var formula bytes.Buffer
+    result := sreq.Operands[0]
+    formula.WriteString(strconv.Itoa(result))
+    for _, v := range sreq.Operands[1:] {
+        switch sreq.Operator {
+        case "+":
+            result += v
+        case "-":
+            result -= v
+        case "*":
+            result *= v
+        case "/", "%":
+            if v == 0 {
+                resp.Err = "Server: Op Error: " + expr.ErrDivByZero.Error()
+                return resp
+            }
+            if sreq.Operator == "/" {
+                result /= v
+            } else {
+                result %= v
+            }
+        default:
+            resp.Err = fmt.Sprintf("Server: Op Error: unknown operator %q", sreq.Operator)
+            return resp
+        }
+        fmt.Fprintf(&formula, " %s %d", sreq.Operator, v)
+    }
+    resp.Result = result
+    resp.Formula = fmt.Sprintf("%s = %d", formula.String(), result)
+    return resp
+}
@@ -0,0 +1,209 @@
+package testserver
+/*
+ * testserver
+ * 故障注入：让服务端故意出错，用来验证客户端（包括unicorn自身）的错误处理
+ * 以服务端的每次写（即一个响应）为单位，按概率注入以下故障，互不排斥，依次判定：
+ *   hang     : 不响应，吞掉这个响应，连接保持
+ *   latency  : 响应之前的延迟，写法和思考时间一致（fixed:5ms、uniform:1ms-20ms、exp:5ms），每个响应都生效
+ *   garbage  : 把响应替换成同样长度的随机内容
+ *   coalesce : 暂存响应，和下一个响应合并发送，没有下一个响应则在coalesce_wait之后发送
+ *   drop     : 只发送响应的前半部分，然后断开连接
+ *   split    : 把响应拆成split_size字节的小段，逐段发送
+ *
+ * 示例（YAML）：
+ *   latency: exp:2ms
+ *   hang: 0.01
+ *   garbage: 0.01
+ *   coalesce: 0.05
+ *   drop: 0.01
+ *   split: 0.2
+ *   split_size: 1
+ */
+
+import (
+    "fmt"
+    "math/rand"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+const (
+    FAULT_DEFAULT_SPLIT_SIZE    = 1
+    FAULT_DEFAULT_COALESCE_WAIT = "10ms"
+    FAULT_SPLIT_PAUSE           = time.Millisecond //小段之间的间隔，避免被内核合并成一个段
+)
+
+//故障描述
+type FaultSpec struct {
+    Latency      string  `json:"latency"       yaml:"latency"`
+    Hang         float64 `json:"hang"          yaml:"hang"`
+    Garbage      float64 `json:"garbage"       yaml:"garbage"`
+    Coalesce     float64 `json:"coalesce"      yaml:"coalesce"`
+    CoalesceWait string  `json:"coalesce_wait" yaml:"coalesce_wait"` //默认10ms
+    Drop         float64 `json:"drop"          yaml:"drop"`
+    Split        float64 `json:"split"         yaml:"split"`
+    SplitSize    int     `json:"split_size"    yaml:"split_size"`    //默认1
+}
+
+//注入的故障计数
+type FaultStats struct {
+    Responses uint64 //全部响应数
+    Hang      uint64
+    Garbage   uint64
+    Coalesce  uint64
+    Drop      uint64
+    Split     uint64
+}
+
+func (fs *FaultStats) String() string {
+    return fmt.Sprintf("responses: %d, hang: %d, garbage: %d, coalesce: %d, drop: %d, split: %d",
+        atomic.LoadUint64(&fs.Responses), atomic.LoadUint64(&fs.Hang), atomic.LoadUint64(&fs.Garbage),
+        atomic.LoadUint64(&fs.Coalesce), atomic.LoadUint64(&fs.Drop), atomic.LoadUint64(&fs.Split))
+}
+
+//编译后的故障描述
+type faultInjector struct {
+    spec         FaultSpec
+    latency      unicorn.ThinkTimerIntfs //可以为空
+    coalesceWait time.Duration
+    stats        *FaultStats
+}
+
+//从文件加载故障描述
+func LoadFaultSpec(path string) (*FaultSpec, error) {
+    var spec FaultSpec
+    if err := unmarshalFile(path, &spec); err != nil {
+        return nil, fmt.Errorf("Fault spec %s: %s", path, err)
+    }
+    return &spec, nil
+}
+
+//给服务端注入故障，需要在Listen之前调用，返回的计数随着服务端运行而更新
+func (srv *Server) InjectFaults(spec *FaultSpec) (*FaultStats, error) {
+    fi := &faultInjector{spec: *spec, stats: &FaultStats{}}
+    for name, p := range map[string]float64{"hang": spec.Hang, "garbage": spec.Garbage, "coalesce": spec.Coalesce, "drop": spec.Drop, "split": spec.Split} {
+        if p < 0 || p > 1 {
+            return nil, fmt.Errorf("Fault: %s probability %v out of [0, 1]", name, p)
+        }
+    }
+    var err error
+    if spec.Latency != "" {
+        if fi.latency, err = unicorn.ParseThinkTimer(spec.Latency); err != nil {
+            return nil, fmt.Errorf("Fault: latency: %s", err)
+        }
+    }
+    wait := spec.CoalesceWait
+    if wait == "" {
+        wait = FAULT_DEFAULT_COALESCE_WAIT
+    }
+    if fi.coalesceWait, err = time.ParseDuration(wait); err != nil {
+        return nil, fmt.Errorf("Fault: coalesce wait: %s", err)
+    }
+    if fi.spec.SplitSize == 0 {
+        fi.spec.SplitSize = FAULT_DEFAULT_SPLIT_SIZE
+    } else if fi.spec.SplitSize < 0 {
+        return nil, fmt.Errorf("Fault: negative split size %d", fi.spec.SplitSize)
+    }
+
+    inner := srv.handler
+    srv.handler = func(conn net.Conn) {
+        fc := &faultConn{Conn: conn, fi: fi}
+        defer fc.flush()
+        inner(fc)
+    }
+    return fi.stats, nil
+}
+
+//注入故障的连接，服务端的每次写作为一个响应
+type faultConn struct {
+    net.Conn
+    fi      *faultInjector
+    lock    sync.Mutex   //pending可能被定时器并发发送
+    pending []byte       //等待合并发送的响应
+    timer   *time.Timer
+}
+
+func hit(p float64) bool {
+    return p > 0 && rand.Float64() < p
+}
+
+func (fc *faultConn) Write(b []byte) (int, error) {
+    fi := fc.fi
+    atomic.AddUint64(&fi.stats.Responses, 1)
+    if hit(fi.spec.Hang) {
+        atomic.AddUint64(&fi.stats.Hang, 1)
+        return len(b), nil
+    }
+    if fi.latency != nil {
+        time.Sleep(fi.latency.Next())
+    }
+    resp := b
+    if hit(fi.spec.Garbage) {
+        atomic.AddUint64(&fi.stats.Garbage, 1)
+        resp = make([]byte, len(b))
+        for i := range resp {
+            resp[i] = byte(rand.Intn(256))
+        }
+    }
+
+    fc.lock.Lock()
+    defer fc.lock.Unlock()
+    if hit(fi.spec.Coalesce) {
+        atomic.AddUint64(&fi.stats.Coalesce, 1)
+        fc.pending = append(fc.pending, resp...)
+        if fc.timer == nil {
+            fc.timer = time.AfterFunc(fi.coalesceWait, fc.flush)
+        }
+        return len(b), nil
+    }
+    //和暂存的响应合并
+    if len(fc.pending) > 0 {
+        resp = append(fc.pending, resp...)
+        fc.pending = nil
+    }
+
+    if hit(fi.spec.Drop) {
+        atomic.AddUint64(&fi.stats.Drop, 1)
+        fc.Conn.Write(resp[:len(resp)/2])
+        fc.Conn.Close()
+        return 0, fmt.Errorf("Fault: connection dropped")
+    }
+    if hit(fi.spec.Split) {
+        atomic.AddUint64(&fi.stats.Split, 1)
+        if tc, ok := fc.Conn.(*net.TCPConn); ok {
+            tc.SetNoDelay(true)
+        }
+        for off := 0; off < len(resp); off += fi.spec.SplitSize {
+            end := off + fi.spec.SplitSize
+            if end > len(resp) {
+                end = len(resp)
+            }
+            if _, err := fc.Conn.Write(resp[off:end]); err != nil {
+                return 0, err
+            }
+            time.Sleep(FAULT_SPLIT_PAUSE)
+        }
+        return len(b), nil
+    }
+    if _, err := fc.Conn.Write(resp); err != nil {
+        return 0, err
+    }
+    return len(b), nil
+}
+
+//发送暂存的响应
+func (fc *faultConn) flush() {
+    fc.lock.Lock()
+    defer fc.lock.Unlock()
+    if fc.timer != nil {
+        fc.timer.Stop()
+        fc.timer = nil
+    }
+    if len(fc.pending) > 0 {
+        fc.Conn.Write(fc.pending)
+        fc.pending = nil
+    }
+}
@@ -0,0 +1,116 @@
+package testserver
+
+import (
+    "bytes"
+    "fmt"
+    "math/rand"
+    "testing"
+    "time"
+    "github.com/hq-cml/unicorn-go/unicorn"
+)
+
+//测试用的行协议插件：发送一行随机内容，期望原样返回
+type linePlugin struct{}
+
+func (lp *linePlugin) GenRequest(id int64) unicorn.RawRequest {
+    return unicorn.RawRequest{Id: id, Req: []byte(fmt.Sprintf("%d:%d\n", id, rand.Int63()))}
+}
+
+func (lp *linePlugin) CheckFull(raw_req *unicorn.RawRequest, response []byte) unicorn.ServerRespStatus {
+    if len(response) < len(raw_req.Req) {
+        return unicorn.SER_NEEDMORE
+    }
+    return unicorn.SER_OK
+}
+
+func (lp *linePlugin) CheckResponse(raw_req unicorn.RawRequest, response []byte) (unicorn.ResultCode, string) {
+    if !bytes.Equal(raw_req.Req, response) {
+        return unicorn.RESULT_CODE_ERROR_RESPONSE, fmt.Sprintf("Mismatch: %q", response)
+    }
+    return unicorn.RESULT_CODE_SUCCESS, "Success"
+}
+
+//对带故障的回显服务端施压，返回各结果码的计数
+func runFaults(t *testing.T, spec *FaultSpec) (map[unicorn.ResultCode]int, *FaultStats) {
+    srv := NewEchoServer()
+    stats, err := srv.InjectFaults(spec)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Listen("127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Close()
+
+    result_chan := make(chan *unicorn.CallResult, 50)
+    unc, err := unicorn.NewUnicorn(srv.Addr(), &linePlugin{}, 100*time.Millisecond, 0, 500*time.Millisecond, 4, true, result_chan)
+    if err != nil {
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
+    }
+    wg := unc.Start()
+    count_map := make(map[unicorn.ResultCode]int)
+    for ret := range result_chan {
+        count_map[ret.Code]++
+    }
+    //故障不应该让引擎卡住
+    done := make(chan bool)
+    go func() {
+        wg.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("Unicorn did not stop")
+    }
+    t.Logf("%v, %s\n", count_map, stats)
+    return count_map, stats
+}
+
+//响应拆成单字节小段，以及多个响应合并：CheckFull的循环需要正确处理
+func TestFaultFraming(t *testing.T) {
+    //测试结束时正在进行的请求可能超时
+    count_map, stats := runFaults(t, &FaultSpec{Split: 1})
+    if count_map[unicorn.RESULT_CODE_SUCCESS] == 0 || len(count_map) > 2 || stats.Split == 0 {
+        t.Fatalf("Split responses should all succeed: %v\n", count_map)
+    }
+    for code := range count_map {
+        if code != unicorn.RESULT_CODE_SUCCESS && code != unicorn.RESULT_CODE_WARING_TIMEOUT {
+            t.Fatalf("Split responses should all succeed: %v\n", count_map)
+        }
+    }
+
+    //合并之后，响应晚于超时到达，或者和下一个响应粘在一起
+    count_map, stats = runFaults(t, &FaultSpec{Coalesce: 0.2, CoalesceWait: "150ms"})
+    if count_map[unicorn.RESULT_CODE_SUCCESS] == 0 || count_map[unicorn.RESULT_CODE_WARING_TIMEOUT] == 0 || stats.Coalesce == 0 {
+        t.Fatalf("Expected successes and timeouts: %v\n", count_map)
+    }
+}
+
+//各种故障混合：超时、错误的响应、断开的连接都应该出现在结果中
+func TestFaultMix(t *testing.T) {
+    spec := &FaultSpec{
+        Latency  : "uniform:0ms-2ms",
+        Hang     : 0.1,
+        Garbage  : 0.1,
+        Drop     : 0.1,
+        Split    : 0.2,
+        Coalesce : 0.05,
+    }
+    count_map, stats := runFaults(t, spec)
+    for _, code := range []unicorn.ResultCode{unicorn.RESULT_CODE_SUCCESS, unicorn.RESULT_CODE_WARING_TIMEOUT, unicorn.RESULT_CODE_ERROR_RESPONSE, unicorn.RESULT_CODE_ERROR_CALL} {
+        if count_map[code] == 0 {
+            t.Fatalf("Missing %s in %v\n", unicorn.ConvertCodePlain(code), count_map)
+        }
+    }
+    if stats.Hang == 0 || stats.Garbage == 0 || stats.Drop == 0 {
+        t.Fatalf("Faults not injected: %s\n", stats)
+    }
+
+    if _, err := NewEchoServer().InjectFaults(&FaultSpec{Drop: 1.5}); err == nil {
+        t.Fatal("Probability out of range should fail")
+    }
+    if _, err := NewEchoServer().InjectFaults(&FaultSpec{Latency: "gauss:1ms"}); err == nil {
+        t.Fatal("Bad latency should fail")
+    }
+}
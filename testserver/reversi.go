@@ -0,0 +1,169 @@
+package testserver
+/*
+ * testserver
+ * 简化版的黑白棋服务端，配合plugin/reversi.go使用：客户端执黑，服务端自己执白
+ * 消息格式（服务端 -> 客户端）：
+ *   U1\n          客户端为黑子，和首局棋盘一起发送
+ *   B<64字节>\n   棋盘，按行排列，'0'为空，'1'为黑子，'2'为白子
+ *   W1\n/W0\n/W2\n 客户端胜/负/平
+ *   G\n           对局结束，随后关闭连接
+ * 客户端 -> 服务端：先上报名字（N开头），之后每条消息是一次落子，取消息中的前两个数字作为行、列（从0开始），
+ * 不能解析或者不合法的落子视为放弃本轮
+ * 简化之处：不做超时判负，服务端总是选择第一个合法的位置落子
+ */
+
+import (
+    "net"
+    "time"
+)
+
+const (
+    REVERSI_EMPTY = 0
+    REVERSI_BLACK = 1
+    REVERSI_WHITE = 2
+    REVERSI_PAUSE = 50 * time.Millisecond //W和G之间的间隔，客户端需要分两次读取
+)
+
+var reversiDirs = [8][2]int{{-1, -1}, {-1, 0}, {-1, 1}, {0, -1}, {0, 1}, {1, -1}, {1, 0}, {1, 1}}
+
+type reversiBoard [8][8]int8
+
+func newReversiBoard() *reversiBoard {
+    b := &reversiBoard{}
+    b[3][3], b[4][4] = REVERSI_WHITE, REVERSI_WHITE
+    b[3][4], b[4][3] = REVERSI_BLACK, REVERSI_BLACK
+    return b
+}
+
+//落子，返回翻转的棋子数，为0表示不合法，此时棋盘不变
+func (b *reversiBoard) place(row, col int, who int8) int {
+    if row < 0 || row > 7 || col < 0 || col > 7 || b[row][col] != REVERSI_EMPTY {
+        return 0
+    }
+    flipped := 0
+    for _, d := range reversiDirs {
+        r, c, n := row+d[0], col+d[1], 0
+        for r >= 0 && r <= 7 && c >= 0 && c <= 7 && b[r][c] == 3-who {
+            r, c, n = r+d[0], c+d[1], n+1
+        }
+        if n == 0 || r < 0 || r > 7 || c < 0 || c > 7 || b[r][c] != who {
+            continue
+        }
+        for i := 1; i <= n; i++ {
+            b[row+i*d[0]][col+i*d[1]] = who
+        }
+        flipped += n
+    }
+    if flipped > 0 {
+        b[row][col] = who
+    }
+    return flipped
+}
+
+//第一个合法的落子位置
+func (b *reversiBoard) firstMove(who int8) (int, int, bool) {
+    for row := 0; row < 8; row++ {
+        for col := 0; col < 8; col++ {
+            tmp := *b
+            if tmp.place(row, col, who) > 0 {
+                return row, col, true
+            }
+        }
+    }
+    return 0, 0, false
+}
+
+func (b *reversiBoard) count(who int8) int {
+    n := 0
+    for _, line := range b {
+        for _, v := range line {
+            if v == who {
+                n++
+            }
+        }
+    }
+    return n
+}
+
+//棋盘消息
+func (b *reversiBoard) message() []byte {
+    msg := make([]byte, 0, 66)
+    msg = append(msg, 'B')
+    for _, line := range b {
+        for _, v := range line {
+            msg = append(msg, byte('0'+v))
+        }
+    }
+    return append(msg, '\n')
+}
+
+//从落子消息中取出行、列
+func parseReversiMove(msg []byte) (int, int, bool) {
+    var digits []int
+    for _, c := range msg {
+        if c >= '0' && c <= '9' {
+            digits = append(digits, int(c-'0'))
+            if len(digits) == 2 {
+                return digits[0], digits[1], true
+            }
+        }
+    }
+    return 0, 0, false
+}
+
+//New函数，创建黑白棋服务端
+func NewReversiServer() *Server {
+    return NewServer(func(conn net.Conn) {
+        buf := make([]byte, 1024)
+        //上报名字
+        if _, err := conn.Read(buf); err != nil {
+            return
+        }
+        board := newReversiBoard()
+        if _, err := conn.Write(append([]byte("U1\n"), board.message()...)); err != nil {
+            return
+        }
+
+        for {
+            n, err := conn.Read(buf)
+            if err != nil {
+                return
+            }
+            if row, col, ok := parseReversiMove(buf[:n]); ok {
+                board.place(row, col, REVERSI_BLACK)
+            }
+
+            //服务端落子，直到客户端有位置可以落子，或者双方都无子可落
+            over := false
+            for {
+                if row, col, ok := board.firstMove(REVERSI_WHITE); ok {
+                    board.place(row, col, REVERSI_WHITE)
+                }
+                if _, _, ok := board.firstMove(REVERSI_BLACK); ok {
+                    break
+                }
+                if _, _, ok := board.firstMove(REVERSI_WHITE); !ok {
+                    over = true
+                    break
+                }
+            }
+            if !over {
+                if _, err := conn.Write(board.message()); err != nil {
+                    return
+                }
+                continue
+            }
+
+            result := "W2\n"
+            if black, white := board.count(REVERSI_BLACK), board.count(REVERSI_WHITE); black > white {
+                result = "W1\n"
+            } else if black < white {
+                result = "W0\n"
+            }
+            conn.Write([]byte(result))
+            time.Sleep(REVERSI_PAUSE)
+            conn.Write([]byte("G\n"))
+            return
+        }
+    })
+}
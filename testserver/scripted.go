@@ -0,0 +1,158 @@
+package testserver
+/*
+ * testserver
+ * 通用的脚本化服务端：按规则文件应答，用来模拟各种简单的文本协议
+ * 按定界方式切分出请求，依次匹配规则，第一个匹配的规则决定响应，响应中可以用$1、${name}引用正则的分组；
+ * 都不匹配时返回default，default为空则不应答
+ *
+ * 示例（YAML）：
+ *   framing: {type: delim, delim: "\n"}   #或者{type: raw}，每次读取到的内容作为一个请求
+ *   rules:
+ *     - {match: "^PING", reply: "PONG\n"}
+ *     - {match: "^GET (\\w+)", reply: "VALUE $1\n", delay: 5ms}
+ *     - {match: "^QUIT", reply: "BYE\n", close: true}
+ *   default: "ERR unknown command\n"
+ */
+
+import (
+    "bufio"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "time"
+    "gopkg.in/yaml.v2"
+)
+
+//定界方式
+const (
+    SCRIPTED_FRAMING_DELIM = "delim" //以定界符结尾（默认，定界符默认为\n）
+    SCRIPTED_FRAMING_RAW   = "raw"   //每次读取到的内容作为一个请求
+    SCRIPTED_READ_SIZE     = 32768
+)
+
+//规则文件
+type ScriptedSpec struct {
+    Framing ScriptedFraming `json:"framing" yaml:"framing"`
+    Rules   []ScriptedRule  `json:"rules"   yaml:"rules"`
+    Default string          `json:"default" yaml:"default"`
+}
+
+type ScriptedFraming struct {
+    Type  string `json:"type"  yaml:"type"`
+    Delim string `json:"delim" yaml:"delim"`
+}
+
+type ScriptedRule struct {
+    Match string `json:"match" yaml:"match"` //匹配请求的正则
+    Reply string `json:"reply" yaml:"reply"` //响应模板
+    Delay string `json:"delay" yaml:"delay"` //可选：应答之前的延迟，比如5ms
+    Close bool   `json:"close" yaml:"close"` //可选：应答之后关闭连接
+}
+
+//编译后的规则
+type scriptedRule struct {
+    re    *regexp.Regexp
+    reply string
+    delay time.Duration
+    close bool
+}
+
+//从文件加载描述，.yaml/.yml按YAML解析，其他按JSON解析
+func unmarshalFile(path string, v interface{}) error {
+    content, err := ioutil.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".yaml", ".yml":
+        return yaml.Unmarshal(content, v)
+    default:
+        return json.Unmarshal(content, v)
+    }
+}
+
+//从文件加载规则
+func LoadScriptedSpec(path string) (*ScriptedSpec, error) {
+    var spec ScriptedSpec
+    if err := unmarshalFile(path, &spec); err != nil {
+        return nil, fmt.Errorf("Scripted spec %s: %s", path, err)
+    }
+    return &spec, nil
+}
+
+//New函数，编译规则，创建脚本化服务端
+func NewScriptedServer(spec *ScriptedSpec) (*Server, error) {
+    var delim byte
+    switch spec.Framing.Type {
+    case "", SCRIPTED_FRAMING_DELIM:
+        delim = '\n'
+        if len(spec.Framing.Delim) > 1 {
+            return nil, errors.New("Scripted: delim should be a single byte")
+        } else if len(spec.Framing.Delim) == 1 {
+            delim = spec.Framing.Delim[0]
+        }
+    case SCRIPTED_FRAMING_RAW:
+    default:
+        return nil, fmt.Errorf("Scripted: unknown framing %s", spec.Framing.Type)
+    }
+
+    var rules []scriptedRule
+    for i, r := range spec.Rules {
+        re, err := regexp.Compile(r.Match)
+        if err != nil {
+            return nil, fmt.Errorf("Scripted: rule %d: %s", i, err)
+        }
+        rule := scriptedRule{re: re, reply: r.Reply, close: r.Close}
+        if r.Delay != "" {
+            if rule.delay, err = time.ParseDuration(r.Delay); err != nil {
+                return nil, fmt.Errorf("Scripted: rule %d: %s", i, err)
+            }
+        }
+        rules = append(rules, rule)
+    }
+
+    raw := spec.Framing.Type == SCRIPTED_FRAMING_RAW
+    return NewServer(func(conn net.Conn) {
+        reader := bufio.NewReader(conn)
+        buf := make([]byte, SCRIPTED_READ_SIZE)
+        for {
+            var req []byte
+            var err error
+            if raw {
+                var n int
+                n, err = reader.Read(buf)
+                req = buf[:n]
+            } else {
+                req, err = reader.ReadBytes(delim)
+            }
+            if err != nil {
+                return
+            }
+
+            reply, quit := spec.Default, false
+            for _, rule := range rules {
+                m := rule.re.FindSubmatchIndex(req)
+                if m == nil {
+                    continue
+                }
+                time.Sleep(rule.delay)
+                reply = string(rule.re.Expand(nil, []byte(rule.reply), req, m))
+                quit = rule.close
+                break
+            }
+            if reply != "" {
+                if _, err := conn.Write([]byte(reply)); err != nil {
+                    return
+                }
+            }
+            if quit {
+                return
+            }
+        }
+    }), nil
+}
@@ -0,0 +1,157 @@
+package testserver
+/*
+ * testserver
+ * 进程内的测试服务端，不依赖外部项目就可以端到端地测试各个插件：
+ *   echo     : 回显
+ *   equation : 算式，配合plugin/equation.go
+ *   reversi  : 简化版的黑白棋服务端，配合plugin/reversi.go
+ *   scripted : 按规则文件应答的通用文本服务端
+ * 既可以在测试中直接使用，也可以通过 unicorn serve <kind> 启动
+ *
+ * 用法：
+ *   srv := testserver.NewEchoServer()
+ *   if err := srv.Listen("127.0.0.1:0"); err != nil { ... }
+ *   defer srv.Close()
+ *   addr := srv.Addr()
+ */
+
+import (
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+//连接的处理函数，返回之后连接会被关闭
+type Handler func(conn net.Conn)
+
+//测试服务端：负责监听、接收连接以及关闭，每个连接的协议由Handler实现
+type Server struct {
+    handler  Handler
+    listener net.Listener
+    lock     sync.Mutex
+    active   bool
+    conns    map[net.Conn]bool  //活跃的连接，关闭服务端时一并关闭
+    wg       sync.WaitGroup
+    connCnt  int64              //处理过的连接数
+}
+
+//New函数，创建一个服务端，handler处理每个连接
+func NewServer(handler Handler) *Server {
+    return &Server{handler: handler, conns: make(map[net.Conn]bool)}
+}
+
+//解析监听地址：host:port、tcp://host:port、unix:///path或者unix-abstract:name
+func parseListenAddr(addr string) (string, string) {
+    switch {
+    case strings.HasPrefix(addr, "tcp://"):
+        return "tcp", strings.TrimPrefix(addr, "tcp://")
+    case strings.HasPrefix(addr, "unix://"):
+        return "unix", strings.TrimPrefix(addr, "unix://")
+    case strings.HasPrefix(addr, "unix-abstract:"):
+        return "unix", "@" + strings.TrimPrefix(addr, "unix-abstract:")
+    }
+    return "tcp", addr
+}
+
+//开始监听，立即返回，连接在后台处理
+func (srv *Server) Listen(addr string) error {
+    srv.lock.Lock()
+    defer srv.lock.Unlock()
+    if srv.active {
+        return fmt.Errorf("Server already listening on %s", srv.listener.Addr())
+    }
+    network, address := parseListenAddr(addr)
+    if network == "unix" && !strings.HasPrefix(address, "@") {
+        os.Remove(address) //上次遗留的socket文件
+    }
+    ln, err := net.Listen(network, address)
+    if err != nil {
+        return err
+    }
+    srv.listener = ln
+    srv.active = true
+    srv.wg.Add(1)
+    go srv.serve(ln)
+    return nil
+}
+
+func (srv *Server) serve(ln net.Listener) {
+    defer srv.wg.Done()
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            srv.lock.Lock()
+            active := srv.active
+            srv.lock.Unlock()
+            if !active {
+                return //已经关闭
+            }
+            continue
+        }
+        if !srv.track(conn, true) {
+            conn.Close()
+            return
+        }
+        atomic.AddInt64(&srv.connCnt, 1)
+        srv.wg.Add(1)
+        go func() {
+            defer srv.wg.Done()
+            defer srv.track(conn, false)
+            defer conn.Close()
+            srv.handler(conn)
+        }()
+    }
+}
+
+//登记或者注销一个连接，服务端已经关闭时登记失败
+func (srv *Server) track(conn net.Conn, add bool) bool {
+    srv.lock.Lock()
+    defer srv.lock.Unlock()
+    if !add {
+        delete(srv.conns, conn)
+        return true
+    }
+    if !srv.active {
+        return false
+    }
+    srv.conns[conn] = true
+    return true
+}
+
+//实际监听的地址，监听端口为0时可以由此得到系统分配的端口
+func (srv *Server) Addr() string {
+    srv.lock.Lock()
+    defer srv.lock.Unlock()
+    if srv.listener == nil {
+        return ""
+    }
+    if srv.listener.Addr().Network() == "unix" {
+        return "unix://" + srv.listener.Addr().String()
+    }
+    return srv.listener.Addr().String()
+}
+
+//处理过的连接数
+func (srv *Server) ConnCount() int64 {
+    return atomic.LoadInt64(&srv.connCnt)
+}
+
+//关闭监听以及全部活跃的连接，等待处理函数全部退出
+func (srv *Server) Close() error {
+    srv.lock.Lock()
+    if !srv.active {
+        srv.lock.Unlock()
+        return nil
+    }
+    srv.active = false
+    err := srv.listener.Close()
+    for conn := range srv.conns {
+        conn.Close()
+    }
+    srv.lock.Unlock()
+    srv.wg.Wait()
+    return err
+}
@@ -0,0 +1,180 @@
+package testserver
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func dial(t *testing.T, srv *Server) net.Conn {
+    network, address := parseListenAddr(srv.Addr())
+    conn, err := net.DialTimeout(network, address, time.Second)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    return conn
+}
+
+//测试回显服务端，以及关闭时断开活跃的连接
+func TestEchoServer(t *testing.T) {
+    for _, addr := range []string{"127.0.0.1:0", "unix://" + filepath.Join(os.TempDir(), "unicorn-testserver.sock")} {
+        srv := NewEchoServer()
+        if err := srv.Listen(addr); err != nil {
+            t.Fatal(err)
+        }
+        conn := dial(t, srv)
+        msg := make([]byte, 100000)
+        for i := range msg {
+            msg[i] = byte(i)
+        }
+        go conn.Write(msg)
+        got := make([]byte, len(msg))
+        if _, err := io.ReadFull(conn, got); err != nil || string(got) != string(msg) {
+            t.Fatalf("%s: echo mismatch, %v\n", addr, err)
+        }
+
+        srv.Close()
+        if _, err := conn.Read(got); err == nil {
+            t.Fatalf("%s: connection should be closed with the server\n", addr)
+        }
+        if srv.ConnCount() != 1 {
+            t.Fatalf("%s: unexpected conn count %d\n", addr, srv.ConnCount())
+        }
+        conn.Close()
+    }
+}
+
+//测试算式服务端：两种请求形式以及错误
+func TestEquationServer(t *testing.T) {
+    srv := NewEquationServer()
+    if err := srv.Listen("127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Close()
+    conn := dial(t, srv)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+
+    cases := []struct {
+        req    string
+        expect EquationResp
+    }{
+        {`{"Id":1,"Operands":[0,5],"Operator":"+"}`, EquationResp{Id: 1, Result: 5, Formula: "0 + 5 = 5"}},
+        {`{"Id":2,"Expr":"(1 + 2) * 3 - 4 / 2"}`, EquationResp{Id: 2, Value: "7", Formula: "(1 + 2) * 3 - 4 / 2 = 7"}},
+        {`{"Id":3,"Expr":"99999999999999999999 + 1"}`, EquationResp{Id: 3, Value: "100000000000000000000", Formula: "99999999999999999999 + 1 = 100000000000000000000"}},
+        {`{"Id":4,"Expr":"1 / (2 - 2)"}`, EquationResp{Id: 4, Err: "Server: Eval Error: division by zero"}},
+        {`{"Id":5,"Operands":[1,0],"Operator":"%"}`, EquationResp{Id: 5, Err: "Server: Op Error: division by zero"}},
+    }
+    for _, c := range cases {
+        fmt.Fprintf(conn, "%s\n", c.req)
+        line, err := reader.ReadBytes('\n')
+        if err != nil {
+            t.Fatal(err)
+        }
+        var resp EquationResp
+        if err := json.Unmarshal(line, &resp); err != nil || resp != c.expect {
+            t.Fatalf("%s: got %s\n", c.req, line)
+        }
+    }
+
+    fmt.Fprintf(conn, "{\"Id\":6,\n")
+    line, err := reader.ReadBytes('\n')
+    var resp EquationResp
+    if err != nil || json.Unmarshal(line, &resp) != nil || resp.Id != 0 || resp.Err == "" {
+        t.Fatalf("Malformed request: got %s %v\n", line, err)
+    }
+}
+
+//测试黑白棋服务端：按服务端的规则落子，直到对局结束
+func TestReversiServer(t *testing.T) {
+    srv := NewReversiServer()
+    if err := srv.Listen("127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Close()
+    conn := dial(t, srv)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+
+    conn.Write([]byte("Nunicorn"))
+    if line, err := reader.ReadString('\n'); err != nil || line != "U1\n" {
+        t.Fatalf("Expected U1, got %q %v\n", line, err)
+    }
+    moves := 0
+    for {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            t.Fatal(err)
+        }
+        if line[0] == 'W' {
+            break
+        }
+        if len(line) != 66 || line[0] != 'B' {
+            t.Fatalf("Bad board %q\n", line)
+        }
+        board := &reversiBoard{}
+        for i, c := range line[1:65] {
+            board[i/8][i%8] = int8(c - '0')
+        }
+        row, col, ok := board.firstMove(REVERSI_BLACK)
+        if !ok {
+            t.Fatalf("Board sent without black moves: %q\n", line)
+        }
+        fmt.Fprintf(conn, "M%d%d", row, col)
+        moves++
+    }
+    if line, err := reader.ReadString('\n'); err != nil || line != "G\n" {
+        t.Fatalf("Expected G, got %q %v\n", line, err)
+    }
+    if moves < 5 {
+        t.Fatalf("Game too short: %d moves\n", moves)
+    }
+}
+
+//测试脚本化服务端：分组引用、默认响应、关闭连接
+func TestScriptedServer(t *testing.T) {
+    spec := &ScriptedSpec{
+        Rules   : []ScriptedRule{
+            {Match: "^GET (\\w+)", Reply: "VALUE $1\n", Delay: "10ms"},
+            {Match: "^QUIT", Reply: "BYE\n", Close: true},
+        },
+        Default : "ERR\n",
+    }
+    srv, err := NewScriptedServer(spec)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := srv.Listen("127.0.0.1:0"); err != nil {
+        t.Fatal(err)
+    }
+    defer srv.Close()
+    conn := dial(t, srv)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+
+    for _, c := range [][2]string{{"GET foo\n", "VALUE foo\n"}, {"PUT x\n", "ERR\n"}} {
+        conn.Write([]byte(c[0]))
+        if line, err := reader.ReadString('\n'); err != nil || line != c[1] {
+            t.Fatalf("%q: got %q %v\n", c[0], line, err)
+        }
+    }
+    conn.Write([]byte("QUIT\n"))
+    if line, _ := reader.ReadString('\n'); line != "BYE\n" {
+        t.Fatalf("Expected BYE, got %q\n", line)
+    }
+    if _, err := reader.ReadByte(); err != io.EOF {
+        t.Fatalf("Expected EOF after QUIT, got %v\n", err)
+    }
+
+    spec.Rules[0].Match = "("
+    if _, err := NewScriptedServer(spec); err == nil {
+        t.Fatal("Bad regex should fail")
+    }
+}
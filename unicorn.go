@@ -9,33 +9,130 @@ import (
     "github.com/hq-cml/unicorn-go/plugin"
     "time"
     "os"
+    "path/filepath"
+    "strconv"
+    "strings"
 )
 
 var ip *string = flag.String("h", "127.0.0.1", "ip")
 var port *string = flag.String("p", "9527", "port")
+var a *string = flag.String("a", "", "target address url")
+var b *string = flag.String("b", "rr", "balance strategy")
+var resolve *bool = flag.Bool("resolve", false, "resolve hostname into endpoints")
+var src *string = flag.String("src", "", "source ips")
+var srcPorts *string = flag.String("src-ports", "", "source port range")
+var reuseAddr *bool = flag.Bool("reuseaddr", false, "SO_REUSEADDR")
+var nodelay *bool = flag.Bool("nodelay", true, "TCP_NODELAY")
+var sndbuf *int = flag.Int("sndbuf", 0, "SO_SNDBUF")
+var rcvbuf *int = flag.Int("rcvbuf", 0, "SO_RCVBUF")
+var tcpKeepalive *int64 = flag.Int64("tcp-keepalive", 0, "tcp keepalive interval")
+var linger *int64 = flag.Int64("linger", 0, "SO_LINGER")
+var rst *bool = flag.Bool("rst", false, "reset on close")
+var quickack *bool = flag.Bool("quickack", false, "TCP_QUICKACK")
 var c *int = flag.Int("c", 0, "concurrency")
 var q *int = flag.Int("q", 0, "qps")
 var m *int = flag.Int("m", 0, "reversi")
+var x *string = flag.String("x", "", "external plugin command")
+var s *string = flag.String("s", "", "scenario or script file")
+var w *string = flag.String("w", "", "weighted scenario files")
 var t *int64 = flag.Int64("t", 50, "timeout")
+var T *string = flag.String("T", "", "think time")
+var R *uint64 = flag.Uint64("R", 0, "max requests per connection")
+var L *string = flag.String("L", "", "max lifetime per connection")
 var D *int64 = flag.Int64("D", 5, "port")
 var k *bool = flag.Bool("k", false, "keep alive")
+var udp *bool = flag.Bool("u", false, "udp")
 var H *bool = flag.Bool("H", false, "help")
+var tlsOn *bool = flag.Bool("tls", false, "tls transport")
+var tlsCA *string = flag.String("tls-ca", "", "tls ca bundle")
+var tlsCert *string = flag.String("tls-cert", "", "tls client cert")
+var tlsKey *string = flag.String("tls-key", "", "tls client key")
+var tlsSNI *string = flag.String("tls-sni", "", "tls server name")
+var tlsALPN *string = flag.String("tls-alpn", "", "tls alpn protocols")
+var tlsMin *string = flag.String("tls-min", "", "tls min version")
+var tlsMax *string = flag.String("tls-max", "", "tls max version")
+var tlsCiphers *string = flag.String("tls-ciphers", "", "tls cipher suites")
+var tlsResume *bool = flag.Bool("tls-resume", false, "tls session resumption")
+var tlsInsecure *bool = flag.Bool("tls-insecure", false, "tls skip verify")
+var capture *string = flag.String("capture", "", "capture file")
+var record *string = flag.String("record", "", "record file")
+var recordSample *float64 = flag.Float64("record-sample", 1, "record sample rate")
+var recordErrors *bool = flag.Bool("record-errors", false, "always record errors")
+var recordPayload *int = flag.Int("record-payload", 0, "max recorded bytes of request and response")
+var recordMax *int64 = flag.Int64("record-max", 0, "max record file size")
+var recordFiles *int = flag.Int("record-files", 3, "rotated record files kept")
+var bw *int64 = flag.Int64("bw", 0, "bandwidth limit per connection")
+var latency *int64 = flag.Int64("latency", 0, "injected latency")
+var payload *string = flag.String("payload", "fixed:10", "echo payload size distribution")
+var binary *bool = flag.Bool("binary", false, "binary echo payload")
 var v *bool = flag.Bool("v", false, "verbose")
 
 func showUseage() {
     fmt.Println()
     fmt.Println("Usage: unicorn -c <concurrency>|-q <qps> [-h <ip>] [-p <port>] [-D <duration>] [-k <boolean>]")
+    fmt.Println("       unicorn serve <echo|equation|reversi|scripted> [-a <address>] [-s <file>] [-f <file>]")
+    fmt.Println("       unicorn proxy -t <target>|-s <file> [-l <address>] [-latency <d>] [-jitter <d>] [-bw <bytes/s>] [-fragment <bytes>] [-reset <p>]")
+    fmt.Println("       unicorn dump [-errors] [-code <code>] [-conn <id>] [-n <max>] [-brief] <file> [<file>...]")
     fmt.Println()
     fmt.Println("Note: !!!!- The argu 'c' and 'q' can't be set at the same time -!!!!")
     fmt.Println()
     fmt.Println(" -h <hostname>      server hostname (default 127.0.0.1)")
     fmt.Println(" -p <port>          server port (default 9527)")
+    fmt.Println(" -a <address>       target url, overrides -h/-p/-u: tcp://host:port, udp://host:port,")
+    fmt.Println("                    unix:///path/to/sock or unix-abstract:name, comma separated for several endpoints")
+    fmt.Println(" -b <strategy>      balance strategy among endpoints: rr, random, least or hash (default rr)")
+    fmt.Println(" -resolve           resolve the hostname, every IP is an endpoint (default false)")
+    fmt.Println(" -src <ip,ip>       bind connections to these local IPs in turn (default chosen by system)")
+    fmt.Println(" -src-ports <m-n>   local port range, e.g. 20000-60000 (default ephemeral ports)")
+    fmt.Println(" -reuseaddr         enable SO_REUSEADDR on outgoing sockets (default false)")
+    fmt.Println(" -nodelay <boolean> TCP_NODELAY, false enables Nagle's algorithm (default true)")
+    fmt.Println(" -sndbuf <bytes>    SO_SNDBUF (default system)")
+    fmt.Println(" -rcvbuf <bytes>    SO_RCVBUF (default system)")
+    fmt.Println(" -tcp-keepalive <s> TCP keepalive probe interval in seconds, -1 disables it (default 15s)")
+    fmt.Println(" -linger <s>        SO_LINGER in seconds (default system)")
+    fmt.Println(" -rst               close connections with RST, i.e. SO_LINGER=0, no TIME_WAIT (default false)")
+    fmt.Println(" -quickack          TCP_QUICKACK, linux only (default false)")
     fmt.Println(" -c <concurrency>   number of parallel connections")
     fmt.Println(" -q <qps>           qps-- the frequence you wanted for requests")
     fmt.Println(" -t <timeout>       time out of per request (default 50 ms)")
     fmt.Println(" -D <duration>      test time duration for requests (default 5s)")
     fmt.Println(" -k <boolean>       true = keep alive, false = reconnect (default false)")
-    fmt.Println(" -m <mode>          0-echo; 1-equation; 2-reversi")
+    fmt.Println(" -u                 UDP transport, each request is one datagram (default false)")
+    fmt.Println(" -T <think>         think time between requests on a connection: fixed:100ms,")
+    fmt.Println("                    uniform:50ms-200ms or exp:100ms (default none)")
+    fmt.Println(" -R <requests>      max requests per connection before reconnecting (default 0, unlimited)")
+    fmt.Println(" -L <lifetime>      max lifetime per connection before reconnecting, e.g. 30s or 2m (default 0, unlimited)")
+    fmt.Println(" -m <mode>          0-echo; 1-equation; 2-reversi; 3-external; 4-scenario; 5-script; 6-mix; 7-http; 8-redis; 9-memcached; 10-websocket; 11-mqtt; 12-dns; 13-rpc")
+    fmt.Println(" -x <command>       external plugin command line, used by mode 3")
+    fmt.Println(" -s <file>          scenario/script/plugin spec file (.yaml/.yml/.json), used by mode 4/5/7-13,")
+    fmt.Println("                    optional for mode 1")
+    fmt.Println(" -payload <dist>    echo payload size, K/M suffixes allowed: fixed:64, uniform:1K-64K,")
+    fmt.Println("                    lognormal:4K,1.0 (median,sigma) or histogram:<file>, used by mode 0 (default fixed:10)")
+    fmt.Println(" -binary            random binary echo payload instead of letters, used by mode 0 (default false)")
+    fmt.Println(" -w <file:weight,>  weighted scenario files, e.g. read.yaml:70,write.yaml:30, used by mode 6")
+    fmt.Println(" -tls               use TLS transport (default false)")
+    fmt.Println(" -tls-ca <file>     CA bundle in PEM (default system CAs)")
+    fmt.Println(" -tls-cert <file>   client certificate in PEM, for mutual TLS")
+    fmt.Println(" -tls-key <file>    client private key in PEM, for mutual TLS")
+    fmt.Println(" -tls-sni <name>    server name (default the target hostname)")
+    fmt.Println(" -tls-alpn <protos> ALPN protocols, comma separated, e.g. h2,http/1.1")
+    fmt.Println(" -tls-min <ver>     min TLS version: 1.0/1.1/1.2/1.3")
+    fmt.Println(" -tls-max <ver>     max TLS version: 1.0/1.1/1.2/1.3")
+    fmt.Println(" -tls-ciphers <cs>  cipher suites, comma separated")
+    fmt.Println(" -tls-resume        enable TLS session resumption (default false)")
+    fmt.Println(" -tls-insecure      skip server certificate verification (default false)")
+    fmt.Println(" -capture <file>    hex dump the traffic of every connection into file")
+    fmt.Println(" -record <file>     record request/response pairs with timestamps, connection id and result code")
+    fmt.Println("                    into a compact binary file, read it with 'unicorn dump'")
+    fmt.Println(" -record-sample <p> fraction of the requests recorded (default 1, all)")
+    fmt.Println(" -record-errors     always record the results other than success, regardless of sampling (default false)")
+    fmt.Println(" -record-payload <bytes>")
+    fmt.Println("                    max recorded bytes of each request and response (default 0, unlimited)")
+    fmt.Println(" -record-max <bytes>")
+    fmt.Println("                    rotate the record file when it grows over this size (default 0, no rotation)")
+    fmt.Println(" -record-files <n>  rotated record files kept, file.1 is the newest (default 3)")
+    fmt.Println(" -bw <bytes/s>      bandwidth limit per connection and direction (default 0, unlimited)")
+    fmt.Println(" -latency <ms>      latency injected before every write (default 0)")
     fmt.Println(" -H                 show help information")
     fmt.Println(" -v                 verbose (default false)\n")
 }
@@ -49,33 +146,68 @@ func checkParams(q int64, c int64) bool{
     return true
 }
 
-//打印测试报告
-func showReport(count_map map[unicorn.ResultCode]int, unc *unicorn.Unicorn) {
-    success_cnt := count_map[unicorn.RESULT_CODE_SUCCESS]
-    tps := float64(success_cnt) / float64(unc.Duration/time.Second)
+//解析混合参数：file:weight,file:weight，每个场景文件的名字（去掉扩展名）作为请求类型
+func loadMixEntries(spec string) ([]plugin.MixEntry, error) {
+    var entries []plugin.MixEntry
+    for _, item := range strings.Split(spec, ",") {
+        i := strings.LastIndex(item, ":")
+        if i < 0 {
+            return nil, fmt.Errorf("Bad mix item %q, expected file:weight", item)
+        }
+        weight, err := strconv.Atoi(item[i+1:])
+        if err != nil {
+            return nil, fmt.Errorf("Bad weight in %q", item)
+        }
+        sc, err := plugin.LoadScenario(item[:i])
+        if err != nil {
+            return nil, err
+        }
+        plg, err := plugin.NewTcpScenarioPlugin(sc)
+        if err != nil {
+            return nil, err
+        }
+        name := strings.TrimSuffix(filepath.Base(item[:i]), filepath.Ext(item[:i]))
+        entries = append(entries, plugin.MixEntry{Name: name, Weight: weight, Plugin: plg})
+    }
+    return entries, nil
+}
 
-    //打印最终结果
-    fmt.Println()
-    fmt.Println()
-    fmt.Println("[FINAL REPORT]")
-    fmt.Println("All     requests:", unc.AllCnt)
-    fmt.Println("Success requests:", success_cnt)
-    fmt.Println("Ignore  requests:", unc.IgnoreCnt)
-    fmt.Printf("Average TPS     : %.2f\n", tps)
-    fmt.Println("Percent of Succ :", fmt.Sprintf("%.3f", 100*(float64(success_cnt)/float64(unc.AllCnt))), "%")
-    fmt.Println("Time    Duration:", unc.Duration)
-    fmt.Println()
+//解析端口范围：min-max
+func parsePortRange(spec string) (int, int, error) {
+    parts := strings.SplitN(spec, "-", 2)
+    if len(parts) != 2 {
+        return 0, 0, fmt.Errorf("Bad port range %q, expected min-max", spec)
+    }
+    min, err1 := strconv.Atoi(parts[0])
+    max, err2 := strconv.Atoi(parts[1])
+    if err1 != nil || err2 != nil {
+        return 0, 0, fmt.Errorf("Bad port range %q, expected min-max", spec)
+    }
+    return min, max, nil
+}
 
-    //打印详细结果
-    fmt.Println("Detail infomation:")
-    for key, val := range count_map {
-        code_plain := unicorn.ConvertCodePlain(key)
-        fmt.Printf("  Code plain: %s, Count: %d.\n", code_plain, val)
+//HTTP默认的Host头：取第一个目标地址中的host:port，Unix socket使用localhost
+func defaultHttpHost(address string) string {
+    first := strings.TrimSpace(strings.Split(address, ",")[0])
+    if strings.HasPrefix(first, "unix") {
+        return "localhost"
     }
+    return strings.TrimPrefix(first, "tcp://")
 }
 
 func main() {
     runtime.GOMAXPROCS(runtime.NumCPU())
+    //子命令：测试服务端、混沌代理
+    if len(os.Args) > 1 && os.Args[1] == "serve" {
+        os.Exit(serve(os.Args[2:]))
+    }
+    if len(os.Args) > 1 && os.Args[1] == "proxy" {
+        os.Exit(runProxy(os.Args[2:]))
+    }
+    if len(os.Args) > 1 && os.Args[1] == "dump" {
+        os.Exit(dump(os.Args[2:]))
+    }
+
     //解析参数
     flag.Parse()
     if *H  {
@@ -89,17 +221,164 @@ func main() {
     }
 
     address := fmt.Sprintf("%s:%s", *ip, *port)
+    if *udp {
+        address = "udp://" + address
+    }
+    if *a != "" {
+        address = *a
+    }
 
     //初始化Plugin
     mode := int(*m)
     var plg unicorn.PluginIntfs
     switch mode{
         case 0:
-            plg = plugin.NewTcpEchoPlugin()
+            size, err := plugin.ParseSizeDist(*payload)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Payload size parsing failing: %s.\n", err))
+                os.Exit(1)
+            }
+            plg = plugin.NewTcpEchoSizedPlugin(size, *binary)
         case 1:
-            plg = plugin.NewTcpEquationPlugin()
+            if *s == "" {
+                plg = plugin.NewTcpEquationPlugin()
+                break
+            }
+            spec, err := plugin.LoadEquationSpec(*s)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Equation spec loading failing: %s.\n", err))
+                os.Exit(1)
+            }
+            plg, err = plugin.NewTcpEquationSpecPlugin(spec)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Equation plugin initialization failing: %s.\n", err))
+                os.Exit(1)
+            }
         case 2:
             plg = plugin.NewTcpReversiPlugin()
+        case 3:
+            args := strings.Fields(*x)
+            if len(args) == 0 {
+                fmt.Println("External command needed! (-x)")
+                os.Exit(1)
+            }
+            ext, err := plugin.NewTcpExternalPlugin(args[0], args[1:]...)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("External plugin startup failing: %s.\n", err))
+                os.Exit(1)
+            }
+            defer ext.(*plugin.TcpExternalPlugin).Close()
+            plg = ext
+        case 4:
+            sc, err := plugin.LoadScenario(*s)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Scenario loading failing: %s.\n", err))
+                os.Exit(1)
+            }
+            plg, err = plugin.NewTcpScenarioPlugin(sc)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Scenario compiling failing: %s.\n", err))
+                os.Exit(1)
+            }
+        case 5:
+            sc, err := plugin.LoadScript(*s)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Script loading failing: %s.\n", err))
+                os.Exit(1)
+            }
+            plg, err = plugin.NewTcpScriptPlugin(sc)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Script compiling failing: %s.\n", err))
+                os.Exit(1)
+            }
+        case 6:
+            entries, err := loadMixEntries(*w)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Mix loading failing: %s.\n", err))
+                os.Exit(1)
+            }
+            plg, err = plugin.NewTcpMixPlugin(entries)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Mix initialization failing: %s.\n", err))
+                os.Exit(1)
+            }
+        case 7:
+            spec, err := plugin.LoadHttpSpec(*s)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Http spec loading failing: %s.\n", err))
+                os.Exit(1)
+            }
+            plg, err = plugin.NewTcpHttpPlugin(spec, defaultHttpHost(address))
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Http spec compiling failing: %s.\n", err))
+                os.Exit(1)
+            }
+        case 8:
+            spec, err := plugin.LoadRedisSpec(*s)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Redis spec loading failing: %s.\n", err))
+                os.Exit(1)
+            }
+            plg, err = plugin.NewTcpRedisPlugin(spec)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Redis plugin initialization failing: %s.\n", err))
+                os.Exit(1)
+            }
+        case 9:
+            spec, err := plugin.LoadMemcachedSpec(*s)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Memcached spec loading failing: %s.\n", err))
+                os.Exit(1)
+            }
+            plg, err = plugin.NewTcpMemcachedPlugin(spec)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Memcached plugin initialization failing: %s.\n", err))
+                os.Exit(1)
+            }
+        case 10:
+            spec, err := plugin.LoadWebSocketSpec(*s)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("WebSocket spec loading failing: %s.\n", err))
+                os.Exit(1)
+            }
+            plg, err = plugin.NewTcpWebSocketPlugin(spec, defaultHttpHost(address))
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("WebSocket plugin initialization failing: %s.\n", err))
+                os.Exit(1)
+            }
+        case 11:
+            spec, err := plugin.LoadMqttSpec(*s)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Mqtt spec loading failing: %s.\n", err))
+                os.Exit(1)
+            }
+            plg, err = plugin.NewTcpMqttPlugin(spec)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Mqtt plugin initialization failing: %s.\n", err))
+                os.Exit(1)
+            }
+        case 12:
+            spec, err := plugin.LoadDnsSpec(*s)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Dns spec loading failing: %s.\n", err))
+                os.Exit(1)
+            }
+            plg, err = plugin.NewTcpDnsPlugin(spec, !strings.HasPrefix(address, "udp://"))
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Dns plugin initialization failing: %s.\n", err))
+                os.Exit(1)
+            }
+        case 13:
+            spec, err := plugin.LoadRpcSpec(*s)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Rpc spec loading failing: %s.\n", err))
+                os.Exit(1)
+            }
+            plg, err = plugin.NewTcpRpcPlugin(spec)
+            if err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Rpc plugin initialization failing: %s.\n", err))
+                os.Exit(1)
+            }
         default:
             fmt.Println("Mode Wrong!")
             os.Exit(1)
@@ -116,6 +395,136 @@ func main() {
         log.Logger.Fatal(fmt.Sprintf("Unicorn initialization failing: %s.\n",  err))
         return
     }
+    u, ok := unc.(*unicorn.Unicorn)
+    if !ok {
+        fmt.Println("Wrong Type!")
+        return
+    }
+
+    //可选设置：负载均衡
+    if err := u.SetBalance(*b, *resolve); err != nil {
+        log.Logger.Fatal(fmt.Sprintf("Balance initialization failing: %s.\n", err))
+        return
+    }
+
+    //可选设置：源地址绑定
+    if *src != "" || *srcPorts != "" || *reuseAddr {
+        opts := &unicorn.SourceOptions{ReuseAddr: *reuseAddr}
+        if *src != "" {
+            opts.IPs = strings.Split(*src, ",")
+        }
+        if *srcPorts != "" {
+            if opts.PortMin, opts.PortMax, err = parsePortRange(*srcPorts); err != nil {
+                log.Logger.Fatal(fmt.Sprintf("Source port parsing failing: %s.\n", err))
+                return
+            }
+        }
+        sd, err := unicorn.NewSourceDialer(opts)
+        if err != nil {
+            log.Logger.Fatal(fmt.Sprintf("Source address initialization failing: %s.\n", err))
+            return
+        }
+        u.SetDialer(sd)
+    }
+
+    //可选设置：socket选项
+    so := &unicorn.SocketOptions{
+        Nagle        : !*nodelay,
+        SendBuf      : *sndbuf,
+        RecvBuf      : *rcvbuf,
+        KeepAlive    : time.Duration(*tcpKeepalive) * time.Second,
+        Linger       : time.Duration(*linger) * time.Second,
+        ResetOnClose : *rst,
+        QuickAck     : *quickack,
+    }
+    if *tcpKeepalive < 0 {
+        so.KeepAlive = -1
+    }
+    if err := u.SetSocketOptions(so); err != nil {
+        log.Logger.Fatal(fmt.Sprintf("Socket options initialization failing: %s.\n", err))
+        return
+    }
+
+    //可选设置：思考时间、会话长度限制
+    if *T != "" {
+        tt, err := unicorn.ParseThinkTimer(*T)
+        if err != nil {
+            log.Logger.Fatal(fmt.Sprintf("Think time parsing failing: %s.\n", err))
+            return
+        }
+        u.SetThinkTimer(tt)
+    }
+    var lifetime time.Duration
+    if *L != "" {
+        var err error
+        if lifetime, err = time.ParseDuration(*L); err != nil || lifetime < 0 {
+            log.Logger.Fatal(fmt.Sprintf("Max lifetime parsing failing: %q, expected a duration like 30s.\n", *L))
+            return
+        }
+    }
+    u.SetSessionLimit(*R, lifetime)
+
+    //可选设置：TLS
+    if *tlsOn {
+        opts := &unicorn.TLSOptions{
+            CAFile             : *tlsCA,
+            CertFile           : *tlsCert,
+            KeyFile            : *tlsKey,
+            ServerName         : *tlsSNI,
+            MinVersion         : *tlsMin,
+            MaxVersion         : *tlsMax,
+            SessionResumption  : *tlsResume,
+            InsecureSkipVerify : *tlsInsecure,
+        }
+        if *tlsALPN != "" {
+            opts.ALPN = strings.Split(*tlsALPN, ",")
+        }
+        if *tlsCiphers != "" {
+            opts.CipherSuites = strings.Split(*tlsCiphers, ",")
+        }
+        if err := u.SetTLS(opts); err != nil {
+            log.Logger.Fatal(fmt.Sprintf("TLS initialization failing: %s.\n", err))
+            return
+        }
+    }
+
+    //连接包装，依次为字节计数、抓包、限速、延迟注入，其中字节计数总是启用，用于计算吞吐量
+    traffic := &unicorn.ByteCounter{}
+    u.UseConnWrapper(traffic.Wrapper())
+    if *capture != "" {
+        f, err := os.Create(*capture)
+        if err != nil {
+            log.Logger.Fatal(fmt.Sprintf("Capture file creating failing: %s.\n", err))
+            return
+        }
+        defer f.Close()
+        u.UseConnWrapper(unicorn.NewCapturer(f).Wrapper())
+    }
+    if *bw > 0 {
+        u.UseConnWrapper(unicorn.ThrottleWrapper(*bw))
+    }
+    if *latency > 0 {
+        u.UseConnWrapper(unicorn.LatencyWrapper(time.Duration(*latency) * time.Millisecond))
+    }
+
+    //可选设置：流量记录
+    var recorder *unicorn.Recorder
+    if *record != "" {
+        var err error
+        recorder, err = unicorn.NewRecorder(unicorn.RecorderOptions{
+            Path       : *record,
+            Sample     : *recordSample,
+            Errors     : *recordErrors,
+            MaxPayload : *recordPayload,
+            MaxSize    : *recordMax,
+            MaxFiles   : *recordFiles,
+        })
+        if err != nil {
+            log.Logger.Fatal(fmt.Sprintf("Recorder initialization failing: %s.\n", err))
+            return
+        }
+        u.SetRecorder(recorder)
+    }
 
     //开始干活儿! Start可以立刻返回的，进去看就知道~
     if qps != 0 {
@@ -127,9 +536,10 @@ func main() {
     wg := unc.Start()
 
     //主流程在外面做一些总体控制工作，比如，循环阻塞接收结果~
-    count_map := make(map[unicorn.ResultCode]int) //将结果按Code分类收集
+    rpt := newReport() //将结果按Code以及请求类型分类收集
+    rpt.traffic = traffic
     for ret := range result_chan {
-        count_map[ret.Code] ++
+        rpt.add(ret)
         if *v && ret.Code != unicorn.RESULT_CODE_SUCCESS{
             time := fmt.Sprintf(time.Now().Format("15:04:05"))
             log.Logger.Warning(fmt.Sprintf("[%s] Result: Id=%d, Code=%d, Msg=%s, Elapse=%v.\n", time, ret.Id, ret.Code, ret.Msg, ret.Elapse))
@@ -139,13 +549,21 @@ func main() {
     //等着最终结束
     wg.Wait()
 
+    //所有worker都已经退出，刷新记录文件
+    if recorder != nil {
+        if err := recorder.Close(); err != nil {
+            log.Logger.Warning(fmt.Sprintf("Record file closing failing: %s.\n", err))
+        }
+        log.Logger.Info(fmt.Sprintf("Recorded %d request/response pairs into %s (rotated %d times).", recorder.Records, *record, recorder.Rotates))
+    }
+
     //打印测试报告
-    //u := unicorn.Unicorn(unc)
-    u,ok := unc.(*unicorn.Unicorn)
-    if ok {
-        showReport(count_map, u)
-    } else {
-        fmt.Println("Wrong Type!")
+    rpt.show(u)
+
+    //插件自己的统计
+    if rp, ok := plg.(unicorn.ReporterIntfs); ok {
+        fmt.Println()
+        fmt.Print(rp.Report())
     }
 
 }
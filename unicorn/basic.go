@@ -4,11 +4,21 @@ package unicorn
  * 基础类型定义
  */
 import (
+    "crypto/tls"
     "time"
     wp "github.com/hq-cml/unicorn-go/worker-pool"
     "sync"
+    "sync/atomic"
 )
 
+//请求Id的序列，从进程启动时的纳秒数开始递增，并发的worker之间不会重复
+var requestIdSeq = time.Now().UnixNano()
+
+//生成请求Id，插件需要预先分配Id时（比如批量生成请求）也应该使用这个函数，避免和框架分配的Id冲突
+func NextRequestId() int64 {
+    return atomic.AddInt64(&requestIdSeq, 1)
+}
+
 //Unicorn接口
 type UnicornIntfs interface {
     Start() *sync.WaitGroup  //启动unicorn
@@ -18,7 +28,10 @@ type UnicornIntfs interface {
 
 //Unicorn接口的实现类型
 type Unicorn struct {
-    serverAdd   string             //服务端地址
+    serverAdd   string             //服务端地址，可以是逗号分隔的多个地址
+    network     string             //传输方式：tcp/udp/unix，多个节点的传输方式相同
+    endpoints   []*Endpoint        //目标节点
+    balancer    *balancer          //负载均衡器，在多个节点之间分发连接
     qps         uint32             //每秒的请求量，这个值和下面concurrency不同时设置，因为会存在一定的矛盾
     concurrency uint32             //并发量，这个值不能喝qps同时设置，可以用户指定，或者根据timeout和qps算出来
     timeout     time.Duration      //规定的每个请求最大延迟
@@ -33,12 +46,26 @@ type Unicorn struct {
     IgnoreCnt   uint64             //忽略掉的请求的计数
     throttle    <-chan time.Time   //断续器（time.Tick），用来控制请求的频率，如果设置了qps，则断续器有效非空
     keepalive   bool               //是否维持长连接模式
+    thinkTimer  ThinkTimerIntfs    //思考时间，同一连接上相邻两个请求之间的间隔，nil表示不等待
+    maxRequests uint64             //每个连接最多发送的请求数，达到后重新建连，0表示不限制
+    maxLifetime time.Duration      //每个连接最长的存活时间，达到后重新建连，0表示不限制
+    tlsConfig   *tls.Config        //TLS配置，非空则建连之后进行TLS握手
+    dialer      DialerIntfs        //拨号器，负责建立原始连接
+    socket      *SocketOptions     //socket选项，nil表示全部使用默认值
+    wrappers    []ConnWrapper      //连接包装的中间件链
+    recorder    *Recorder          //流量记录器，nil表示不记录
+    connSeq     uint64             //连接编号，每次建连加1
 }
 
 //原生request的结构。本质上就是字节流
 type RawRequest struct {
-    Id  int64   //请求Id，这个request应该一一对应
-    Req []byte  //字节流
+    Id      int64          //请求Id，这个request应该一一对应
+    Req     []byte         //字节流
+    Timeout time.Duration  //可选：本次请求的超时，为0则使用Unicorn的timeout
+    Type    string         //可选：请求类型，报告中会按类型分类统计
+    Key     string         //可选：请求的key，负载均衡策略为hash时按key选择节点
+    Err     error          //可选：生成请求失败的原因，非空时框架不发送请求，直接记为致命错误并关闭连接
+    State   interface{}    //可选：插件在CheckFull中保存的解析状态，框架原样交给同一请求的CheckResponse和ShouldClose
 }
 
 //原生response结构。出了字节流之外，还有错误标记和耗时
@@ -54,9 +81,11 @@ type ResultCode int
 const (
     RESULT_CODE_SUCCESS         ResultCode = 0    //成功
     RESULT_CODE_WARING_TIMEOUT  ResultCode = 1001 //请求超时
+    RESULT_CODE_WARING_LOST     ResultCode = 1002 //数据报丢失（UDP），超过丢失判定窗口仍未收到响应
     RESULT_CODE_ERROR_CALL      ResultCode = 2001 //请求发生错误
     RESULT_CODE_ERROR_RESPONSE  ResultCode = 2002 //错误的响应内容
     RESULT_CODE_ERROR_CALEE     ResultCode = 2003 //被调用方内部错误
+    RESULT_CODE_ERROR_PORT      ResultCode = 2004 //建连时本地地址或者端口耗尽（EADDRNOTAVAIL）
     RESULT_CODE_FATAL_CALL      ResultCode = 3001 //调用过程中的致命错误
     RESULT_CODE_DONE            ResultCode = 4001 //结束，框架收到这个状态码应该主动断开连接
 )
@@ -66,9 +95,13 @@ type CallResult struct {
     Id     int64         //ID
     //Req    RawRequest    //原生请求
     //Resp   RawResponse   //原生响应
+    Type   string        //请求类型，来自RawRequest.Type
     Code   ResultCode    //响应码
     Msg    string        //细节信息
     Elapse time.Duration //耗时，这个貌似和RawResponse里面的Elapse重复。。
+    Connect   time.Duration //建连耗时，只有连接上的第一个结果才有值
+    Handshake time.Duration //TLS握手耗时，只有连接上的第一个结果才有值
+    Endpoint  string        //目标节点
 }
 
 //unicorn的当前状态
@@ -94,8 +127,33 @@ type PluginIntfs interface {
     //这种情况下，需要将RawRequest.Req设置为""
     GenRequest(id int64) RawRequest
     //必选函数：判断接收到的内容，是否是完整的响应包
+    //每次收到数据都会调用，response是目前为止收到的全部内容，插件可以把解析进度保存在rawReq.State中，避免重复解析
     CheckFull(rawReq *RawRequest, response []byte)(ServerRespStatus)
     //必选函数：检查响应内容是否符合用户需求
     //某些时候，需要通知框架在本次check之后主动结束请求，需要返回RESULT_CODE_DONE
     CheckResponse(rawReq RawRequest, response []byte) (ResultCode, string)
-}
\ No newline at end of file
+}
+
+//可选接口：有状态的会话插件
+//插件实现了这个接口，框架会在每个连接建立之后调用NewSession，生成这个连接独享的插件实例，
+//连接上的所有交互都交给这个实例处理。比如send/expect脚本，每个连接各自维护执行进度和变量
+type SessionFactoryIntfs interface {
+    NewSession() SessionIntfs
+}
+
+//会话插件实例
+type SessionIntfs interface {
+    PluginIntfs
+    //会话是否已经结束，结束之后框架会关闭连接。会话进行中，即使不是长连接模式也不会断开连接
+    Done() bool
+}
+
+//可选接口：插件根据响应判断服务端是否会关闭连接（比如HTTP的Connection: close），是则框架关闭连接，重新建连
+type ConnCloseIntfs interface {
+    ShouldClose(rawReq RawRequest, response []byte) bool
+}
+
+//可选接口：插件自己的统计（比如HTTP状态码分布），测试结束之后打印在报告的最后
+type ReporterIntfs interface {
+    Report() string
+}
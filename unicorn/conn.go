@@ -0,0 +1,232 @@
+package unicorn
+
+/*
+ * 拨号器以及连接包装
+ * 拨号器负责建立原始连接，用户可以替换成自己的实现（比如自定义的传输）
+ * 连接包装以中间件链的方式套在原始连接外面（TLS在最外层），可以实现字节计数、限速、
+ * 延迟注入、抓包等功能，而不必修改worker的代码
+ */
+import (
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+//拨号器接口
+type DialerIntfs interface {
+    Dial(network, address string, timeout time.Duration) (net.Conn, error)
+}
+
+//默认的拨号器
+type NetDialer struct{}
+
+func (nd *NetDialer) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+    return net.DialTimeout(network, address, timeout)
+}
+
+//连接包装，返回包装之后的连接
+//包装类型应该实现NetConn() net.Conn（和tls.Conn一致）返回被包装的连接，socket选项据此找到底层的socket
+type ConnWrapper func(net.Conn) net.Conn
+
+//被包装的连接
+type netConnIntfs interface {
+    NetConn() net.Conn
+}
+
+//逐层取出被包装的连接，直到不再是包装类型
+func baseConn(conn net.Conn) net.Conn {
+    for {
+        nc, ok := conn.(netConnIntfs)
+        if !ok {
+            return conn
+        }
+        conn = nc.NetConn()
+    }
+}
+
+/************************** 字节计数 **************************/
+//字节计数器，可以被多个连接共享
+type ByteCounter struct {
+    Sent uint64 //发送的字节数
+    Recv uint64 //接收的字节数
+}
+
+type countingConn struct {
+    net.Conn
+    bc *ByteCounter
+}
+
+func (cc *countingConn) NetConn() net.Conn {
+    return cc.Conn
+}
+
+func (cc *countingConn) Read(b []byte) (int, error) {
+    n, err := cc.Conn.Read(b)
+    atomic.AddUint64(&cc.bc.Recv, uint64(n))
+    return n, err
+}
+
+func (cc *countingConn) Write(b []byte) (int, error) {
+    n, err := cc.Conn.Write(b)
+    atomic.AddUint64(&cc.bc.Sent, uint64(n))
+    return n, err
+}
+
+//字节计数的包装
+func (bc *ByteCounter) Wrapper() ConnWrapper {
+    return func(conn net.Conn) net.Conn {
+        return &countingConn{Conn: conn, bc: bc}
+    }
+}
+
+/************************** 限速 **************************/
+//每个连接各自限速，读写方向分别计算
+type throttleConn struct {
+    net.Conn
+    bytesPerSec int64
+    datagram    bool //数据报不能拆分，整个写出之后再等待
+    readStart   time.Time
+    readBytes   int64
+    writeStart  time.Time
+    writeBytes  int64
+}
+
+//按照已经传输的字节数和限速，等待到应该完成的时刻
+func throttleWait(start time.Time, bytes, bytesPerSec int64) {
+    expect := start.Add(time.Duration(bytes * int64(time.Second) / bytesPerSec))
+    if d := expect.Sub(time.Now()); d > 0 {
+        time.Sleep(d)
+    }
+}
+
+func (tc *throttleConn) NetConn() net.Conn {
+    return tc.Conn
+}
+
+func (tc *throttleConn) Read(b []byte) (int, error) {
+    //单次读取不超过每秒的额度，避免突发
+    if int64(len(b)) > tc.bytesPerSec {
+        b = b[:tc.bytesPerSec]
+    }
+    n, err := tc.Conn.Read(b)
+    if tc.readStart.IsZero() {
+        tc.readStart = time.Now()
+    }
+    tc.readBytes += int64(n)
+    throttleWait(tc.readStart, tc.readBytes, tc.bytesPerSec)
+    return n, err
+}
+
+func (tc *throttleConn) Write(b []byte) (int, error) {
+    if tc.writeStart.IsZero() {
+        tc.writeStart = time.Now()
+    }
+    written := 0
+    for written < len(b) {
+        chunk := b[written:]
+        if !tc.datagram && int64(len(chunk)) > tc.bytesPerSec {
+            chunk = chunk[:tc.bytesPerSec]
+        }
+        n, err := tc.Conn.Write(chunk)
+        written += n
+        tc.writeBytes += int64(n)
+        if err != nil {
+            return written, err
+        }
+        throttleWait(tc.writeStart, tc.writeBytes, tc.bytesPerSec)
+    }
+    return written, nil
+}
+
+//限速的包装，bytesPerSec是每个连接每个方向的带宽
+func ThrottleWrapper(bytesPerSec int64) ConnWrapper {
+    return func(conn net.Conn) net.Conn {
+        if bytesPerSec <= 0 {
+            return conn
+        }
+        return &throttleConn{
+            Conn        : conn,
+            bytesPerSec : bytesPerSec,
+            datagram    : conn.LocalAddr().Network() == NETWORK_UDP,
+        }
+    }
+}
+
+/************************** 延迟注入 **************************/
+type latencyConn struct {
+    net.Conn
+    delay time.Duration
+}
+
+func (lc *latencyConn) NetConn() net.Conn {
+    return lc.Conn
+}
+
+func (lc *latencyConn) Write(b []byte) (int, error) {
+    time.Sleep(lc.delay)
+    return lc.Conn.Write(b)
+}
+
+//延迟注入的包装：每次写之前等待delay，模拟单向的网络延迟
+func LatencyWrapper(delay time.Duration) ConnWrapper {
+    return func(conn net.Conn) net.Conn {
+        if delay <= 0 {
+            return conn
+        }
+        return &latencyConn{Conn: conn, delay: delay}
+    }
+}
+
+/************************** 抓包 **************************/
+//抓包：把每个连接上收发的数据以十六进制的形式写入w，多个连接共享同一个w
+type Capturer struct {
+    w    io.Writer
+    lock sync.Mutex
+    seq  uint64 //连接编号
+}
+
+func NewCapturer(w io.Writer) *Capturer {
+    return &Capturer{w: w}
+}
+
+func (cp *Capturer) dump(connId uint64, direction string, b []byte) {
+    if len(b) == 0 {
+        return
+    }
+    cp.lock.Lock()
+    defer cp.lock.Unlock()
+    fmt.Fprintf(cp.w, "[%s] conn=%d %s %d bytes\n%s", time.Now().Format("15:04:05.000000"), connId, direction, len(b), hex.Dump(b))
+}
+
+type captureConn struct {
+    net.Conn
+    cp *Capturer
+    id uint64
+}
+
+func (cc *captureConn) NetConn() net.Conn {
+    return cc.Conn
+}
+
+func (cc *captureConn) Read(b []byte) (int, error) {
+    n, err := cc.Conn.Read(b)
+    cc.cp.dump(cc.id, "<<", b[:n])
+    return n, err
+}
+
+func (cc *captureConn) Write(b []byte) (int, error) {
+    n, err := cc.Conn.Write(b)
+    cc.cp.dump(cc.id, ">>", b[:n])
+    return n, err
+}
+
+//抓包的包装
+func (cp *Capturer) Wrapper() ConnWrapper {
+    return func(conn net.Conn) net.Conn {
+        return &captureConn{Conn: conn, cp: cp, id: atomic.AddUint64(&cp.seq, 1)}
+    }
+}
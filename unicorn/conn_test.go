@@ -0,0 +1,76 @@
+package unicorn
+
+import (
+    "bytes"
+    "net"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+//线程安全的buffer，供抓包使用
+type syncBuffer struct {
+    lock sync.Mutex
+    buf  bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(b []byte) (int, error) {
+    sb.lock.Lock()
+    defer sb.lock.Unlock()
+    return sb.buf.Write(b)
+}
+
+//计数的拨号器
+type countDialer struct {
+    NetDialer
+    cnt  int64
+    lock sync.Mutex
+}
+
+func (cd *countDialer) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+    cd.lock.Lock()
+    cd.cnt++
+    cd.lock.Unlock()
+    return cd.NetDialer.Dial(network, address, timeout)
+}
+
+//测试拨号器以及连接包装链：字节计数、抓包
+func TestConnWrapper(t *testing.T) {
+    ln := startEchoServer(t, "tcp", "127.0.0.1:0")
+    defer ln.Close()
+
+    result_chan := make(chan *CallResult, 50)
+    unc, err := NewUnicorn(ln.Addr().String(), &testEchoPlugin{}, 100*time.Millisecond, 0, 200*time.Millisecond, 2, true, result_chan)
+    if err != nil {
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
+    }
+    dialer := &countDialer{}
+    bc := &ByteCounter{}
+    capture := &syncBuffer{}
+    u := unc.(*Unicorn)
+    u.SetDialer(dialer)
+    u.UseConnWrapper(bc.Wrapper(), NewCapturer(capture).Wrapper(), LatencyWrapper(time.Millisecond))
+
+    wg := unc.Start()
+    success := 0
+    for ret := range result_chan {
+        if ret.Code == RESULT_CODE_SUCCESS {
+            success++
+        }
+    }
+    wg.Wait()
+
+    if success == 0 || dialer.cnt != 2 {
+        t.Fatalf("Expected 2 dials and some successes, got %d dials, %d successes\n", dialer.cnt, success)
+    }
+    //只统计了成功的请求，发出去但被停止打断的请求也会被计数
+    size := uint64(success * len("hello unicorn"))
+    if bc.Sent < size || bc.Recv < size {
+        t.Fatalf("Expected at least %d bytes, got sent=%d recv=%d\n", size, bc.Sent, bc.Recv)
+    }
+    dump := capture.buf.String()
+    if !strings.Contains(dump, "conn=1 >>") || !strings.Contains(dump, "conn=2 <<") {
+        t.Fatalf("Unexpected capture: %.200s\n", dump)
+    }
+}
@@ -0,0 +1,106 @@
+package unicorn
+
+/*
+ * 建立连接
+ */
+import (
+    "crypto/tls"
+    "errors"
+    "fmt"
+    "net"
+    "strings"
+    "time"
+)
+
+//传输方式
+const (
+    NETWORK_TCP  = "tcp"
+    NETWORK_UDP  = "udp"
+    NETWORK_UNIX = "unix"
+)
+
+const (
+    UDP_LOSS_WINDOW_FACTOR = 2     //UDP超过timeout*2仍未收到响应，判定为丢失；在此之前收到的算作迟到
+    UDP_MAX_DATAGRAM       = 65535 //数据报的最大长度
+    RECV_BUFFER_SIZE       = 32768 //流式连接每次读取的最大长度
+)
+
+/*
+ * 解析目标地址，返回传输方式和实际地址：
+ *   host:port              TCP（兼容原有的写法）
+ *   tcp://host:port        TCP
+ *   udp://host:port        UDP
+ *   unix:///path/to/sock   Unix domain socket
+ *   unix-abstract:name     Linux的抽象命名空间Unix socket
+ */
+func parseAddress(addr string) (string, string, error) {
+    switch {
+    case strings.HasPrefix(addr, "tcp://"):
+        return NETWORK_TCP, strings.TrimPrefix(addr, "tcp://"), nil
+    case strings.HasPrefix(addr, "udp://"):
+        return NETWORK_UDP, strings.TrimPrefix(addr, "udp://"), nil
+    case strings.HasPrefix(addr, "unix://"):
+        path := strings.TrimPrefix(addr, "unix://")
+        if path == "" {
+            return "", "", errors.New("Empty unix socket path")
+        }
+        return NETWORK_UNIX, path, nil
+    case strings.HasPrefix(addr, "unix-abstract:"):
+        name := strings.TrimPrefix(addr, "unix-abstract:")
+        if name == "" {
+            return "", "", errors.New("Empty abstract socket name")
+        }
+        return NETWORK_UNIX, "@" + name, nil //Go约定以@开头表示抽象命名空间
+    case strings.Contains(addr, "://"):
+        return "", "", fmt.Errorf("Unknown address scheme: %s", addr)
+    }
+    return NETWORK_TCP, addr, nil
+}
+
+//建立连接：先通过拨号器建连，设置socket选项，套上连接包装，如果配置了TLS，再进行TLS握手
+//返回连接，以及建连和握手各自的耗时，握手耗时作为单独的阶段出现在报告中
+func (unc *Unicorn) dial(ep *Endpoint) (net.Conn, time.Duration, time.Duration, error) {
+    start := time.Now()
+    conn, err := unc.dialer.Dial(ep.Network, ep.Address, unc.timeout)
+    if err != nil {
+        return nil, 0, 0, err
+    }
+    connect := time.Since(start)
+
+    //socket选项
+    if unc.socket != nil {
+        tuned, err := unc.socket.apply(conn)
+        if err != nil {
+            conn.Close()
+            return nil, connect, 0, err
+        }
+        conn = tuned
+    }
+
+    //连接包装的中间件链
+    for _, wrap := range unc.wrappers {
+        conn = wrap(conn)
+    }
+
+    if unc.tlsConfig == nil {
+        return conn, connect, 0, nil
+    }
+
+    //没有指定SNI时，使用节点的主机名（Unix socket的地址不是主机名，没有默认的SNI）
+    cfg := unc.tlsConfig
+    if cfg.ServerName == "" && ep.Host != "" {
+        cfg = cfg.Clone()
+        cfg.ServerName = ep.Host
+    }
+
+    //TLS握手，同样受timeout约束
+    start = time.Now()
+    tlsConn := tls.Client(conn, cfg)
+    tlsConn.SetDeadline(start.Add(unc.timeout))
+    if err = tlsConn.Handshake(); err != nil {
+        conn.Close()
+        return nil, connect, 0, err
+    }
+    tlsConn.SetDeadline(time.Time{})
+    return tlsConn, connect, time.Since(start), nil
+}
@@ -0,0 +1,95 @@
+package unicorn
+
+import (
+    "io"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "runtime"
+    "testing"
+    "time"
+)
+
+//测试地址解析
+func TestParseAddress(t *testing.T) {
+    cases := []struct {
+        addr    string
+        network string
+        address string
+    }{
+        {"127.0.0.1:9527", NETWORK_TCP, "127.0.0.1:9527"},
+        {"tcp://127.0.0.1:9527", NETWORK_TCP, "127.0.0.1:9527"},
+        {"udp://127.0.0.1:53", NETWORK_UDP, "127.0.0.1:53"},
+        {"unix:///tmp/server.sock", NETWORK_UNIX, "/tmp/server.sock"},
+        {"unix-abstract:server", NETWORK_UNIX, "@server"},
+    }
+    for _, c := range cases {
+        network, address, err := parseAddress(c.addr)
+        if err != nil || network != c.network || address != c.address {
+            t.Fatalf("parseAddress(%q) = %s, %s, %v\n", c.addr, network, address, err)
+        }
+    }
+    for _, addr := range []string{"http://127.0.0.1", "unix://", "unix-abstract:"} {
+        if _, _, err := parseAddress(addr); err == nil {
+            t.Fatalf("parseAddress(%q) should fail\n", addr)
+        }
+    }
+}
+
+//启动一个回显服务端
+func startEchoServer(t *testing.T, network, addr string) net.Listener {
+    ln, err := net.Listen(network, addr)
+    if err != nil {
+        t.Fatal(err)
+    }
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                io.Copy(conn, conn)
+            }()
+        }
+    }()
+    return ln
+}
+
+//测试Unix socket：同一个插件，分别通过路径和抽象命名空间访问
+func TestUnixSocket(t *testing.T) {
+    dir, err := ioutil.TempDir("", "unicorn-unix")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    path := filepath.Join(dir, "echo.sock")
+    targets := map[string]string{"unix://" + path: path}
+    if runtime.GOOS == "linux" {
+        targets["unix-abstract:unicorn-test"] = "@unicorn-test"
+    }
+
+    for url, addr := range targets {
+        ln := startEchoServer(t, "unix", addr)
+        result_chan := make(chan *CallResult, 50)
+        unc, err := NewUnicorn(url, &testEchoPlugin{}, 100*time.Millisecond, 0, 200*time.Millisecond, 2, true, result_chan)
+        if err != nil {
+            t.Fatalf("Unicorn initialization failing: %s.\n", err)
+        }
+        wg := unc.Start()
+        count_map := make(map[ResultCode]int)
+        for ret := range result_chan {
+            count_map[ret.Code]++
+        }
+        wg.Wait()
+        ln.Close()
+
+        t.Logf("%s: %v\n", url, count_map)
+        if count_map[RESULT_CODE_SUCCESS] == 0 || len(count_map) != 1 {
+            t.Fatalf("%s failing: %v\n", url, count_map)
+        }
+    }
+}
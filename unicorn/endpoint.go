@@ -0,0 +1,170 @@
+package unicorn
+
+/*
+ * 多个目标节点以及负载均衡
+ * 目标地址可以是逗号分隔的多个地址，也可以是解析出多个IP的主机名
+ * 负载均衡在建连时进行，同一个连接上的请求都发往同一个节点；按key分发时，请求的key换了节点则重新建连
+ */
+import (
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "math/rand"
+    "net"
+    "sort"
+    "strings"
+    "sync/atomic"
+)
+
+//负载均衡策略
+const (
+    BALANCE_ROUND_ROBIN = "rr"     //轮询（默认）
+    BALANCE_RANDOM      = "random" //随机
+    BALANCE_LEAST       = "least"  //进行中的请求数最少
+    BALANCE_HASH        = "hash"   //按请求的key一致性哈希，key为空的请求退化为轮询
+)
+
+const (
+    HASH_VIRTUAL_NODES = 160 //一致性哈希中，每个节点的虚拟节点数
+)
+
+//目标节点
+type Endpoint struct {
+    Network     string //传输方式
+    Address     string //实际地址
+    Host        string //主机名，用作默认的SNI；主机名解析成多个IP之后，仍然保留原来的主机名
+    outstanding int64  //进行中的请求数
+}
+
+//报告中使用的节点名字
+func (ep *Endpoint) String() string {
+    if ep.Network == NETWORK_TCP {
+        return ep.Address
+    }
+    return ep.Network + "://" + ep.Address
+}
+
+//解析逗号分隔的目标地址，所有节点的传输方式必须相同
+func parseEndpoints(addrs string) ([]*Endpoint, error) {
+    var eps []*Endpoint
+    for _, addr := range strings.Split(addrs, ",") {
+        addr = strings.TrimSpace(addr)
+        if addr == "" {
+            continue
+        }
+        network, address, err := parseAddress(addr)
+        if err != nil {
+            return nil, err
+        }
+        if len(eps) > 0 && eps[0].Network != network {
+            return nil, fmt.Errorf("Mixed transports: %s and %s", eps[0].Network, network)
+        }
+        ep := &Endpoint{Network: network, Address: address}
+        if network != NETWORK_UNIX {
+            if host, _, err := net.SplitHostPort(address); err == nil {
+                ep.Host = host
+            }
+        }
+        eps = append(eps, ep)
+    }
+    if len(eps) == 0 {
+        return nil, errors.New("Nil address")
+    }
+    return eps, nil
+}
+
+//把主机名解析成IP，每个IP作为一个节点
+func resolveEndpoints(eps []*Endpoint) ([]*Endpoint, error) {
+    var resolved []*Endpoint
+    for _, ep := range eps {
+        if ep.Network == NETWORK_UNIX || net.ParseIP(ep.Host) != nil {
+            resolved = append(resolved, ep)
+            continue
+        }
+        _, port, err := net.SplitHostPort(ep.Address)
+        if err != nil {
+            return nil, err
+        }
+        ips, err := net.LookupHost(ep.Host)
+        if err != nil {
+            return nil, err
+        }
+        for _, ip := range ips {
+            resolved = append(resolved, &Endpoint{
+                Network : ep.Network,
+                Address : net.JoinHostPort(ip, port),
+                Host    : ep.Host,
+            })
+        }
+    }
+    return resolved, nil
+}
+
+//一致性哈希环上的虚拟节点
+type hashNode struct {
+    hash uint32
+    ep   *Endpoint
+}
+
+//负载均衡器，可以被多个worker并发使用
+type balancer struct {
+    strategy  string
+    endpoints []*Endpoint
+    next      uint64     //轮询的游标
+    ring      []hashNode //一致性哈希环，按hash排序
+}
+
+func newBalancer(strategy string, eps []*Endpoint) (*balancer, error) {
+    b := &balancer{strategy: strategy, endpoints: eps}
+    switch strategy {
+    case BALANCE_ROUND_ROBIN, BALANCE_RANDOM, BALANCE_LEAST:
+    case BALANCE_HASH:
+        for _, ep := range eps {
+            for i := 0; i < HASH_VIRTUAL_NODES; i++ {
+                h := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", ep.String(), i)))
+                b.ring = append(b.ring, hashNode{hash: h, ep: ep})
+            }
+        }
+        sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+    default:
+        return nil, fmt.Errorf("Unknown balance strategy: %s", strategy)
+    }
+    return b, nil
+}
+
+//是否按请求的key分发，是的话需要先生成请求再选择节点
+func (b *balancer) keyed() bool {
+    return b.strategy == BALANCE_HASH
+}
+
+//选择一个节点
+func (b *balancer) pick(key string) *Endpoint {
+    if len(b.endpoints) == 1 {
+        return b.endpoints[0]
+    }
+    switch b.strategy {
+    case BALANCE_RANDOM:
+        return b.endpoints[rand.Intn(len(b.endpoints))]
+    case BALANCE_LEAST:
+        //进行中的请求数相同时，从轮询的位置开始找，避免总是落到第一个节点
+        start := atomic.AddUint64(&b.next, 1)
+        var best *Endpoint
+        for i := range b.endpoints {
+            ep := b.endpoints[(start+uint64(i))%uint64(len(b.endpoints))]
+            if best == nil || atomic.LoadInt64(&ep.outstanding) < atomic.LoadInt64(&best.outstanding) {
+                best = ep
+            }
+        }
+        return best
+    case BALANCE_HASH:
+        if key != "" {
+            h := crc32.ChecksumIEEE([]byte(key))
+            i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+            if i == len(b.ring) {
+                i = 0
+            }
+            return b.ring[i].ep
+        }
+    }
+    return b.endpoints[(atomic.AddUint64(&b.next, 1)-1)%uint64(len(b.endpoints))]
+}
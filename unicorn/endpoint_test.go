@@ -0,0 +1,98 @@
+package unicorn
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+//测试负载均衡策略
+func TestBalancer(t *testing.T) {
+    eps, err := parseEndpoints("127.0.0.1:1, 127.0.0.1:2,127.0.0.1:3")
+    if err != nil || len(eps) != 3 {
+        t.Fatalf("parseEndpoints: %v, %v\n", eps, err)
+    }
+    if _, err := parseEndpoints("127.0.0.1:1,udp://127.0.0.1:2"); err == nil {
+        t.Fatal("Mixed transports should fail")
+    }
+
+    //轮询：均匀分布
+    b, _ := newBalancer(BALANCE_ROUND_ROBIN, eps)
+    count_map := make(map[*Endpoint]int)
+    for i := 0; i < 30; i++ {
+        count_map[b.pick("")]++
+    }
+    for _, ep := range eps {
+        if count_map[ep] != 10 {
+            t.Fatalf("Round robin: %v\n", count_map)
+        }
+    }
+
+    //最少进行中的请求
+    b, _ = newBalancer(BALANCE_LEAST, eps)
+    eps[0].outstanding, eps[1].outstanding, eps[2].outstanding = 3, 1, 2
+    for i := 0; i < 3; i++ {
+        if ep := b.pick(""); ep != eps[1] {
+            t.Fatalf("Least outstanding picked %s\n", ep)
+        }
+    }
+    eps[0].outstanding, eps[1].outstanding, eps[2].outstanding = 0, 0, 0
+
+    //一致性哈希：同一个key总是落到同一个节点，去掉一个节点之后，其他节点上的key不受影响
+    b, _ = newBalancer(BALANCE_HASH, eps)
+    b2, _ := newBalancer(BALANCE_HASH, eps[:2])
+    count_map = make(map[*Endpoint]int)
+    for i := 0; i < 3000; i++ {
+        key := fmt.Sprintf("user-%d", i)
+        ep := b.pick(key)
+        if b.pick(key) != ep {
+            t.Fatalf("Key %s moved\n", key)
+        }
+        if ep != eps[2] && b2.pick(key) != ep {
+            t.Fatalf("Key %s remapped after removing another endpoint\n", key)
+        }
+        count_map[ep]++
+    }
+    for _, ep := range eps {
+        if count_map[ep] < 500 {
+            t.Fatalf("Consistent hash unbalanced: %v\n", count_map)
+        }
+    }
+
+    if _, err := newBalancer("foo", eps); err == nil {
+        t.Fatal("Unknown strategy should fail")
+    }
+}
+
+//测试多个节点：结果按节点标记，每个节点都有成功的请求
+func TestMultiEndpoint(t *testing.T) {
+    ln1 := startEchoServer(t, "tcp", "127.0.0.1:0")
+    defer ln1.Close()
+    ln2 := startEchoServer(t, "tcp", "127.0.0.1:0")
+    defer ln2.Close()
+    addrs := ln1.Addr().String() + "," + ln2.Addr().String()
+
+    for _, strategy := range []string{BALANCE_ROUND_ROBIN, BALANCE_RANDOM, BALANCE_LEAST} {
+        result_chan := make(chan *CallResult, 50)
+        unc, err := NewUnicorn(addrs, &testEchoPlugin{}, 100*time.Millisecond, 0, 200*time.Millisecond, 4, false, result_chan)
+        if err != nil {
+            t.Fatalf("Unicorn initialization failing: %s.\n", err)
+        }
+        if err := unc.(*Unicorn).SetBalance(strategy, false); err != nil {
+            t.Fatal(err)
+        }
+        wg := unc.Start()
+        count_map := make(map[string]int)
+        for ret := range result_chan {
+            if ret.Code == RESULT_CODE_SUCCESS {
+                count_map[ret.Endpoint]++
+            }
+        }
+        wg.Wait()
+
+        t.Logf("%s: %v\n", strategy, count_map)
+        if count_map[ln1.Addr().String()] == 0 || count_map[ln2.Addr().String()] == 0 {
+            t.Fatalf("%s: expected successes on both endpoints, got %v\n", strategy, count_map)
+        }
+    }
+}
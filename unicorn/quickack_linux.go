@@ -0,0 +1,14 @@
+//go:build linux
+
+package unicorn
+
+/*
+ * TCP_QUICKACK，仅Linux支持
+ */
+import (
+    "syscall"
+)
+
+func setQuickAck(fd uintptr) error {
+    return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_QUICKACK, 1)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package unicorn
+
+/*
+ * TCP_QUICKACK，其他系统不支持
+ */
+import (
+    "errors"
+)
+
+func setQuickAck(fd uintptr) error {
+    return errors.New("TCP_QUICKACK is only supported on linux")
+}
@@ -0,0 +1,321 @@
+package unicorn
+
+/*
+ * 流量记录：把请求/响应对连同时间戳、连接编号、结果码写入紧凑的二进制文件，
+ * 压测出现错误之后，可以事后查看出错的交互到底收发了什么（unicorn dump <file>）
+ *
+ * 文件格式：文件头"UNCREC1\n"，之后是若干条记录，每条记录是uvarint长度 + 记录体
+ * 记录体依次为：
+ *   时间戳(varint, 纳秒) 连接编号(uvarint) 请求Id(varint) 结果码(varint) 耗时(varint, 纳秒)
+ *   类型 节点 请求 响应（均为uvarint长度 + 字节）请求原始长度(uvarint) 响应原始长度(uvarint)
+ * 请求或者响应被截断时，原始长度大于记录下来的字节数
+ *
+ * 单个文件超过MaxSize之后轮转：path -> path.1 -> path.2 ...，最多保留MaxFiles个历史文件
+ */
+import (
+    "bufio"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "math/rand"
+    "os"
+    "sync"
+    "time"
+)
+
+const (
+    RECORD_FILE_MAGIC  = "UNCREC1\n"
+    RECORD_MAX_BODY    = 64 * 1024 * 1024 //读取时单条记录的上限，防止损坏的文件导致巨大的分配
+)
+
+//一条记录，即一次请求/响应的交互
+type Record struct {
+    Time     time.Time     //请求发出的时刻
+    ConnId   uint64        //连接编号，同一个连接上的交互编号相同
+    Id       int64         //请求Id
+    Code     ResultCode    //结果码
+    Elapse   time.Duration //耗时
+    Type     string        //请求类型
+    Endpoint string        //目标节点
+    Req      []byte        //请求，可能被截断
+    Resp     []byte        //响应，出错时是已经收到的部分，可能被截断
+    ReqLen   int           //请求的原始长度
+    RespLen  int           //响应的原始长度
+}
+
+//记录器的选项
+type RecorderOptions struct {
+    Path       string  //记录文件
+    Sample     float64 //采样比例(0,1]，0表示全部记录
+    Errors     bool    //非成功的结果总是记录，不受采样比例的限制
+    MaxPayload int     //请求和响应各自最多记录的字节数，0表示不截断
+    MaxSize    int64   //单个文件的最大字节数，超过则轮转，0表示不轮转
+    MaxFiles   int     //轮转时保留的历史文件数，0表示轮转时直接丢弃旧文件
+}
+
+//记录器，可以被多个worker共享
+type Recorder struct {
+    opts    RecorderOptions
+    lock    sync.Mutex
+    file    *os.File
+    w       *bufio.Writer
+    size    int64  //当前文件已经写入的字节数
+    buf     []byte //编码记录的缓冲，在记录之间复用
+    Records uint64 //写入的记录数
+    Rotates uint64 //轮转次数
+}
+
+func NewRecorder(opts RecorderOptions) (*Recorder, error) {
+    if opts.Path == "" {
+        return nil, errors.New("Recorder: path is empty")
+    }
+    if opts.Sample < 0 || opts.Sample > 1 {
+        return nil, fmt.Errorf("Recorder: sample %v out of range (0,1]", opts.Sample)
+    }
+    if opts.Sample == 0 {
+        opts.Sample = 1
+    }
+    if opts.MaxSize < 0 || opts.MaxFiles < 0 || opts.MaxPayload < 0 {
+        return nil, errors.New("Recorder: negative limit")
+    }
+    rc := &Recorder{opts: opts}
+    if err := rc.open(); err != nil {
+        return nil, err
+    }
+    return rc, nil
+}
+
+//打开新的记录文件，写入文件头
+func (rc *Recorder) open() error {
+    f, err := os.Create(rc.opts.Path)
+    if err != nil {
+        return err
+    }
+    rc.file = f
+    rc.w = bufio.NewWriter(f)
+    rc.size = 0
+    n, err := rc.w.WriteString(RECORD_FILE_MAGIC)
+    rc.size += int64(n)
+    return err
+}
+
+//轮转：关闭当前文件，历史文件依次后移，超出MaxFiles的被覆盖
+func (rc *Recorder) rotate() error {
+    if err := rc.closeFile(); err != nil {
+        return err
+    }
+    path := rc.opts.Path
+    if rc.opts.MaxFiles == 0 {
+        os.Remove(path)
+    } else {
+        for i := rc.opts.MaxFiles - 1; i >= 1; i-- {
+            os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+        }
+        if err := os.Rename(path, path+".1"); err != nil {
+            return err
+        }
+    }
+    rc.Rotates++
+    return rc.open()
+}
+
+func (rc *Recorder) closeFile() error {
+    if rc.file == nil {
+        return nil
+    }
+    err := rc.w.Flush()
+    if cerr := rc.file.Close(); err == nil {
+        err = cerr
+    }
+    rc.file = nil
+    return err
+}
+
+//是否需要记录：采样，Errors为true时非成功的结果总是记录
+func (rc *Recorder) sampled(code ResultCode) bool {
+    if rc.opts.Errors && code != RESULT_CODE_SUCCESS {
+        return true
+    }
+    return rc.opts.Sample >= 1 || rand.Float64() < rc.opts.Sample
+}
+
+//写入一条记录，未被采样的记录直接忽略
+func (rc *Recorder) Record(r *Record) error {
+    if !rc.sampled(r.Code) {
+        return nil
+    }
+    rc.lock.Lock()
+    defer rc.lock.Unlock()
+    if rc.file == nil {
+        return errors.New("Recorder: closed")
+    }
+
+    rc.buf = rc.encode(rc.buf[:0], r)
+    var head [binary.MaxVarintLen64]byte
+    hn := binary.PutUvarint(head[:], uint64(len(rc.buf)))
+    total := int64(hn + len(rc.buf))
+
+    //当前文件写入这条记录之后会超限，则先轮转（空文件不轮转，避免单条记录过大时反复轮转）
+    if rc.opts.MaxSize > 0 && rc.size > int64(len(RECORD_FILE_MAGIC)) && rc.size+total > rc.opts.MaxSize {
+        if err := rc.rotate(); err != nil {
+            return err
+        }
+    }
+    if _, err := rc.w.Write(head[:hn]); err != nil {
+        return err
+    }
+    if _, err := rc.w.Write(rc.buf); err != nil {
+        return err
+    }
+    rc.size += total
+    rc.Records++
+    return nil
+}
+
+//刷新缓冲并关闭文件
+func (rc *Recorder) Close() error {
+    rc.lock.Lock()
+    defer rc.lock.Unlock()
+    return rc.closeFile()
+}
+
+func (rc *Recorder) truncate(b []byte) []byte {
+    if rc.opts.MaxPayload > 0 && len(b) > rc.opts.MaxPayload {
+        return b[:rc.opts.MaxPayload]
+    }
+    return b
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+    buf = binary.AppendUvarint(buf, uint64(len(b)))
+    return append(buf, b...)
+}
+
+//编码记录体，Req/Resp按照MaxPayload截断，ReqLen/RespLen记录原始长度
+func (rc *Recorder) encode(buf []byte, r *Record) []byte {
+    buf = binary.AppendVarint(buf, r.Time.UnixNano())
+    buf = binary.AppendUvarint(buf, r.ConnId)
+    buf = binary.AppendVarint(buf, r.Id)
+    buf = binary.AppendVarint(buf, int64(r.Code))
+    buf = binary.AppendVarint(buf, int64(r.Elapse))
+    buf = appendBytes(buf, []byte(r.Type))
+    buf = appendBytes(buf, []byte(r.Endpoint))
+    buf = appendBytes(buf, rc.truncate(r.Req))
+    buf = appendBytes(buf, rc.truncate(r.Resp))
+    buf = binary.AppendUvarint(buf, uint64(len(r.Req)))
+    buf = binary.AppendUvarint(buf, uint64(len(r.Resp)))
+    return buf
+}
+
+/************************** 读取 **************************/
+//记录体的解码器，任何一步出错之后的读取都返回零值，最后统一检查err
+type recordDecoder struct {
+    b   []byte
+    err error
+}
+
+func (d *recordDecoder) uvarint() uint64 {
+    if d.err != nil {
+        return 0
+    }
+    v, n := binary.Uvarint(d.b)
+    if n <= 0 {
+        d.err = errors.New("Recorder: corrupted record")
+        return 0
+    }
+    d.b = d.b[n:]
+    return v
+}
+
+func (d *recordDecoder) varint() int64 {
+    if d.err != nil {
+        return 0
+    }
+    v, n := binary.Varint(d.b)
+    if n <= 0 {
+        d.err = errors.New("Recorder: corrupted record")
+        return 0
+    }
+    d.b = d.b[n:]
+    return v
+}
+
+func (d *recordDecoder) bytes() []byte {
+    l := d.uvarint()
+    if d.err != nil {
+        return nil
+    }
+    if l > uint64(len(d.b)) {
+        d.err = errors.New("Recorder: corrupted record")
+        return nil
+    }
+    v := d.b[:l:l]
+    d.b = d.b[l:]
+    return v
+}
+
+func decodeRecord(body []byte) (*Record, error) {
+    d := &recordDecoder{b: body}
+    r := &Record{}
+    r.Time = time.Unix(0, d.varint())
+    r.ConnId = d.uvarint()
+    r.Id = d.varint()
+    r.Code = ResultCode(d.varint())
+    r.Elapse = time.Duration(d.varint())
+    r.Type = string(d.bytes())
+    r.Endpoint = string(d.bytes())
+    r.Req = d.bytes()
+    r.Resp = d.bytes()
+    r.ReqLen = int(d.uvarint())
+    r.RespLen = int(d.uvarint())
+    if d.err != nil {
+        return nil, d.err
+    }
+    return r, nil
+}
+
+//依次读出记录交给fn，fn返回错误则停止读取并返回该错误
+func ReadRecords(rd io.Reader, fn func(*Record) error) error {
+    br := bufio.NewReader(rd)
+    magic := make([]byte, len(RECORD_FILE_MAGIC))
+    if _, err := io.ReadFull(br, magic); err != nil || string(magic) != RECORD_FILE_MAGIC {
+        return errors.New("Recorder: not a record file")
+    }
+    for {
+        l, err := binary.ReadUvarint(br)
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            return nil
+        } else if err != nil {
+            return err
+        }
+        if l > RECORD_MAX_BODY {
+            return errors.New("Recorder: corrupted record")
+        }
+        body := make([]byte, l)
+        if _, err := io.ReadFull(br, body); err != nil {
+            //最后一条记录不完整（比如进程被杀死），视为文件结束
+            if err == io.ErrUnexpectedEOF {
+                return nil
+            }
+            return err
+        }
+        r, err := decodeRecord(body)
+        if err != nil {
+            return err
+        }
+        if err := fn(r); err != nil {
+            return err
+        }
+    }
+}
+
+//读取记录文件
+func ReadRecordFile(path string, fn func(*Record) error) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    return ReadRecords(f, fn)
+}
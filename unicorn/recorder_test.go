@@ -0,0 +1,212 @@
+package unicorn
+
+import (
+    "bytes"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func readAll(t *testing.T, path string) []*Record {
+    var records []*Record
+    err := ReadRecordFile(path, func(r *Record) error {
+        records = append(records, r)
+        return nil
+    })
+    if err != nil {
+        t.Fatalf("Reading %s failing: %s\n", path, err)
+    }
+    return records
+}
+
+//测试编码和解码、截断以及轮转
+func TestRecorderRotate(t *testing.T) {
+    dir, err := ioutil.TempDir("", "unicorn-record")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "rec.bin")
+
+    rec, err := NewRecorder(RecorderOptions{Path: path, MaxPayload: 16, MaxSize: 1024, MaxFiles: 2})
+    if err != nil {
+        t.Fatal(err)
+    }
+    start := time.Now()
+    total := 100
+    for i := 0; i < total; i++ {
+        err := rec.Record(&Record{
+            Time     : start.Add(time.Duration(i) * time.Millisecond),
+            ConnId   : uint64(i/10 + 1),
+            Id       : int64(i),
+            Code     : RESULT_CODE_WARING_TIMEOUT,
+            Elapse   : 3 * time.Millisecond,
+            Type     : "get",
+            Endpoint : "127.0.0.1:9527",
+            Req      : []byte(fmt.Sprintf("request %d", i)),
+            Resp     : bytes.Repeat([]byte{byte(i)}, i),
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := rec.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if rec.Records != uint64(total) || rec.Rotates == 0 {
+        t.Fatalf("Expected %d records with rotations, got %d records, %d rotations\n", total, rec.Records, rec.Rotates)
+    }
+    if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+        t.Fatalf("Expected at most 2 rotated files, got %s.3\n", path)
+    }
+
+    //最旧的文件在前，依次读取，记录是连续的，前面的被轮转丢弃
+    var records []*Record
+    for _, p := range []string{path + ".2", path + ".1", path} {
+        info, err := os.Stat(p)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if info.Size() > 1024 {
+            t.Fatalf("Expected %s no more than 1024 bytes, got %d\n", p, info.Size())
+        }
+        records = append(records, readAll(t, p)...)
+    }
+    if len(records) == 0 || records[len(records)-1].Id != int64(total-1) {
+        t.Fatalf("Expected the newest records kept, got %d records\n", len(records))
+    }
+    first := int(records[0].Id)
+    for i, r := range records {
+        id := first + i
+        if r.Id != int64(id) || r.ConnId != uint64(id/10+1) || r.Code != RESULT_CODE_WARING_TIMEOUT ||
+            r.Type != "get" || r.Endpoint != "127.0.0.1:9527" || r.Elapse != 3*time.Millisecond ||
+            !r.Time.Equal(start.Add(time.Duration(id)*time.Millisecond)) {
+            t.Fatalf("Unexpected record %d: %+v\n", id, r)
+        }
+        req := fmt.Sprintf("request %d", id)
+        if string(r.Req) != req || r.ReqLen != len(req) {
+            t.Fatalf("Unexpected request of record %d: %q (%d)\n", id, r.Req, r.ReqLen)
+        }
+        resp := bytes.Repeat([]byte{byte(id)}, id)
+        if len(resp) > 16 {
+            resp = resp[:16]
+        }
+        if !bytes.Equal(r.Resp, resp) || r.RespLen != id {
+            t.Fatalf("Unexpected response of record %d: %x (%d)\n", id, r.Resp, r.RespLen)
+        }
+    }
+}
+
+//测试采样：成功的结果按照比例记录，错误总是记录
+func TestRecorderSample(t *testing.T) {
+    dir, err := ioutil.TempDir("", "unicorn-record")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "rec.bin")
+
+    if _, err := NewRecorder(RecorderOptions{Path: path, Sample: 1.5}); err == nil {
+        t.Fatal("Expected error for sample out of range")
+    }
+    rec, err := NewRecorder(RecorderOptions{Path: path, Sample: 0.1, Errors: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 2000; i++ {
+        code := RESULT_CODE_SUCCESS
+        if i%100 == 0 {
+            code = RESULT_CODE_ERROR_RESPONSE
+        }
+        rec.Record(&Record{Id: int64(i), Code: code})
+    }
+    rec.Close()
+
+    errs, success := 0, 0
+    for _, r := range readAll(t, path) {
+        if r.Code == RESULT_CODE_SUCCESS {
+            success++
+        } else {
+            errs++
+        }
+    }
+    if errs != 20 || success < 100 || success > 300 {
+        t.Fatalf("Expected 20 errors and about 200 successes, got %d errors, %d successes\n", errs, success)
+    }
+}
+
+//测试引擎中的记录：超时的结果记录的是已经收到的部分响应
+func TestRecorderEngine(t *testing.T) {
+    //只回显前5个字节，之后不再响应，客户端超时
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func(conn net.Conn) {
+                defer conn.Close()
+                buf := make([]byte, 1024)
+                for {
+                    n, err := conn.Read(buf)
+                    if err != nil {
+                        return
+                    }
+                    if n > 5 {
+                        n = 5
+                    }
+                    conn.Write(buf[:n])
+                }
+            }(conn)
+        }
+    }()
+
+    dir, err := ioutil.TempDir("", "unicorn-record")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "rec.bin")
+    rec, err := NewRecorder(RecorderOptions{Path: path})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    result_chan := make(chan *CallResult, 50)
+    unc, err := NewUnicorn(ln.Addr().String(), &testEchoPlugin{}, 20*time.Millisecond, 0, 200*time.Millisecond, 2, true, result_chan)
+    if err != nil {
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
+    }
+    unc.(*Unicorn).SetRecorder(rec)
+    wg := unc.Start()
+    for range result_chan {
+    }
+    wg.Wait()
+    rec.Close()
+
+    records := readAll(t, path)
+    if len(records) == 0 || uint64(len(records)) != rec.Records {
+        t.Fatalf("Expected %d records, got %d\n", rec.Records, len(records))
+    }
+    conns := make(map[uint64]bool)
+    for _, r := range records {
+        if r.Code != RESULT_CODE_WARING_TIMEOUT || string(r.Req) != "hello unicorn" || string(r.Resp) != "hello" ||
+            r.Endpoint != ln.Addr().String() || r.ConnId == 0 {
+            t.Fatalf("Unexpected record: %+v\n", r)
+        }
+        conns[r.ConnId] = true
+    }
+    //每次超时之后重新建连，每个连接上只有一条记录
+    if len(conns) != len(records) {
+        t.Fatalf("Expected a new connection after every timeout, got %d connections for %d records\n", len(conns), len(records))
+    }
+}
@@ -0,0 +1,188 @@
+package unicorn
+
+/*
+ * socket调优
+ * 建连之后、套上连接包装之前设置，所以对任意拨号器都生效
+ * 拨号器返回的连接是包装过的，则通过NetConn()逐层找到底层的socket，找不到时建连失败，而不是忽略选项
+ * 注意：SO_RCVBUF在建连之后设置，不影响握手时已经协商好的窗口扩大因子
+ */
+import (
+    "errors"
+    "fmt"
+    "net"
+    "runtime"
+    "syscall"
+    "time"
+)
+
+//socket选项，零值表示全部使用默认值
+type SocketOptions struct {
+    Nagle        bool          //开启Nagle算法，即关闭TCP_NODELAY（Go默认开启TCP_NODELAY）
+    SendBuf      int           //SO_SNDBUF，0表示系统默认
+    RecvBuf      int           //SO_RCVBUF，0表示系统默认
+    KeepAlive    time.Duration //TCP keepalive的探测间隔，0表示Go默认（15s），<0表示关闭
+    Linger       time.Duration //SO_LINGER，关闭时等待未发送数据的最长时间，0表示系统默认
+    ResetOnClose bool          //SO_LINGER为0，关闭时直接发送RST，不进入TIME_WAIT
+    QuickAck     bool          //TCP_QUICKACK，收到数据立即回复ACK，不延迟（仅Linux）
+}
+
+//校验选项
+func (so *SocketOptions) check(network string) error {
+    if so.SendBuf < 0 || so.RecvBuf < 0 {
+        return errors.New("Negative socket buffer size")
+    }
+    if so.Linger < 0 {
+        return errors.New("Negative linger")
+    }
+    if so.Linger > 0 && so.ResetOnClose {
+        return errors.New("Linger and reset-on-close can't be set at the same time")
+    }
+    if so.QuickAck && runtime.GOOS != "linux" {
+        return errors.New("TCP_QUICKACK is only supported on linux")
+    }
+    if so.tcpOnly() && network != NETWORK_TCP {
+        return fmt.Errorf("TCP socket options are not supported over %s", network)
+    }
+    return nil
+}
+
+//是否设置了只对TCP生效的选项
+func (so *SocketOptions) tcpOnly() bool {
+    return so.Nagle || so.KeepAlive != 0 || so.Linger > 0 || so.ResetOnClose || so.QuickAck
+}
+
+//在连接上设置选项，返回的连接可能被包装过（TCP_QUICKACK需要在每次读之后重新设置）
+//选项设置在底层的socket上，设置了选项却找不到支持的socket时返回错误
+func (so *SocketOptions) apply(conn net.Conn) (net.Conn, error) {
+    base := baseConn(conn)
+
+    //缓冲区大小，TCP、UDP、Unix socket都支持
+    if so.SendBuf > 0 || so.RecvBuf > 0 {
+        bc, ok := base.(interface {
+            SetReadBuffer(int) error
+            SetWriteBuffer(int) error
+        })
+        if !ok {
+            return nil, fmt.Errorf("Socket buffer size can't be set on %T", base)
+        }
+        if so.SendBuf > 0 {
+            if err := bc.SetWriteBuffer(so.SendBuf); err != nil {
+                return nil, err
+            }
+        }
+        if so.RecvBuf > 0 {
+            if err := bc.SetReadBuffer(so.RecvBuf); err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    //以下只对TCP连接生效
+    if !so.tcpOnly() {
+        return conn, nil
+    }
+    tc, ok := base.(*net.TCPConn)
+    if !ok {
+        return nil, fmt.Errorf("TCP socket options can't be set on %T", base)
+    }
+    if so.Nagle {
+        if err := tc.SetNoDelay(false); err != nil {
+            return nil, err
+        }
+    }
+    if so.KeepAlive < 0 {
+        if err := tc.SetKeepAlive(false); err != nil {
+            return nil, err
+        }
+    } else if so.KeepAlive > 0 {
+        if err := tc.SetKeepAlive(true); err != nil {
+            return nil, err
+        }
+        if err := tc.SetKeepAlivePeriod(so.KeepAlive); err != nil {
+            return nil, err
+        }
+    }
+    if so.ResetOnClose {
+        if err := tc.SetLinger(0); err != nil {
+            return nil, err
+        }
+    } else if so.Linger > 0 {
+        if err := tc.SetLinger(int((so.Linger + time.Second - 1) / time.Second)); err != nil {
+            return nil, err
+        }
+    }
+    if so.QuickAck {
+        qc := &quickAckConn{Conn: conn, tc: tc}
+        if err := qc.rearm(); err != nil {
+            return nil, err
+        }
+        return qc, nil
+    }
+    return conn, nil
+}
+
+//报告中显示的选项
+func (so *SocketOptions) String() string {
+    onOff := func(b bool) string {
+        if b {
+            return "on"
+        }
+        return "off"
+    }
+    size := func(n int) string {
+        if n == 0 {
+            return "default"
+        }
+        return fmt.Sprintf("%d", n)
+    }
+    keepalive := "default"
+    if so.KeepAlive < 0 {
+        keepalive = "off"
+    } else if so.KeepAlive > 0 {
+        keepalive = so.KeepAlive.String()
+    }
+    linger := "default"
+    if so.ResetOnClose {
+        linger = "0 (rst)"
+    } else if so.Linger > 0 {
+        linger = so.Linger.String()
+    }
+    return fmt.Sprintf("nodelay=%s, sndbuf=%s, rcvbuf=%s, keepalive=%s, linger=%s, quickack=%s",
+        onOff(!so.Nagle), size(so.SendBuf), size(so.RecvBuf), keepalive, linger, onOff(so.QuickAck))
+}
+
+//Linux的TCP_QUICKACK不是持久的，内核会在之后恢复延迟ACK，所以每次读之后重新设置
+//读写经过拨号器返回的连接，设置作用在底层的TCP连接上
+type quickAckConn struct {
+    net.Conn
+    tc *net.TCPConn
+}
+
+func (qc *quickAckConn) NetConn() net.Conn {
+    return qc.Conn
+}
+
+func (qc *quickAckConn) Read(b []byte) (int, error) {
+    n, err := qc.Conn.Read(b)
+    if err == nil {
+        qc.rearm()
+    }
+    return n, err
+}
+
+func (qc *quickAckConn) rearm() error {
+    rc, err := qc.tc.SyscallConn()
+    if err != nil {
+        return err
+    }
+    return rawControl(rc, setQuickAck)
+}
+
+//在原始的文件描述符上执行设置
+func rawControl(rc syscall.RawConn, set func(fd uintptr) error) error {
+    var serr error
+    if err := rc.Control(func(fd uintptr) { serr = set(fd) }); err != nil {
+        return err
+    }
+    return serr
+}
@@ -0,0 +1,123 @@
+package unicorn
+
+import (
+    "net"
+    "runtime"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+//测试socket选项：设置之后请求正常，非法的组合被拒绝
+func TestSocketOptions(t *testing.T) {
+    ln := startEchoServer(t, "tcp", "127.0.0.1:0")
+    defer ln.Close()
+
+    opts := &SocketOptions{
+        Nagle        : true,
+        SendBuf      : 8192,
+        RecvBuf      : 8192,
+        KeepAlive    : 5 * time.Second,
+        ResetOnClose : true,
+        QuickAck     : runtime.GOOS == "linux",
+    }
+    result_chan := make(chan *CallResult, 50)
+    unc, err := NewUnicorn(ln.Addr().String(), &testEchoPlugin{}, 100*time.Millisecond, 0, 200*time.Millisecond, 2, false, result_chan)
+    if err != nil {
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
+    }
+    if err := unc.(*Unicorn).SetSocketOptions(opts); err != nil {
+        t.Fatal(err)
+    }
+    wg := unc.Start()
+    count_map := make(map[ResultCode]int)
+    for ret := range result_chan {
+        count_map[ret.Code]++
+    }
+    wg.Wait()
+    t.Logf("%s: %v\n", opts, count_map)
+    if count_map[RESULT_CODE_SUCCESS] == 0 || len(count_map) != 1 {
+        t.Fatalf("Socket options failing: %v\n", count_map)
+    }
+
+    for _, bad := range []*SocketOptions{
+        {SendBuf: -1},
+        {Linger: time.Second, ResetOnClose: true},
+    } {
+        if err := bad.check(NETWORK_TCP); err == nil {
+            t.Fatalf("%s should fail\n", bad)
+        }
+    }
+    if err := (&SocketOptions{Nagle: true}).check(NETWORK_UDP); err == nil {
+        t.Fatal("TCP options over udp should fail")
+    }
+}
+
+//不暴露被包装连接的包装
+type opaqueConn struct {
+    net.Conn
+}
+
+//返回包装过的连接的拨号器
+type wrappingDialer struct {
+    NetDialer
+    wrap func(net.Conn) net.Conn
+}
+
+func (wd *wrappingDialer) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+    conn, err := wd.NetDialer.Dial(network, address, timeout)
+    if err != nil {
+        return nil, err
+    }
+    return wd.wrap(conn), nil
+}
+
+//测试拨号器返回包装过的连接：通过NetConn()设置在底层的socket上，无法设置时建连失败
+func TestSocketOptionsWrapped(t *testing.T) {
+    ln := startEchoServer(t, "tcp", "127.0.0.1:0")
+    defer ln.Close()
+
+    opts := &SocketOptions{
+        Nagle    : true,
+        SendBuf  : 8192,
+        QuickAck : runtime.GOOS == "linux",
+    }
+    run := func(wrap func(net.Conn) net.Conn) map[ResultCode]int {
+        result_chan := make(chan *CallResult, 50)
+        unc, err := NewUnicorn(ln.Addr().String(), &testEchoPlugin{}, 100*time.Millisecond, 0, 200*time.Millisecond, 2, true, result_chan)
+        if err != nil {
+            t.Fatalf("Unicorn initialization failing: %s.\n", err)
+        }
+        unc.(*Unicorn).SetDialer(&wrappingDialer{wrap: wrap})
+        if err := unc.(*Unicorn).SetSocketOptions(opts); err != nil {
+            t.Fatal(err)
+        }
+        wg := unc.Start()
+        count_map := make(map[ResultCode]int)
+        for ret := range result_chan {
+            count_map[ret.Code]++
+            if ret.Code == RESULT_CODE_ERROR_CALL && !strings.Contains(ret.Msg, "can't be set") {
+                t.Errorf("Unexpected error: %s\n", ret.Msg)
+            }
+        }
+        wg.Wait()
+        return count_map
+    }
+
+    //包装实现了NetConn()，选项生效，拨号器的包装仍然在读写路径上
+    bc := &ByteCounter{}
+    count_map := run(bc.Wrapper())
+    if count_map[RESULT_CODE_SUCCESS] == 0 || len(count_map) != 1 {
+        t.Fatalf("Socket options over wrapped conn failing: %v\n", count_map)
+    }
+    if atomic.LoadUint64(&bc.Recv) == 0 || atomic.LoadUint64(&bc.Sent) == 0 {
+        t.Fatalf("Expected the dialer's wrapper kept, got %+v\n", bc)
+    }
+
+    //包装没有实现NetConn()，不会悄悄忽略选项
+    count_map = run(func(conn net.Conn) net.Conn { return &opaqueConn{conn} })
+    if count_map[RESULT_CODE_ERROR_CALL] == 0 || len(count_map) != 1 {
+        t.Fatalf("Expected dial errors over opaque conn, got %v\n", count_map)
+    }
+}
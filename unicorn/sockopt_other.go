@@ -0,0 +1,14 @@
+//go:build !unix
+
+package unicorn
+
+/*
+ * socket选项，其他系统暂不支持
+ */
+import (
+    "errors"
+)
+
+func setReuseAddr(fd uintptr) error {
+    return errors.New("SO_REUSEADDR is not supported on this platform")
+}
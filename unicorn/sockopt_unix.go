@@ -0,0 +1,14 @@
+//go:build unix
+
+package unicorn
+
+/*
+ * socket选项，类unix系统
+ */
+import (
+    "syscall"
+)
+
+func setReuseAddr(fd uintptr) error {
+    return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
@@ -0,0 +1,122 @@
+package unicorn
+
+/*
+ * 源地址绑定
+ * 高频短连接时，单个客户端IP的临时端口很快被耗尽（大量处于TIME_WAIT），建连报EADDRNOTAVAIL
+ * SourceDialer可以把连接轮流绑定到多个本地IP上，指定本地端口范围，以及开启SO_REUSEADDR
+ * 端口耗尽的错误以单独的结果码RESULT_CODE_ERROR_PORT出现在报告中
+ */
+import (
+    "errors"
+    "fmt"
+    "net"
+    "sync/atomic"
+    "syscall"
+    "time"
+)
+
+const (
+    SOURCE_PORT_RETRIES = 16 //指定端口范围时，端口被占用的重试次数
+)
+
+//源地址选项
+type SourceOptions struct {
+    IPs       []string //本地IP列表，轮流使用，为空则由系统选择
+    PortMin   int      //本地端口范围的下限，为0则由系统分配临时端口
+    PortMax   int      //本地端口范围的上限
+    ReuseAddr bool     //是否开启SO_REUSEADDR
+}
+
+//绑定源地址的拨号器，可以被多个worker并发使用
+type SourceDialer struct {
+    ips       []net.IP
+    portMin   int
+    portMax   int
+    reuseAddr bool
+    nextIP    uint64 //本地IP的轮询游标
+    nextPort  uint64 //本地端口的轮询游标
+}
+
+//New函数，校验选项，创建SourceDialer
+func NewSourceDialer(opts *SourceOptions) (*SourceDialer, error) {
+    sd := &SourceDialer{
+        portMin   : opts.PortMin,
+        portMax   : opts.PortMax,
+        reuseAddr : opts.ReuseAddr,
+    }
+    for _, s := range opts.IPs {
+        ip := net.ParseIP(s)
+        if ip == nil {
+            return nil, fmt.Errorf("Invalid source ip: %s", s)
+        }
+        sd.ips = append(sd.ips, ip)
+    }
+    if sd.portMin != 0 || sd.portMax != 0 {
+        if sd.portMin <= 0 || sd.portMax > 65535 || sd.portMin > sd.portMax {
+            return nil, fmt.Errorf("Invalid source port range: %d-%d", sd.portMin, sd.portMax)
+        }
+    }
+    return sd, nil
+}
+
+//*SourceDialer实现DialerIntfs接口
+func (sd *SourceDialer) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+    //Unix socket没有源地址的概念
+    if network == NETWORK_UNIX {
+        return net.DialTimeout(network, address, timeout)
+    }
+
+    var ip net.IP
+    if len(sd.ips) > 0 {
+        ip = sd.ips[(atomic.AddUint64(&sd.nextIP, 1)-1)%uint64(len(sd.ips))]
+    }
+
+    //指定了端口范围时，端口可能被占用，换下一个端口重试
+    attempts := 1
+    if sd.portMin > 0 {
+        attempts = SOURCE_PORT_RETRIES
+        if size := sd.portMax - sd.portMin + 1; size < attempts {
+            attempts = size
+        }
+    }
+    var err error
+    for i := 0; i < attempts; i++ {
+        port := 0
+        if sd.portMin > 0 {
+            port = sd.portMin + int((atomic.AddUint64(&sd.nextPort, 1)-1)%uint64(sd.portMax-sd.portMin+1))
+        }
+        d := net.Dialer{
+            Timeout   : timeout,
+            LocalAddr : localAddr(network, ip, port),
+        }
+        if sd.reuseAddr {
+            d.Control = reuseAddrControl
+        }
+        var conn net.Conn
+        if conn, err = d.Dial(network, address); err == nil || !isPortExhausted(err) {
+            return conn, err
+        }
+    }
+    return nil, err
+}
+
+//本地地址，IP和端口都不指定时返回nil，由系统选择
+func localAddr(network string, ip net.IP, port int) net.Addr {
+    if ip == nil && port == 0 {
+        return nil
+    }
+    if network == NETWORK_UDP {
+        return &net.UDPAddr{IP: ip, Port: port}
+    }
+    return &net.TCPAddr{IP: ip, Port: port}
+}
+
+//在socket绑定之前开启SO_REUSEADDR
+func reuseAddrControl(network, address string, c syscall.RawConn) error {
+    return rawControl(c, setReuseAddr)
+}
+
+//是否是本地地址或者端口耗尽导致的错误
+func isPortExhausted(err error) bool {
+    return errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EADDRINUSE)
+}
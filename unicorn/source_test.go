@@ -0,0 +1,55 @@
+package unicorn
+
+import (
+    "net"
+    "runtime"
+    "testing"
+    "time"
+)
+
+//测试源地址绑定：本地IP轮流使用，端口在指定范围内，被占用的端口会被跳过
+func TestSourceDialer(t *testing.T) {
+    if runtime.GOOS != "linux" {
+        t.Skip("127.0.0.0/8 is only fully routed to lo on linux")
+    }
+    ln := startEchoServer(t, "tcp", "127.0.0.1:0")
+    defer ln.Close()
+
+    //占住一个端口，作为端口范围的起点
+    busy, err := net.Listen("tcp", "127.0.0.2:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer busy.Close()
+    portMin := busy.Addr().(*net.TCPAddr).Port
+
+    if _, err := NewSourceDialer(&SourceOptions{PortMin: 2000, PortMax: 1000}); err == nil {
+        t.Fatal("Bad port range should fail")
+    }
+    sd, err := NewSourceDialer(&SourceOptions{
+        IPs       : []string{"127.0.0.2"},
+        PortMin   : portMin,
+        PortMax   : portMin + 3,
+        ReuseAddr : true,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 3; i++ {
+        conn, err := sd.Dial(NETWORK_TCP, ln.Addr().String(), time.Second)
+        if err != nil {
+            t.Fatalf("Dial failing: %s\n", err)
+        }
+        local := conn.LocalAddr().(*net.TCPAddr)
+        conn.Close()
+        if local.IP.String() != "127.0.0.2" || local.Port <= portMin || local.Port > portMin+3 {
+            t.Fatalf("Unexpected local address: %s\n", local)
+        }
+    }
+
+    //只有一个被占用的端口可用时，报端口耗尽
+    sd, _ = NewSourceDialer(&SourceOptions{IPs: []string{"127.0.0.2"}, PortMin: portMin, PortMax: portMin})
+    if _, err := sd.Dial(NETWORK_TCP, ln.Addr().String(), time.Second); err == nil || !isPortExhausted(err) {
+        t.Fatalf("Expected port exhausted, got %v\n", err)
+    }
+}
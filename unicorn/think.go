@@ -0,0 +1,122 @@
+package unicorn
+
+/*
+ * 思考时间：模拟真实用户，同一连接上相邻两个请求之间的间隔
+ * 支持固定、均匀分布、指数分布，插件也可以自己提供（实现ThinkTimeIntfs接口）
+ */
+import (
+    "errors"
+    "fmt"
+    "math/rand"
+    "strings"
+    "time"
+)
+
+//思考时间生成器，多个worker会并发调用
+type ThinkTimerIntfs interface {
+    Next() time.Duration
+}
+
+//可选接口：插件实现了这个接口，则由插件根据刚完成的请求决定思考时间，优先于Unicorn的设置
+type ThinkTimeIntfs interface {
+    ThinkTime(rawReq RawRequest) time.Duration
+}
+
+//固定的思考时间
+type FixedThinkTimer struct {
+    d time.Duration
+}
+
+func (ft *FixedThinkTimer) Next() time.Duration {
+    return ft.d
+}
+
+func NewFixedThinkTimer(d time.Duration) ThinkTimerIntfs {
+    return &FixedThinkTimer{d: d}
+}
+
+//[min, max]之间均匀分布的思考时间
+type UniformThinkTimer struct {
+    min, max time.Duration
+}
+
+func (ut *UniformThinkTimer) Next() time.Duration {
+    if ut.max <= ut.min {
+        return ut.min
+    }
+    return ut.min + time.Duration(rand.Int63n(int64(ut.max-ut.min)+1))
+}
+
+func NewUniformThinkTimer(min, max time.Duration) (ThinkTimerIntfs, error) {
+    if min < 0 || max < min {
+        return nil, fmt.Errorf("Bad think time range [%v, %v]", min, max)
+    }
+    return &UniformThinkTimer{min: min, max: max}, nil
+}
+
+//均值为mean的指数分布思考时间，对应泊松到达
+type ExpThinkTimer struct {
+    mean time.Duration
+}
+
+func (et *ExpThinkTimer) Next() time.Duration {
+    return time.Duration(rand.ExpFloat64() * float64(et.mean))
+}
+
+func NewExpThinkTimer(mean time.Duration) ThinkTimerIntfs {
+    return &ExpThinkTimer{mean: mean}
+}
+
+/*
+ * 解析思考时间的描述：
+ *   fixed:100ms
+ *   uniform:50ms-200ms
+ *   exp:100ms
+ */
+func ParseThinkTimer(spec string) (ThinkTimerIntfs, error) {
+    kind, arg := spec, ""
+    if i := strings.Index(spec, ":"); i >= 0 {
+        kind, arg = spec[:i], spec[i+1:]
+    }
+    switch kind {
+    case "fixed":
+        d, err := parseThinkDuration(arg)
+        if err != nil {
+            return nil, err
+        }
+        return NewFixedThinkTimer(d), nil
+    case "uniform":
+        parts := strings.SplitN(arg, "-", 2)
+        if len(parts) != 2 {
+            return nil, errors.New("Uniform think time should be like uniform:50ms-200ms")
+        }
+        min, err := time.ParseDuration(parts[0])
+        if err != nil {
+            return nil, err
+        }
+        max, err := time.ParseDuration(parts[1])
+        if err != nil {
+            return nil, err
+        }
+        return NewUniformThinkTimer(min, max)
+    case "exp":
+        d, err := parseThinkDuration(arg)
+        if err != nil {
+            return nil, err
+        }
+        return NewExpThinkTimer(d), nil
+    }
+    return nil, fmt.Errorf("Unknown think time: %s", spec)
+}
+
+//思考时间不能为负
+func parseThinkDuration(s string) (time.Duration, error) {
+    d, err := time.ParseDuration(s)
+    if err != nil {
+        return 0, err
+    }
+    if d < 0 {
+        return 0, fmt.Errorf("Negative think time: %s", s)
+    }
+    return d, nil
+}
@@ -0,0 +1,93 @@
+package unicorn
+
+import (
+    "testing"
+    "time"
+)
+
+//测试思考时间的解析：各种格式的取值范围，以及错误的格式
+func TestParseThinkTimer(t *testing.T) {
+    cases := []struct {
+        spec     string
+        min, max time.Duration
+    }{
+        {"fixed:100ms", 100 * time.Millisecond, 100 * time.Millisecond},
+        {"fixed:0s", 0, 0},
+        {"uniform:50ms-200ms", 50 * time.Millisecond, 200 * time.Millisecond},
+        {"uniform:1s-1s", time.Second, time.Second},
+        {"exp:10ms", 0, time.Duration(1<<63 - 1)},
+    }
+    for _, c := range cases {
+        tt, err := ParseThinkTimer(c.spec)
+        if err != nil {
+            t.Fatalf("%s: %s\n", c.spec, err)
+        }
+        var sum time.Duration
+        for i := 0; i < 1000; i++ {
+            d := tt.Next()
+            if d < c.min || d > c.max {
+                t.Fatalf("%s: %v out of [%v, %v]\n", c.spec, d, c.min, c.max)
+            }
+            sum += d
+        }
+        //指数分布的均值
+        if c.spec == "exp:10ms" && (sum/1000 < 8*time.Millisecond || sum/1000 > 12*time.Millisecond) {
+            t.Fatalf("%s: unexpected mean %v\n", c.spec, sum/1000)
+        }
+    }
+
+    for _, bad := range []string{
+        "", "100ms", "fixed", "fixed:100", "fixed:-1s", "exp:abc", "exp:-5ms",
+        "uniform:50ms", "uniform:200ms-50ms", "uniform:-1s-1s", "uniform:1s-x", "poisson:1s",
+    } {
+        if _, err := ParseThinkTimer(bad); err == nil {
+            t.Fatalf("%q: expected error\n", bad)
+        }
+    }
+}
+
+//测试会话长度限制：达到最多请求数或者最长存活时间之后重新建连
+func TestSessionLimit(t *testing.T) {
+    ln := startEchoServer(t, "tcp", "127.0.0.1:0")
+    defer ln.Close()
+
+    run := func(maxRequests uint64, maxLifetime time.Duration) (int64, int) {
+        result_chan := make(chan *CallResult, 50)
+        unc, err := NewUnicorn(ln.Addr().String(), &testEchoPlugin{}, 100*time.Millisecond, 0, 300*time.Millisecond, 1, true, result_chan)
+        if err != nil {
+            t.Fatalf("Unicorn initialization failing: %s.\n", err)
+        }
+        dialer := &countDialer{}
+        u := unc.(*Unicorn)
+        u.SetDialer(dialer)
+        u.SetSessionLimit(maxRequests, maxLifetime)
+        //思考时间使得最长存活时间内只能发送有限的请求
+        u.SetThinkTimer(NewFixedThinkTimer(5 * time.Millisecond))
+        wg := unc.Start()
+        success := 0
+        for ret := range result_chan {
+            if ret.Code == RESULT_CODE_SUCCESS {
+                success++
+            }
+        }
+        wg.Wait()
+        return dialer.cnt, success
+    }
+
+    //每个连接最多3个请求
+    dials, success := run(3, 0)
+    if success < 9 || dials < int64(success/3) || dials > int64(success/3)+1 {
+        t.Fatalf("maxRequests=3: %d dials for %d successes\n", dials, success)
+    }
+
+    //每个连接最多存活50ms，300ms内至少重连4次
+    dials, success = run(0, 50*time.Millisecond)
+    if dials < 5 || dials > 8 || int64(success) < 2*dials {
+        t.Fatalf("maxLifetime=50ms: %d dials for %d successes\n", dials, success)
+    }
+
+    //不限制时只建连一次
+    if dials, _ = run(0, 0); dials != 1 {
+        t.Fatalf("Unlimited: expected 1 dial, got %d\n", dials)
+    }
+}
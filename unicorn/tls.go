@@ -0,0 +1,115 @@
+package unicorn
+
+/*
+ * TLS传输
+ * 支持CA证书、客户端证书（mTLS）、SNI、ALPN、协议版本范围、加密套件以及会话复用
+ */
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "strings"
+)
+
+const (
+    TLS_SESSION_CACHE_SIZE = 1024  //会话复用时，客户端会话缓存的容量
+)
+
+//TLS选项
+type TLSOptions struct {
+    CAFile             string   //CA证书（PEM），为空则使用系统CA
+    CertFile           string   //客户端证书（PEM），mTLS时使用
+    KeyFile            string   //客户端私钥（PEM），mTLS时使用
+    ServerName         string   //SNI，为空则使用目标地址中的主机名
+    ALPN               []string //ALPN协议列表，比如h2、http/1.1
+    MinVersion         string   //最低版本：1.0/1.1/1.2/1.3，为空则使用默认值
+    MaxVersion         string   //最高版本：1.0/1.1/1.2/1.3，为空则使用默认值
+    CipherSuites       []string //加密套件名字，比如TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256，为空则使用默认值
+    SessionResumption  bool     //是否开启会话复用
+    InsecureSkipVerify bool     //不校验服务端证书，仅用于测试
+}
+
+var tlsVersions = map[string]uint16{
+    "1.0": tls.VersionTLS10,
+    "1.1": tls.VersionTLS11,
+    "1.2": tls.VersionTLS12,
+    "1.3": tls.VersionTLS13,
+}
+
+//根据选项生成tls.Config
+//没有指定SNI时不在这里推断，建连时按照各个节点的主机名设置（见dial）
+func (opts *TLSOptions) Build() (*tls.Config, error) {
+    cfg := &tls.Config{
+        ServerName         : opts.ServerName,
+        NextProtos         : opts.ALPN,
+        InsecureSkipVerify : opts.InsecureSkipVerify,
+    }
+
+    //CA证书
+    if opts.CAFile != "" {
+        pem, err := ioutil.ReadFile(opts.CAFile)
+        if err != nil {
+            return nil, err
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("No certificate found in %s", opts.CAFile)
+        }
+        cfg.RootCAs = pool
+    }
+
+    //客户端证书
+    if opts.CertFile != "" || opts.KeyFile != "" {
+        if opts.CertFile == "" || opts.KeyFile == "" {
+            return nil, errors.New("Both client cert and key are needed")
+        }
+        cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+        if err != nil {
+            return nil, err
+        }
+        cfg.Certificates = []tls.Certificate{cert}
+    }
+
+    //版本范围
+    if opts.MinVersion != "" {
+        v, ok := tlsVersions[opts.MinVersion]
+        if !ok {
+            return nil, fmt.Errorf("Unknown TLS version: %s", opts.MinVersion)
+        }
+        cfg.MinVersion = v
+    }
+    if opts.MaxVersion != "" {
+        v, ok := tlsVersions[opts.MaxVersion]
+        if !ok {
+            return nil, fmt.Errorf("Unknown TLS version: %s", opts.MaxVersion)
+        }
+        cfg.MaxVersion = v
+    }
+
+    //加密套件（TLS1.3的套件不可配置）
+    if len(opts.CipherSuites) > 0 {
+        ids := make(map[string]uint16)
+        for _, cs := range tls.CipherSuites() {
+            ids[cs.Name] = cs.ID
+        }
+        for _, cs := range tls.InsecureCipherSuites() {
+            ids[cs.Name] = cs.ID
+        }
+        for _, name := range opts.CipherSuites {
+            id, ok := ids[strings.TrimSpace(name)]
+            if !ok {
+                return nil, fmt.Errorf("Unknown cipher suite: %s", name)
+            }
+            cfg.CipherSuites = append(cfg.CipherSuites, id)
+        }
+    }
+
+    //会话复用：客户端缓存会话票据，重新建连时可以跳过完整握手
+    if opts.SessionResumption {
+        cfg.ClientSessionCache = tls.NewLRUClientSessionCache(TLS_SESSION_CACHE_SIZE)
+    }
+
+    return cfg, nil
+}
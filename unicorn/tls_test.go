@@ -0,0 +1,179 @@
+package unicorn
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "io"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+//测试用的回显插件
+type testEchoPlugin struct{}
+
+func (tep *testEchoPlugin) GenRequest(id int64) RawRequest {
+    return RawRequest{Id: id, Req: []byte("hello unicorn")}
+}
+
+func (tep *testEchoPlugin) CheckFull(rawReq *RawRequest, response []byte) ServerRespStatus {
+    if len(response) < len(rawReq.Req) {
+        return SER_NEEDMORE
+    } else if len(response) == len(rawReq.Req) {
+        return SER_OK
+    }
+    return SER_ERROR
+}
+
+func (tep *testEchoPlugin) CheckResponse(rawReq RawRequest, response []byte) (ResultCode, string) {
+    if string(response) != string(rawReq.Req) {
+        return RESULT_CODE_ERROR_RESPONSE, "Mismatch"
+    }
+    return RESULT_CODE_SUCCESS, "Success"
+}
+
+//在本地生成证书：签发者为nil时生成自签名的CA
+func genCert(t *testing.T, cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+    tmpl := &x509.Certificate{
+        SerialNumber : serial,
+        Subject      : pkix.Name{CommonName: cn},
+        NotBefore    : time.Now().Add(-time.Hour),
+        NotAfter     : time.Now().Add(time.Hour),
+        KeyUsage     : x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+        ExtKeyUsage  : []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        DNSNames     : []string{cn},
+    }
+    if isCA {
+        tmpl.IsCA = true
+        tmpl.BasicConstraintsValid = true
+        tmpl.KeyUsage |= x509.KeyUsageCertSign
+    }
+    if parent == nil {
+        parent, parentKey = tmpl, key
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert, _ := x509.ParseCertificate(der)
+    keyDer, _ := x509.MarshalECPrivateKey(key)
+    return cert, key,
+        pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+        pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+//启动一个要求客户端证书的TLS回显服务端
+func startTLSEchoServer(t *testing.T, caCert *x509.Certificate, certPEM, keyPEM []byte) net.Listener {
+    cert, err := tls.X509KeyPair(certPEM, keyPEM)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pool := x509.NewCertPool()
+    pool.AddCert(caCert)
+    ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+        Certificates : []tls.Certificate{cert},
+        ClientCAs    : pool,
+        ClientAuth   : tls.RequireAndVerifyClientCert,
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                io.Copy(conn, conn)
+            }()
+        }
+    }()
+    return ln
+}
+
+//测试mTLS：有客户端证书时成功，且握手耗时被记录；没有客户端证书时握手失败
+func TestTLS(t *testing.T) {
+    dir, err := ioutil.TempDir("", "unicorn-tls")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    caCert, caKey, caPEM, _ := genCert(t, "unicorn-ca", true, nil, nil)
+    _, _, serverPEM, serverKeyPEM := genCert(t, "localhost", false, caCert, caKey)
+    _, _, clientPEM, clientKeyPEM := genCert(t, "unicorn-client", false, caCert, caKey)
+    files := map[string][]byte{"ca.pem": caPEM, "client.pem": clientPEM, "client.key": clientKeyPEM}
+    for name, content := range files {
+        if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    ln := startTLSEchoServer(t, caCert, serverPEM, serverKeyPEM)
+    defer ln.Close()
+
+    run := func(opts *TLSOptions) map[ResultCode]int {
+        result_chan := make(chan *CallResult, 50)
+        unc, err := NewUnicorn(ln.Addr().String(), &testEchoPlugin{}, 500*time.Millisecond, 0, 300*time.Millisecond, 2, true, result_chan)
+        if err != nil {
+            t.Fatalf("Unicorn initialization failing: %s.\n", err)
+        }
+        if err := unc.(*Unicorn).SetTLS(opts); err != nil {
+            t.Fatalf("TLS initialization failing: %s.\n", err)
+        }
+        wg := unc.Start()
+        count_map := make(map[ResultCode]int)
+        handshakes := 0
+        for ret := range result_chan {
+            count_map[ret.Code]++
+            if ret.Handshake > 0 {
+                handshakes++
+            }
+        }
+        wg.Wait()
+        if count_map[RESULT_CODE_SUCCESS] > 0 && handshakes == 0 {
+            t.Fatal("Handshake time not reported")
+        }
+        return count_map
+    }
+
+    //mTLS
+    count_map := run(&TLSOptions{
+        CAFile            : filepath.Join(dir, "ca.pem"),
+        CertFile          : filepath.Join(dir, "client.pem"),
+        KeyFile           : filepath.Join(dir, "client.key"),
+        ServerName        : "localhost",
+        MinVersion        : "1.2",
+        SessionResumption : true,
+    })
+    t.Logf("mTLS: %v\n", count_map)
+    if count_map[RESULT_CODE_SUCCESS] == 0 || count_map[RESULT_CODE_ERROR_CALL] > 0 {
+        t.Fatalf("mTLS failing: %v\n", count_map)
+    }
+
+    //没有客户端证书，服务端拒绝。TLS1.3下客户端证书在握手之后才被校验，所以错误可能出现在首次读写时
+    count_map = run(&TLSOptions{
+        CAFile     : filepath.Join(dir, "ca.pem"),
+        ServerName : "localhost",
+    })
+    t.Logf("No client cert: %v\n", count_map)
+    if count_map[RESULT_CODE_SUCCESS] > 0 || count_map[RESULT_CODE_ERROR_CALL] == 0 {
+        t.Fatalf("Expected handshake failure: %v\n", count_map)
+    }
+}
@@ -0,0 +1,65 @@
+package unicorn
+
+import (
+    "net"
+    "testing"
+    "time"
+)
+
+//启动一个UDP回显服务端：每3个数据报丢弃1个，迟到1个（超过timeout，但在丢失判定窗口之内）
+func startLossyUDPServer(t *testing.T, late time.Duration) net.PacketConn {
+    pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go func() {
+        buf := make([]byte, UDP_MAX_DATAGRAM)
+        for i := 0; ; i++ {
+            n, addr, err := pc.ReadFrom(buf)
+            if err != nil {
+                return
+            }
+            switch i % 3 {
+            case 0: //丢弃
+            case 1:
+                resp := append([]byte(nil), buf[:n]...)
+                time.AfterFunc(late, func() { pc.WriteTo(resp, addr) })
+            default:
+                pc.WriteTo(buf[:n], addr)
+            }
+        }
+    }()
+    return pc
+}
+
+//测试UDP：丢失和迟到分开计数
+func TestUDPLoss(t *testing.T) {
+    timeout := 20 * time.Millisecond
+    pc := startLossyUDPServer(t, timeout + timeout/2)
+    defer pc.Close()
+
+    result_chan := make(chan *CallResult, 50)
+    unc, err := NewUnicorn("udp://" + pc.LocalAddr().String(), &testEchoPlugin{}, timeout, 0, 500*time.Millisecond, 1, true, result_chan)
+    if err != nil {
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
+    }
+    if unc.(*Unicorn).Network() != NETWORK_UDP {
+        t.Fatalf("Expected udp, got %s\n", unc.(*Unicorn).Network())
+    }
+    wg := unc.Start()
+    count_map := make(map[ResultCode]int)
+    for ret := range result_chan {
+        count_map[ret.Code]++
+    }
+    wg.Wait()
+
+    t.Logf("Result: %v\n", count_map)
+    for _, code := range []ResultCode{RESULT_CODE_SUCCESS, RESULT_CODE_WARING_LOST, RESULT_CODE_WARING_TIMEOUT} {
+        if count_map[code] == 0 {
+            t.Fatalf("Expected some %s, got %v\n", ConvertCodePlain(code), count_map)
+        }
+    }
+    if count_map[RESULT_CODE_ERROR_CALL] > 0 || count_map[RESULT_CODE_ERROR_RESPONSE] > 0 {
+        t.Fatalf("Unexpected errors: %v\n", count_map)
+    }
+}
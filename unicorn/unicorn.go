@@ -77,9 +77,22 @@ func NewUnicorn(
         return nil, err
     }
 
+    //解析地址中的传输方式，比如udp://127.0.0.1:53、unix:///tmp/server.sock，多个地址以逗号分隔
+    endpoints, err := parseEndpoints(addr)
+    if err != nil {
+        return nil, err
+    }
+    balancer, err := newBalancer(BALANCE_ROUND_ROBIN, endpoints)
+    if err != nil {
+        return nil, err
+    }
+
     //创建instance
     unc := &Unicorn{
         serverAdd  : addr,
+        network    : endpoints[0].Network,
+        endpoints  : endpoints,
+        balancer   : balancer,
         plugin     : plugin,
         timeout    : timeout,
         qps        : qps,
@@ -94,6 +107,7 @@ func NewUnicorn(
         pool       : pool,
         throttle   : throttle,
         keepalive  : keepalive,
+        dialer     : &NetDialer{},
     }
 
     return unc, nil
@@ -142,6 +156,103 @@ func (unc *Unicorn) Status() UncStatus {
     return unc.status
 }
 
+//传输方式
+func (unc *Unicorn) Network() string {
+    return unc.network
+}
+
+/******************** 可选设置，需要在Start之前调用 *******************/
+//设置思考时间
+func (unc *Unicorn) SetThinkTimer(tt ThinkTimerIntfs) {
+    unc.thinkTimer = tt
+}
+
+//设置每个连接的会话长度限制：最多请求数、最长存活时间，0表示不限制
+//达到限制后关闭连接，重新建连
+func (unc *Unicorn) SetSessionLimit(maxRequests uint64, maxLifetime time.Duration) {
+    unc.maxRequests = maxRequests
+    unc.maxLifetime = maxLifetime
+}
+
+//设置TLS，建连之后进行TLS握手
+func (unc *Unicorn) SetTLS(opts *TLSOptions) error {
+    if unc.network == NETWORK_UDP {
+        return errors.New("TLS is not supported over udp")
+    }
+    //默认的SNI在建连时按照节点的主机名确定
+    cfg, err := opts.Build()
+    if err != nil {
+        return err
+    }
+    unc.tlsConfig = cfg
+    return nil
+}
+
+//设置负载均衡策略，resolve为true时把主机名解析成多个IP，每个IP作为一个节点
+func (unc *Unicorn) SetBalance(strategy string, resolve bool) error {
+    endpoints := unc.endpoints
+    if resolve {
+        var err error
+        if endpoints, err = resolveEndpoints(endpoints); err != nil {
+            return err
+        }
+    }
+    balancer, err := newBalancer(strategy, endpoints)
+    if err != nil {
+        return err
+    }
+    unc.endpoints = endpoints
+    unc.balancer = balancer
+    return nil
+}
+
+//目标节点
+func (unc *Unicorn) Endpoints() []*Endpoint {
+    return unc.endpoints
+}
+
+//设置socket选项
+func (unc *Unicorn) SetSocketOptions(opts *SocketOptions) error {
+    if err := opts.check(unc.network); err != nil {
+        return err
+    }
+    unc.socket = opts
+    return nil
+}
+
+//目标地址
+func (unc *Unicorn) Address() string {
+    return unc.serverAdd
+}
+
+//负载均衡策略
+func (unc *Unicorn) Balance() string {
+    return unc.balancer.strategy
+}
+
+//socket选项，未设置时返回零值，即全部使用默认值
+func (unc *Unicorn) SocketOptions() *SocketOptions {
+    if unc.socket == nil {
+        return &SocketOptions{}
+    }
+    return unc.socket
+}
+
+//替换拨号器
+func (unc *Unicorn) SetDialer(d DialerIntfs) {
+    unc.dialer = d
+}
+
+//设置流量记录器，每次交互的请求和响应按照记录器的采样比例写入记录文件
+func (unc *Unicorn) SetRecorder(rec *Recorder) {
+    unc.recorder = rec
+}
+
+//追加连接包装，按照追加的顺序由内向外包装原始连接，TLS始终在最外层
+func (unc *Unicorn) UseConnWrapper(wrappers ...ConnWrapper) {
+    unc.wrappers = append(unc.wrappers, wrappers...)
+}
+
 /*
  * 发送请求的总控制逻辑，放置在独立的goroutine中执行
  */
@@ -180,12 +291,16 @@ func ConvertCodePlain(code ResultCode) string {
         code_plain = "Success"
     case RESULT_CODE_WARING_TIMEOUT:
         code_plain = "Call Timeout Warning"
+    case RESULT_CODE_WARING_LOST:
+        code_plain = "Datagram Lost Warning"
     case RESULT_CODE_ERROR_CALL:
         code_plain = "Call Error"
     case RESULT_CODE_ERROR_RESPONSE:
         code_plain = "Response Error"
     case RESULT_CODE_ERROR_CALEE:
         code_plain = "Callee Error"
+    case RESULT_CODE_ERROR_PORT:
+        code_plain = "Port Exhausted Error"
     case RESULT_CODE_FATAL_CALL:
         code_plain = "Call Fatal Error"
     case RESULT_CODE_DONE:
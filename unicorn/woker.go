@@ -12,9 +12,15 @@ import (
     "net"
     "bufio"
     "io"
+    "sync"
     "sync/atomic"
 )
 
+//流式连接的接收缓冲，在交互之间复用
+var recvBufPool = sync.Pool{
+    New: func() interface{} { return make([]byte, RECV_BUFFER_SIZE) },
+}
+
 //兜底的错误处理，以defer的形式存在
 func (unc *Unicorn) handleError() {
     if p := recover(); p != nil {
@@ -68,14 +74,65 @@ func (unc *Unicorn) createWorker() {
             return
         }
 
-        //和服务端建立连接
-        conn, err := net.DialTimeout("tcp", unc.serverAdd, unc.timeout)
-        if err != nil {
+        var conn net.Conn
+        var ep *Endpoint                     //当前连接的目标节点
+        var connect, handshake time.Duration //建连以及握手的耗时
+        var connStart time.Time
+        var connReqs uint64 //本连接上已发送的请求数
+        var connId uint64   //连接编号，流量记录用来区分不同的连接
+
+        //注册defer：关闭连接
+        defer func(){
+            if conn != nil {
+                conn.Close()
+            }
+        }()
+
+        //和节点建立连接，建连或者握手失败也作为一次调用错误记录下来
+        redial := func(target *Endpoint, typ string) bool {
+            if conn != nil {
+                conn.Close()
+            }
+            var err error
+            ep = target
+            conn, connect, handshake, err = unc.dial(target)
+            if err != nil {
+                //端口耗尽单独计数，以便和其他的建连错误区分开
+                code := RESULT_CODE_ERROR_CALL
+                if isPortExhausted(err) {
+                    code = RESULT_CODE_ERROR_PORT
+                }
+                atomic.AddUint64(&unc.AllCnt, 1)
+                unc.saveResult(&CallResult{
+                    Id        : -1,
+                    Type      : typ,
+                    Code      : code,
+                    Msg       : "Dial failed: " + err.Error(),
+                    Connect   : connect,
+                    Handshake : handshake,
+                    Endpoint  : target.String(),
+                })
+                return false
+            }
+            connStart = time.Now()
+            connReqs = 0
+            connId = atomic.AddUint64(&unc.connSeq, 1)
+            return true
+        }
+
+        //按key分发时，需要先生成请求，才能确定节点，所以在循环中建连；否则先建连
+        keyed := unc.balancer.keyed()
+        if !keyed && !redial(unc.balancer.pick(""), "") {
             return
         }
 
-        //注册defer：关闭连接
-        defer func(){ conn.Close() }()
+        //本连接使用的插件：会话插件为每个连接生成独享的实例
+        plugin := unc.plugin
+        var session SessionIntfs
+        if factory, ok := unc.plugin.(SessionFactoryIntfs); ok {
+            session = factory.NewSession()
+            plugin = session
+        }
 
         //开启探测
         for {
@@ -94,51 +151,123 @@ func (unc *Unicorn) createWorker() {
             }
 
             //构造请求
-            id := time.Now().UnixNano() //用纳秒就能保证唯一性了吗？
-            raw_request := unc.plugin.GenRequest(id)
+            id := NextRequestId()
+            raw_request := plugin.GenRequest(id)
 
-            //启动一个异步定时器，check超时
-            var timeout_flag = false
-            timer := time.AfterFunc(unc.timeout, func(){
-                timeout_flag = true
-            })
+            //插件生成请求失败，记为致命错误，结束当前连接
+            if raw_request.Err != nil {
+                atomic.AddUint64(&unc.AllCnt, 1)
+                unc.saveResult(&CallResult{
+                    Id   : raw_request.Id,
+                    Type : raw_request.Type,
+                    Code : RESULT_CODE_FATAL_CALL,
+                    Msg  : "Request generating failed: " + raw_request.Err.Error(),
+                })
+                return
+            }
+
+            //请求的key对应的节点和当前连接的不同，则重新建连
+            if keyed {
+                if target := unc.balancer.pick(raw_request.Key); conn == nil || target != ep {
+                    if !redial(target, raw_request.Type) {
+                        return
+                    }
+                }
+            }
+            connReqs++
+
+            //超时：插件可以为单个请求指定超时，否则使用全局超时
+            //超时通过连接的deadline实现，服务端迟迟不返回时，读操作会在deadline处返回超时错误
+            timeout := unc.timeout
+            if raw_request.Timeout > 0 {
+                timeout = raw_request.Timeout
+            }
 
             //同步交互：发送请求+接收响应
-            start := time.Now().Nanosecond()
-            data, err := unc.interact(&raw_request, conn)
-            end := time.Now().Nanosecond()
+            //UDP的deadline是丢失判定窗口，窗口内迟到的响应仍然可以收到，用来区分迟到和丢失
+            start := time.Now()
+            var data []byte
+            var err error
+            atomic.AddInt64(&ep.outstanding, 1)
+            if unc.network == NETWORK_UDP {
+                conn.SetDeadline(start.Add(timeout * UDP_LOSS_WINDOW_FACTOR))
+                data, err = unc.interactDatagram(plugin, &raw_request, conn)
+            } else {
+                conn.SetDeadline(start.Add(timeout))
+                data, err = unc.interact(plugin, &raw_request, conn)
+            }
+            atomic.AddInt64(&ep.outstanding, -1)
+            elapse := time.Since(start)
 
             //上面是一个同步的过程，所以到了此处，可能是已经超时了
-            //所以检测超时标志，只有未超时，才有必要继续
+            //所以检测超时，只有未超时，才有必要继续
             var result *CallResult
             var code ResultCode
             var msg string
-            if err != nil {
-                timer.Stop() //!!立刻停止异步定时器
+            if err != nil && isTimeout(err) && unc.network == NETWORK_UDP {
+                code = RESULT_CODE_WARING_LOST
                 result = &CallResult{
-                    Id     : id,
+                    Id     : raw_request.Id,
                     //Req    : raw_request,
-                    Code   : RESULT_CODE_ERROR_CALL,
-                    Msg    : err.Error(),
-                    Elapse : time.Duration(end - start),
+                    Type   : raw_request.Type,
+                    Code   : code,
+                    Msg    : fmt.Sprintf("Lost! (no response in %v)", timeout * UDP_LOSS_WINDOW_FACTOR),
+                    Elapse : elapse,
                 }
-            }else if timeout_flag {
+            } else if err != nil && isTimeout(err) || err == nil && elapse > timeout {
+                code = RESULT_CODE_WARING_TIMEOUT
                 result = &CallResult{
                     Id     : raw_request.Id,
                     //Req    : raw_request,
-                    Code   : RESULT_CODE_WARING_TIMEOUT,
-                    Msg    : fmt.Sprintf("Timeout! (expected: < %v)", unc.timeout),
-                    Elapse : time.Duration(end - start),
+                    Type   : raw_request.Type,
+                    Code   : code,
+                    Msg    : fmt.Sprintf("Timeout! (expected: < %v)", timeout),
+                    Elapse : elapse,
+                }
+            } else if err != nil {
+                code = RESULT_CODE_ERROR_CALL
+                result = &CallResult{
+                    Id     : id,
+                    //Req    : raw_request,
+                    Type   : raw_request.Type,
+                    Code   : code,
+                    Msg    : err.Error(),
+                    Elapse : elapse,
                 }
             } else {
-                timer.Stop() //!!立刻停止异步定时器
-                code, msg = unc.plugin.CheckResponse(raw_request, data)
+                code, msg = plugin.CheckResponse(raw_request, data)
                 result = &CallResult{
                     Id     : raw_request.Id,
                     //Req    : raw_request,
+                    Type   : raw_request.Type,
                     Code   : code,
                     Msg    : msg,
-                    Elapse : time.Duration(end - start),
+                    Elapse : elapse,
+                }
+            }
+
+            //结果所属的节点，建连以及握手的耗时记在连接上的第一个结果里
+            result.Endpoint = ep.String()
+            if connReqs == 1 {
+                result.Connect = connect
+                result.Handshake = handshake
+            }
+
+            //流量记录：出错时data是已经收到的部分响应
+            if unc.recorder != nil {
+                err := unc.recorder.Record(&Record{
+                    Time     : start,
+                    ConnId   : connId,
+                    Id       : result.Id,
+                    Code     : code,
+                    Elapse   : elapse,
+                    Type     : raw_request.Type,
+                    Endpoint : result.Endpoint,
+                    Req      : raw_request.Req,
+                    Resp     : data,
+                })
+                if err != nil {
+                    log.Logger.Info("Record failed: " + err.Error())
                 }
             }
 
@@ -149,10 +278,41 @@ func (unc *Unicorn) createWorker() {
                 unc.Stop()
             }
 
-            //如果不是长连接模式，则退出
-            if !unc.keepalive {
+            //出错或者超时之后，连接上可能残留着半个响应，无法继续使用，关闭连接
+            //UDP的数据报之间互不影响，丢包之后连接仍然可用
+            if err != nil && code != RESULT_CODE_WARING_LOST {
                 break
             }
+
+            //服务端会关闭连接，不能继续使用
+            if cp, ok := plugin.(ConnCloseIntfs); ok && err == nil && cp.ShouldClose(raw_request, data) {
+                break
+            }
+
+            //会话插件：会话结束则关闭连接
+            if session != nil && session.Done() {
+                break
+            }
+
+            //如果不是长连接模式，则退出（会话插件的会话进行中则继续）
+            if !unc.keepalive && session == nil {
+                break
+            }
+
+            //会话长度限制：达到最多请求数或者最长存活时间，关闭连接，重新建连
+            if unc.maxRequests > 0 && connReqs >= unc.maxRequests {
+                break
+            }
+            if unc.maxLifetime > 0 && time.Since(connStart) >= unc.maxLifetime {
+                break
+            }
+
+            //思考时间：插件提供的优先
+            if tp, ok := plugin.(ThinkTimeIntfs); ok {
+                unc.think(tp.ThinkTime(raw_request))
+            } else if unc.thinkTimer != nil {
+                unc.think(unc.thinkTimer.Next())
+            }
             //fmt.Println("Go on")
         }
     }()
@@ -171,8 +331,24 @@ func (unc *Unicorn)checkSigStopNonBlock(){
     }
 }
 
+//思考时间，期间定期检查停止信号，避免拖慢整体的停止
+func (unc *Unicorn) think(d time.Duration) {
+    deadline := time.Now().Add(d)
+    for !unc.stopFlag {
+        remain := deadline.Sub(time.Now())
+        if remain <= 0 {
+            return
+        }
+        if remain > 10*time.Millisecond {
+            remain = 10*time.Millisecond
+        }
+        time.Sleep(remain)
+        unc.checkSigStopNonBlock()
+    }
+}
+
 //实际的交互逻辑
-func (unc *Unicorn)interact(raw_request *RawRequest, conn net.Conn) ([]byte, error){
+func (unc *Unicorn)interact(plugin PluginIntfs, raw_request *RawRequest, conn net.Conn) ([]byte, error){
     //总请求计数+1，一个大坑++操作是非原子的，需要使用atomic.AddXXX
     //unc.AllCnt ++
     atomic.AddUint64(&unc.AllCnt, 1)
@@ -188,32 +364,71 @@ func (unc *Unicorn)interact(raw_request *RawRequest, conn net.Conn) ([]byte, err
         _ = n
     }
 
+    //接收缓冲从池中获取，大的响应不必每次读取都重新分配
+    buf := recvBufPool.Get().([]byte)
+    defer recvBufPool.Put(buf)
     data := make([]byte, 0)
     Loop:
     for {
-        buf, n, err := recvResponse(conn)
+        //出错时返回已经收到的部分响应，供流量记录使用，调用方只在没有错误时才检查响应
+        n, err := recvResponse(conn, buf)
         if err != nil && err != io.EOF {
-            return nil, err
+            return data, err
         } else if err == io.EOF {
             //服务端关闭连接，通常，服务端不会主动关闭连接
             log.Logger.Info("Server close connection!")
-            return nil, err
+            return data, err
         } else {
             data = append(data, buf[0:n]...)
-            switch unc.plugin.CheckFull(raw_request, data) {
+            switch plugin.CheckFull(raw_request, data) {
             case SER_OK:
                 break Loop
             case SER_NEEDMORE:
                 continue Loop
             default:
-                err = errors.New("Sth Wrong!")
-                break Loop
+                return data, errors.New("Sth Wrong!")
             }
         }
     }
     return data, nil
 }
 
+//UDP的交互逻辑：请求作为一个数据报发出，逐个接收数据报交给插件判断
+//插件判定为错误的数据报（比如之前丢失判定之后才到达的响应）被丢弃，继续等待，直到deadline
+func (unc *Unicorn)interactDatagram(plugin PluginIntfs, raw_request *RawRequest, conn net.Conn) ([]byte, error){
+    atomic.AddUint64(&unc.AllCnt, 1)
+
+    if len(raw_request.Req) > 0 {
+        if _, err := conn.Write(raw_request.Req); err != nil {
+            return nil, err
+        }
+    }
+
+    buf := make([]byte, UDP_MAX_DATAGRAM)
+    data := make([]byte, 0)
+    for {
+        n, err := conn.Read(buf)
+        if err != nil {
+            return data, err
+        }
+        data = append(data, buf[0:n]...)
+        switch plugin.CheckFull(raw_request, data) {
+        case SER_OK:
+            return data, nil
+        case SER_NEEDMORE:
+            //响应由多个数据报组成
+        default:
+            data = data[:0]
+        }
+    }
+}
+
+//判断是否是超时错误（deadline到期）
+func isTimeout(err error) bool {
+    ne, ok := err.(net.Error)
+    return ok && ne.Timeout()
+}
+
 //请求发送
 func sendRequest(conn net.Conn, content []byte) (int, error) {
     //利用带缓冲的Writer
@@ -227,15 +442,13 @@ func sendRequest(conn net.Conn, content []byte) (int, error) {
 }
 
 //接收请求
-func recvResponse(conn net.Conn) ([]byte, int, error) {
-    buf := make([]byte, 1024)
-
+func recvResponse(conn net.Conn, buf []byte) (int, error) {
     n, err := conn.Read(buf)
     if err != nil {
-        return nil, 0, err
+        return 0, err
     }
 
-    return buf, n, nil
+    return n, nil
 }
 
 //保存结果:将结果存入通道
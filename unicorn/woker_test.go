@@ -0,0 +1,102 @@
+package unicorn
+
+import (
+    "errors"
+    "net"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+//每隔几个请求生成失败一次的插件
+type failingGenPlugin struct {
+    testEchoPlugin
+    cnt int64
+}
+
+func (fgp *failingGenPlugin) GenRequest(id int64) RawRequest {
+    if atomic.AddInt64(&fgp.cnt, 1)%3 == 0 {
+        return RawRequest{Id: id, Err: errors.New("no more requests")}
+    }
+    return fgp.testEchoPlugin.GenRequest(id)
+}
+
+//运行引擎直到结束，按结果码统计，并检查每个结果都计入了总调用数
+func runCounted(t *testing.T, unc UnicornIntfs, result_chan chan *CallResult) map[ResultCode]int {
+    codes := make(map[ResultCode]int)
+    wg := unc.Start()
+    total := uint64(0)
+    for ret := range result_chan {
+        codes[ret.Code]++
+        total++
+    }
+    wg.Wait()
+    u := unc.(*Unicorn)
+    if all := atomic.LoadUint64(&u.AllCnt); all != total+atomic.LoadUint64(&u.IgnoreCnt) {
+        t.Fatalf("Expected AllCnt %d (%d results, %d ignored), got %d\n", total+u.IgnoreCnt, total, u.IgnoreCnt, all)
+    }
+    return codes
+}
+
+//测试生成请求失败：记为致命错误并计数，框架重新建连之后继续
+func TestGenRequestError(t *testing.T) {
+    ln := startEchoServer(t, "tcp", "127.0.0.1:0")
+    defer ln.Close()
+
+    ids := make(map[int64]bool)
+    for i := 0; i < 1000; i++ {
+        id := NextRequestId()
+        if ids[id] {
+            t.Fatalf("Duplicated request id %d\n", id)
+        }
+        ids[id] = true
+    }
+
+    result_chan := make(chan *CallResult, 50)
+    unc, err := NewUnicorn(ln.Addr().String(), &failingGenPlugin{}, 100*time.Millisecond, 0, 200*time.Millisecond, 2, true, result_chan)
+    if err != nil {
+        t.Fatalf("Unicorn initialization failing: %s.\n", err)
+    }
+    codes := runCounted(t, unc, result_chan)
+    if codes[RESULT_CODE_FATAL_CALL] == 0 || codes[RESULT_CODE_SUCCESS] == 0 {
+        t.Fatalf("Expected both fatal calls and successes, got %v\n", codes)
+    }
+}
+
+//测试建连和握手失败：作为调用错误记录，并且计入总调用数
+func TestDialErrorCounted(t *testing.T) {
+    //已经关闭的端口，建连失败
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    closed := ln.Addr().String()
+    ln.Close()
+
+    //回显服务端，TLS握手失败
+    echo := startEchoServer(t, "tcp", "127.0.0.1:0")
+    defer echo.Close()
+
+    for _, c := range []struct {
+        addr string
+        tls  bool
+    }{
+        {closed, false},
+        {echo.Addr().String(), true},
+    } {
+        result_chan := make(chan *CallResult, 50)
+        unc, err := NewUnicorn(c.addr, &testEchoPlugin{}, 100*time.Millisecond, 0, 200*time.Millisecond, 2, true, result_chan)
+        if err != nil {
+            t.Fatalf("Unicorn initialization failing: %s.\n", err)
+        }
+        if c.tls {
+            if err := unc.(*Unicorn).SetTLS(&TLSOptions{InsecureSkipVerify: true}); err != nil {
+                t.Fatalf("TLS initialization failing: %s.\n", err)
+            }
+        }
+        codes := runCounted(t, unc, result_chan)
+        if codes[RESULT_CODE_ERROR_CALL] == 0 || codes[RESULT_CODE_SUCCESS] != 0 {
+            t.Fatalf("%s (tls=%v): expected only call errors, got %v\n", c.addr, c.tls, codes)
+        }
+    }
+}